@@ -34,5 +34,4 @@ Install iptables service using yum package manager using the following command.
 
 Now check the iptables service status using below command.
 
-	$ sudo systemctl status iptables
-`
\ No newline at end of file
+	$ sudo systemctl status iptables`
\ No newline at end of file
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/controller"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/opa"
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/version"
 	"github.com/sirupsen/logrus"
 )
@@ -18,6 +22,17 @@ func main() {
 	opaEndpoint := flag.String("opa-endpoint", "http://127.0.0.1:8181", "endpoint of opa in form of http://ip:port i.e. http://192.33.0.1:8181")
 	opaAuthorization := flag.String("opa-authorization", "", "Bearer token for OPA authorization")
 	opaTrustedCAFile := flag.String("opa-trusted-cafile", "", "File path to the OPA trusted CA certificate")
+	opaTLSCertFile := flag.String("opa-tls-cert-file", "", "path of the client certificate file presented to OPA (mTLS)")
+	opaTLSKeyFile := flag.String("opa-tls-private-key-file", "", "path of the private key file of the client certificate presented to OPA")
+	opaTimeout := flag.Duration("opa-timeout", opa.DefaultTimeout, "timeout of each attempt of a call to OPA")
+	opaMaxRetries := flag.Int("opa-max-retries", opa.DefaultMaxRetries, "number of times a call is retried while OPA is unavailable")
+	opaRateLimit := flag.Float64("opa-rate-limit", 0, "maximum number of calls per second sent to OPA. i.e. 50 (disabled by default)")
+	opaBreakerThreshold := flag.Int("opa-breaker-threshold", opa.DefaultBreakerThreshold, "number of consecutive failed calls after which calls to OPA fail fast. 0 disables the circuit breaker")
+	opaBreakerTimeout := flag.Duration("opa-breaker-timeout", opa.DefaultBreakerTimeout, "time calls to OPA fail fast once the circuit breaker is open")
+	opaMode := flag.String("opa-mode", opa.ModeRemote, "where policies are evaluated. i.e. remote | embedded")
+	opaConfigFile := flag.String("opa-config-file", "", "path of the OPA configuration file of the embedded OPA, i.e. for downloading bundles from services")
+	opaBundles := flag.String("opa-bundles", "", "comma-separated paths of bundle directories or archives loaded by the embedded OPA. i.e. /etc/opa-iptables/policy")
+	opaV0Compatible := flag.Bool("opa-v0-compatible", false, "parse policies of the embedded OPA written for OPA v0.x")
 	controllerAddr := flag.String("controller-host", "0.0.0.0", "controller host")
 	// setting default port value to some high port to prevent accidentally block this port in IPTable rules
 	controllerPort := flag.String("controller-port", "33455", "controller port on which it listen on")
@@ -27,6 +42,23 @@ func main() {
 	v := flag.Bool("v", false, "show version")
 	workerCount := flag.Int("worker", 3, "number of workers needed for watcher")
 	watcherFlag := flag.Bool("watcher", false, "use experimental watcher")
+	reconcileInterval := flag.Duration("reconcile-interval", 0, "time interval for reconciler to repair drift between watched rules and the kernel. i.e. 5m (disabled by default, requires watcher)")
+	stateFile := flag.String("state-file", "", "file used for persisting watcher states across restarts. i.e. /var/lib/opa-iptables/state.json (disabled by default)")
+	restorePolicy := flag.String("state-restore", "resume", "action taken on persisted watcher states on startup. i.e. resume | cleanup | ignore")
+	managedChains := flag.Bool("managed-chains", false, "insert rules of each ruleset into dedicated OPA-<hash> chains owned by the controller")
+	backendName := flag.String("backend", "iptables", "firewall backend used for programming rules. i.e. iptables | nftables")
+	defaultFamily := flag.String("default-family", "ipv4", "family of rules which neither specify a family nor use any address. i.e. ipv4 | ipv6 | both")
+	tlsCertFile := flag.String("tls-cert-file", "", "path of the TLS certificate file. API is served over HTTPS if it's set")
+	tlsKeyFile := flag.String("tls-private-key-file", "", "path of the TLS private key file")
+	tlsClientCAFile := flag.String("tls-client-ca-file", "", "path of the CA certificate file used for verifying client certificates (mTLS)")
+	tokenFile := flag.String("token-file", "", "path of the file containing bearer tokens accepted by the API, one \"<token> [<subject>]\" per line")
+	authorizationPath := flag.String("authorization-path", "", "path of the OPA policy rule which authorizes each API call. i.e. system/iptables/authz/allow")
+	instanceID := flag.String("instance-id", "", "identifier of the controller added to comments of inserted rules for tracking their ownership. i.e. node-1 (disabled by default)")
+	shutdownPolicy := flag.String("shutdown-policy", "keep", "action taken on inserted rules on shutdown. i.e. keep | cleanup | pin")
+	auditFile := flag.String("audit-file", "", "file the shutdown audit record is appended to. i.e. /var/log/opa-iptables/audit.log (disabled by default)")
+	countersInterval := flag.Duration("counters-interval", 0, "time interval for pushing packet and byte counters of inserted rules into OPA. i.e. 30s (disabled by default)")
+	countersPath := flag.String("counters-path", controller.DefaultCountersPath, "path of the OPA data document counters of inserted rules are pushed into")
+	gcInterval := flag.Duration("gc-interval", 0, "time interval for removing rules tagged by the controller which are no longer backed by any known ruleset. i.e. 10m (disabled by default, requires instance-id)")
 
 	flag.Parse()
 
@@ -48,29 +80,146 @@ func main() {
 		os.Exit(1)
 	}
 
-	if !iptablesExists() {
-		logger.Error("command \"iptables\" not found at path \"/sbin/iptables\".")
-		fmt.Println(installationHelp)
-		os.Exit(1)
+	backend, err := iptables.NewBackend(*backendName)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := iptables.SetDefaultFamily(*defaultFamily); err != nil {
+		logger.Fatal(err)
+	}
+
+	if backend.Name() == iptables.BackendIPTables {
+		if !iptablesExists() {
+			logger.Error("command \"iptables\" not found at path \"/sbin/iptables\".")
+			fmt.Println(installationHelp)
+			os.Exit(1)
+		}
+
+		if !ip6tablesExists() {
+			if iptables.DefaultFamily() != iptables.IPv4 {
+				logger.Fatalf("command \"ip6tables\" not found at path \"/sbin/ip6tables\", but it's required by -default-family %v.", iptables.DefaultFamily())
+			}
+			logger.Warn("command \"ip6tables\" not found at path \"/sbin/ip6tables\". Rules of ipv6 family can't be inserted.")
+		}
 	}
 
 	if *workerCount < 1 || *workerCount > 10 {
 		logger.Fatalf(`Provided worker count "%v" is not valid. It must be between 1 and 10.`, *workerCount)
 	}
 
+	policy, err := controller.ParseRestorePolicy(*restorePolicy)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	shutdown, err := controller.ParseShutdownPolicy(*shutdownPolicy)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		logger.Fatal("both -tls-cert-file and -tls-private-key-file must be provided")
+	}
+	if *tlsClientCAFile != "" && *tlsCertFile == "" {
+		logger.Fatal("-tls-client-ca-file requires -tls-cert-file and -tls-private-key-file")
+	}
+
+	if *instanceID != "" {
+		if err := controller.ValidateInstanceID(*instanceID); err != nil {
+			logger.Fatal(err)
+		}
+	} else if *gcInterval > 0 {
+		logger.Fatal("-gc-interval requires -instance-id")
+	}
+
+	var opaClient opa.Client
+	switch *opaMode {
+	case opa.ModeRemote:
+		if *opaConfigFile != "" || *opaBundles != "" {
+			logger.Fatal("-opa-config-file and -opa-bundles require -opa-mode=embedded")
+		}
+		if (*opaTLSCertFile == "") != (*opaTLSKeyFile == "") {
+			logger.Fatal("both -opa-tls-cert-file and -opa-tls-private-key-file must be provided")
+		}
+		opaClient, err = opa.New(opa.Config{
+			Endpoint:         *opaEndpoint,
+			Token:            *opaAuthorization,
+			TrustedCAFile:    *opaTrustedCAFile,
+			CertFile:         *opaTLSCertFile,
+			KeyFile:          *opaTLSKeyFile,
+			Timeout:          *opaTimeout,
+			MaxRetries:       *opaMaxRetries,
+			RateLimit:        *opaRateLimit,
+			BreakerThreshold: *opaBreakerThreshold,
+			BreakerTimeout:   *opaBreakerTimeout,
+		})
+		if err != nil {
+			logger.Fatal(err)
+		}
+	case opa.ModeEmbedded:
+		var bundles []string
+		if *opaBundles != "" {
+			bundles = strings.Split(*opaBundles, ",")
+		}
+		embedded, err := opa.NewEmbedded(context.Background(), opa.EmbeddedConfig{
+			ID:           *instanceID,
+			ConfigFile:   *opaConfigFile,
+			Bundles:      bundles,
+			V0Compatible: *opaV0Compatible,
+		})
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer embedded.Stop(context.Background())
+		opaClient = embedded
+	default:
+		logger.Fatalf("invalid OPA mode %q: must be one of %v | %v", *opaMode, opa.ModeRemote, opa.ModeEmbedded)
+	}
+
+	var tokens map[string]string
+	if *tokenFile != "" {
+		tokens, err = controller.LoadTokens(*tokenFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
 	controllerConfig := controller.Config{
-		OpaEndpoint:      *opaEndpoint,
-		ControllerAddr:   *controllerAddr,
-		ControllerPort:   *controllerPort,
-		WatcherInterval:  *watcherInterval,
-		WatcherFlag:      *watcherFlag,
-		WorkerCount:      *workerCount,
-		OpaAuthorization: *opaAuthorization,
-		OpaTrustedCAFile: *opaTrustedCAFile,
+		ControllerAddr:    *controllerAddr,
+		ControllerPort:    *controllerPort,
+		WatcherInterval:   *watcherInterval,
+		WatcherFlag:       *watcherFlag,
+		WorkerCount:       *workerCount,
+		Backend:           backend,
+		ManagedChains:     *managedChains,
+		ReconcileInterval: *reconcileInterval,
+		StateFile:         *stateFile,
+		RestorePolicy:     policy,
+		TLSCertFile:       *tlsCertFile,
+		TLSKeyFile:        *tlsKeyFile,
+		TLSClientCAFile:   *tlsClientCAFile,
+		Tokens:            tokens,
+		AuthorizationPath: *authorizationPath,
+		InstanceID:        *instanceID,
+		GCInterval:        *gcInterval,
+		ShutdownPolicy:    shutdown,
+		AuditFile:         *auditFile,
+		CountersInterval:  *countersInterval,
+		CountersPath:      *countersPath,
+		OpaClient:         opaClient,
 	}
 
 	logger.WithFields(logrus.Fields{
-		"OPA Endpoint": controllerConfig.OpaEndpoint,
+		"OPA Endpoint": *opaEndpoint,
+		"OPA Mode":     *opaMode,
+		"Backend":      backend.Name(),
+		"TLS":          *tlsCertFile != "",
+		"mTLS":         *tlsClientCAFile != "",
+		"Token Auth":   len(tokens) > 0,
+		"Authz Path":   *authorizationPath,
+		"Instance ID":  *instanceID,
+		"Shutdown":     shutdown,
 		"Log Format":   logConfig.Format,
 		"Log Level":    logConfig.Level,
 	}).Info("Started Controller with following configuration:")
@@ -85,3 +234,10 @@ func iptablesExists() bool {
 	}
 	return true
 }
+
+func ip6tablesExists() bool {
+	if _, err := os.Stat("/sbin/ip6tables"); os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
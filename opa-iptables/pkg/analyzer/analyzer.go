@@ -0,0 +1,208 @@
+// Package analyzer detects rules of a chain which never match a packet or contradict each other,
+// i.e a rule shadowed by a broader earlier rule, or an ACCEPT overlapping a DROP.
+package analyzer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// Kind is the kind of problem found by the analyzer.
+type Kind string
+
+const (
+	// Shadowed rule matches only packets which are already handled by an earlier rule with a
+	// different target, so it never matches.
+	Shadowed Kind = "shadowed"
+	// Redundant rule matches only packets which are already handled by an earlier rule with the
+	// same target, so it can be removed.
+	Redundant Kind = "redundant"
+	// Conflicting rule partially overlaps an earlier rule, which accepts packets the rule drops or
+	// vice versa, so the earlier rule decides the fate of the packets matched by both. Rules
+	// covering an earlier rule, i.e a DROP of every packet after ACCEPT rules, are not conflicting.
+	Conflicting Kind = "conflicting"
+	// Unreachable rule follows a rule which handles every packet, so it's never evaluated.
+	Unreachable Kind = "unreachable"
+)
+
+// RuleRef refers to an analyzed rule.
+type RuleRef struct {
+	// Index of the rule in the analyzed list.
+	Index int `json:"index"`
+	// Position of the rule in its chain starting at 1, among the analyzed rules of the family.
+	Position int    `json:"position"`
+	Spec     string `json:"spec"`
+}
+
+// Finding describes a rule, along with the earlier rule of the same chain which causes the problem.
+type Finding struct {
+	Kind Kind `json:"kind"`
+	// Family of the packets affected by the problem.
+	Family  iptables.Family `json:"family"`
+	Table   string          `json:"table"`
+	Chain   string          `json:"chain"`
+	Rule    RuleRef         `json:"rule"`
+	By      RuleRef         `json:"by"`
+	Message string          `json:"message"`
+}
+
+// Analyze detects shadowed, redundant, conflicting and unreachable rules of the list. Rules are
+// compared only with earlier rules of the same table, chain and family. Only rules with a target
+// which ends the traversal of the chain, i.e ACCEPT, DROP or RETURN, can hide later rules.
+//
+// Matches which can't be modeled, i.e mark or set, are compared by value, and rules with matches
+// depending on earlier packets, i.e limit or recent, never hide later rules, so the analyzer
+// doesn't report problems it can't prove.
+func Analyze(rules []iptables.Rule) []Finding {
+	findings := []Finding{}
+	index := make(map[string]int)
+	for _, family := range iptables.DualStack.Expand() {
+		for _, f := range analyzeFamily(rules, family) {
+			key := fmt.Sprintf("%v/%v/%v", f.Kind, f.Rule.Index, f.By.Index)
+			if i, ok := index[key]; ok {
+				findings[i].Family = iptables.DualStack
+				continue
+			}
+			index[key] = len(findings)
+			findings = append(findings, f)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Rule.Index < findings[j].Rule.Index })
+	return findings
+}
+
+type analyzedRule struct {
+	RuleRef
+	rule  iptables.Rule
+	space space
+}
+
+func analyzeFamily(rules []iptables.Rule, family iptables.Family) []Finding {
+	var chains []string
+	byChain := make(map[string][]analyzedRule)
+	for i, r := range rules {
+		r.SetDefaults()
+		families, err := r.Families()
+		if err != nil || !containsFamily(families, family) {
+			continue
+		}
+		key := r.Table + "/" + r.Chain
+		if _, ok := byChain[key]; !ok {
+			chains = append(chains, key)
+		}
+		spec := r
+		spec.Action, spec.RuleNumber = "", ""
+		byChain[key] = append(byChain[key], analyzedRule{
+			RuleRef: RuleRef{Index: i, Position: len(byChain[key]) + 1, Spec: spec.String()},
+			rule:    r,
+			space:   newSpace(r, family),
+		})
+	}
+
+	var findings []Finding
+	for _, key := range chains {
+		for _, f := range analyzeChain(byChain[key]) {
+			f.Family = family
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+func analyzeChain(rules []analyzedRule) []Finding {
+	var findings []Finding
+	// hidden rules never match a packet, so they can't conflict with later rules
+	hidden := make([]bool, len(rules))
+	for j, later := range rules {
+		finding := func(kind Kind, by analyzedRule, format string, a ...interface{}) {
+			findings = append(findings, Finding{
+				Kind:    kind,
+				Table:   later.rule.Table,
+				Chain:   later.rule.Chain,
+				Rule:    later.RuleRef,
+				By:      by.RuleRef,
+				Message: fmt.Sprintf(format, a...),
+			})
+		}
+
+		for _, earlier := range rules[:j] {
+			if !terminates(earlier.rule) {
+				continue
+			}
+			switch {
+			case earlier.space.all():
+				finding(Unreachable, earlier, "rule is never evaluated, because rule %v of the chain handles every packet", earlier.Position)
+			case !earlier.space.covers(later.space):
+				continue
+			case target(earlier.rule) == target(later.rule):
+				finding(Redundant, earlier, "every packet matched by the rule is already handled by rule %v with the same target", earlier.Position)
+			default:
+				finding(Shadowed, earlier, "every packet matched by the rule is already handled by rule %v with target %v", earlier.Position, earlier.rule.Jump)
+			}
+			hidden[j] = true
+			break
+		}
+		if hidden[j] || verdict(later.rule) == "" {
+			continue
+		}
+		for i, earlier := range rules[:j] {
+			if hidden[i] {
+				continue
+			}
+			// a later rule covering the earlier one, i.e a default DROP after ACCEPT rules, is intended
+			if v := verdict(earlier.rule); v != "" && v != verdict(later.rule) && earlier.space.overlaps(later.space) &&
+				!later.space.covers(earlier.space) {
+				finding(Conflicting, earlier, "rule %v with target %v handles packets matched by both rules before the rule", earlier.Position, earlier.rule.Jump)
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// terminates reports whether matching the rule ends the traversal of its chain.
+func terminates(r iptables.Rule) bool {
+	switch r.Jump {
+	case "ACCEPT", "DROP", "REJECT", "RETURN", "QUEUE", "NFQUEUE":
+		return true
+	case "DNAT", "SNAT", "MASQUERADE", "REDIRECT":
+		return r.Table == "nat"
+	}
+	return false
+}
+
+// verdict returns accept or deny for rules deciding the fate of the packet.
+func verdict(r iptables.Rule) string {
+	switch r.Jump {
+	case "ACCEPT":
+		return "accept"
+	case "DROP", "REJECT":
+		return "deny"
+	}
+	return ""
+}
+
+// target returns the target of the rule along with its options.
+func target(r iptables.Rule) string {
+	t := iptables.Rule{
+		Jump:          r.Jump,
+		RejectWith:    r.RejectWith,
+		ToSource:      r.ToSource,
+		ToDestination: r.ToDestination,
+		ToPorts:       r.ToPorts,
+		Random:        r.Random,
+	}
+	return strings.Join(t.Construct(), " ")
+}
+
+func containsFamily(families []iptables.Family, family iptables.Family) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
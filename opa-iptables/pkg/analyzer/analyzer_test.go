@@ -0,0 +1,132 @@
+package analyzer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+type expectedFinding struct {
+	kind   Kind
+	family iptables.Family
+	rule   int
+	by     int
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []iptables.Rule
+		expected []expectedFinding
+	}{
+		{
+			name: "shadowed by broader network",
+			rules: []iptables.Rule{
+				{SourceAddress: "10.0.0.0/8", Jump: "DROP"},
+				{SourceAddress: "10.1.0.0/16", Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"},
+			},
+			expected: []expectedFinding{{Shadowed, iptables.IPv4, 1, 0}},
+		},
+		{
+			name: "redundant port",
+			rules: []iptables.Rule{
+				{Protocol: "tcp", Multiport: &iptables.Multiport{DestinationPorts: "80,443,8000:8100"}, Jump: "ACCEPT"},
+				{Protocol: "6", DestinationPort: "8080", Jump: "ACCEPT"},
+			},
+			expected: []expectedFinding{{Redundant, iptables.IPv4, 1, 0}},
+		},
+		{
+			name: "conflicting overlap",
+			rules: []iptables.Rule{
+				{SourceAddress: "10.0.0.0/8", Protocol: "tcp", Jump: "ACCEPT"},
+				{Protocol: "tcp", DestinationPort: "22", Jump: "DROP"},
+			},
+			expected: []expectedFinding{{Conflicting, iptables.IPv4, 1, 0}},
+		},
+		{
+			name: "unreachable after catch all",
+			rules: []iptables.Rule{
+				{InInterface: "lo", Jump: "ACCEPT"},
+				{Jump: "DROP"},
+				{Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT"},
+				{Chain: "OUTPUT", Jump: "ACCEPT"},
+			},
+			expected: []expectedFinding{{Unreachable, iptables.IPv4, 2, 1}},
+		},
+		{
+			name: "inverted matches",
+			rules: []iptables.Rule{
+				{SourceAddress: "!10.0.0.0/8", Jump: "DROP"},
+				{SourceAddress: "192.168.0.0/16", Jump: "ACCEPT"},
+				{Chain: "FORWARD", InInterface: "!eth+", Jump: "DROP"},
+				{Chain: "FORWARD", InInterface: "lo", Jump: "ACCEPT"},
+				{Chain: "OUTPUT", Ctstate: []string{"!NEW"}, Jump: "ACCEPT"},
+				{Chain: "OUTPUT", Ctstate: []string{"ESTABLISHED"}, Jump: "ACCEPT"},
+			},
+			expected: []expectedFinding{
+				{Shadowed, iptables.IPv4, 1, 0},
+				{Shadowed, iptables.IPv4, 3, 2},
+				{Redundant, iptables.IPv4, 5, 4},
+			},
+		},
+		{
+			name: "not proven",
+			rules: []iptables.Rule{
+				{Protocol: "tcp", DestinationPort: "22", Limit: &iptables.Limit{Rate: "3/minute"}, Jump: "ACCEPT"},
+				{Protocol: "tcp", DestinationPort: "22", Jump: "DROP"},
+				{Protocol: "tcp", Mark: "0x1", Jump: "ACCEPT"},
+				{Protocol: "tcp", Mark: "0x2", DestinationPort: "80", Jump: "DROP"},
+				{SourceAddress: "example.com", Jump: "DROP"},
+				{Jump: "LOG"},
+				{Protocol: "tcp", DestinationPort: "443", Jump: "ACCEPT"},
+			},
+			expected: []expectedFinding{{Conflicting, iptables.IPv4, 2, 1}},
+		},
+		{
+			name: "families",
+			rules: []iptables.Rule{
+				{SourceAddress: "fd00::/8", Jump: "DROP"},
+				{SourceAddress: "10.0.0.1", Jump: "ACCEPT"},
+				{SourceAddress: "fd00::1", Jump: "DROP"},
+			},
+			expected: []expectedFinding{{Redundant, iptables.IPv6, 2, 0}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []expectedFinding
+			for _, f := range Analyze(tc.rules) {
+				got = append(got, expectedFinding{f.Kind, f.Family, f.Rule.Index, f.By.Index})
+				if f.Message == "" || f.Rule.Spec == "" || f.By.Position == 0 {
+					t.Errorf("incomplete finding %+v", f)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected findings %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRangeSet(t *testing.T) {
+	s := newRangeSet(
+		interval{pointOf(10), pointOf(20)},
+		interval{pointOf(21), pointOf(30)},
+		interval{pointOf(50), pointOf(40)},
+	)
+	if !reflect.DeepEqual(s, rangeSet{{pointOf(10), pointOf(30)}, {pointOf(40), pointOf(50)}}) {
+		t.Errorf("unexpected set %v", s)
+	}
+	c := s.complement(portUniverse)
+	expected := rangeSet{{pointOf(0), pointOf(9)}, {pointOf(31), pointOf(39)}, {pointOf(51), pointOf(65535)}}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected complement %v, got %v", expected, c)
+	}
+	if !c.complement(portUniverse).equal(s) || len(c.intersect(s)) != 0 {
+		t.Error("expected complement of complement to be the set")
+	}
+	if !(rangeSet{ipv6Universe}).complement(ipv6Universe).equal(nil) {
+		t.Error("expected empty complement of the universe")
+	}
+}
@@ -0,0 +1,535 @@
+package analyzer
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// point is an address or a port, as a 128 bit big endian number.
+type point [16]byte
+
+func pointOf(n uint64) point {
+	var p point
+	for i := 15; i >= 8; i-- {
+		p[i] = byte(n)
+		n >>= 8
+	}
+	return p
+}
+
+func ipPoint(ip net.IP, family iptables.Family) point {
+	var p point
+	if family == iptables.IPv4 {
+		copy(p[12:], ip.To4())
+	} else {
+		copy(p[:], ip.To16())
+	}
+	return p
+}
+
+func (p point) less(q point) bool {
+	return bytes.Compare(p[:], q[:]) < 0
+}
+
+// next returns p+1, and false if p is the largest point.
+func (p point) next() (point, bool) {
+	for i := 15; i >= 0; i-- {
+		p[i]++
+		if p[i] != 0 {
+			return p, true
+		}
+	}
+	return p, false
+}
+
+// prev returns p-1, and false if p is zero.
+func (p point) prev() (point, bool) {
+	for i := 15; i >= 0; i-- {
+		p[i]--
+		if p[i] != 0xff {
+			return p, true
+		}
+	}
+	return p, false
+}
+
+type interval struct {
+	lo, hi point
+}
+
+// rangeSet is a union of sorted, disjoint and non-adjacent intervals.
+type rangeSet []interval
+
+func newRangeSet(intervals ...interval) rangeSet {
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].lo.less(intervals[j].lo) })
+	var s rangeSet
+	for _, iv := range intervals {
+		if iv.hi.less(iv.lo) {
+			iv.lo, iv.hi = iv.hi, iv.lo
+		}
+		if n := len(s); n > 0 {
+			// merge overlapping and adjacent intervals
+			if next, ok := s[n-1].hi.next(); !ok || !next.less(iv.lo) {
+				if s[n-1].hi.less(iv.hi) {
+					s[n-1].hi = iv.hi
+				}
+				continue
+			}
+		}
+		s = append(s, iv)
+	}
+	return s
+}
+
+func (s rangeSet) intersect(t rangeSet) rangeSet {
+	var result []interval
+	for _, a := range s {
+		for _, b := range t {
+			lo, hi := a.lo, a.hi
+			if lo.less(b.lo) {
+				lo = b.lo
+			}
+			if b.hi.less(hi) {
+				hi = b.hi
+			}
+			if !hi.less(lo) {
+				result = append(result, interval{lo, hi})
+			}
+		}
+	}
+	return newRangeSet(result...)
+}
+
+// complement returns points of the universe which are not in s.
+func (s rangeSet) complement(universe interval) rangeSet {
+	var result []interval
+	lo, open := universe.lo, true
+	for _, iv := range s.intersect(rangeSet{universe}) {
+		if lo.less(iv.lo) {
+			hi, _ := iv.lo.prev()
+			result = append(result, interval{lo, hi})
+		}
+		lo, open = iv.hi.next()
+		if !open || universe.hi.less(lo) {
+			open = false
+			break
+		}
+	}
+	if open {
+		result = append(result, interval{lo, universe.hi})
+	}
+	return newRangeSet(result...)
+}
+
+// contains reports whether t is a subset of s.
+func (s rangeSet) contains(t rangeSet) bool {
+	for _, b := range t {
+		found := false
+		for _, a := range s {
+			if !b.lo.less(a.lo) && !a.hi.less(b.hi) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (s rangeSet) equal(t rangeSet) bool {
+	return s.contains(t) && t.contains(s)
+}
+
+var (
+	portUniverse = interval{pointOf(0), pointOf(65535)}
+	ipv4Universe = interval{pointOf(0), pointOf(1<<32 - 1)}
+	ipv6Universe = interval{point{}, point{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}}
+)
+
+func addressUniverse(family iptables.Family) interval {
+	if family == iptables.IPv4 {
+		return ipv4Universe
+	}
+	return ipv6Universe
+}
+
+// parseAddresses parses a comma separated list of addresses and networks. i.e 10.0.0.1,10.0.0.0/8
+func parseAddresses(spec string, family iptables.Family) (rangeSet, bool) {
+	var intervals []interval
+	for _, item := range strings.Split(spec, ",") {
+		iv, ok := parseNetwork(strings.TrimSpace(item), family)
+		if !ok {
+			return nil, false
+		}
+		intervals = append(intervals, iv)
+	}
+	return newRangeSet(intervals...), true
+}
+
+// parseNetwork parses an address with an optional prefix length or network mask.
+func parseNetwork(spec string, family iptables.Family) (interval, bool) {
+	parts := strings.SplitN(spec, "/", 2)
+	ip := net.ParseIP(parts[0])
+	if ip == nil || (ip.To4() != nil) != (family == iptables.IPv4) {
+		return interval{}, false
+	}
+	bits := 8 * net.IPv6len
+	if family == iptables.IPv4 {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	mask := net.CIDRMask(bits, bits)
+	if len(parts) == 2 {
+		if m := net.ParseIP(parts[1]); m != nil {
+			if family == iptables.IPv4 {
+				m = m.To4()
+			}
+			mask = net.IPMask(m)
+		} else {
+			ones, err := strconv.Atoi(parts[1])
+			if err != nil || ones < 0 || ones > bits {
+				return interval{}, false
+			}
+			mask = net.CIDRMask(ones, bits)
+		}
+	}
+	if len(mask) != len(ip) {
+		return interval{}, false
+	}
+	first := ip.Mask(mask)
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^mask[i]
+	}
+	return interval{ipPoint(first, family), ipPoint(last, family)}, true
+}
+
+// parseRange parses a range of addresses. i.e 10.0.0.1-10.0.0.9
+func parseRange(spec string, family iptables.Family) (rangeSet, bool) {
+	bounds := strings.SplitN(spec, "-", 2)
+	first, ok := parseNetwork(strings.TrimSpace(bounds[0]), family)
+	if !ok || strings.Contains(bounds[0], "/") {
+		return nil, false
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, ok = parseNetwork(strings.TrimSpace(bounds[1]), family); !ok || strings.Contains(bounds[1], "/") {
+			return nil, false
+		}
+	}
+	return newRangeSet(interval{first.lo, last.hi}), true
+}
+
+// parsePorts parses a comma separated list of ports and port ranges, which can use service names.
+// i.e 80,443,8000:8080
+func parsePorts(spec, protocol string) (rangeSet, bool) {
+	lookup := func(s string, empty uint64) (uint64, bool) {
+		if s == "" {
+			return empty, true
+		}
+		if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+			return n, true
+		}
+		n, err := net.LookupPort(protocol, s)
+		return uint64(n), err == nil
+	}
+	var intervals []interval
+	for _, item := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		first, ok := lookup(bounds[0], 0)
+		if !ok {
+			return nil, false
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = lookup(bounds[1], 65535); !ok {
+				return nil, false
+			}
+		}
+		intervals = append(intervals, interval{pointOf(first), pointOf(last)})
+	}
+	return newRangeSet(intervals...), true
+}
+
+// states are the conntrack states modeled by the analyzer, SNAT and DNAT are compared by value.
+var states = []string{"NEW", "ESTABLISHED", "RELATED", "INVALID", "UNTRACKED"}
+
+const allStates = 1<<5 - 1
+
+// space is the set of packets matched by a rule of a family, as a conjunction of its matches.
+type space struct {
+	universe interval
+	// protocol is empty if the rule matches all protocols.
+	protocol         string
+	protocolInverted bool
+	src, dst         rangeSet
+	sport, dport     rangeSet
+	in, out          ifaceMatch
+	states           uint8
+	// exact holds matches which can't be modeled, i.e mark or set, by their name.
+	exact map[string]string
+	// stateful is set if the rule has matches depending on earlier packets, i.e limit.
+	stateful bool
+	// unknown is set if the rule has matches which can't be parsed, i.e hostnames.
+	unknown bool
+}
+
+func newSpace(r iptables.Rule, family iptables.Family) space {
+	universe := addressUniverse(family)
+	s := space{
+		universe: universe,
+		src:      rangeSet{universe},
+		dst:      rangeSet{universe},
+		sport:    rangeSet{portUniverse},
+		dport:    rangeSet{portUniverse},
+		states:   allStates,
+		exact:    make(map[string]string),
+		stateful: r.Limit != nil || r.HashLimit != nil || r.Recent != nil,
+	}
+
+	protocol, inverted := invert(r.Protocol)
+	if protocol = protocolName(protocol); protocol != "all" {
+		s.protocol, s.protocolInverted = protocol, inverted
+	}
+
+	restrict := func(dim *rangeSet, spec string, universe interval, parse func(string) (rangeSet, bool)) {
+		value, inverted := invert(spec)
+		if value == "" {
+			return
+		}
+		set, ok := parse(value)
+		if !ok {
+			s.unknown = true
+			return
+		}
+		if inverted {
+			set = set.complement(universe)
+		}
+		*dim = dim.intersect(set)
+	}
+	addresses := func(v string) (rangeSet, bool) { return parseAddresses(v, family) }
+	addressRange := func(v string) (rangeSet, bool) { return parseRange(v, family) }
+	ports := func(v string) (rangeSet, bool) { return parsePorts(v, s.protocol) }
+	restrict(&s.src, r.SourceAddress, universe, addresses)
+	restrict(&s.src, r.SourceRange, universe, addressRange)
+	restrict(&s.dst, r.DestinationAddress, universe, addresses)
+	restrict(&s.dst, r.DestinationRange, universe, addressRange)
+	restrict(&s.sport, r.SourcePort, portUniverse, ports)
+	restrict(&s.dport, r.DestinationPort, portUniverse, ports)
+	if m := r.Multiport; m != nil {
+		restrict(&s.sport, m.SourcePorts, portUniverse, ports)
+		restrict(&s.dport, m.DestinationPorts, portUniverse, ports)
+		s.exactly("multiport", m.Ports)
+	}
+	s.in = newIfaceMatch(r.InInterface)
+	s.out = newIfaceMatch(r.OutInterface)
+
+	if value, inverted := invert(strings.Join(r.Ctstate, ",")); value != "" {
+		var mask uint8
+		for _, state := range strings.Split(value, ",") {
+			i := indexOf(states, strings.ToUpper(strings.TrimSpace(state)))
+			if i < 0 {
+				// SNAT and DNAT states are orthogonal to the other states
+				s.exactly("ctstate", strings.Join(r.Ctstate, ","))
+				mask = allStates
+				inverted = false
+				break
+			}
+			mask |= 1 << uint(i)
+		}
+		if inverted {
+			mask = allStates &^ mask
+		}
+		s.states = mask
+	}
+
+	s.exactly("mark", r.Mark)
+	s.exactly("connmark", r.ConnMark)
+	s.exactly("mac", r.MacSource)
+	s.exactly("icmp-type", r.ICMPType)
+	if len(r.TCPFlags.Flags) > 0 {
+		s.exactly("tcp-flags", strings.Join(r.TCPFlags.Flags, ",")+" "+strings.Join(r.TCPFlags.FlagsSet, ","))
+	}
+	if r.MatchSet != nil {
+		s.exactly("set", r.MatchSet.Name+" "+r.MatchSet.Flags)
+	}
+	if r.Owner != nil {
+		s.exactly("owner", fmt.Sprintf("%+v", *r.Owner))
+	}
+	if r.AddrType != nil {
+		s.exactly("addrtype", fmt.Sprintf("%+v", *r.AddrType))
+	}
+	return s
+}
+
+func (s *space) exactly(name, value string) {
+	if value != "" {
+		s.exact[name] = value
+	}
+}
+
+// all reports whether the rule matches every packet of the family.
+func (s space) all() bool {
+	full := rangeSet{s.universe}
+	ports := rangeSet{portUniverse}
+	return !s.unknown && !s.stateful && s.protocol == "" && len(s.exact) == 0 && s.states == allStates &&
+		s.src.equal(full) && s.dst.equal(full) && s.sport.equal(ports) && s.dport.equal(ports) &&
+		s.in.name == "" && s.out.name == ""
+}
+
+// covers reports whether every packet matched by t is matched by s.
+func (s space) covers(t space) bool {
+	if s.unknown || t.unknown || s.stateful {
+		return false
+	}
+	for name, value := range s.exact {
+		if t.exact[name] != value {
+			return false
+		}
+	}
+	return s.protocolCovers(t) && s.states&t.states == t.states &&
+		s.src.contains(t.src) && s.dst.contains(t.dst) && s.sport.contains(t.sport) && s.dport.contains(t.dport) &&
+		s.in.covers(t.in) && s.out.covers(t.out)
+}
+
+// overlaps reports whether some packet is matched by both s and t. Matches compared by value
+// overlap only if they're equal.
+func (s space) overlaps(t space) bool {
+	if s.unknown || t.unknown {
+		return false
+	}
+	for name, value := range s.exact {
+		if other, ok := t.exact[name]; ok && other != value {
+			return false
+		}
+	}
+	return s.protocolOverlaps(t) && s.states&t.states != 0 &&
+		len(s.src.intersect(t.src)) > 0 && len(s.dst.intersect(t.dst)) > 0 &&
+		len(s.sport.intersect(t.sport)) > 0 && len(s.dport.intersect(t.dport)) > 0 &&
+		s.in.overlaps(t.in) && s.out.overlaps(t.out)
+}
+
+func (s space) protocolCovers(t space) bool {
+	switch {
+	case s.protocol == "":
+		return true
+	case t.protocol == "":
+		return false
+	case !s.protocolInverted:
+		return !t.protocolInverted && s.protocol == t.protocol
+	default:
+		return s.protocol != t.protocol || t.protocolInverted
+	}
+}
+
+func (s space) protocolOverlaps(t space) bool {
+	switch {
+	case s.protocol == "" || t.protocol == "" || (s.protocolInverted && t.protocolInverted):
+		return true
+	case s.protocolInverted != t.protocolInverted:
+		return s.protocol != t.protocol
+	default:
+		return s.protocol == t.protocol
+	}
+}
+
+// ifaceMatch is an interface match, name ending with + matches any interface which begins with it.
+// Empty name matches any interface.
+type ifaceMatch struct {
+	name     string
+	inverted bool
+}
+
+func newIfaceMatch(spec string) ifaceMatch {
+	name, inverted := invert(spec)
+	return ifaceMatch{name: name, inverted: inverted}
+}
+
+func (m ifaceMatch) covers(o ifaceMatch) bool {
+	switch {
+	case m.name == "":
+		return true
+	case o.name == "":
+		return false
+	case !m.inverted && !o.inverted:
+		return patternContains(m.name, o.name)
+	case m.inverted && o.inverted:
+		return patternContains(o.name, m.name)
+	case m.inverted:
+		return !patternContains(m.name, o.name) && !patternContains(o.name, m.name)
+	default:
+		return false
+	}
+}
+
+func (m ifaceMatch) overlaps(o ifaceMatch) bool {
+	switch {
+	case m.name == "" || o.name == "" || (m.inverted && o.inverted):
+		return true
+	case m.inverted:
+		return !patternContains(m.name, o.name)
+	case o.inverted:
+		return !patternContains(o.name, m.name)
+	default:
+		return patternContains(m.name, o.name) || patternContains(o.name, m.name)
+	}
+}
+
+// patternContains reports whether every interface matched by q is matched by p.
+func patternContains(p, q string) bool {
+	if strings.HasSuffix(p, "+") {
+		return strings.HasPrefix(strings.TrimSuffix(q, "+"), strings.TrimSuffix(p, "+"))
+	}
+	return p == q
+}
+
+// invert returns the value of the option and whether it's inverted by a ! argument.
+func invert(spec string) (string, bool) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "!") {
+		return strings.TrimSpace(strings.TrimPrefix(spec, "!")), true
+	}
+	return spec, false
+}
+
+var protocolNumbers = map[string]string{
+	"":    "all",
+	"0":   "all",
+	"1":   "icmp",
+	"6":   "tcp",
+	"17":  "udp",
+	"33":  "dccp",
+	"50":  "esp",
+	"51":  "ah",
+	"58":  "icmpv6",
+	"132": "sctp",
+	"136": "udplite",
+}
+
+// protocolName returns the name of the protocol given by a name or a number.
+func protocolName(protocol string) string {
+	protocol = strings.ToLower(protocol)
+	if name, ok := protocolNumbers[protocol]; ok {
+		return name
+	}
+	if protocol == "ipv6-icmp" {
+		return "icmpv6"
+	}
+	return protocol
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -1,9 +1,12 @@
 package command
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os/exec"
+	"strings"
 )
 
 func RunCommand(name string, args ...string) (output []byte, err error) {
@@ -39,8 +42,27 @@ func RunCommand(name string, args ...string) (output []byte, err error) {
 	}
 
 	if string(stderrorCmd) != "" {
-		return nil, fmt.Errorf(string(stderrorCmd))
+		return nil, errors.New(string(stderrorCmd))
 	}
 
 	return stdoutCmd, nil
-}
\ No newline at end of file
+}
+
+// RunCommandWithInput runs the command with given input as its standard input.
+// If command fails, output of standard error is returned as a part of the error.
+func RunCommandWithInput(input []byte, name string, args ...string) (output []byte, err error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
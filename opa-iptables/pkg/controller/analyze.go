@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/analyzer"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/converter"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// Modes of the analysis of RuleSets before they're inserted, selected by "analyze" query parameter.
+const (
+	// analyzeWarn inserts the RuleSets and reports findings of the analyzer in the response.
+	analyzeWarn = "warn"
+	// analyzeReject doesn't insert any RuleSet, if the analyzer finds a problem in any of them.
+	analyzeReject = "reject"
+)
+
+// analysisResult is the analysis of the rules of the kernel.
+type analysisResult struct {
+	Findings []analyzer.Finding `json:"findings"`
+	// Skipped describes rules of the kernel which can't be converted, so they're not analyzed.
+	Skipped converter.SaveErrors `json:"skipped,omitempty"`
+}
+
+// analyzeRuleSets returns findings of the analyzer for each RuleSet, along with their total number.
+func analyzeRuleSets(ruleSets []iptables.RuleSet) ([][]analyzer.Finding, int) {
+	findings := make([][]analyzer.Finding, len(ruleSets))
+	total := 0
+	for i, ruleSet := range ruleSets {
+		findings[i] = analyzer.Analyze(ruleSet.Rules)
+		total += len(findings[i])
+	}
+	return findings, total
+}
+
+// analyzeKernel analyzes rules of the chains in the kernel. Empty table or chain selects every
+// table or chain.
+func (c *Controller) analyzeKernel(table, chain string) (analysisResult, error) {
+	result := analysisResult{Findings: []analyzer.Finding{}}
+	for _, f := range iptables.DualStack.Expand() {
+		listing, err := c.kernelListing(f)
+		if err != nil {
+			if f == iptables.IPv6 {
+				c.logger.Debugf("Unable to read ipv6 rules: %v", err)
+				continue
+			}
+			return result, err
+		}
+
+		var rules []iptables.Rule
+		for _, r := range listing.Rules {
+			if (table == "" || r.Table == table) && (chain == "" || r.Chain == chain) {
+				rules = append(rules, r)
+			}
+		}
+		result.Findings = append(result.Findings, analyzer.Analyze(rules)...)
+		result.Skipped = append(result.Skipped, listing.Skipped...)
+	}
+	if len(result.Findings) > 0 {
+		c.logger.Infof("Analyzer found %v problems in the rules of the kernel", len(result.Findings))
+	}
+	return result, nil
+}
+
+// analysisError describes the findings which prevent RuleSets from being inserted.
+func analysisError(total int) error {
+	return fmt.Errorf("analyzer found %v shadowed, redundant, conflicting or unreachable rules", total)
+}
@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// identity describes the caller of the API, as presented to the authorization policy.
+type identity struct {
+	// Subject is the common name of the verified client certificate, or the subject of the
+	// bearer token.
+	Subject string `json:"subject,omitempty"`
+	// DNSNames are the DNS subject alternative names of the verified client certificate.
+	DNSNames []string `json:"dns_names,omitempty"`
+	// Authenticated is true if the caller presented a verified client certificate or a valid
+	// bearer token.
+	Authenticated bool `json:"authenticated"`
+}
+
+// authzInput is the input document of the authorization policy.
+// i.e {"identity": {"subject": "ops"}, "operation": "insert", "method": "POST", "path": "/v1/iptables/insert", "query": "iptables/webserver"}
+type authzInput struct {
+	Identity  identity `json:"identity"`
+	Operation string   `json:"operation"`
+	Method    string   `json:"method"`
+	Path      string   `json:"path"`
+	Query     string   `json:"query,omitempty"`
+}
+
+// authenticator authenticates and authorizes requests to the API.
+type authenticator struct {
+	// tokens maps bearer tokens to their subject. Token authentication is disabled if it's empty.
+	tokens map[string]string
+	// authzPath is the path of the OPA policy rule authorizing each request. Empty disables authorization.
+	authzPath string
+}
+
+// LoadTokens reads bearer tokens from the file, one per line in form of "<token> [<subject>]".
+// Empty lines and lines starting with # are ignored.
+func LoadTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token file: %v", err)
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid line in token file: expected \"<token> [<subject>]\"")
+		}
+		subject := ""
+		if len(fields) == 2 {
+			subject = fields[1]
+		}
+		tokens[fields[0]] = subject
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read token file: %v", err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("token file %v doesn't contain any token", path)
+	}
+	return tokens, nil
+}
+
+// serverTLSConfig returns TLS configuration of the API server. If clientCAFile is set, clients
+// must present a certificate signed by one of its CAs.
+func serverTLSConfig(clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(pem); !ok {
+		return nil, fmt.Errorf("failed to append client CA certificate")
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// authenticate returns identity of the caller. Error is returned if token authentication is
+// enabled and the request doesn't carry a valid bearer token.
+func (a *authenticator) authenticate(r *http.Request) (identity, error) {
+	var id identity
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		id = identity{Subject: cert.Subject.CommonName, DNSNames: cert.DNSNames, Authenticated: true}
+	}
+	if len(a.tokens) == 0 {
+		return id, nil
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return identity{}, fmt.Errorf("missing bearer token")
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	for t, subject := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			// subject of the client certificate takes precedence
+			if id.Subject == "" {
+				id.Subject = subject
+			}
+			id.Authenticated = true
+			return id, nil
+		}
+	}
+	return identity{}, fmt.Errorf("invalid bearer token")
+}
+
+// authorize queries the authorization policy in OPA, which must return true to allow the request.
+func (c *Controller) authorize(ctx context.Context, input authzInput) (bool, error) {
+	res, err := c.handleQuery(ctx, c.auth.authzPath, input)
+	if err != nil {
+		return false, err
+	}
+	var decision struct {
+		Result interface{} `json:"result"`
+	}
+	if err := json.Unmarshal(res, &decision); err != nil {
+		return false, err
+	}
+	allowed, ok := decision.Result.(bool)
+	return ok && allowed, nil
+}
+
+// authMiddleware authenticates every request and, if authorization is enabled, asks OPA whether
+// the caller is allowed to perform the operation. Operation is the name of the matched route.
+func (c *Controller) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := c.auth.authenticate(r)
+		if err != nil {
+			c.logger.Errorf("Unauthenticated request %v %v from %v: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, &response{Status: statusFailure, Message: err.Error()})
+			return
+		}
+
+		if c.auth.authzPath != "" {
+			input := authzInput{
+				Identity: id,
+				Method:   r.Method,
+				Path:     r.URL.Path,
+				Query:    strings.TrimPrefix(r.URL.Query().Get("q"), "/"),
+			}
+			if route := mux.CurrentRoute(r); route != nil {
+				input.Operation = route.GetName()
+			}
+			allowed, err := c.authorize(r.Context(), input)
+			if err != nil {
+				c.logger.Errorf("Unable to authorize request %v %v: %v", r.Method, r.URL.Path, err)
+				writeJSON(w, http.StatusInternalServerError, errorResponse(fmt.Errorf("unable to authorize request: %w", err)))
+				return
+			}
+			if !allowed {
+				c.logger.Errorf("Request %v %v of %q was denied by authorization policy", r.Method, r.URL.Path, id.Subject)
+				writeJSON(w, http.StatusForbidden, &response{Status: statusFailure, Message: "request denied by authorization policy"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/opa"
+)
+
+func TestLoadTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	content := "# tokens of the API\ns3cr3t ops\n\nanonymous-token\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"s3cr3t": "ops", "anonymous-token": ""}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("wanted: %v, but got: %v", expected, tokens)
+	}
+
+	for _, content := range []string{"", "# no tokens\n", "token subject extra\n"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadTokens(path); err == nil {
+			t.Errorf("expected error for %q", content)
+		}
+	}
+	if _, err := LoadTokens(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "node-1"}, DNSNames: []string{"node-1.example.com"}}
+	mtls := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	tests := []struct {
+		name      string
+		tokens    map[string]string
+		authzPath string
+		opa       *fakeOPA
+		token     string
+		tls       *tls.ConnectionState
+		code      int
+		input     *authzInput
+	}{
+		{
+			name: "no authentication",
+			code: http.StatusOK,
+		},
+		{
+			name:   "missing token",
+			tokens: map[string]string{"s3cr3t": "ops"},
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:   "invalid token",
+			tokens: map[string]string{"s3cr3t": "ops"},
+			token:  "guess",
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:   "valid token",
+			tokens: map[string]string{"s3cr3t": "ops"},
+			token:  "s3cr3t",
+			code:   http.StatusOK,
+		},
+		{
+			name:      "allowed by policy",
+			tokens:    map[string]string{"s3cr3t": "ops"},
+			authzPath: "system/authz/allow",
+			opa:       &fakeOPA{result: `{"result": true}`},
+			token:     "s3cr3t",
+			code:      http.StatusOK,
+			input:     &authzInput{Identity: identity{Subject: "ops", Authenticated: true}, Operation: "metrics", Method: "GET", Path: "/metrics"},
+		},
+		{
+			name:      "client certificate",
+			authzPath: "system/authz/allow",
+			opa:       &fakeOPA{result: `{"result": true}`},
+			tls:       mtls,
+			code:      http.StatusOK,
+			input:     &authzInput{Identity: identity{Subject: "node-1", DNSNames: []string{"node-1.example.com"}, Authenticated: true}, Operation: "metrics", Method: "GET", Path: "/metrics"},
+		},
+		{
+			name:      "denied by policy",
+			authzPath: "system/authz/allow",
+			opa:       &fakeOPA{result: `{"result": false}`},
+			code:      http.StatusForbidden,
+		},
+		{
+			name:      "undefined decision",
+			authzPath: "system/authz/allow",
+			opa:       &fakeOPA{result: `{}`},
+			code:      http.StatusForbidden,
+		},
+		{
+			name:      "policy error",
+			authzPath: "system/authz/allow",
+			opa:       &fakeOPA{queryErr: &opa.Error{Code: "internal_error", Message: "eval failed"}},
+			code:      http.StatusInternalServerError,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Controller{logger: logging.GetLogger(), auth: &authenticator{tokens: tc.tokens, authzPath: tc.authzPath}}
+			if tc.opa != nil {
+				c.opaClient = tc.opa
+			}
+
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			req.TLS = tc.tls
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			c.router().ServeHTTP(rec, req)
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %v, got %v: %v", tc.code, rec.Code, rec.Body.String())
+			}
+			if tc.input != nil {
+				var query struct {
+					Input authzInput `json:"input"`
+				}
+				if err := json.Unmarshal(tc.opa.input, &query); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(query.Input, *tc.input) {
+					t.Errorf("wanted input: %+v, but got: %+v", *tc.input, query.Input)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"regexp"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+var chainNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// managedChainName returns name of the chain owned by the controller, which contains rules
+// of the ruleset with given id targeting given chain of given table. i.e OPA-170d319c4a57a873eaea29f0
+// The name is derived from a hash of the whole (table, id, chain) tuple, so names of different
+// tuples don't collide even though chain names are limited to 28 characters.
+func managedChainName(table, id, chain string) string {
+	sum := sha256.Sum256([]byte(table + "\x00" + id + "\x00" + chain))
+	return fmt.Sprintf("OPA-%x", sum[:12])
+}
+
+// chainGroup contains rules of a ruleset which target the same chain.
+type chainGroup struct {
+	table  string
+	chain  string
+	family iptables.Family
+	rules  []iptables.Rule
+}
+
+// managedChainGroups groups rules of the ruleset by table and chain, in order of appearance.
+func managedChainGroups(rs iptables.RuleSet) []*chainGroup {
+	var groups []*chainGroup
+	index := make(map[string]*chainGroup)
+	for _, r := range rs.Rules {
+		r.SetDefaults()
+		key := r.Table + "/" + r.Chain
+		g, ok := index[key]
+		if !ok {
+			g = &chainGroup{table: r.Table, chain: r.Chain}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.rules = append(g.rules, r)
+	}
+
+	for _, g := range groups {
+		g.family = groupFamily(g.rules)
+	}
+	return groups
+}
+
+// groupFamily returns the family which covers families of all the rules.
+func groupFamily(rules []iptables.Rule) iptables.Family {
+	var family iptables.Family
+	for _, r := range rules {
+		families, err := r.Families()
+		if err != nil || len(families) != 1 {
+			return iptables.DualStack
+		}
+		if family != "" && family != families[0] {
+			return iptables.DualStack
+		}
+		family = families[0]
+	}
+	if family == "" {
+		return iptables.DualStack
+	}
+	return family
+}
+
+// jumpRule returns the rule which jumps from the chain of the group to the managed chain.
+func (g *chainGroup) jumpRule(id string) iptables.Rule {
+	return iptables.Rule{
+		Table:   g.table,
+		Chain:   g.chain,
+		Jump:    managedChainName(g.table, id, g.chain),
+		Family:  g.family,
+		Comment: "opa-iptables ruleset " + id,
+	}
+}
+
+// addManagedRuleSet adds operations for creating managed chains of the ruleset, filling
+// them with rules and installing a single jump rule into each of the targeted chains.
+// Rules are appended into managed chain in the order they are provided.
+func addManagedRuleSet(tx *iptables.Transaction, rs iptables.RuleSet) error {
+	id := rs.Metadata.ID
+	if id == "" {
+		return fmt.Errorf("managed chains require RuleSet with non-empty \"_id\" field")
+	}
+	for _, g := range managedChainGroups(rs) {
+		g.fill(tx, id)
+		tx.Add(g.jumpRule(id))
+	}
+	return nil
+}
+
+// fill adds operations for creating the managed chain of the group, or flushing it if it exists,
+// and appending rules of the group into it in the order they are provided.
+func (g *chainGroup) fill(tx *iptables.Transaction, id string) {
+	name := managedChainName(g.table, id, g.chain)
+	tx.NewChain(g.table, name, g.family)
+	for _, r := range g.rules {
+		r.Chain = name
+		r.Action = ""
+		r.RuleNumber = ""
+		tx.Add(r)
+	}
+}
+
+// deleteManagedRuleSet adds operations for removing jump rules and managed chains of the ruleset.
+func deleteManagedRuleSet(tx *iptables.Transaction, rs iptables.RuleSet) error {
+	id := rs.Metadata.ID
+	if id == "" {
+		return fmt.Errorf("managed chains require RuleSet with non-empty \"_id\" field")
+	}
+	for _, g := range managedChainGroups(rs) {
+		tx.Delete(g.jumpRule(id))
+		tx.DeleteChain(g.table, managedChainName(g.table, id, g.chain), g.family)
+	}
+	return nil
+}
+
+// replaceManagedRuleSet adds operations for replacing managed chains of old ruleset with managed
+// chains of new ruleset. Operations of new ruleset come first, and the number of them is returned.
+// Chains shared by both rulesets, i.e. rulesets with the same id target the same chain, are
+// flushed and refilled instead of being deleted, and their jump rules are kept if they don't change.
+func replaceManagedRuleSet(tx *iptables.Transaction, old, new iptables.RuleSet) (int, error) {
+	if old.Metadata.ID == "" || new.Metadata.ID == "" {
+		return 0, fmt.Errorf("managed chains require RuleSet with non-empty \"_id\" field")
+	}
+	oldGroups, newGroups := managedChainGroups(old), managedChainGroups(new)
+	oldJumps := make(map[string]iptables.Rule)
+	for _, g := range oldGroups {
+		jump := g.jumpRule(old.Metadata.ID)
+		oldJumps[jump.Jump] = jump
+	}
+	newJumps := make(map[string]iptables.Rule)
+	for _, g := range newGroups {
+		jump := g.jumpRule(new.Metadata.ID)
+		newJumps[jump.Jump] = jump
+	}
+
+	for _, g := range newGroups {
+		g.fill(tx, new.Metadata.ID)
+		jump := g.jumpRule(new.Metadata.ID)
+		if oldJump, ok := oldJumps[jump.Jump]; !ok || !reflect.DeepEqual(oldJump, jump) {
+			tx.Add(jump)
+		}
+	}
+	added := len(tx.Ops)
+
+	for _, g := range oldGroups {
+		jump := g.jumpRule(old.Metadata.ID)
+		newJump, shared := newJumps[jump.Jump]
+		if !shared {
+			tx.Delete(jump)
+			tx.DeleteChain(g.table, jump.Jump, g.family)
+			continue
+		}
+		if reflect.DeepEqual(newJump, jump) {
+			continue
+		}
+		// the family of the group changed, so the chain is deleted from families it left
+		tx.Delete(jump)
+		kept := make(map[iptables.Family]bool)
+		for _, f := range newJump.Family.Expand() {
+			kept[f] = true
+		}
+		for _, f := range g.family.Expand() {
+			if !kept[f] {
+				tx.DeleteChain(g.table, jump.Jump, f)
+			}
+		}
+	}
+	return added, nil
+}
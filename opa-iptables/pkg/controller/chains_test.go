@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+func TestManagedChainName(t *testing.T) {
+	var testcases = []struct {
+		table  string
+		id     string
+		chain  string
+		result string
+	}{
+		{"filter", "web", "INPUT", "OPA-170d319c4a57a873eaea29f0"},
+		{"filter", "web server", "INPUT", "OPA-36d80b738d7e13deb00ab683"},
+		{"nat", "webserver-rules-v1", "POSTROUTING", "OPA-08bc27a12f57acc3503d565b"},
+		// joined with "-", these would collide with each other
+		{"filter", "web-INPUT", "FORWARD", "OPA-fd93260e5fe293ab956932c3"},
+		{"filter", "web", "INPUT-FORWARD", "OPA-500f3eeeb17011b1e66b9fb1"},
+	}
+	for _, tt := range testcases {
+		if name := managedChainName(tt.table, tt.id, tt.chain); name != tt.result {
+			t.Errorf("Expected %v, got %v", tt.result, name)
+		}
+	}
+}
+
+func TestAddManagedRuleSet(t *testing.T) {
+	var rs iptables.RuleSet
+	rs.Metadata.ID = "web"
+	rs.Rules = []iptables.Rule{
+		{Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT"},
+		{Chain: "input", Action: "insert", RuleNumber: "1", SourceAddress: "10.0.0.1", Jump: "DROP"},
+	}
+
+	var tx iptables.Transaction
+	if err := addManagedRuleSet(&tx, rs); err != nil {
+		t.Fatal(err)
+	}
+
+	var result []string
+	for _, op := range tx.Ops {
+		result = append(result, string(op.Type)+" "+op.Rule.String())
+	}
+	expected := []string{
+		"new_chain filter OPA-170d319c4a57a873eaea29f0",
+		"add filter OPA-170d319c4a57a873eaea29f0 -p tcp --dport 80 -j ACCEPT",
+		"add filter OPA-170d319c4a57a873eaea29f0 -s 10.0.0.1 -j DROP",
+		"add filter INPUT -j OPA-170d319c4a57a873eaea29f0 -m comment --comment \"opa-iptables ruleset web\"",
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	rs.Metadata.ID = ""
+	if err := addManagedRuleSet(&tx, rs); err == nil {
+		t.Errorf("Expected error for RuleSet without _id")
+	}
+}
+
+func TestReplaceManagedRuleSet(t *testing.T) {
+	var old, new iptables.RuleSet
+	old.Metadata.ID = "web"
+	old.Rules = []iptables.Rule{
+		{Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT"},
+		{Chain: "FORWARD", Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT"},
+	}
+	new.Metadata.ID = "web"
+	new.Rules = []iptables.Rule{
+		{Protocol: "tcp", DestinationPort: "443", Jump: "ACCEPT"},
+	}
+
+	var tx iptables.Transaction
+	added, err := replaceManagedRuleSet(&tx, old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result []string
+	for _, op := range tx.Ops {
+		result = append(result, string(op.Type)+" "+op.Rule.String())
+	}
+	// INPUT chain is shared, so it's refilled and its jump rule is kept
+	expected := []string{
+		"new_chain filter OPA-170d319c4a57a873eaea29f0",
+		"add filter OPA-170d319c4a57a873eaea29f0 -p tcp --dport 443 -j ACCEPT",
+		"delete filter FORWARD -j OPA-61c2d17be4f20128dcf3f390 -m comment --comment \"opa-iptables ruleset web\"",
+		"delete_chain filter OPA-61c2d17be4f20128dcf3f390",
+	}
+	if !reflect.DeepEqual(result, expected) || added != 2 {
+		t.Errorf("Expected %v operations of new ruleset %v, got %v %v", 2, expected, added, result)
+	}
+}
@@ -5,28 +5,53 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/metrics"
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/opa"
 )
 
 func New(config Config) *Controller {
-	return &Controller{
-		logger:     logging.GetLogger(),
-		listenAddr: config.ControllerAddr + ":" + config.ControllerPort,
-		opaClient:  opa.New(config.OpaEndpoint, config.OpaAuthorization, config.OpaTrustedCAFile),
+	c := &Controller{
+		logger:         logging.GetLogger(),
+		listenAddr:     config.ControllerAddr + ":" + config.ControllerPort,
+		opaClient:      opa.Instrument(config.OpaClient),
+		backend:        config.Backend,
+		sets:           iptables.NewSetManager(),
+		managedChains:  config.ManagedChains,
+		restorePolicy:  config.RestorePolicy,
+		tlsCertFile:    config.TLSCertFile,
+		tlsKeyFile:     config.TLSKeyFile,
+		tlsClientCA:    config.TLSClientCAFile,
+		auth:           &authenticator{tokens: config.Tokens, authzPath: strings.Trim(config.AuthorizationPath, "/")},
+		instanceID:     config.InstanceID,
+		shutdownPolicy: config.ShutdownPolicy,
+		auditFile:      config.AuditFile,
+		counters:       newCounterCollector(config.CountersInterval, config.CountersPath),
 		w: &watcher{
 			watcherInterval: config.WatcherInterval,
-			watcherState:    make(map[string]*state),
+			watcherState:    make(map[stateKey]*state),
 			watcherDoneCh:   make(chan struct{}, 1),
 			logger:          logging.GetLogger(),
 		},
 		watcherWorkerCount: config.WorkerCount,
 		watcher:            config.WatcherFlag,
 	}
+	if config.StateFile != "" {
+		c.w.store = newStateStore(config.StateFile)
+	}
+	if config.ReconcileInterval > 0 {
+		c.reconciler = newReconciler(config.ReconcileInterval)
+	}
+	if config.GCInterval > 0 && config.InstanceID != "" {
+		c.collector = newCollector(config.GCInterval)
+	}
+	return c
 }
 
 func (c *Controller) Run() {
@@ -35,18 +60,15 @@ func (c *Controller) Run() {
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
 
-	r := mux.NewRouter()
-	r.HandleFunc("/v1/iptables/insert", c.insertRuleHandler()).Methods("POST").Queries("q", "")
-	r.HandleFunc("/v1/iptables/delete", c.deleteRuleHandler()).Methods("POST").Queries("q", "")
-	r.HandleFunc("/v1/iptables/json", c.jsonRuleHandler()).Methods("POST")
-	r.HandleFunc("/v1/iptables/list/{table}/{chain}", c.listRulesHandler()).Methods("GET")
-	r.HandleFunc("/v1/iptables/list/all", c.listAllRulesHandler()).Methods("GET")
-
 	c.server = http.Server{
 		Addr:         c.listenAddr,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
-		Handler:      r,
+		Handler:      c.router(),
+	}
+
+	if c.w.store != nil {
+		c.restoreStates()
 	}
 
 	go c.startController()
@@ -55,14 +77,71 @@ func (c *Controller) Run() {
 		go c.startWatcher()
 	}
 
+	if c.reconciler != nil {
+		if c.watcher {
+			go c.startReconciler()
+		} else {
+			c.logger.Warn("reconciler requires watcher, it won't be started")
+		}
+	}
+
+	if c.collector != nil {
+		go c.startCollector()
+	}
+
+	if c.counters.interval > 0 {
+		go c.startCounterCollector()
+	}
+
 	<-signalCh
 	c.logger.Info("Received SIGINT SIGNAL")
 
+	if c.collector != nil {
+		c.stopCollector()
+	}
+
+	if c.counters.interval > 0 {
+		c.stopCounterCollector()
+	}
+
+	if c.reconciler != nil && c.watcher {
+		c.stopReconciler()
+	}
+
 	if c.watcher {
 		c.shutdownWatcher()
 	}
 
 	c.shutdownController()
+
+	// API server is stopped, so rules are no longer changed by requests
+	c.applyShutdownPolicy()
+}
+
+// router returns routes of the API. Routes are named after the operation they perform, which is
+// passed to the authorization policy.
+func (c *Controller) router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/iptables/insert", c.insertRuleHandler()).Methods("POST").Queries("q", "").Name("insert")
+	r.HandleFunc("/v1/iptables/delete", c.deleteRuleHandler()).Methods("POST").Queries("q", "").Name("delete")
+	r.HandleFunc("/v1/iptables/plan", c.planHandler()).Methods("POST").Queries("q", "").Name("plan")
+	r.HandleFunc("/v1/iptables/export", c.exportHandler()).Methods("POST").Queries("q", "").Name("export")
+	r.HandleFunc("/v1/iptables/json", c.jsonRuleHandler()).Methods("POST").Name("json")
+	r.HandleFunc("/v1/iptables/import", c.importHandler()).Methods("POST").Name("import")
+	r.HandleFunc("/v1/iptables/list/{table}/{chain}", c.listRulesHandler()).Methods("GET").Name("list")
+	r.HandleFunc("/v1/iptables/list/all", c.listAllRulesHandler()).Methods("GET").Name("list_all")
+	r.HandleFunc("/v1/iptables/reconcile", c.reconcileStatusHandler()).Methods("GET").Name("reconcile_status")
+	r.HandleFunc("/v1/iptables/reconcile", c.reconcileHandler()).Methods("POST").Name("reconcile")
+	r.HandleFunc("/v1/iptables/watch", c.watchListHandler()).Methods("GET").Name("watch_list")
+	r.HandleFunc("/v1/iptables/watch/check", c.watchCheckHandler()).Methods("POST").Name("watch_check")
+	r.HandleFunc("/v1/iptables/watch", c.unwatchHandler()).Methods("DELETE").Queries("q", "").Name("unwatch")
+	r.HandleFunc("/v1/iptables/gc", c.gcHandler()).Methods("POST").Name("gc")
+	r.HandleFunc("/v1/iptables/stats", c.statsHandler()).Methods("GET").Name("stats")
+	r.HandleFunc("/v1/iptables/trace", c.traceHandler()).Methods("POST").Name("trace")
+	r.HandleFunc("/v1/iptables/analyze", c.analyzeHandler()).Methods("GET").Name("analyze")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET").Name("metrics")
+	r.Use(c.authMiddleware)
+	return r
 }
 
 func (c *Controller) startWatcher() {
@@ -84,7 +163,16 @@ func (c *Controller) shutdownWatcher() {
 }
 
 func (c *Controller) startController() {
-	err := c.server.ListenAndServe()
+	var err error
+	if c.tlsCertFile != "" {
+		c.server.TLSConfig, err = serverTLSConfig(c.tlsClientCA)
+		if err != nil {
+			c.logger.Fatal(err)
+		}
+		err = c.server.ListenAndServeTLS(c.tlsCertFile, c.tlsKeyFile)
+	} else {
+		err = c.server.ListenAndServe()
+	}
 	if err != http.ErrServerClosed {
 		c.logger.Fatal(err)
 	}
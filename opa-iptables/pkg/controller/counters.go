@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	cmd "github.com/open-policy-agent/contrib/opa-iptables/pkg/command"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/converter"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// DefaultCountersPath is the path of OPA data document counters are pushed into by default.
+const DefaultCountersPath = "opa_iptables/counters"
+
+// counterCollector periodically reads packet and byte counters of rules inserted by the
+// controller and pushes them into OPA, so policies can react to traffic matched by the rules.
+type counterCollector struct {
+	interval time.Duration
+	// dataPath is the path of OPA data document counters are pushed into.
+	dataPath string
+	doneCh   chan struct{}
+
+	mu   sync.Mutex
+	last *counterReport
+}
+
+// counterReport contains counters of every RuleSet inserted by the controller, by "_id".
+type counterReport struct {
+	CollectedAt time.Time                  `json:"collected_at"`
+	RuleSets    map[string]ruleSetCounters `json:"rulesets"`
+}
+
+type ruleSetCounters struct {
+	Packets uint64         `json:"packets"`
+	Bytes   uint64         `json:"bytes"`
+	Rules   []ruleCounters `json:"rules"`
+}
+
+type ruleCounters struct {
+	Spec    string `json:"spec"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	// Found is false if the rule isn't present in the kernel in any of its families.
+	Found bool `json:"found"`
+}
+
+// kernelCounters are counters of the rules read from the kernel, by family and counterKey of the rule.
+type kernelCounters map[iptables.Family]map[string]ruleCounters
+
+func newCounterCollector(interval time.Duration, dataPath string) *counterCollector {
+	return &counterCollector{
+		interval: interval,
+		dataPath: strings.Trim(dataPath, "/"),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+func (c *Controller) startCounterCollector() {
+	c.logger.Infof("starting counter collector with interval %v", c.counters.interval)
+	ticker := time.NewTicker(c.counters.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.updateCounters(context.Background(), true); err != nil {
+				c.logger.Errorf("Counter collection failed: %v", err)
+			}
+		case <-c.counters.doneCh:
+			c.logger.Info("counter collector stopped")
+			return
+		}
+	}
+}
+
+func (c *Controller) stopCounterCollector() {
+	close(c.counters.doneCh)
+}
+
+// updateCounters collects counters and stores them as the last report. With push, they're also
+// pushed into OPA.
+func (c *Controller) updateCounters(ctx context.Context, push bool) (counterReport, error) {
+	report, err := c.collectCounters()
+	if err != nil {
+		return report, err
+	}
+	c.counters.mu.Lock()
+	c.counters.last = &report
+	c.counters.mu.Unlock()
+
+	if !push || c.counters.dataPath == "" {
+		return report, nil
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return report, err
+	}
+	if err := c.opaClient.PutData(ctx, c.counters.dataPath, data); err != nil {
+		return report, fmt.Errorf("unable to push counters into OPA: %v", err)
+	}
+	c.logger.Debugf("Pushed counters of %v RuleSets into OPA", len(report.RuleSets))
+	return report, nil
+}
+
+// lastCounters returns the last collected report, or nil if counters weren't collected yet.
+func (c *Controller) lastCounters() *counterReport {
+	c.counters.mu.Lock()
+	defer c.counters.mu.Unlock()
+	return c.counters.last
+}
+
+// collectCounters reads counters of the rules from the kernel and reports counters of every
+// RuleSet inserted by the controller.
+func (c *Controller) collectCounters() (counterReport, error) {
+	if c.backend.Name() != iptables.BackendIPTables {
+		return counterReport{}, fmt.Errorf("rule counters are not supported by the %v backend", c.backend.Name())
+	}
+	kernel := make(kernelCounters)
+	for _, f := range iptables.DualStack.Expand() {
+		out, err := cmd.RunCommand(iptablesCommand(f)+"-save", "-c")
+		if err != nil {
+			if f == iptables.IPv6 {
+				c.logger.Debugf("Unable to read ipv6 counters: %v", err)
+				continue
+			}
+			return counterReport{}, fmt.Errorf("unable to read %v counters: %v", f, err)
+		}
+		if err := kernel.add(out, f); err != nil {
+			return counterReport{}, err
+		}
+	}
+	return c.countRuleSets(kernel), nil
+}
+
+// add adds counters of the rules of iptables-save -c output. Counters of identical rules are summed.
+func (k kernelCounters) add(save []byte, family iptables.Family) error {
+	rules, err := converter.IPTablesSaveCounters(bytes.NewReader(save), family)
+	if err != nil {
+		return fmt.Errorf("unable to parse %v counters: %v", family, err)
+	}
+	if k[family] == nil {
+		k[family] = make(map[string]ruleCounters)
+	}
+	for _, r := range rules {
+		key := counterKey(r.Rule)
+		counters := k[family][key]
+		counters.Packets += r.Packets
+		counters.Bytes += r.Bytes
+		k[family][key] = counters
+	}
+	return nil
+}
+
+// countRuleSets matches rules of the RuleSets inserted by the controller with the kernel counters.
+// Counters of a rule programmed into both families are summed.
+func (c *Controller) countRuleSets(kernel kernelCounters) counterReport {
+	report := counterReport{CollectedAt: time.Now(), RuleSets: make(map[string]ruleSetCounters)}
+	for _, ruleSet := range c.ownedRuleSets() {
+		rules, err := c.effectiveRules(ruleSet.RuleSet)
+		if err != nil {
+			c.logger.Warnf("Unable to count rules of RuleSet %q: %v", ruleSet.Metadata.ID, err)
+			continue
+		}
+		counted := ruleSetCounters{Rules: make([]ruleCounters, 0, len(rules))}
+		for _, r := range rules {
+			r.SetDefaults()
+			rc := ruleCounters{Spec: untagRule(r).String()}
+			families, err := r.Families()
+			if err != nil {
+				families = nil
+			}
+			key := counterKey(r)
+			for _, f := range families {
+				if k, ok := kernel[f][key]; ok {
+					rc.Found = true
+					rc.Packets += k.Packets
+					rc.Bytes += k.Bytes
+				}
+			}
+			counted.Packets += rc.Packets
+			counted.Bytes += rc.Bytes
+			counted.Rules = append(counted.Rules, rc)
+		}
+		report.RuleSets[ruleSet.Metadata.ID] = counted
+	}
+	return report
+}
+
+// counterKey returns spec of the rule normalized the way the kernel prints it, so a rule inserted
+// by the controller has the same key as the rule read back by iptables-save.
+func counterKey(r iptables.Rule) string {
+	r.SetDefaults()
+	r.Action, r.RuleNumber, r.Family, r.Match = "", "", "", nil
+	r.SourceAddress = hostMask(r.SourceAddress)
+	r.DestinationAddress = hostMask(r.DestinationAddress)
+	return r.String()
+}
+
+// hostMask adds prefix length to a single address, as the kernel always prints one. i.e 10.0.0.1/32
+func hostMask(address string) string {
+	addr := strings.TrimPrefix(address, "!")
+	if addr == "" || strings.Contains(addr, "/") {
+		return address
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return address
+	}
+	if ip.To4() != nil {
+		return address + "/32"
+	}
+	return address + "/128"
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+)
+
+func TestCountRuleSets(t *testing.T) {
+	c := &Controller{
+		logger:     logging.GetLogger(),
+		instanceID: "node-1",
+		w:          &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+	}
+	var web iptables.RuleSet
+	web.Metadata.ID = "web"
+	web.Rules = []iptables.Rule{
+		{Chain: "INPUT", Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT", Comment: "http", Family: iptables.DualStack},
+		{Chain: "INPUT", SourceAddress: "10.0.0.1", Jump: "DROP"},
+		{Chain: "INPUT", Protocol: "tcp", DestinationPort: "8080", Jump: "ACCEPT"},
+	}
+	c.own("", web)
+
+	kernel := make(kernelCounters)
+	save4 := []byte(`*filter
+:INPUT ACCEPT [0:0]
+[10:840] -A INPUT -p tcp -m tcp --dport 80 -m comment --comment "\"opa-iptables:node-1:web http\"" -j ACCEPT
+[3:180] -A INPUT -s 10.0.0.1/32 -m comment --comment "\"opa-iptables:node-1:web\"" -j DROP
+[7:420] -A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
+COMMIT
+`)
+	save6 := []byte(`*filter
+:INPUT ACCEPT [0:0]
+[2:160] -A INPUT -p tcp -m tcp --dport 80 -m comment --comment "\"opa-iptables:node-1:web http\"" -j ACCEPT
+COMMIT
+`)
+	if err := kernel.add(save4, iptables.IPv4); err != nil {
+		t.Fatal(err)
+	}
+	if err := kernel.add(save6, iptables.IPv6); err != nil {
+		t.Fatal(err)
+	}
+
+	report := c.countRuleSets(kernel)
+	expected := ruleSetCounters{
+		Packets: 15,
+		Bytes:   1180,
+		Rules: []ruleCounters{
+			{Spec: `filter INPUT -p tcp --dport 80 -j ACCEPT -m comment --comment "http"`, Packets: 12, Bytes: 1000, Found: true},
+			{Spec: `filter INPUT -s 10.0.0.1 -j DROP`, Packets: 3, Bytes: 180, Found: true},
+			{Spec: `filter INPUT -p tcp --dport 8080 -j ACCEPT`},
+		},
+	}
+	if !reflect.DeepEqual(report.RuleSets, map[string]ruleSetCounters{"web": expected}) {
+		t.Errorf("expected counters %+v, got %+v", expected, report.RuleSets)
+	}
+}
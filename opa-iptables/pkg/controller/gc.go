@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	cmd "github.com/open-policy-agent/contrib/opa-iptables/pkg/command"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/converter"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// collector periodically removes rules tagged by the controller which are no longer backed by
+// any known RuleSet, i.e rules which the delete API couldn't remove, because the policy changed.
+type collector struct {
+	interval time.Duration
+	doneCh   chan struct{}
+}
+
+// gcResult describes a single garbage collection.
+type gcResult struct {
+	DryRun bool `json:"dry_run"`
+	// Orphaned lists tagged rules of RuleSets unknown to the controller.
+	Orphaned []orphanedRule `json:"orphaned"`
+	// Chains lists managed chains which contain only orphaned rules, they are deleted as a whole.
+	Chains  []string `json:"chains,omitempty"`
+	Removed bool     `json:"removed"`
+}
+
+type orphanedRule struct {
+	// ID is "_id" of the RuleSet as used in the ownership tag of the rule.
+	ID     string          `json:"_id"`
+	Family iptables.Family `json:"family"`
+	Spec   string          `json:"spec"`
+}
+
+func newCollector(interval time.Duration) *collector {
+	return &collector{
+		interval: interval,
+		doneCh:   make(chan struct{}),
+	}
+}
+
+func (c *Controller) startCollector() {
+	c.logger.Infof("starting garbage collector with interval %v", c.collector.interval)
+	ticker := time.NewTicker(c.collector.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.collectGarbage(false); err != nil {
+				c.logger.Errorf("Garbage collection failed: %v", err)
+			}
+		case <-c.collector.doneCh:
+			c.logger.Info("garbage collector stopped")
+			return
+		}
+	}
+}
+
+func (c *Controller) stopCollector() {
+	close(c.collector.doneCh)
+}
+
+// collectGarbage removes rules tagged by this instance of the controller, whose RuleSet isn't known
+// by the controller, as a single transaction. With dryRun, orphaned rules are only reported.
+func (c *Controller) collectGarbage(dryRun bool) (gcResult, error) {
+	result := gcResult{DryRun: dryRun, Orphaned: []orphanedRule{}}
+	if c.instanceID == "" {
+		return result, errors.New("ownership tags are not enabled")
+	}
+	if c.backend.Name() != iptables.BackendIPTables {
+		return result, fmt.Errorf("garbage collection is not supported by the %v backend", c.backend.Name())
+	}
+
+	// kernel is read before known RuleSets, and RuleSets are owned before their rules are
+	// inserted, so rules inserted in the meantime are never collected
+	saved := make(map[iptables.Family][]byte)
+	for _, f := range iptables.DualStack.Expand() {
+		out, err := cmd.RunCommand(iptablesCommand(f) + "-save")
+		if err != nil {
+			if f == iptables.IPv6 {
+				c.logger.Debugf("Unable to read ipv6 rules: %v", err)
+				continue
+			}
+			return result, fmt.Errorf("unable to read %v rules: %v", f, err)
+		}
+		saved[f] = out
+	}
+	known := c.knownTagIDs()
+
+	var tx iptables.Transaction
+	for _, f := range iptables.DualStack.Expand() {
+		if _, ok := saved[f]; !ok {
+			continue
+		}
+		if err := collectOrphans(&tx, &result, saved[f], f, c.instanceID, known); err != nil {
+			return result, err
+		}
+	}
+	if len(result.Orphaned) == 0 {
+		c.logger.Debug("Garbage collector found no orphaned rules")
+		return result, nil
+	}
+	c.logger.Infof("Garbage collector found %v orphaned rules", len(result.Orphaned))
+	if dryRun {
+		return result, nil
+	}
+	if err := c.applyTransaction(&tx, "Collected"); err != nil {
+		return result, err
+	}
+	result.Removed = true
+	return result, nil
+}
+
+// collectOrphans adds deletion of rules tagged by the instance, whose tag id isn't known, from the
+// output of iptables-save to the transaction. Managed chains containing only orphaned rules are
+// deleted once the rules jumping to them are deleted.
+func collectOrphans(tx *iptables.Transaction, result *gcResult, save []byte, family iptables.Family, instance string, known map[string]bool) error {
+	marker := ownershipPrefix + instance + ":"
+
+	// only tagged rules are converted, so rules of other tools never fail the conversion
+	var tagged bytes.Buffer
+	total := make(map[string]int)
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(save))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = strings.TrimPrefix(line, "*")
+			fmt.Fprintln(&tagged, line)
+		case line == "COMMIT":
+			fmt.Fprintln(&tagged, line)
+		case strings.HasPrefix(line, "-A "):
+			if fields := strings.Fields(line); len(fields) > 1 {
+				total[table+"/"+fields[1]]++
+			}
+			if strings.Contains(line, marker) {
+				fmt.Fprintln(&tagged, line)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ruleSet, err := converter.IPTablesSaveToRuleSet(&tagged, "", family)
+	if err != nil {
+		return fmt.Errorf("unable to parse tagged %v rules: %v", family, err)
+	}
+
+	var orphans []iptables.Rule
+	orphaned := make(map[string]int)
+	for _, r := range ruleSet.Rules {
+		inst, id, ok := parseOwnershipTag(r.Comment)
+		if !ok || inst != instance || known[id] {
+			continue
+		}
+		r.Action = ""
+		orphans = append(orphans, r)
+		orphaned[r.Table+"/"+r.Chain]++
+		result.Orphaned = append(result.Orphaned, orphanedRule{ID: id, Family: family, Spec: r.String()})
+	}
+
+	var chains []iptables.Rule
+	deleted := make(map[string]bool)
+	for _, r := range orphans {
+		key := r.Table + "/" + r.Chain
+		if strings.HasPrefix(r.Chain, "OPA-") && orphaned[key] == total[key] {
+			if !deleted[key] {
+				deleted[key] = true
+				chains = append(chains, iptables.Rule{Table: r.Table, Chain: r.Chain})
+				result.Chains = append(result.Chains, fmt.Sprintf("%v %v %v", family, r.Table, r.Chain))
+			}
+			continue
+		}
+		tx.Delete(r)
+	}
+	for _, ch := range chains {
+		tx.DeleteChain(ch.Table, ch.Chain, family)
+	}
+	return nil
+}
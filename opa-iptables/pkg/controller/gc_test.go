@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+)
+
+func TestOwnershipTags(t *testing.T) {
+	c := &Controller{instanceID: "node-1"}
+	var tx iptables.Transaction
+	tx.NewChain("filter", "OPA-web-INPUT", iptables.IPv4)
+	tx.Add(iptables.Rule{Jump: "ACCEPT"}, iptables.Rule{Jump: "DROP", Comment: "block all"})
+	c.tagOps(tx.Ops, "web")
+	c.tagOps(tx.Ops, "other")
+
+	if tx.Ops[0].Rule.Comment != "" {
+		t.Errorf("expected chain not to be tagged, got %q", tx.Ops[0].Rule.Comment)
+	}
+	if comment := tx.Ops[1].Rule.Comment; comment != "opa-iptables:node-1:web" {
+		t.Errorf("unexpected comment %q", comment)
+	}
+	if comment := tx.Ops[2].Rule.Comment; comment != "opa-iptables:node-1:web block all" {
+		t.Errorf("unexpected comment %q", comment)
+	}
+	if r := untagRule(tx.Ops[2].Rule); r.Comment != "block all" {
+		t.Errorf("expected tag to be removed, got %q", r.Comment)
+	}
+
+	instance, id, ok := parseOwnershipTag(ownershipTag("node-1", "web server v1"))
+	if !ok || instance != "node-1" || id != tagID("web server v1") || id == "web server v1" {
+		t.Errorf("unexpected tag: %v %v %v", instance, id, ok)
+	}
+	if _, _, ok := parseOwnershipTag("allow ssh"); ok {
+		t.Error("expected untagged comment")
+	}
+
+	for _, id := range []string{"", "node 1", "node:1"} {
+		if err := ValidateInstanceID(id); err == nil {
+			t.Errorf("expected error for instance id %q", id)
+		}
+	}
+}
+
+func TestReplaceRuleSetRetagsRules(t *testing.T) {
+	backend := &recordBackend{}
+	c := &Controller{
+		logger:     logging.GetLogger(),
+		backend:    backend,
+		instanceID: "node-1",
+		w:          &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+	}
+	rule := iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT"}
+
+	var old, new iptables.RuleSet
+	old.Metadata.ID, new.Metadata.ID = "web-v1", "web-v2"
+	old.Rules, new.Rules = []iptables.Rule{rule}, []iptables.Rule{rule}
+	c.own("", old)
+	if err := c.replaceRuleSet("", old, new); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{
+		`delete filter INPUT -p tcp --dport 80 -j ACCEPT -m comment --comment "opa-iptables:node-1:web-v1"`,
+		`add filter INPUT -p tcp --dport 80 -j ACCEPT -m comment --comment "opa-iptables:node-1:web-v2"`,
+	}}
+	if !reflect.DeepEqual(backend.txs, expected) {
+		t.Errorf("expected transactions %v, got %v", expected, backend.txs)
+	}
+	if known := c.knownTagIDs(); !reflect.DeepEqual(known, map[string]bool{"web-v2": true}) {
+		t.Errorf("unexpected known RuleSets %v", known)
+	}
+}
+
+func TestOwnershipOfRejectedRuleSets(t *testing.T) {
+	c := &Controller{
+		logger:  logging.GetLogger(),
+		backend: &rejectBackend{},
+		w:       &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+	}
+	rule := iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT"}
+	evil := iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: "666", Jump: "DROP"}
+
+	var web, rejected iptables.RuleSet
+	web.Metadata.ID, rejected.Metadata.ID = "web", "web"
+	web.Rules, rejected.Rules = []iptables.Rule{rule}, []iptables.Rule{evil}
+	if err := c.insertRuleSet("iptables/a", web); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.insertRuleSet("iptables/b", web); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.insertRuleSet("iptables/c", rejected); err == nil {
+		t.Fatal("expected insert to be rejected")
+	}
+	if err := c.replaceRuleSet("iptables/a", web, rejected); err == nil {
+		t.Fatal("expected replace to be rejected")
+	}
+	// RuleSets with the same "_id" are owned per query path, and rejected RuleSets are not owned
+	expected := []ownedRuleSet{{queryPath: "iptables/a", RuleSet: web}, {queryPath: "iptables/b", RuleSet: web}}
+	if owned := c.ownedRuleSets(); !reflect.DeepEqual(owned, expected) {
+		t.Errorf("expected owned RuleSets %v, got %v", expected, owned)
+	}
+
+	if err := c.deleteRuleSet("iptables/a", web); err != nil {
+		t.Fatal(err)
+	}
+	if owned := c.ownedRuleSets(); len(owned) != 1 || owned[0].queryPath != "iptables/b" {
+		t.Errorf("expected RuleSet of iptables/b to stay owned, got %v", owned)
+	}
+}
+
+func TestCollectOrphans(t *testing.T) {
+	save := []byte(`# Generated by iptables-save
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:OPA-db-INPUT - [0:0]
+-A INPUT -p tcp -m tcp --dport 80 -m comment --comment "\"opa-iptables:node-1:web\"" -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 22 -m comment --comment "\"opa-iptables:node-1:ssh allow ssh\"" -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 23 -m comment --comment "\"opa-iptables:node-2:telnet\"" -j ACCEPT
+-A INPUT -m comment --comment "\"opa-iptables:node-1:db opa-iptables ruleset db\"" -j OPA-db-INPUT
+-A INPUT -m set --match-set docker src -j ACCEPT
+-A OPA-db-INPUT -p tcp -m tcp --dport 5432 -m comment --comment "\"opa-iptables:node-1:db\"" -j ACCEPT
+COMMIT
+`)
+	var tx iptables.Transaction
+	result := gcResult{Orphaned: []orphanedRule{}}
+	known := map[string]bool{"web": true}
+	if err := collectOrphans(&tx, &result, save, iptables.IPv4, "node-1", known); err != nil {
+		t.Fatal(err)
+	}
+
+	var specs []string
+	for _, o := range result.Orphaned {
+		specs = append(specs, o.ID)
+	}
+	if !reflect.DeepEqual(specs, []string{"ssh", "db", "db"}) {
+		t.Errorf("unexpected orphaned rules %+v", result.Orphaned)
+	}
+	if !reflect.DeepEqual(result.Chains, []string{"ipv4 filter OPA-db-INPUT"}) {
+		t.Errorf("unexpected chains %v", result.Chains)
+	}
+
+	var ops []string
+	for _, op := range tx.Ops {
+		r := op.Rule
+		r.SetDefaults()
+		ops = append(ops, string(op.Type)+" "+r.String())
+	}
+	expected := []string{
+		`delete filter INPUT -p tcp --dport 22 -j ACCEPT -m comment --comment "opa-iptables:node-1:ssh allow ssh"`,
+		`delete filter INPUT -j OPA-db-INPUT -m comment --comment "opa-iptables:node-1:db opa-iptables ruleset db"`,
+		`delete_chain filter OPA-db-INPUT`,
+	}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected operations %v, got %v", expected, ops)
+	}
+}
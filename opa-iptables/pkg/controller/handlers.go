@@ -2,7 +2,9 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -10,8 +12,10 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/analyzer"
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/converter"
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/trace"
 	cmd "github.com/open-policy-agent/contrib/opa-iptables/pkg/command"
 )
 
@@ -27,43 +31,122 @@ func (c *Controller) jsonRuleHandler() http.HandlerFunc {
 			return
 		}
 
-		var buf bytes.Buffer
+		var invalid []ruleValidation
 		for i, rule := range jsonRules {
-			// for first rule
-			if i == 0 {
-				buf.Write([]byte("["))
+			var ipRule iptables.Rule
+			// lines which failed to parse are reported as JSON strings
+			if err := json.Unmarshal([]byte(rule), &ipRule); err != nil {
+				continue
 			}
+			if err := ipRule.Validate(); err != nil {
+				invalid = append(invalid, ruleValidation{Line: i + 1, Errors: err.(iptables.ValidationErrors)})
+			}
+		}
+		if len(invalid) > 0 {
+			writeJSON(w, http.StatusBadRequest, invalid)
+			return
+		}
 
-			// add each rule to buffer
-			buf.WriteString(rule)
-
-			// add ',' and '\n' to each rule except last rule
-			if i != len(jsonRules)-1 {
-				buf.WriteByte(',')
-				buf.WriteByte('\n')
+		rules := []json.RawMessage{}
+		for _, rule := range jsonRules {
+			// empty input is converted to an empty rule
+			if rule == "" {
+				continue
 			}
+			rules = append(rules, json.RawMessage(rule))
+		}
+		writeJSON(w, http.StatusOK, rules)
+	}
+}
 
-			// for last rule
-			if i == len(jsonRules)-1 {
-				buf.Write([]byte("]"))
+// importHandler converts iptables-save output of the request body into a RuleSet, which can be
+// loaded into OPA as data.
+//
+//      Query Parameters:
+//
+//      id               -   "_id" of the RuleSet. Default is "imported"
+//      family           -   family of the rules, ipv4 for iptables-save or ipv6 for ip6tables-save. Default is ipv4
+//      data_path        -   if it's set, the RuleSet is also stored into OPA as a data document at this path
+//
+//      Server Response:
+//
+//      200 OK           -   RuleSet converted from the request body
+//      400 Bad Request  -   family is invalid or some lines can't be converted. Response body describes
+//                           each such line.
+//      500 Server Error -   Fail to store the RuleSet into OPA
+//
+func (c *Controller) importHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
+		defer r.Body.Close()
+
+		id := r.FormValue("id")
+		if id == "" {
+			id = "imported"
+		}
+		family, err := iptables.ParseFamily(r.FormValue("family"))
+		if err == nil && family == iptables.DualStack {
+			err = fmt.Errorf("family of iptables-save output must be one of ipv4 | ipv6")
+		}
+		if err != nil {
+			c.logger.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if family == "" {
+			family = iptables.IPv4
+		}
+
+		ruleSet, err := converter.IPTablesSaveToRuleSet(r.Body, id, family)
+		if errs, ok := err.(converter.SaveErrors); ok {
+			c.logger.Errorf("Unable to import iptables-save output: %v", errs)
+			writeJSON(w, http.StatusBadRequest, errs)
+			return
+		}
+		if err != nil {
+			c.logger.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if path := strings.Trim(r.FormValue("data_path"), "/"); path != "" {
+			data, err := json.Marshal(ruleSet)
+			if err != nil {
+				c.logger.Error(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if err := c.opaClient.PutData(r.Context(), path, data); err != nil {
+				c.logger.Errorf("Unable to store imported RuleSet into OPA: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
 			}
+			c.logger.Infof("Stored %v imported rules into OPA at %v", len(ruleSet.Rules), path)
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(buf.Bytes())
+		writeJSON(w, http.StatusOK, ruleSet)
 	}
 }
 
 // insertRuleHandler query OPA using provided payload through request and get iptables rules
-// and insert them to the kernel
+// and insert them to the kernel. Response body describes the outcome of each RuleSet and rule,
+// and the watch state of the query path.
 //
 //      Server Response:
 //
 //      200 OK           - 	 Successfully inserted given iptables rules
 //      400 Bad Request  -   If provided query path didn't resolve to any defined OPA policy
-//                           rule or server fail to parse JSON payload
+//                           rule, server fail to parse JSON payload, returned rules are invalid
+//                           or the query path can't be watched.
 //      404 Not Found    -   OPA policy rule didn't return any iptables rules
-//      500 Server Error -   Fail to insert given iptables rules
+//      500 Server Error -   Fail to insert given iptables rules or to store the watch state.
+//                           Each RuleSet is inserted as a single transaction, so none of the
+//                           rules of failed RuleSet is inserted.
+//
+// With "dry_run=true" query parameter, the plan of the insertion is returned instead.
 //
+// With "analyze=warn" query parameter, the analyzer checks each RuleSet for shadowed, redundant,
+// conflicting and unreachable rules and its findings are included in the response. With
+// "analyze=reject", no RuleSet is inserted if any problem is found, and 409 Conflict is returned.
 //
 func (c *Controller) insertRuleHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -71,126 +154,376 @@ func (c *Controller) insertRuleHandler() http.HandlerFunc {
 		ruleSets, request, err := c.handlePayload(r)
 		if err != nil {
 			c.logger.Error(err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, http.StatusBadRequest, errorResponse(err))
 			return
 		}
-		
-		var insertError error
-		if len(ruleSets) > 0 {
-			for _, ruleSet := range ruleSets {
 
-				if len(ruleSet.Rules) > 0 {
-					err := insertRules(ruleSet.Rules)
-					if err != nil {
-						insertError = err
-						continue
-					}
-				}
-			}
+		if invalid := validateRuleSets(planInsert, ruleSets); len(invalid) > 0 {
+			c.logger.Error("RuleSet contains invalid rules")
+			writeJSON(w, http.StatusBadRequest, validationResponse(planInsert, ruleSets))
+			return
+		}
 
-			if insertError != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "%s. Checkout log for more details", err)
+		watch := stringToBool(r.FormValue("watch"))
+		if watch {
+			// checked before the kernel is changed, so a rejected request doesn't insert any rule
+			if err := c.checkWatchable(ruleSets); err != nil {
+				c.logger.Errorf("Unable to watch queryPath %v: %v", request.queryPath, err)
+				resp := errorResponse(fmt.Errorf("unable to watch queryPath: %v", err))
+				resp.Watch = &watchResult{QueryPath: request.queryPath, Error: err.Error()}
+				writeJSON(w, http.StatusBadRequest, resp)
 				return
 			}
+		}
 
-		} else {
-			c.logger.Error("Query didn't returned any ruleSet")
-			w.WriteHeader(http.StatusNotFound)
+		var findings [][]analyzer.Finding
+		switch mode := r.FormValue("analyze"); mode {
+		case "":
+		case analyzeWarn, analyzeReject:
+			var total int
+			findings, total = analyzeRuleSets(ruleSets)
+			if total > 0 {
+				c.logger.Warnf("RuleSets of %v: %v", request.queryPath, analysisError(total))
+				if mode == analyzeReject {
+					writeJSON(w, http.StatusConflict, analysisResponse(ruleSets, findings, total))
+					return
+				}
+			}
+		default:
+			err := fmt.Errorf("invalid analyze mode %q: must be one of %v | %v", mode, analyzeWarn, analyzeReject)
+			c.logger.Error(err)
+			writeJSON(w, http.StatusBadRequest, errorResponse(err))
 			return
 		}
 
-		if c.watcher {
-
-			watch := stringToBool(r.FormValue("watch"))
-
-			if len(ruleSets) > 1 && watch {
-				c.logger.Error("Unable to watch queryPath. Query returns multiple ruleSet")
-				return
-			}
-			if watch {
+		if stringToBool(r.FormValue("dry_run")) {
+			c.writePlan(w, planInsert, ruleSets)
+			return
+		}
 
-				rs := ruleSets[0]
-				s := state{
-					id:        rs.Metadata.ID,
-					payload:   request.p,
-					queryPath: request.queryPath,
-				}
+		if len(ruleSets) == 0 {
+			c.logger.Error("Query didn't returned any ruleSet")
+			writeJSON(w, http.StatusNotFound, &response{Status: statusFailure, Message: "query didn't return any RuleSet"})
+			return
+		}
 
-				if s.id == "" {
-					c.logger.Error("Unable to watch current queryPath. RuleSet cotains empty \"_id\" field.")
-					return
-				}
+		if watch {
+			// the query path is locked until its states are set, so workers never check it
+			// in between and never see inserted rules without their states
+			unlock := c.w.lockQueryPath(request.queryPath)
+			defer unlock()
+		}
 
-				err := c.putNewRulesToOPA(s.id,rs.Rules)
+		resp := &response{}
+		for i, ruleSet := range ruleSets {
+			var err error
+			if len(ruleSet.Rules) > 0 || len(ruleSet.Sets) > 0 {
+				err = c.insertRuleSet(request.queryPath, ruleSet)
 				if err != nil {
-					return
+					c.logger.Error(ruleSetError(ruleSet, err))
 				}
-				
-				c.w.addState(&s)
 			}
+			result := newRuleSetResult(ruleSet, err)
+			if findings != nil {
+				result.Findings = findings[i]
+			}
+			resp.add(result)
+		}
+
+		if watch && resp.finish() == http.StatusOK {
+			c.watchRuleSet(r.Context(), resp, request, ruleSets)
+		}
+		writeJSON(w, resp.finish(), resp)
+	}
+}
+
+// checkWatchable returns an error if the query path of ruleSets can't be watched. Every RuleSet
+// is watched by its "_id", so "_id" of the RuleSets must be non-empty and unique.
+func (c *Controller) checkWatchable(ruleSets []iptables.RuleSet) error {
+	if !c.watcher {
+		return errors.New("watcher is not enabled")
+	}
+	ids := make(map[string]bool)
+	for _, rs := range ruleSets {
+		id := rs.Metadata.ID
+		if id == "" {
+			return errors.New("RuleSet contains empty \"_id\" field")
+		}
+		if ids[id] {
+			return fmt.Errorf("query returns multiple RuleSets with \"_id\" %q", id)
 		}
+		ids[id] = true
 	}
+	return nil
+}
+
+// watchRuleSet adds the query path of inserted ruleSets, which are checked by checkWatchable,
+// to the watcher and records the resulting watch state in the response.
+func (c *Controller) watchRuleSet(ctx context.Context, resp *response, request request, ruleSets []iptables.RuleSet) {
+	watch := &watchResult{QueryPath: request.queryPath}
+	resp.Watch = watch
+
+	var states []state
+	for _, rs := range ruleSets {
+		states = append(states, state{
+			id:        rs.Metadata.ID,
+			payload:   request.p,
+			queryPath: request.queryPath,
+			rules:     rs.Rules,
+			sets:      rs.Sets,
+		})
+	}
+
+	for _, s := range states {
+		watch.IDs = append(watch.IDs, s.id)
+		err := c.putNewRulesToOPA(ctx, s.id, s.rules)
+		if err != nil {
+			c.logger.Errorf("Unable to store rules of RuleSet %q into OPA: %v", s.id, err)
+			resp.watchError(watch, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	c.w.setStates(request.queryPath, states)
+	watch.Watched = true
 }
 
 // deleteRuleHandler query OPA using provided payload through request and get iptables rules
-// and delete them from the kernel
+// and delete them from the kernel. Response body describes the outcome of each RuleSet and
+// rule, and the watch state of the query path.
 //
 //      Server Response:
 //
 //      200 OK           - 	 Successfully deleted given iptables rules
 //      400 Bad Request  -   If provided query path didn't resolve to any defined OPA policy
-//                           rule or server fail to parse JSON payload
+//                           rule, server fail to parse JSON payload or returned rules are invalid.
 //      404 Not Found    -   OPA policy rule didn't return any iptables rules
-//      500 Server Error -   Fail to delete given iptables rules
+//      500 Server Error -   Fail to delete given iptables rules or to remove the watch state.
+//                           Each RuleSet is deleted as a single transaction, so none of the
+//                           rules of failed RuleSet is deleted.
 //
+// With "dry_run=true" query parameter, the plan of the deletion is returned instead.
 //
 func (c *Controller) deleteRuleHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ruleSets, request, err := c.handlePayload(r)
 		if err != nil {
 			c.logger.Error(err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, http.StatusBadRequest, errorResponse(err))
 			return
 		}
 
-		var deleteError error
-		if len(ruleSets) > 0 {
-			for _, ruleSet := range ruleSets {
-				if len(ruleSet.Rules) > 0 {
-					err := deleteRules(ruleSet.Rules)
-					if err != nil {
-						deleteError = err
-						continue
-					}
+		if invalid := validateRuleSets(planDelete, ruleSets); len(invalid) > 0 {
+			c.logger.Error("RuleSet contains invalid rules")
+			writeJSON(w, http.StatusBadRequest, validationResponse(planDelete, ruleSets))
+			return
+		}
+
+		if stringToBool(r.FormValue("dry_run")) {
+			c.writePlan(w, planDelete, ruleSets)
+			return
+		}
+
+		if len(ruleSets) == 0 {
+			c.logger.Error("Query didn't returned any RuleSet")
+			writeJSON(w, http.StatusNotFound, &response{Status: statusFailure, Message: "query didn't return any RuleSet"})
+			return
+		}
+
+		resp := &response{}
+		for _, ruleSet := range ruleSets {
+			var err error
+			if len(ruleSet.Rules) > 0 || len(ruleSet.Sets) > 0 {
+				err = c.deleteRuleSet(request.queryPath, ruleSet)
+				if err != nil {
+					c.logger.Error(ruleSetError(ruleSet, err))
 				}
 			}
+			resp.add(newRuleSetResult(ruleSet, err))
+		}
 
-			if deleteError != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "%s. Checkout log for more details", err)
-				return
-			}
+		if c.watcher && resp.finish() == http.StatusOK {
+			c.unwatchRuleSet(r.Context(), resp, request)
+		}
+		writeJSON(w, resp.finish(), resp)
+	}
+}
+
+// unwatchRuleSet removes the query path of deleted ruleSets from the watcher, if it's watched,
+// and records the resulting watch state in the response.
+func (c *Controller) unwatchRuleSet(ctx context.Context, resp *response, request request) {
+	unlock := c.w.lockQueryPath(request.queryPath)
+	defer unlock()
+
+	states, err := c.w.getStates(request.queryPath)
+	if err != nil {
+		// query path isn't watched
+		return
+	}
+	watch := &watchResult{QueryPath: request.queryPath, Watched: true}
+	for _, s := range states {
+		watch.IDs = append(watch.IDs, s.id)
+	}
+	resp.Watch = watch
+
+	if err := c.unwatch(ctx, request.queryPath, states); err != nil {
+		resp.watchError(watch, err, http.StatusInternalServerError)
+		return
+	}
+	watch.Watched = false
+}
+
+// unwatch stops watching the query path with given states. Rules of the states stored in OPA
+// are deleted, rules in the kernel are left untouched.
+func (c *Controller) unwatch(ctx context.Context, queryPath string, states []state) error {
+	for _, s := range states {
+		if err := c.deleteOldRulesFromOPA(ctx, s.id); err != nil {
+			c.logger.Errorf("Unable to delete rules of RuleSet %q from OPA: %v", s.id, err)
+			return err
+		}
+	}
+	c.w.setStates(queryPath, nil)
+	c.logger.Infof("Stopped watching queryPath %v", queryPath)
+	return nil
+}
+
+// planHandler query OPA same as insert and delete handlers and returns the diff between
+// returned rules and the kernel, without changing the kernel.
+//
+//      Server Response:
+//
+//      200 OK           -   Plan of the operation
+//      400 Bad Request  -   If provided query path didn't resolve to any defined OPA policy
+//                           rule, server fail to parse JSON payload, op is not valid or
+//                           returned rules are invalid
+//      404 Not Found    -   OPA policy rule didn't return any iptables rules
+//
+func (c *Controller) planHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ruleSets, _, err := c.handlePayload(r)
+		if err != nil {
+			c.logger.Error(err)
+			writeJSON(w, http.StatusBadRequest, errorResponse(err))
+			return
+		}
+
+		op := r.FormValue("op")
+		if op == "" {
+			op = planInsert
+		}
+		if op != planInsert && op != planDelete {
+			err := fmt.Errorf("unknown plan op %q: must be one of %v | %v", op, planInsert, planDelete)
+			c.logger.Error(err)
+			writeJSON(w, http.StatusBadRequest, errorResponse(err))
+			return
+		}
+		if invalid := validateRuleSets(op, ruleSets); len(invalid) > 0 {
+			c.logger.Error("RuleSet contains invalid rules")
+			writeJSON(w, http.StatusBadRequest, validationResponse(op, ruleSets))
+			return
+		}
+		c.writePlan(w, op, ruleSets)
+	}
+}
+
+func (c *Controller) writePlan(w http.ResponseWriter, op string, ruleSets []iptables.RuleSet) {
+	if len(ruleSets) == 0 {
+		c.logger.Error("Query didn't returned any RuleSet")
+		writeJSON(w, http.StatusNotFound, errorResponse(errors.New("query didn't return any RuleSet")))
+		return
+	}
+	p, err := c.planRuleSets(op, ruleSets)
+	if err != nil {
+		c.logger.Error(err)
+		writeJSON(w, http.StatusBadRequest, errorResponse(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// exportHandler query OPA using provided payload through request and returns returned RuleSets
+// as iptables commands or iptables-restore input, without changing the kernel.
+//
+//      Query Parameters:
+//
+//      format           -   commands | restore. Default is commands
+//      family           -   family of iptables-restore input, ipv4 | ipv6. Default is ipv4
+//
+//      Server Response:
+//
+//      200 OK           -   iptables commands, one per line, or iptables-restore input
+//      400 Bad Request  -   If provided query path didn't resolve to any defined OPA policy
+//                           rule, server fail to parse JSON payload, format or family is
+//                           invalid or returned rules can't be exported
+//      404 Not Found    -   OPA policy rule didn't return any iptables rules
+//
+func (c *Controller) exportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ruleSets, _, err := c.handlePayload(r)
+		if err != nil {
+			c.logger.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(ruleSets) == 0 {
+			c.logger.Error("Query didn't returned any RuleSet")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
-			if c.watcher {
-				s, err := c.w.getState(request.queryPath)
+		var buf bytes.Buffer
+		switch format := r.FormValue("format"); format {
+		case "", converter.FormatCommands:
+			for _, ruleSet := range ruleSets {
+				commands, err := converter.RuleSetToCommands(ruleSet)
 				if err != nil {
-					c.logger.Error(err)
+					c.logger.Errorf("Unable to export RuleSet %v: %v", ruleSet.Metadata.ID, err)
+					w.WriteHeader(http.StatusBadRequest)
 					return
 				}
-	
-				err = c.deleteOldRulesFromOPA(s.id)
-				if err != nil {
-					c.logger.Error(err)
-					return
+				for _, command := range commands {
+					buf.WriteString(command + "\n")
 				}
-				c.w.removeState(s.queryPath)
 			}
-
-		} else {
-			c.logger.Error("Query didn't returned any RuleSet")
-			w.WriteHeader(http.StatusNotFound)
+		case converter.FormatRestore:
+			family, err := iptables.ParseFamily(r.FormValue("family"))
+			if family == "" {
+				family = iptables.IPv4
+			}
+			if err == nil && family == iptables.DualStack {
+				err = fmt.Errorf("family of iptables-restore input must be one of ipv4 | ipv6")
+			}
+			if err != nil {
+				c.logger.Error(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			// rules of all the RuleSets are restored together, so each table is declared once
+			var all iptables.RuleSet
+			for _, ruleSet := range ruleSets {
+				for _, rule := range ruleSet.Rules {
+					if rule.Family == "" {
+						rule.Family = ruleSet.Family
+					}
+					all.Rules = append(all.Rules, rule)
+				}
+			}
+			out, err := converter.RuleSetToRestore(all, family)
+			if err != nil {
+				c.logger.Errorf("Unable to export rules: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			buf.Write(out)
+		default:
+			c.logger.Errorf("unknown export format %q", format)
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
 	}
 }
 
@@ -205,15 +538,28 @@ func (c *Controller) listRulesHandler() http.HandlerFunc {
 		if chain == "" {
 			chain = "INPUT"
 		}
-		rules, err := iptables.ListRules(table, chain)
+		family, err := iptables.ParseFamily(r.FormValue("family"))
+		if err != nil {
+			c.logger.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rules, err := c.backend.ListRules(table, chain, family)
 		if err != nil {
 			c.logger.Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		for _, rule := range rules {
-			fmt.Fprintln(w, rule)
+		families := family.Expand()
+		for _, f := range families {
+			// rules of both families are listed in separate sections
+			if len(families) > 1 {
+				fmt.Fprintf(w, "# %v\n", f)
+			}
+			for _, rule := range rules[f] {
+				fmt.Fprintln(w, rule)
+			}
 		}
 	}
 }
@@ -225,30 +571,334 @@ func (c *Controller) listAllRulesHandler() http.HandlerFunc {
 		verbose := stringToBool(r.FormValue("verbose"))
 		var iptableTableList = [...]string{"filter", "nat"}
 
-		if verbose {
-			var buf bytes.Buffer
-			for _, table := range iptableTableList {
-				stdout, err := cmd.RunCommand("/sbin/iptables", "-n", "-v", "-L", "-t", table)
+		family, err := iptables.ParseFamily(r.FormValue("family"))
+		if err != nil {
+			c.logger.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if c.backend.Name() == iptables.BackendNFTables {
+			stdout, err := cmd.RunCommand("nft", "list", "ruleset")
+			if err != nil {
+				c.logger.Errorf("Unable to list nftables ruleset: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, string(stdout))
+			return
+		}
+
+		var buf bytes.Buffer
+		for _, f := range family.Expand() {
+			command := iptablesCommand(f)
+			if verbose {
+				for _, table := range iptableTableList {
+					stdout, err := cmd.RunCommand(command, "-n", "-v", "-L", "-t", table)
+					if err != nil {
+						c.logger.Errorf("Unable to list %v rule: %v", f, err)
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					buf.Write(stdout)
+				}
+			} else {
+				stdout, err := cmd.RunCommand(command, "-S")
 				if err != nil {
-					c.logger.Errorf("Unable to list iptables rule: %v", err)
+					c.logger.Errorf("Unable to list %v rule: %v", f, err)
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
 				buf.Write(stdout)
 			}
-			fmt.Fprint(w, buf.String())
-		} else {
-			stdout, err := cmd.RunCommand("/sbin/iptables", "-S")
-			if err != nil {
-				c.logger.Errorf("Unable to list iptables rule: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+		}
+		fmt.Fprint(w, buf.String())
+	}
+}
+
+// iptablesCommand returns path of the iptables utility used for given family.
+func iptablesCommand(family iptables.Family) string {
+	if family == iptables.IPv6 {
+		return "/sbin/ip6tables"
+	}
+	return "/sbin/iptables"
+}
+
+// reconcileStatusHandler reports drift counts and the result of last reconciliation.
+//
+//      Server Response:
+//
+//      200 OK           -   Status of the reconciler
+//      404 Not Found    -   Reconciler is not enabled
+//
+func (c *Controller) reconcileStatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
+		if c.reconciler == nil || !c.watcher {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "reconciler is not enabled")
+			return
+		}
+		writeJSON(w, http.StatusOK, c.reconciler.getStatus())
+	}
+}
+
+// reconcileHandler runs reconciliation immediately and returns its result.
+//
+//      Server Response:
+//
+//      200 OK           -   Result of the reconciliation
+//      404 Not Found    -   Reconciler is not enabled
+//
+func (c *Controller) reconcileHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
+		if c.reconciler == nil || !c.watcher {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "reconciler is not enabled")
+			return
+		}
+		writeJSON(w, http.StatusOK, c.reconcile(r.Context()))
+	}
+}
+
+// watchListHandler lists watched query paths with "_id" of their RuleSets, input payload and
+// the outcome of their last check. With "q" query parameter, only the given query path is returned.
+//
+//      Server Response:
+//
+//      200 OK           -   Watched query paths
+//      404 Not Found    -   Watcher is not enabled or given query path isn't watched
+//
+func (c *Controller) watchListHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
+		if !c.watcher {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "watcher is not enabled")
+			return
+		}
+		queryPath := strings.Trim(r.FormValue("q"), "/")
+		if queryPath == "" {
+			writeJSON(w, http.StatusOK, c.w.entries())
+			return
+		}
+		e, err := c.w.entry(queryPath)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+	}
+}
+
+// watchCheckHandler checks watched query paths immediately, instead of waiting for the next
+// tick of the watcher, and returns the updated watch entries. With "q" query parameter, only
+// the given query path is checked.
+//
+//      Server Response:
+//
+//      200 OK           -   Watch entries after the check, errors are reported in "last_error"
+//      404 Not Found    -   Watcher is not enabled or given query path isn't watched
+//
+func (c *Controller) watchCheckHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
+		if !c.watcher {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "watcher is not enabled")
+			return
+		}
+		queryPaths := c.w.queryPaths()
+		if queryPath := strings.Trim(r.FormValue("q"), "/"); queryPath != "" {
+			queryPaths = []string{queryPath}
+		}
+
+		entries := []watchEntry{}
+		for _, queryPath := range queryPaths {
+			if !c.checkQueryPath(r.Context(), 0, queryPath) {
+				if len(queryPaths) == 1 {
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprintf(w, "queryPath %v is not watched\n", queryPath)
+					return
+				}
+				continue
+			}
+			// all RuleSets may have been removed by the check
+			if e, err := c.w.entry(queryPath); err == nil {
+				entries = append(entries, e)
 			}
-			fmt.Fprint(w, string(stdout))
 		}
+		writeJSON(w, http.StatusOK, entries)
 	}
 }
 
+// unwatchHandler stops watching the query path given by "q" query parameter. Rules of the
+// query path are left in the kernel, use delete API for deleting them as well.
+//
+//      Server Response:
+//
+//      200 OK           -   Watch entry of the query path, which is no longer watched
+//      404 Not Found    -   Watcher is not enabled or given query path isn't watched
+//      500 Server Error -   Fail to delete rules of the query path stored in OPA
+//
+func (c *Controller) unwatchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
+		if !c.watcher {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "watcher is not enabled")
+			return
+		}
+		queryPath := strings.Trim(r.FormValue("q"), "/")
+		unlock := c.w.lockQueryPath(queryPath)
+		defer unlock()
+
+		e, err := c.w.entry(queryPath)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, err)
+			return
+		}
+		states, _ := c.w.getStates(queryPath)
+		if err := c.unwatch(r.Context(), queryPath, states); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+	}
+}
+
+// gcHandler removes rules tagged by the controller which are no longer backed by any known
+// RuleSet. With "dry_run=true" query parameter, orphaned rules are only reported.
+//
+//      Server Response:
+//
+//      200 OK           -   Orphaned rules, and whether they were removed
+//      404 Not Found    -   Ownership tags are not enabled
+//      500 Server Error -   Fail to read or remove the rules
+//
+func (c *Controller) gcHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
+		if c.instanceID == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "ownership tags are not enabled")
+			return
+		}
+		result, err := c.collectGarbage(stringToBool(r.FormValue("dry_run")))
+		if err != nil {
+			c.logger.Errorf("Garbage collection failed: %v", err)
+			writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// statsHandler reports packet and byte counters of rules inserted by the controller. Counters are
+// collected on request if periodic collection is disabled, they weren't collected yet or
+// "refresh=true" query parameter is given.
+//
+//      Server Response:
+//
+//      200 OK           -   Counters of every RuleSet inserted by the controller
+//      500 Server Error -   Fail to read counters of the rules
+//
+func (c *Controller) statsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
+		if report := c.lastCounters(); report != nil && c.counters.interval > 0 && !stringToBool(r.FormValue("refresh")) {
+			writeJSON(w, http.StatusOK, report)
+			return
+		}
+		// counters are pushed into OPA only by the periodic collection
+		report, err := c.updateCounters(r.Context(), c.counters.interval > 0)
+		if err != nil {
+			c.logger.Errorf("Counter collection failed: %v", err)
+			writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// traceHandler simulates the traversal of the packet described by the request body through the
+// rules, without touching the kernel, and reports the rule and the verdict which decide its fate.
+// "source" query parameter selects the rules: kernel (default) or managed, which are the RuleSets
+// inserted by the controller.
+//
+//      Server Response:
+//
+//      200 OK           -   Trace of the packet
+//      400 Bad Request  -   Invalid packet or source
+//      500 Server Error -   Fail to read rules of the kernel
+//
+func (c *Controller) traceHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
+		defer r.Body.Close()
+		var packet trace.Packet
+		if err := json.NewDecoder(r.Body).Decode(&packet); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse(fmt.Errorf("Error while unmarshalling packet: %v", err)))
+			return
+		}
+
+		source := r.FormValue("source")
+		if source == "" {
+			source = traceKernel
+		}
+		if source != traceKernel && source != traceManaged {
+			writeJSON(w, http.StatusBadRequest, errorResponse(fmt.Errorf("invalid source %q: must be one of %v | %v", source, traceKernel, traceManaged)))
+			return
+		}
+		// packet is validated before rules are read
+		if err := packet.Validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse(err))
+			return
+		}
+
+		resp, err := c.tracePacket(source, packet)
+		if err != nil {
+			c.logger.Errorf("Trace failed: %v", err)
+			writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// analyzeHandler analyzes rules of the chains in the kernel for shadowed, redundant, conflicting
+// and unreachable rules. "table" and "chain" query parameters limit the analysis to given table
+// and chain.
+//
+//      Server Response:
+//
+//      200 OK           -   Findings of the analyzer
+//      500 Server Error -   Fail to read rules of the kernel
+//
+func (c *Controller) analyzeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
+		result, err := c.analyzeKernel(r.FormValue("table"), r.FormValue("chain"))
+		if err != nil {
+			c.logger.Errorf("Analysis failed: %v", err)
+			writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
 func (c *Controller) handlePayload(r *http.Request) ([]iptables.RuleSet, request, error) {
 	c.logger.Infof("msg=\"Received Request\" req_method=%v req_path=%v\n", r.Method, r.URL)
 	body, err := ioutil.ReadAll(r.Body)
@@ -264,9 +914,9 @@ func (c *Controller) handlePayload(r *http.Request) ([]iptables.RuleSet, request
 	}
 
 	queryPath := strings.TrimPrefix(r.FormValue("q"), "/")
-	res, err := c.handleQuery(queryPath, payload.Input)
+	res, err := c.handleQuery(r.Context(), queryPath, payload.Input)
 	if err != nil {
-		return nil, request{}, fmt.Errorf("Error while quering OPA: %v", err)
+		return nil, request{}, fmt.Errorf("Error while quering OPA: %w", err)
 	}
 
 	if len(string(res)) == 2 && string(res) == "{}" {
@@ -281,6 +931,42 @@ func (c *Controller) handlePayload(r *http.Request) ([]iptables.RuleSet, request
 	return ruleSets, request{queryPath: queryPath, p: payload}, nil
 }
 
+// ruleSetValidation lists invalid fields of the ruleSet.
+type ruleSetValidation struct {
+	ID     string                    `json:"_id"`
+	Errors iptables.ValidationErrors `json:"errors"`
+}
+
+// ruleValidation lists invalid fields of the rule at given line of the converter input.
+type ruleValidation struct {
+	Line   int                       `json:"line"`
+	Errors iptables.ValidationErrors `json:"errors"`
+}
+
+// validateRuleSets returns validation errors of invalid ruleSets, which are inserted or deleted by op.
+func validateRuleSets(op string, ruleSets []iptables.RuleSet) []ruleSetValidation {
+	var invalid []ruleSetValidation
+	for _, ruleSet := range ruleSets {
+		if err := validateRuleSet(op, ruleSet); err != nil {
+			invalid = append(invalid, ruleSetValidation{ID: ruleSet.Metadata.ID, Errors: err.(iptables.ValidationErrors)})
+		}
+	}
+	return invalid
+}
+
+// validateRuleSet validates the ruleSet before it's inserted or deleted by op.
+func validateRuleSet(op string, ruleSet iptables.RuleSet) error {
+	if op == planDelete {
+		return ruleSet.ValidateDelete()
+	}
+	return ruleSet.Validate()
+}
+
+// ruleSetError describes the error of applying given ruleSet, including the rule which was rejected.
+func ruleSetError(ruleSet iptables.RuleSet, err error) string {
+	return fmt.Sprintf("RuleSet %q: %v", ruleSet.Metadata.ID, err)
+}
+
 func stringToBool(value string) bool {
 	if value == "true" {
 		return true
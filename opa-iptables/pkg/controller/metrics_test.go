@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// applyBackend applies every transaction with the same result.
+type applyBackend struct {
+	fakeBackend
+	err error
+}
+
+func (b *applyBackend) Apply(tx *iptables.Transaction) error {
+	return b.err
+}
+
+func TestApplyTransactionMetrics(t *testing.T) {
+	backend := &applyBackend{}
+	c := &Controller{backend: backend}
+	count := func(operation, result, chain string) float64 {
+		return testutil.ToFloat64(metrics.Rules.WithLabelValues(operation, result, "filter", chain))
+	}
+	inserted := count("insert", metrics.ResultSuccess, "INPUT")
+	deleted := count("delete", metrics.ResultSuccess, "OUTPUT")
+	failed := count("insert", metrics.ResultFailure, "INPUT")
+
+	var tx iptables.Transaction
+	tx.NewChain("filter", "OPA-web-INPUT", iptables.IPv4)
+	tx.Add(iptables.Rule{Jump: "ACCEPT"}, iptables.Rule{Protocol: "tcp", Jump: "DROP"})
+	tx.Delete(iptables.Rule{Chain: "OUTPUT", Jump: "DROP"})
+	if err := c.applyTransaction(&tx, "Replaced"); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.err = errors.New("rejected")
+	tx = iptables.Transaction{}
+	tx.Add(iptables.Rule{Jump: "ACCEPT"})
+	if err := c.applyTransaction(&tx, "Inserted"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if n := count("insert", metrics.ResultSuccess, "INPUT") - inserted; n != 2 {
+		t.Errorf("expected 2 inserted rules, got %v", n)
+	}
+	if n := count("delete", metrics.ResultSuccess, "OUTPUT") - deleted; n != 1 {
+		t.Errorf("expected 1 deleted rule, got %v", n)
+	}
+	if n := count("insert", metrics.ResultFailure, "INPUT") - failed; n != 1 {
+		t.Errorf("expected 1 failed rule, got %v", n)
+	}
+}
+
+func TestManagedChainMetrics(t *testing.T) {
+	c := &Controller{backend: &applyBackend{}, managedChains: true}
+	count := func(chain string) float64 {
+		return testutil.ToFloat64(metrics.Rules.WithLabelValues("insert", metrics.ResultSuccess, "filter", chain))
+	}
+	forward, managed := count("FORWARD"), count(managedChainName("filter", "web", "FORWARD"))
+
+	var rs iptables.RuleSet
+	rs.Metadata.ID = "web"
+	rs.Rules = []iptables.Rule{{Chain: "FORWARD", Jump: "ACCEPT"}, {Chain: "FORWARD", Protocol: "tcp", Jump: "DROP"}}
+	if err := c.insertRuleSet("", rs); err != nil {
+		t.Fatal(err)
+	}
+
+	// jump rule isn't counted, rules of the managed chain are counted as rules of FORWARD
+	if n := count("FORWARD") - forward; n != 2 {
+		t.Errorf("expected 2 inserted rules, got %v", n)
+	}
+	if n := count(managedChainName("filter", "web", "FORWARD")) - managed; n != 0 {
+		t.Errorf("expected rules not to be labeled with managed chain, got %v", n)
+	}
+}
@@ -1,25 +1,27 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/sirupsen/logrus"
 )
 
-func (c *Controller) putNewRulesToOPA(id string, rules []iptables.Rule) error {
+func (c *Controller) putNewRulesToOPA(ctx context.Context, id string, rules []iptables.Rule) error {
 	data, err := iptables.MarshalRules(rules)
 	if err != nil {
 		return err
 	}
-	return c.opaClient.PutData("state/"+id, data)
+	return c.opaClient.PutData(ctx, "state/"+id, data)
 }
 
-func (c *Controller) deleteOldRulesFromOPA(id string) error {
-	return c.opaClient.DeleteData("state/"+id)
+func (c *Controller) deleteOldRulesFromOPA(ctx context.Context, id string) error {
+	return c.opaClient.DeleteData(ctx, "state/"+id)
 }
 
-func (c *Controller) getCurrentRulesFromOPA(id string) ([]iptables.Rule,error) {
-	data, err := c.opaClient.GetData("state/" + id)
+func (c *Controller) getCurrentRulesFromOPA(ctx context.Context, id string) ([]iptables.Rule,error) {
+	data, err := c.opaClient.GetData(ctx, "state/" + id)
 	if err != nil {
 		return nil, err
 	}
@@ -28,16 +30,25 @@ func (c *Controller) getCurrentRulesFromOPA(id string) ([]iptables.Rule,error) {
 	return rules, nil
 }
 
-func (c *Controller) handleQuery(path string, data interface{}) ([]byte, error) {
+// handleQuery queries the policy at path with given input. The decision id returned by OPA is
+// logged, so the query can be found in decision logs.
+func (c *Controller) handleQuery(ctx context.Context, path string, data interface{}) ([]byte, error) {
 	input, err := marshalInput(data)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := c.opaClient.DoQuery(path, input)
+	res, err := c.opaClient.DoQuery(ctx, path, input)
 	if err != nil {
 		return nil, err
 	}
+
+	var decision struct {
+		DecisionID string `json:"decision_id"`
+	}
+	if err := json.Unmarshal(res, &decision); err == nil && decision.DecisionID != "" {
+		c.logger.WithFields(logrus.Fields{"query_path": path, "decision_id": decision.DecisionID}).Info("Received decision from OPA")
+	}
 	return res, nil
 }
 
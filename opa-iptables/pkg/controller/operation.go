@@ -1,57 +1,190 @@
 package controller
 
 import (
-	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
-	"fmt"
+	"reflect"
+
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/metrics"
 )
 
-func insertRules(rules []iptables.Rule) error {
-	logger := logging.GetLogger()
-	successCount := 0
-	totalRules := len(rules)
-	var gotError bool
+// insertRuleSet inserts rules of the ruleSet as a single transaction. If any rule is rejected,
+// none of the rules is inserted and *iptables.TransactionError describing rejected rule is returned.
+// Sets of the ruleSet are synced before the rules are inserted, and reverted if the rules are rejected.
+func (c *Controller) insertRuleSet(queryPath string, ruleSet iptables.RuleSet) error {
+	previous := c.ownedSets()
+	restore := c.own(queryPath, ruleSet)
+	rollback := func(err error) error {
+		restore()
+		c.revertSets(ruleSet.Sets, previous)
+		return err
+	}
+	if err := c.syncSets(ruleSet.Sets); err != nil {
+		return rollback(err)
+	}
+	if len(ruleSet.Rules) == 0 {
+		return nil
+	}
+	var tx iptables.Transaction
+	if c.managedChains {
+		if err := addManagedRuleSet(&tx, ruleSet); err != nil {
+			return rollback(err)
+		}
+	} else {
+		tx.Add(ruleSet.Rules...)
+	}
+	c.tagOps(tx.Ops, ruleSet.Metadata.ID)
+	if err := c.applyTransaction(&tx, "Inserted"); err != nil {
+		return rollback(err)
+	}
+	return nil
+}
+
+// deleteRuleSet deletes rules of the ruleSet as a single transaction. If any rule is rejected,
+// none of the rules is deleted and *iptables.TransactionError describing rejected rule is returned.
+// Sets of the ruleSet are destroyed once the rules are deleted.
+func (c *Controller) deleteRuleSet(queryPath string, ruleSet iptables.RuleSet) error {
+	if len(ruleSet.Rules) > 0 {
+		var tx iptables.Transaction
+		if c.managedChains {
+			if err := deleteManagedRuleSet(&tx, ruleSet); err != nil {
+				return err
+			}
+		} else {
+			tx.Delete(ruleSet.Rules...)
+		}
+		c.tagOps(tx.Ops, ruleSet.Metadata.ID)
+		if err := c.applyTransaction(&tx, "Deleted"); err != nil {
+			return err
+		}
+	}
+	c.disown(queryPath, ruleSet.Metadata.ID)
+	c.destroySets(ruleSet.Sets, nil)
+	return nil
+}
+
+// replaceRuleSet replaces rules of old ruleSet with rules of new ruleSet as a single transaction,
+// so kernel is never left with half replaced rules. With managed chains, chains of new ruleSet
+// are filled before jump rules are swapped and chains of old ruleSet, which are not reused by
+// new ruleSet, are deleted.
+// Sets of new ruleSet are synced first, and rules are left untouched if only the sets changed.
+// If the rules are rejected, sets are reverted to the entries of old ruleSet. Sets of old
+// ruleSet, which are not in new ruleSet, are destroyed.
+func (c *Controller) replaceRuleSet(queryPath string, old, new iptables.RuleSet) error {
+	previous := c.ownedSets()
+	for _, s := range old.Sets {
+		previous[s.Name] = s
+	}
+	restore := c.own(queryPath, new)
+	rollback := func(err error) error {
+		restore()
+		c.revertSets(new.Sets, previous)
+		return err
+	}
+	if err := c.syncSets(new.Sets); err != nil {
+		return rollback(err)
+	}
+	// managed chains are named after the id of the ruleSet, and ownership tags contain the id,
+	// so they need to be replaced
+	sameTags := c.instanceID == "" || old.Metadata.ID == new.Metadata.ID
+	if !c.managedChains && sameTags && reflect.DeepEqual(old.Rules, new.Rules) {
+		c.destroySets(old.Sets, new.Sets)
+		return nil
+	}
 
-	for _, rule := range rules {
-		logger.Debugf("Inserting Rule: %v", rule.String())
-		err := rule.AddRule()
+	var tx iptables.Transaction
+	if c.managedChains {
+		added, err := replaceManagedRuleSet(&tx, old, new)
 		if err != nil {
-			gotError = true
-			logger.Errorf("Error while inserting rule: %v", err)
-			continue
+			return rollback(err)
 		}
-		successCount++
+		c.tagOps(tx.Ops[:added], new.Metadata.ID)
+		c.tagOps(tx.Ops[added:], old.Metadata.ID)
+	} else {
+		tx.Delete(old.Rules...)
+		c.tagOps(tx.Ops, old.Metadata.ID)
+		deleted := len(tx.Ops)
+		tx.Add(new.Rules...)
+		c.tagOps(tx.Ops[deleted:], new.Metadata.ID)
 	}
-	
-	logger.Infof("Inserted %v out of %v rules (%v/%v)", successCount, totalRules,successCount,totalRules)
-	if gotError {
-		return fmt.Errorf("get error during inserting rules")
+	if err := c.applyTransaction(&tx, "Replaced"); err != nil {
+		return rollback(err)
 	}
+	if old.Metadata.ID != new.Metadata.ID {
+		c.disown(queryPath, old.Metadata.ID)
+	}
+	c.destroySets(old.Sets, new.Sets)
 	return nil
 }
 
-func deleteRules(rules []iptables.Rule) error {
+// applyTransaction applies the transaction using backend of the controller.
+// Transactions are serialized, so the watcher, the reconciler and API requests never
+// interleave their changes.
+func (c *Controller) applyTransaction(tx *iptables.Transaction, verb string) error {
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+
 	logger := logging.GetLogger()
-	successCount := 0
-	totalRules := len(rules)
-	var gotError bool
+	totalRules := len(tx.Ops)
 
-	for _, rule := range rules {
-		logger.Debugf("Deleting Rule: %v", rule.String())
-		err := rule.DeleteRule()
-		if err != nil {
-			gotError = true
-			logger.Errorf("Error while deleting rule: %v", err)
+	for _, op := range tx.Ops {
+		logger.Debugf("%v Rule: %v", op.Type, op.Rule.String())
+	}
+
+	err := c.backend.Apply(tx)
+	c.recordRules(tx, err)
+	if err != nil {
+		logger.Errorf("Error while applying rules: %v", err)
+		logger.Infof("%v 0 out of %v rules (0/%v)", verb, totalRules, totalRules)
+		return err
+	}
+
+	logger.Infof("%v %v out of %v rules (%v/%v)", verb, totalRules, totalRules, totalRules, totalRules)
+	return nil
+}
+
+// recordRules counts rules of the applied transaction in metrics.Rules. If the transaction
+// failed, none of its rules was applied, so all of them are counted as failed.
+// Rules of managed chains are labeled with the chain targeted by the RuleSet, and jump rules
+// into managed chains aren't counted, so metrics don't depend on -managed-chains.
+func (c *Controller) recordRules(tx *iptables.Transaction, err error) {
+	targets := c.managedChainTargets()
+	for _, op := range tx.Ops {
+		var operation string
+		switch op.Type {
+		case iptables.OpAdd:
+			operation = "insert"
+		case iptables.OpDelete:
+			operation = "delete"
+		default:
 			continue
 		}
-		successCount++
+		r := op.Rule
+		r.SetDefaults()
+		if _, ok := targets[r.Table+"/"+r.Jump]; ok {
+			continue
+		}
+		chain := r.Chain
+		if target, ok := targets[r.Table+"/"+r.Chain]; ok {
+			chain = target
+		}
+		metrics.Rules.WithLabelValues(operation, metrics.Result(err), r.Table, chain).Inc()
 	}
+}
 
-	logger.Infof("Deleted %v out of %v rules (%v/%v)", successCount, totalRules, successCount, totalRules)
-	if gotError {
-		return fmt.Errorf("get error during deleting rules")
+// managedChainTargets returns chains targeted by RuleSets owned by the controller, by table and
+// name of their managed chain.
+func (c *Controller) managedChainTargets() map[string]string {
+	if !c.managedChains {
+		return nil
 	}
-	return nil
+	targets := make(map[string]string)
+	for _, ruleSet := range c.ownedRuleSets() {
+		for _, g := range managedChainGroups(ruleSet.RuleSet) {
+			targets[g.table+"/"+managedChainName(g.table, ruleSet.Metadata.ID, g.chain)] = g.chain
+		}
+	}
+	return targets
 }
 
 func testRules(ruleSet iptables.RuleSet) {
@@ -59,4 +192,4 @@ func testRules(ruleSet iptables.RuleSet) {
 	for i, rule := range ruleSet.Rules {
 		logger.Infof("Rule %v: %v\n", i+1, rule.String())
 	}
-}
\ No newline at end of file
+}
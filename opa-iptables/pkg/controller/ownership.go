@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// ownershipPrefix starts the comment of every rule owned by the controller, which is followed by
+// the instance of the controller and "_id" of the RuleSet. i.e opa-iptables:node-1:webserver
+const ownershipPrefix = "opa-iptables:"
+
+var instanceIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// ValidateInstanceID validates the instance of the controller used in ownership tags of the rules.
+func ValidateInstanceID(id string) error {
+	if !instanceIDRegexp.MatchString(id) {
+		return fmt.Errorf("invalid instance id %q: must be 1-32 characters of letters, digits, '_', '.' or '-'", id)
+	}
+	return nil
+}
+
+// tagID returns "_id" as used in ownership tags. Hash of the id is used, if it contains
+// characters which would make the tag ambiguous.
+func tagID(id string) string {
+	if len(id) <= 64 && chainNameRegexp.MatchString(id) {
+		return id
+	}
+	sum := sha1.Sum([]byte(id))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// ownershipTag returns the tag of rules of the RuleSet with given id owned by given instance.
+func ownershipTag(instance, id string) string {
+	return ownershipPrefix + instance + ":" + tagID(id)
+}
+
+// parseOwnershipTag returns the instance and tag id of the comment starting with ownership tag.
+func parseOwnershipTag(comment string) (instance, id string, ok bool) {
+	fields := strings.Fields(comment)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], ownershipPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(fields[0], ownershipPrefix), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// tagOps prepends ownership tag of the RuleSet with given id to comments of the rules added or
+// deleted by ops. Rules which are already tagged are left untouched. Rules are not tagged if
+// ownership tags are disabled or the RuleSet has no "_id", as such rules can't be tracked.
+func (c *Controller) tagOps(ops []iptables.Operation, id string) {
+	if c.instanceID == "" || id == "" {
+		return
+	}
+	tag := ownershipTag(c.instanceID, id)
+	for i := range ops {
+		if ops[i].Type != iptables.OpAdd && ops[i].Type != iptables.OpDelete {
+			continue
+		}
+		r := &ops[i].Rule
+		if _, _, ok := parseOwnershipTag(r.Comment); ok {
+			continue
+		}
+		if r.Comment == "" {
+			r.Comment = tag
+		} else {
+			r.Comment = tag + " " + r.Comment
+		}
+	}
+}
+
+// untagRule returns the rule without ownership tag in its comment, as it was returned by OPA.
+func untagRule(r iptables.Rule) iptables.Rule {
+	if _, _, ok := parseOwnershipTag(r.Comment); ok {
+		fields := strings.SplitN(r.Comment, " ", 2)
+		r.Comment = ""
+		if len(fields) == 2 {
+			r.Comment = fields[1]
+		}
+	}
+	return r
+}
+
+// ownedRuleSet is a RuleSet inserted by the controller along with the query path it came from.
+type ownedRuleSet struct {
+	queryPath string
+	iptables.RuleSet
+}
+
+// own records the RuleSet of the query path as inserted by the controller, so its rules are not
+// garbage collected and can be cleaned up on shutdown. RuleSets are owned before their rules are
+// inserted, the returned func restores the previous record if the rules are rejected.
+// RuleSets without "_id" can't be tracked.
+func (c *Controller) own(queryPath string, ruleSet iptables.RuleSet) (restore func()) {
+	if ruleSet.Metadata.ID == "" {
+		return func() {}
+	}
+	key := stateKey{queryPath: queryPath, id: ruleSet.Metadata.ID}
+	c.ownedMu.Lock()
+	defer c.ownedMu.Unlock()
+	if c.owned == nil {
+		c.owned = make(map[stateKey]iptables.RuleSet)
+	}
+	previous, wasOwned := c.owned[key]
+	c.owned[key] = ruleSet
+	return func() {
+		c.ownedMu.Lock()
+		defer c.ownedMu.Unlock()
+		if wasOwned {
+			c.owned[key] = previous
+		} else {
+			delete(c.owned, key)
+		}
+	}
+}
+
+// disown forgets the RuleSet of the query path with given id, once its rules are deleted.
+func (c *Controller) disown(queryPath, id string) {
+	c.ownedMu.Lock()
+	defer c.ownedMu.Unlock()
+	delete(c.owned, stateKey{queryPath: queryPath, id: id})
+}
+
+// ownedRuleSets returns RuleSets inserted by the controller, sorted by "_id" and query path.
+func (c *Controller) ownedRuleSets() []ownedRuleSet {
+	c.ownedMu.Lock()
+	defer c.ownedMu.Unlock()
+	ruleSets := make([]ownedRuleSet, 0, len(c.owned))
+	for key, ruleSet := range c.owned {
+		ruleSets = append(ruleSets, ownedRuleSet{queryPath: key.queryPath, RuleSet: ruleSet})
+	}
+	sort.Slice(ruleSets, func(i, j int) bool {
+		if ruleSets[i].Metadata.ID != ruleSets[j].Metadata.ID {
+			return ruleSets[i].Metadata.ID < ruleSets[j].Metadata.ID
+		}
+		return ruleSets[i].queryPath < ruleSets[j].queryPath
+	})
+	return ruleSets
+}
+
+// knownTagIDs returns tag ids of the RuleSets known by the controller: RuleSets inserted since
+// start of the controller and RuleSets of the watched states, which may have been restored.
+func (c *Controller) knownTagIDs() map[string]bool {
+	known := make(map[string]bool)
+	c.ownedMu.Lock()
+	for key := range c.owned {
+		known[tagID(key.id)] = true
+	}
+	c.ownedMu.Unlock()
+	for _, s := range c.w.states() {
+		known[tagID(s.id)] = true
+	}
+	return known
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+const (
+	planInsert = "insert"
+	planDelete = "delete"
+)
+
+// plan describes changes of the kernel which insert or delete request would make.
+type plan struct {
+	Op       string        `json:"op"`
+	RuleSets []ruleSetPlan `json:"rulesets"`
+}
+
+// ruleSetPlan is a diff between rules of a ruleset and the rules present in the kernel.
+// Rules of managed chains are reported as they are placed in the kernel, including jump rules.
+type ruleSetPlan struct {
+	ID string `json:"_id"`
+	// Add lists rules which would be inserted.
+	Add []plannedRule `json:"add"`
+	// Remove lists rules which would be deleted.
+	Remove []plannedRule `json:"remove"`
+	// Present lists rules which are already in the kernel and would be left untouched by insert.
+	Present []plannedRule `json:"present"`
+	// Missing lists rules which can't be deleted, because they are not in the kernel.
+	Missing []plannedRule `json:"missing,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+type plannedRule struct {
+	Rule iptables.Rule `json:"rule"`
+	Spec string        `json:"spec"`
+}
+
+// planRuleSets compares rules of the ruleSets with the kernel without changing it.
+func (c *Controller) planRuleSets(op string, ruleSets []iptables.RuleSet) (plan, error) {
+	if op != planInsert && op != planDelete {
+		return plan{}, fmt.Errorf("unknown plan op %q: must be one of %v | %v", op, planInsert, planDelete)
+	}
+
+	p := plan{Op: op, RuleSets: []ruleSetPlan{}}
+	for _, ruleSet := range ruleSets {
+		rp := ruleSetPlan{ID: ruleSet.Metadata.ID, Add: []plannedRule{}, Remove: []plannedRule{}, Present: []plannedRule{}}
+		if err := c.planRuleSet(op, ruleSet, &rp); err != nil {
+			rp.Error = err.Error()
+		}
+		p.RuleSets = append(p.RuleSets, rp)
+	}
+	return p, nil
+}
+
+func (c *Controller) planRuleSet(op string, ruleSet iptables.RuleSet, rp *ruleSetPlan) error {
+	if err := validateRuleSet(op, ruleSet); err != nil {
+		return err
+	}
+	rules, err := c.effectiveRules(ruleSet)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rules {
+		r.SetDefaults()
+		exists, err := c.backend.RuleExists(r)
+		if err != nil {
+			return err
+		}
+		pr := plannedRule{Rule: r, Spec: r.String()}
+		switch {
+		case op == planDelete && exists:
+			rp.Remove = append(rp.Remove, pr)
+		case op == planDelete:
+			rp.Missing = append(rp.Missing, pr)
+		// inserting at position doesn't check for existing rule, so it always adds the rule
+		case exists && r.Action != "insert":
+			rp.Present = append(rp.Present, pr)
+		default:
+			rp.Add = append(rp.Add, pr)
+		}
+	}
+	return nil
+}
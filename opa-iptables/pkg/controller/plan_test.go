@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// fakeBackend reports rules stored in memory as existing.
+type fakeBackend struct {
+	iptables.Backend
+	rules map[string]bool
+	// chains are rules listed by ListRules, by chain
+	chains map[string][]string
+}
+
+func (b *fakeBackend) RuleExists(r iptables.Rule) (bool, error) {
+	return b.rules[r.String()], nil
+}
+
+func (b *fakeBackend) ListRules(table, chain string, family iptables.Family) (map[iptables.Family][]string, error) {
+	rules := make(map[iptables.Family][]string)
+	for _, f := range family.Expand() {
+		rules[f] = b.chains[chain]
+	}
+	return rules, nil
+}
+
+func TestPlanRuleSets(t *testing.T) {
+	present := iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"}
+	absent := iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT"}
+	inserted := iptables.Rule{Table: "filter", Chain: "INPUT", Action: "insert", RuleNumber: "1", Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"}
+
+	c := &Controller{backend: &fakeBackend{rules: map[string]bool{present.String(): true}}}
+
+	var rs iptables.RuleSet
+	rs.Metadata.ID = "web"
+	rs.Rules = []iptables.Rule{present, absent, inserted}
+
+	var testcases = []struct {
+		op                            string
+		add, remove, present, missing int
+	}{
+		{planInsert, 2, 0, 1, 0},
+		{planDelete, 0, 2, 0, 1},
+	}
+	for _, tt := range testcases {
+		p, err := c.planRuleSets(tt.op, []iptables.RuleSet{rs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rp := p.RuleSets[0]
+		if rp.Error != "" {
+			t.Fatal(rp.Error)
+		}
+		if len(rp.Add) != tt.add || len(rp.Remove) != tt.remove || len(rp.Present) != tt.present || len(rp.Missing) != tt.missing {
+			t.Errorf("%v: Expected add=%v remove=%v present=%v missing=%v, got add=%v remove=%v present=%v missing=%v",
+				tt.op, tt.add, tt.remove, tt.present, tt.missing, len(rp.Add), len(rp.Remove), len(rp.Present), len(rp.Missing))
+		}
+	}
+
+	if _, err := c.planRuleSets("replace", nil); err == nil {
+		t.Error("Expected error for unknown op")
+	}
+}
@@ -0,0 +1,525 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/converter"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// reconciler periodically compares rules of the watched states, as returned by OPA, with the rules
+// present in the kernel and repairs any drift, i.e rules deleted manually using "iptables -D",
+// rules inserted into managed chains or rules moved within their chain.
+type reconciler struct {
+	interval time.Duration
+	doneCh   chan struct{}
+
+	mu     sync.Mutex // guard the following fields
+	status reconcileStatus
+}
+
+// reconcileStatus is reported by reconcile API.
+type reconcileStatus struct {
+	Runs          int              `json:"runs"`
+	TotalDrifted  int              `json:"total_drifted_rules"`
+	TotalRepaired int              `json:"total_repaired_rules"`
+	Last          *reconcileResult `json:"last_result,omitempty"`
+}
+
+// reconcileResult describes a single reconciliation of all the watched states.
+type reconcileResult struct {
+	StartedAt time.Time    `json:"started_at"`
+	Duration  string       `json:"duration"`
+	States    int          `json:"states"`
+	Checked   int          `json:"checked_rules"`
+	Drifted   int          `json:"drifted_rules"`
+	Repaired  int          `json:"repaired_rules"`
+	Drift     []driftEntry `json:"drift,omitempty"`
+	Errors    []string     `json:"errors,omitempty"`
+}
+
+// driftEntry lists rules of a watched state which drifted from the kernel.
+type driftEntry struct {
+	QueryPath  string   `json:"query_path"`
+	ID         string   `json:"_id"`
+	Missing    []string `json:"missing_rules"`
+	Unexpected []string `json:"unexpected_rules,omitempty"`
+	Reordered  []string `json:"reordered_rules,omitempty"`
+	Repaired   bool     `json:"repaired"`
+}
+
+func (e driftEntry) count() int {
+	return len(e.Missing) + len(e.Unexpected) + len(e.Reordered)
+}
+
+func newReconciler(interval time.Duration) *reconciler {
+	return &reconciler{
+		interval: interval,
+		doneCh:   make(chan struct{}),
+	}
+}
+
+func (c *Controller) startReconciler() {
+	c.logger.Infof("starting reconciler with interval %v", c.reconciler.interval)
+	ticker := time.NewTicker(c.reconciler.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.reconcile(context.Background())
+		case <-c.reconciler.doneCh:
+			c.logger.Info("reconciler stopped")
+			return
+		}
+	}
+}
+
+func (c *Controller) stopReconciler() {
+	close(c.reconciler.doneCh)
+}
+
+// reconcile checks every watched state once and records the result.
+func (c *Controller) reconcile(ctx context.Context) reconcileResult {
+	result := reconcileResult{StartedAt: time.Now()}
+
+	for _, s := range c.w.states() {
+		result.States++
+		entry, checked, err := c.reconcileState(ctx, s)
+		result.Checked += checked
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%v: %v", s.queryPath, err))
+		}
+		if entry != nil {
+			result.Drift = append(result.Drift, *entry)
+			result.Drifted += entry.count()
+			if entry.Repaired {
+				result.Repaired += entry.count()
+			}
+		}
+	}
+	result.Duration = time.Since(result.StartedAt).String()
+
+	if result.Drifted > 0 {
+		c.logger.Infof("Reconciler found %v drifted rules, repaired %v", result.Drifted, result.Repaired)
+	} else {
+		c.logger.Debugf("Reconciler found no drift in %v rules", result.Checked)
+	}
+
+	c.reconciler.mu.Lock()
+	c.reconciler.status.Runs++
+	c.reconciler.status.TotalDrifted += result.Drifted
+	c.reconciler.status.TotalRepaired += result.Repaired
+	c.reconciler.status.Last = &result
+	c.reconciler.mu.Unlock()
+	return result
+}
+
+// reconcileState compares desired rules of the state with the kernel and repairs the drift.
+// The query path is locked, so the watcher doesn't replace the rules while they're repaired.
+func (c *Controller) reconcileState(ctx context.Context, s state) (*driftEntry, int, error) {
+	unlock := c.w.lockQueryPath(s.queryPath)
+	defer unlock()
+
+	// the state may have been replaced or unwatched before the lock was acquired
+	if !c.w.hasState(s.queryPath, s.id) {
+		return nil, 0, nil
+	}
+
+	res, err := c.handleQuery(ctx, s.queryPath, s.payload.Input)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error while querying opa: %v", err)
+	}
+	ruleSets, err := iptables.UnmarshalRuleset(res)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error while unmarshaling ruleset: %v", err)
+	}
+
+	var ruleSet *iptables.RuleSet
+	for i := range ruleSets {
+		if ruleSets[i].Metadata.ID == s.id {
+			ruleSet = &ruleSets[i]
+		}
+	}
+	if ruleSet == nil {
+		// RuleSet has been changed, it will be replaced by the watcher
+		return nil, 0, nil
+	}
+
+	d, checked, err := c.repairRuleSet(s.queryPath, *ruleSet, func(d drift) {
+		c.logger.Infof("Detected %v drifted rules of queryPath %v, repairing", d.count(), s.queryPath)
+	})
+	if d.count() == 0 {
+		return nil, checked, err
+	}
+
+	entry := &driftEntry{QueryPath: s.queryPath, ID: s.id}
+	for _, r := range d.missing {
+		entry.Missing = append(entry.Missing, r.String())
+	}
+	for _, k := range d.unexpected {
+		entry.Unexpected = append(entry.Unexpected, k.spec)
+	}
+	for _, r := range d.reordered {
+		entry.Reordered = append(entry.Reordered, r.String())
+	}
+	if err != nil {
+		return entry, checked, err
+	}
+	entry.Repaired = true
+	return entry, checked, nil
+}
+
+// drift describes rules of a RuleSet which drifted from the kernel.
+type drift struct {
+	// missing rules of the RuleSet are not in the kernel
+	missing []iptables.Rule
+	// unexpected rules are in managed chains of the RuleSet, or tagged as rules of the RuleSet,
+	// but they're not rules of the RuleSet
+	unexpected []kernelRule
+	// reordered rules of the RuleSet are in the kernel, but not in the order of the RuleSet
+	reordered []iptables.Rule
+
+	chains []*chainDrift
+}
+
+func (d drift) count() int {
+	return len(d.missing) + len(d.unexpected) + len(d.reordered)
+}
+
+// kernelRule is a rule listed by the backend. rule is nil if the listing can't be converted.
+type kernelRule struct {
+	key  string
+	spec string
+	rule *iptables.Rule
+}
+
+// chainDrift compares desired rules of a chain of single-stack family with the rules in the kernel.
+type chainDrift struct {
+	family iptables.Family
+	table  string
+	chain  string
+	kernel []kernelRule
+	// desired are indices of the desired rules of the RuleSet in the chain, in order
+	desired []int
+	// position is the index of the kernel rule matching each desired rule, or -1 if it's missing
+	position []int
+	// inPlace reports whether each desired rule is in the kernel in the order of the RuleSet
+	inPlace []bool
+	// absent reports whether each desired rule is missing from the chain
+	absent []bool
+	// unexpected are indices of the unexpected kernel rules
+	unexpected []int
+}
+
+// repairRuleSet repairs rules of the ruleSet which drifted from the kernel. Missing and reordered
+// rules are inserted at their position in the RuleSet, relative to the other rules of the RuleSet,
+// and unexpected rules are deleted. Managed chains are rebuilt as a whole. It returns the drift
+// and the number of checked rules. found is called before the drift is repaired.
+func (c *Controller) repairRuleSet(queryPath string, ruleSet iptables.RuleSet, found func(d drift)) (drift, int, error) {
+	desired, err := c.effectiveRules(ruleSet)
+	if err != nil {
+		return drift{}, 0, err
+	}
+
+	var d drift
+	missing := make(map[int]bool)
+	for i, r := range desired {
+		exists, err := c.backend.RuleExists(r)
+		if err != nil {
+			return drift{}, len(desired), err
+		}
+		if !exists {
+			missing[i] = true
+			d.missing = append(d.missing, r)
+		}
+	}
+	if err := c.compareChains(ruleSet, desired, missing, &d); err != nil {
+		return drift{}, len(desired), err
+	}
+	if d.count() == 0 {
+		return d, len(desired), nil
+	}
+	found(d)
+
+	// managed chains are rebuilt as a whole, so the order of rules is preserved
+	if c.managedChains {
+		err = c.insertRuleSet(queryPath, ruleSet)
+	} else {
+		tx := repairTransaction(desired, d)
+		err = c.applyTransaction(&tx, "Repaired")
+	}
+	if err != nil {
+		return d, len(desired), fmt.Errorf("unable to repair drift: %v", err)
+	}
+	return d, len(desired), nil
+}
+
+// compareChains compares desired rules with the rules listed by the backend, chain by chain, and
+// records unexpected and reordered rules. Rules of other tools in the chains targeted by the
+// RuleSet are ignored, except in its managed chains, which are owned by the RuleSet.
+func (c *Controller) compareChains(ruleSet iptables.RuleSet, desired []iptables.Rule, missing map[int]bool, d *drift) error {
+	owned := make(map[string]bool)
+	if c.managedChains {
+		for _, g := range managedChainGroups(ruleSet) {
+			owned[g.table+"/"+managedChainName(g.table, ruleSet.Metadata.ID, g.chain)] = true
+		}
+	}
+
+	index := make(map[string]*chainDrift)
+	for i, r := range desired {
+		r.SetDefaults()
+		families, err := r.Families()
+		if err != nil {
+			return err
+		}
+		for _, f := range families {
+			key := string(f) + "/" + r.Table + "/" + r.Chain
+			cd, ok := index[key]
+			if !ok {
+				cd = &chainDrift{family: f, table: r.Table, chain: r.Chain}
+				index[key] = cd
+				d.chains = append(d.chains, cd)
+			}
+			cd.desired = append(cd.desired, i)
+		}
+	}
+
+	for _, cd := range d.chains {
+		kernel, err := c.listChain(cd.table, cd.chain, cd.family)
+		if err != nil {
+			return err
+		}
+		cd.kernel = kernel
+		used := make([]bool, len(kernel))
+		for _, i := range cd.desired {
+			cd.position = append(cd.position, matchKernelRule(kernel, used, desired[i]))
+		}
+		cd.inPlace = inOrder(cd.position)
+		for j, i := range cd.desired {
+			r := desired[i]
+			r.Family = cd.family
+			if cd.position[j] >= 0 && !cd.inPlace[j] {
+				d.reordered = append(d.reordered, r)
+			}
+			// dual-stack rule may be missing from one of its families only
+			absent := false
+			if missing[i] {
+				exists, err := c.backend.RuleExists(r)
+				if err != nil {
+					return err
+				}
+				absent = !exists
+			}
+			cd.absent = append(cd.absent, absent)
+		}
+		for j, k := range kernel {
+			if used[j] {
+				continue
+			}
+			if owned[cd.table+"/"+cd.chain] || c.ownsKernelRule(ruleSet, k) {
+				cd.unexpected = append(cd.unexpected, j)
+				d.unexpected = append(d.unexpected, k)
+			}
+		}
+	}
+	return nil
+}
+
+// listChain lists rules of the chain of single-stack family using the backend. Rules listed by the
+// iptables backend are converted, so they can be compared with desired rules by counterKey. The
+// nftables backend lists specification of the rules it inserted.
+func (c *Controller) listChain(table, chain string, family iptables.Family) ([]kernelRule, error) {
+	lines, err := c.backend.ListRules(table, chain, family)
+	if err != nil {
+		// chain doesn't exist, i.e managed chain was deleted
+		c.logger.Debugf("Unable to list %v chain %v of table %v: %v", family, chain, table, err)
+		return nil, nil
+	}
+	var rules []kernelRule
+	for _, line := range lines[family] {
+		if !strings.HasPrefix(line, "-") {
+			rules = append(rules, kernelRule{key: line, spec: line})
+			continue
+		}
+		if !strings.HasPrefix(line, "-A ") {
+			// i.e -P INPUT ACCEPT or -N OPA-web
+			continue
+		}
+		listing, err := converter.IPTablesSaveToListing(strings.NewReader("*"+table+"\n"+line+"\nCOMMIT\n"), family)
+		if err != nil || len(listing.Rules) != 1 {
+			rules = append(rules, kernelRule{key: line, spec: line})
+			continue
+		}
+		r := listing.Rules[0]
+		r.Action, r.Family = "", family
+		rules = append(rules, kernelRule{key: counterKey(r), spec: r.String(), rule: &r})
+	}
+	return rules, nil
+}
+
+// ownsKernelRule reports whether the kernel rule is tagged as a rule of the ruleSet.
+func (c *Controller) ownsKernelRule(ruleSet iptables.RuleSet, k kernelRule) bool {
+	if c.instanceID == "" || k.rule == nil {
+		return false
+	}
+	instance, id, ok := parseOwnershipTag(k.rule.Comment)
+	return ok && instance == c.instanceID && id == tagID(ruleSet.Metadata.ID)
+}
+
+// matchKernelRule returns index of the first unused kernel rule matching the desired rule and marks
+// it as used, or -1 if there is no such rule.
+func matchKernelRule(kernel []kernelRule, used []bool, r iptables.Rule) int {
+	r.SetDefaults()
+	keys := []string{counterKey(r), r.String()}
+	for j, k := range kernel {
+		if !used[j] && (k.key == keys[0] || k.key == keys[1]) {
+			used[j] = true
+			return j
+		}
+	}
+	return -1
+}
+
+// inOrder reports which of the present rules, whose kernel positions are given, are in order. The
+// longest subsequence of increasing positions is kept in place, so the fewest rules are reordered.
+func inOrder(position []int) []bool {
+	n := len(position)
+	length, prev := make([]int, n), make([]int, n)
+	best := -1
+	for i := 0; i < n; i++ {
+		prev[i] = -1
+		if position[i] < 0 {
+			continue
+		}
+		length[i] = 1
+		for j := 0; j < i; j++ {
+			if position[j] >= 0 && position[j] < position[i] && length[j]+1 > length[i] {
+				length[i], prev[i] = length[j]+1, j
+			}
+		}
+		if best < 0 || length[i] > length[best] {
+			best = i
+		}
+	}
+	inPlace := make([]bool, n)
+	for i := best; i >= 0; i = prev[i] {
+		inPlace[i] = true
+	}
+	return inPlace
+}
+
+// repairTransaction returns the transaction repairing the drift of rules inserted straight into
+// the chains they target. Unexpected and reordered rules are deleted, then missing and reordered
+// rules are inserted right after the preceding rule of the RuleSet in the chain, or before the
+// following one, so they're placed at their original position among rules of other tools.
+func repairTransaction(desired []iptables.Rule, d drift) iptables.Transaction {
+	var tx iptables.Transaction
+	for _, cd := range d.chains {
+		deleted := make(map[int]bool)
+		for _, j := range cd.unexpected {
+			deleted[j] = true
+			tx.Delete(*cd.kernel[j].rule)
+		}
+		for j, i := range cd.desired {
+			if cd.position[j] >= 0 && !cd.inPlace[j] {
+				deleted[cd.position[j]] = true
+				r := desired[i]
+				r.Family = cd.family
+				tx.Delete(r)
+			}
+		}
+
+		// chain holds indices of kernel rules after the deletions, -1 for inserted rules
+		var chain []int
+		for j := range cd.kernel {
+			if !deleted[j] {
+				chain = append(chain, j)
+			}
+		}
+		last := -1
+		for j, i := range cd.desired {
+			if cd.inPlace[j] {
+				last = indexOf(chain, cd.position[j])
+				continue
+			}
+			if cd.position[j] < 0 && !cd.absent[j] {
+				// rule exists, but its listing doesn't match the rule
+				continue
+			}
+			r := desired[i]
+			r.Family = cd.family
+			at := last + 1
+			if last < 0 {
+				at = followingPosition(cd, j, chain)
+			}
+			if at < 0 {
+				at = len(chain)
+				if n, err := strconv.Atoi(r.RuleNumber); err == nil && r.Action == "insert" && n >= 1 && n <= len(chain) {
+					at = n - 1
+				}
+			}
+			if at == len(chain) && r.Action != "insert" {
+				r.Action, r.RuleNumber = "", ""
+			} else {
+				r.Action, r.RuleNumber = "insert", strconv.Itoa(at+1)
+			}
+			tx.Add(r)
+			chain = append(chain[:at], append([]int{-1}, chain[at:]...)...)
+			last = at
+		}
+	}
+	return tx
+}
+
+// followingPosition returns position of the first rule of the RuleSet in place after the desired
+// rule j, or -1 if there is no such rule.
+func followingPosition(cd *chainDrift, j int, chain []int) int {
+	for k := j + 1; k < len(cd.desired); k++ {
+		if cd.inPlace[k] {
+			return indexOf(chain, cd.position[k])
+		}
+	}
+	return -1
+}
+
+func indexOf(list []int, v int) int {
+	for i, x := range list {
+		if x == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// effectiveRules returns rules which are present in the kernel after inserting the ruleSet,
+// including ownership tags.
+func (c *Controller) effectiveRules(ruleSet iptables.RuleSet) ([]iptables.Rule, error) {
+	var tx iptables.Transaction
+	if c.managedChains {
+		if err := addManagedRuleSet(&tx, ruleSet); err != nil {
+			return nil, err
+		}
+	} else {
+		tx.Add(ruleSet.Rules...)
+	}
+	c.tagOps(tx.Ops, ruleSet.Metadata.ID)
+
+	var rules []iptables.Rule
+	for _, op := range tx.Ops {
+		if op.Type == iptables.OpAdd {
+			rules = append(rules, op.Rule)
+		}
+	}
+	return rules, nil
+}
+
+func (r *reconciler) getStatus() reconcileStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+)
+
+func TestRepairRuleSet(t *testing.T) {
+	rule := func(port string) iptables.Rule {
+		return iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: port, Jump: "ACCEPT", Family: iptables.IPv4}
+	}
+	tagged := func(port string) string {
+		return `-A INPUT -p tcp -m tcp --dport ` + port + ` -m comment --comment "\"opa-iptables:node-1:web\"" -j ACCEPT`
+	}
+
+	var rs iptables.RuleSet
+	rs.Metadata.ID = "web"
+	rs.Rules = []iptables.Rule{rule("22"), rule("80"), rule("443")}
+
+	backend := &recordBackend{fakeBackend: fakeBackend{
+		rules: make(map[string]bool),
+		// rule 80 was deleted, rule 443 was moved in front of rule 22 and rule 8080 was inserted
+		chains: map[string][]string{"INPUT": {
+			"-P INPUT ACCEPT",
+			"-A INPUT -s 10.0.0.1/32 -j DROP",
+			tagged("443"),
+			tagged("22"),
+			tagged("8080"),
+		}},
+	}}
+	c := &Controller{
+		logger:     logging.GetLogger(),
+		backend:    backend,
+		instanceID: "node-1",
+		w:          &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+	}
+	desired, err := c.effectiveRules(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.rules[desired[0].String()] = true
+	backend.rules[desired[2].String()] = true
+
+	d, checked, err := c.repairRuleSet("", rs, func(drift) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 3 || len(d.missing) != 1 || len(d.reordered) != 1 || len(d.unexpected) != 1 || d.count() != 3 {
+		t.Fatalf("unexpected drift %+v", d)
+	}
+	if d.missing[0].DestinationPort != "80" || d.reordered[0].DestinationPort != "443" || d.unexpected[0].rule.DestinationPort != "8080" {
+		t.Errorf("unexpected drift %+v", d)
+	}
+
+	comment := ` -m comment --comment "opa-iptables:node-1:web"`
+	expected := [][]string{{
+		"delete filter INPUT -p tcp --dport 8080 -j ACCEPT" + comment,
+		"delete filter INPUT -p tcp --dport 443 -j ACCEPT" + comment,
+		"add filter INPUT -p tcp --dport 80 -j ACCEPT" + comment,
+		"add filter INPUT -p tcp --dport 443 -j ACCEPT" + comment,
+	}}
+	if !reflect.DeepEqual(backend.txs, expected) {
+		t.Errorf("expected transactions %v, got %v", expected, backend.txs)
+	}
+}
+
+func TestRepairTransactionPositions(t *testing.T) {
+	rule := func(port string) iptables.Rule {
+		return iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: port, Jump: "ACCEPT", Family: iptables.IPv4}
+	}
+	// rules of other tools surround the RuleSet, its first rule is missing
+	cd := &chainDrift{
+		family:   iptables.IPv4,
+		table:    "filter",
+		chain:    "INPUT",
+		kernel:   make([]kernelRule, 3),
+		desired:  []int{0, 1},
+		position: []int{-1, 1},
+		inPlace:  []bool{false, true},
+		absent:   []bool{true, false},
+	}
+	tx := repairTransaction([]iptables.Rule{rule("22"), rule("80")}, drift{chains: []*chainDrift{cd}})
+	if len(tx.Ops) != 1 || tx.Ops[0].Rule.Action != "insert" || tx.Ops[0].Rule.RuleNumber != "2" {
+		t.Errorf("expected rule 22 to be inserted before rule 80, got %+v", tx.Ops)
+	}
+}
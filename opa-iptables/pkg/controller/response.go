@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/analyzer"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/opa"
+)
+
+// Status of a response, a RuleSet or a rule.
+const (
+	statusSuccess = "success"
+	// statusPartial is used when some RuleSets were applied and some weren't, or the RuleSets
+	// were applied but the watch state couldn't be updated.
+	statusPartial = "partial"
+	statusFailure = "failure"
+	statusInvalid = "invalid"
+
+	ruleApplied = "applied"
+	// ruleRejected is the rule rejected by the kernel.
+	ruleRejected = "rejected"
+	// ruleNotApplied is a rule of the RuleSet which was rolled back, or never reached the kernel,
+	// because of an other rule or an invalid RuleSet.
+	ruleNotApplied = "not_applied"
+)
+
+// response is the body returned by insert and delete APIs.
+type response struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	// OPAError is the error returned by OPA, either while querying the RuleSets or while
+	// updating the watch state.
+	OPAError *opa.Error      `json:"opa_error,omitempty"`
+	RuleSets []ruleSetResult `json:"rulesets,omitempty"`
+	Watch    *watchResult    `json:"watch,omitempty"`
+
+	// watchCode is the status code of the error of updating the watch state.
+	watchCode int
+}
+
+// ruleSetResult is the outcome of applying a single RuleSet.
+type ruleSetResult struct {
+	ID     string `json:"_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// ValidationErrors lists invalid fields of the RuleSet. Invalid RuleSets aren't applied.
+	ValidationErrors iptables.ValidationErrors `json:"validation_errors,omitempty"`
+	// Findings are problems of the rules found by the analyzer, if analysis is requested.
+	Findings []analyzer.Finding `json:"findings,omitempty"`
+	Rules    []ruleResult       `json:"rules"`
+}
+
+// ruleResult is the outcome of a single rule of a RuleSet.
+type ruleResult struct {
+	Spec   string `json:"spec"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// watchResult describes the watch state of the query path after the request.
+type watchResult struct {
+	QueryPath string `json:"query_path"`
+	// IDs are "_id" of the watched RuleSets of the query path.
+	IDs     []string `json:"_ids,omitempty"`
+	Watched bool     `json:"watched"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// errorResponse returns failed response of the request which didn't reach any RuleSet.
+// Details of the error returned by OPA are included.
+func errorResponse(err error) *response {
+	resp := &response{Status: statusFailure, Message: err.Error()}
+	var opaErr *opa.Error
+	if errors.As(err, &opaErr) {
+		resp.OPAError = opaErr
+	}
+	return resp
+}
+
+// validationResponse returns response listing rules of every RuleSet and invalid fields of
+// invalid RuleSets, which is returned if any RuleSet inserted or deleted by op is invalid.
+func validationResponse(op string, ruleSets []iptables.RuleSet) *response {
+	resp := &response{Status: statusInvalid, Message: "RuleSet contains invalid rules"}
+	for _, ruleSet := range ruleSets {
+		result := newRuleSetResult(ruleSet, nil)
+		result.Status, result.Error = statusFailure, "not applied, because some RuleSets are invalid"
+		if err := validateRuleSet(op, ruleSet); err != nil {
+			result.Error = ""
+			result.Status = statusInvalid
+			result.ValidationErrors = err.(iptables.ValidationErrors)
+		}
+		for i := range result.Rules {
+			result.Rules[i].Status = ruleNotApplied
+		}
+		resp.RuleSets = append(resp.RuleSets, result)
+	}
+	return resp
+}
+
+// analysisResponse returns response listing rules and findings of the analyzer of every RuleSet,
+// which is returned if RuleSets are rejected because of the findings.
+func analysisResponse(ruleSets []iptables.RuleSet, findings [][]analyzer.Finding, total int) *response {
+	resp := &response{Status: statusInvalid, Message: analysisError(total).Error()}
+	for i, ruleSet := range ruleSets {
+		result := newRuleSetResult(ruleSet, nil)
+		result.Status, result.Error = statusFailure, "not applied, because the analyzer found problems in some RuleSets"
+		if len(findings[i]) > 0 {
+			result.Error = ""
+			result.Status = statusInvalid
+			result.Findings = findings[i]
+		}
+		for j := range result.Rules {
+			result.Rules[j].Status = ruleNotApplied
+		}
+		resp.RuleSets = append(resp.RuleSets, result)
+	}
+	return resp
+}
+
+// newRuleSetResult returns the outcome of applying the ruleSet, where err is the error returned
+// by applying it. If err is *iptables.TransactionError, the rejected rule is marked as rejected
+// and the rest of the rules as not applied.
+func newRuleSetResult(ruleSet iptables.RuleSet, err error) ruleSetResult {
+	result := ruleSetResult{ID: ruleSet.Metadata.ID, Status: statusSuccess, Rules: []ruleResult{}}
+	if err != nil {
+		result.Status = statusFailure
+		result.Error = err.Error()
+	}
+
+	var rejected string
+	var txErr *iptables.TransactionError
+	if errors.As(err, &txErr) && txErr.Index >= 0 {
+		rejected = untagRule(txErr.Op.Rule).String()
+	}
+
+	for _, r := range ruleSet.Rules {
+		if r.Family == "" {
+			r.Family = ruleSet.Family
+		}
+		r.SetDefaults()
+		rule := ruleResult{Spec: r.String(), Status: ruleApplied}
+		switch {
+		case err == nil:
+		case rule.Spec == rejected:
+			rule.Status, rule.Error = ruleRejected, txErr.Err.Error()
+		default:
+			rule.Status = ruleNotApplied
+		}
+		result.Rules = append(result.Rules, rule)
+	}
+	return result
+}
+
+// add adds the outcome of a RuleSet to the response.
+func (resp *response) add(result ruleSetResult) {
+	resp.RuleSets = append(resp.RuleSets, result)
+}
+
+// watchError records the error of updating the watch state, and the status code returned if
+// every RuleSet was applied. Details of the error returned by OPA are included.
+func (resp *response) watchError(watch *watchResult, err error, code int) {
+	resp.Watch = watch
+	resp.watchCode = code
+	watch.Error = err.Error()
+	var opaErr *opa.Error
+	if errors.As(err, &opaErr) {
+		resp.OPAError = opaErr
+	}
+}
+
+// finish sets status of the response from the outcome of the RuleSets and the watch state,
+// and returns status code of the response.
+func (resp *response) finish() int {
+	failed := 0
+	for _, result := range resp.RuleSets {
+		if result.Status != statusSuccess {
+			failed++
+		}
+	}
+
+	switch {
+	case failed == 0 && resp.watchCode == 0:
+		resp.Status = statusSuccess
+		return http.StatusOK
+	case failed == 0:
+		// RuleSets were applied, but the watch state wasn't updated
+		resp.Status = statusPartial
+		return resp.watchCode
+	case failed == len(resp.RuleSets):
+		resp.Status = statusFailure
+	default:
+		resp.Status = statusPartial
+	}
+	return http.StatusInternalServerError
+}
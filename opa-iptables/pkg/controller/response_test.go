@@ -0,0 +1,366 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/analyzer"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/opa"
+)
+
+// fakeOPA returns the same result for every query and stores data in memory.
+type fakeOPA struct {
+	input    []byte
+	result   string
+	queryErr error
+	putErr   error
+	data     map[string][]byte
+}
+
+func (o *fakeOPA) DoQuery(ctx context.Context, path string, input interface{}) ([]byte, error) {
+	o.input, _ = input.([]byte)
+	return []byte(o.result), o.queryErr
+}
+
+func (o *fakeOPA) PutData(ctx context.Context, path string, data []byte) error {
+	if o.putErr != nil {
+		return o.putErr
+	}
+	o.data[path] = data
+	return nil
+}
+
+func (o *fakeOPA) GetData(ctx context.Context, path string) ([]byte, error) {
+	return o.data[path], nil
+}
+
+func (o *fakeOPA) DeleteData(ctx context.Context, path string) error {
+	delete(o.data, path)
+	return nil
+}
+
+// rejectBackend rejects transactions containing a rule with destination port 666.
+type rejectBackend struct {
+	fakeBackend
+}
+
+func (b *rejectBackend) Apply(tx *iptables.Transaction) error {
+	for i, op := range tx.Ops {
+		if op.Rule.DestinationPort == "666" {
+			op.Rule.SetDefaults()
+			return &iptables.TransactionError{Index: i, Op: op, Err: errors.New("iptables: Bad rule")}
+		}
+	}
+	return nil
+}
+
+const ruleSets = `{"result": [
+	{"metadata": {"_id": "web"}, "rules": [{"protocol": "tcp", "destination_port": "80", "jump": "ACCEPT"}]},
+	{"metadata": {"_id": "evil"}, "rules": [
+		{"protocol": "tcp", "destination_port": "666", "jump": "DROP"},
+		{"protocol": "tcp", "destination_port": "667", "jump": "DROP"}
+	]}
+]}`
+
+func TestInsertRuleHandlerResponse(t *testing.T) {
+	webOnly := `{"result": [{"metadata": {"_id": "web"}, "rules": [{"protocol": "tcp", "destination_port": "80", "jump": "ACCEPT"}]}]}`
+	shadowed := `{"result": [
+		{"metadata": {"_id": "web"}, "rules": [{"protocol": "tcp", "destination_port": "80", "jump": "ACCEPT"}]},
+		{"metadata": {"_id": "ssh"}, "rules": [
+			{"source": "10.0.0.0/8", "jump": "DROP"},
+			{"source": "10.1.0.0/16", "protocol": "tcp", "destination_port": "22", "jump": "ACCEPT"}
+		]}
+	]}`
+
+	tests := []struct {
+		name    string
+		opa     *fakeOPA
+		watcher bool
+		query   string
+		code    int
+		check   func(t *testing.T, resp response)
+	}{
+		{
+			name: "partial failure",
+			opa:  &fakeOPA{result: ruleSets},
+			code: http.StatusInternalServerError,
+			check: func(t *testing.T, resp response) {
+				if resp.Status != statusPartial || len(resp.RuleSets) != 2 {
+					t.Fatalf("unexpected response: %+v", resp)
+				}
+				if web := resp.RuleSets[0]; web.Status != statusSuccess || web.Rules[0].Status != ruleApplied ||
+					web.Rules[0].Spec != "filter INPUT -p tcp --dport 80 -j ACCEPT" {
+					t.Errorf("unexpected result of web: %+v", web)
+				}
+				evil := resp.RuleSets[1]
+				if evil.Status != statusFailure || evil.Error == "" {
+					t.Errorf("unexpected result of evil: %+v", evil)
+				}
+				if evil.Rules[0].Status != ruleRejected || evil.Rules[0].Error != "iptables: Bad rule" || evil.Rules[1].Status != ruleNotApplied {
+					t.Errorf("unexpected rules of evil: %+v", evil.Rules)
+				}
+			},
+		},
+		{
+			name: "opa error",
+			opa:  &fakeOPA{queryErr: &opa.Error{Code: "internal_error", Message: "policy failed"}},
+			code: http.StatusBadRequest,
+			check: func(t *testing.T, resp response) {
+				if resp.Status != statusFailure || resp.OPAError == nil || resp.OPAError.Code != "internal_error" {
+					t.Errorf("unexpected response: %+v", resp)
+				}
+			},
+		},
+		{
+			name:  "watcher disabled",
+			opa:   &fakeOPA{result: webOnly},
+			query: "&watch=true",
+			code:  http.StatusBadRequest,
+			check: func(t *testing.T, resp response) {
+				if resp.Status != statusFailure || len(resp.RuleSets) != 0 || resp.Watch == nil || resp.Watch.Error == "" {
+					t.Errorf("unexpected response: %+v", resp)
+				}
+			},
+		},
+		{
+			name:    "watch state not stored",
+			opa:     &fakeOPA{result: webOnly, putErr: &opa.Error{Code: "unavailable", Message: "storage is down"}},
+			watcher: true,
+			query:   "&watch=true",
+			code:    http.StatusInternalServerError,
+			check: func(t *testing.T, resp response) {
+				if resp.Status != statusPartial || resp.Watch.Watched || resp.OPAError == nil || resp.OPAError.Code != "unavailable" {
+					t.Errorf("unexpected response: %+v", resp)
+				}
+			},
+		},
+		{
+			name:    "watched",
+			opa:     &fakeOPA{result: webOnly},
+			watcher: true,
+			query:   "&watch=true",
+			code:    http.StatusOK,
+			check: func(t *testing.T, resp response) {
+				if resp.Status != statusSuccess || resp.Watch == nil || !resp.Watch.Watched || !reflect.DeepEqual(resp.Watch.IDs, []string{"web"}) || resp.Watch.QueryPath != "iptables/rules" {
+					t.Errorf("unexpected response: %+v", resp)
+				}
+			},
+		},
+		{
+			name:  "rejected by analyzer",
+			opa:   &fakeOPA{result: shadowed},
+			query: "&analyze=reject",
+			code:  http.StatusConflict,
+			check: func(t *testing.T, resp response) {
+				if resp.Status != statusInvalid || len(resp.RuleSets) != 2 {
+					t.Fatalf("unexpected response: %+v", resp)
+				}
+				if web := resp.RuleSets[0]; web.Status != statusFailure || len(web.Findings) != 0 || web.Rules[0].Status != ruleNotApplied {
+					t.Errorf("unexpected result of web: %+v", web)
+				}
+				ssh := resp.RuleSets[1]
+				if ssh.Status != statusInvalid || len(ssh.Findings) != 1 || ssh.Findings[0].Kind != analyzer.Shadowed || ssh.Findings[0].Rule.Index != 1 {
+					t.Errorf("unexpected result of ssh: %+v", ssh)
+				}
+			},
+		},
+		{
+			name:  "analyzer warning",
+			opa:   &fakeOPA{result: shadowed},
+			query: "&analyze=warn",
+			code:  http.StatusOK,
+			check: func(t *testing.T, resp response) {
+				if resp.Status != statusSuccess || len(resp.RuleSets) != 2 || len(resp.RuleSets[1].Findings) != 1 || resp.RuleSets[1].Rules[1].Status != ruleApplied {
+					t.Errorf("unexpected response: %+v", resp)
+				}
+			},
+		},
+		{
+			name:  "invalid analyze mode",
+			opa:   &fakeOPA{result: shadowed},
+			query: "&analyze=always",
+			code:  http.StatusBadRequest,
+			check: func(t *testing.T, resp response) {
+				if resp.Status != statusFailure || len(resp.RuleSets) != 0 {
+					t.Errorf("unexpected response: %+v", resp)
+				}
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opa.data = make(map[string][]byte)
+			c := &Controller{
+				logger:    logging.GetLogger(),
+				opaClient: tc.opa,
+				backend:   &rejectBackend{},
+				watcher:   tc.watcher,
+				w:         &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+			}
+
+			req := httptest.NewRequest("POST", "/v1/iptables/insert?q=iptables/rules"+tc.query, strings.NewReader(`{"input": {}}`))
+			rec := httptest.NewRecorder()
+			c.insertRuleHandler()(rec, req)
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %v, got %v", tc.code, rec.Code)
+			}
+			var resp response
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("unable to decode %q: %v", rec.Body.String(), err)
+			}
+			tc.check(t, resp)
+		})
+	}
+}
+
+func TestInsertRuleHandlerLocksQueryPath(t *testing.T) {
+	c := &Controller{
+		logger:    logging.GetLogger(),
+		opaClient: &fakeOPA{result: `{"result": [{"metadata": {"_id": "web"}, "rules": [{"protocol": "tcp", "destination_port": "80", "jump": "ACCEPT"}]}]}`, data: make(map[string][]byte)},
+		backend:   &rejectBackend{},
+		watcher:   true,
+		w:         &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+	}
+
+	// a worker checking the query path holds the lock
+	unlock := c.w.lockQueryPath("iptables/rules")
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest("POST", "/v1/iptables/insert?q=iptables/rules&watch=true", strings.NewReader(`{"input": {}}`))
+		c.insertRuleHandler()(rec, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected insert to wait for the lock of the query path")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-done
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected response %v: %v", rec.Code, rec.Body.String())
+	}
+	if !c.w.hasState("iptables/rules", "web") {
+		t.Error("expected query path to be watched")
+	}
+}
+
+func TestDeleteRuleHandlerUnwatch(t *testing.T) {
+	o := &fakeOPA{
+		result: `{"result": [{"metadata": {"_id": "web"}, "rules": [{"protocol": "tcp", "destination_port": "80", "jump": "ACCEPT"}]}]}`,
+		data:   map[string][]byte{"state/web": []byte("[]")},
+	}
+	c := &Controller{
+		logger:    logging.GetLogger(),
+		opaClient: o,
+		backend:   &rejectBackend{},
+		watcher:   true,
+		w:         &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+	}
+	c.w.addState(&state{id: "web", queryPath: "iptables/rules"})
+
+	req := httptest.NewRequest("POST", "/v1/iptables/delete?q=iptables/rules", strings.NewReader(`{"input": {}}`))
+	rec := httptest.NewRecorder()
+	c.deleteRuleHandler()(rec, req)
+
+	var resp response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || resp.Status != statusSuccess || resp.Watch == nil || resp.Watch.Watched {
+		t.Errorf("unexpected response %v: %+v", rec.Code, resp)
+	}
+	if _, err := c.w.getStates("iptables/rules"); err == nil {
+		t.Error("expected state to be removed")
+	}
+	if _, ok := o.data["state/web"]; ok {
+		t.Error("expected rules of the state to be deleted from OPA")
+	}
+}
+
+func TestValidationResponse(t *testing.T) {
+	var valid, invalid iptables.RuleSet
+	valid.Metadata.ID = "valid"
+	valid.Rules = []iptables.Rule{{Jump: "ACCEPT"}}
+	invalid.Metadata.ID = "invalid"
+	invalid.Rules = []iptables.Rule{{Table: "nat", Chain: "FORWARD", Jump: "ACCEPT"}}
+
+	resp := validationResponse(planInsert, []iptables.RuleSet{valid, invalid})
+	if resp.Status != statusInvalid || len(resp.RuleSets) != 2 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if r := resp.RuleSets[0]; r.Status != statusFailure || len(r.ValidationErrors) != 0 || r.Rules[0].Status != ruleNotApplied {
+		t.Errorf("unexpected result of valid RuleSet: %+v", r)
+	}
+	if r := resp.RuleSets[1]; r.Status != statusInvalid || len(r.ValidationErrors) == 0 {
+		t.Errorf("unexpected result of invalid RuleSet: %+v", r)
+	}
+}
+
+func TestPlanHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		result string
+		query  string
+		code   int
+		status string
+	}{
+		{"invalid rules", `{"result": [{"metadata": {"_id": "nat"}, "rules": [{"table": "nat", "chain": "FORWARD", "jump": "ACCEPT"}]}]}`, "", http.StatusBadRequest, statusInvalid},
+		{"unknown op", ruleSets, "&op=replace", http.StatusBadRequest, statusFailure},
+		{"no RuleSet", `{"result": []}`, "", http.StatusNotFound, statusFailure},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Controller{
+				logger:    logging.GetLogger(),
+				opaClient: &fakeOPA{result: tc.result},
+				backend:   &rejectBackend{},
+			}
+			req := httptest.NewRequest("POST", "/v1/iptables/plan?q=iptables/rules"+tc.query, strings.NewReader(`{"input": {}}`))
+			rec := httptest.NewRecorder()
+			c.planHandler()(rec, req)
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %v, got %v", tc.code, rec.Code)
+			}
+			var resp response
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("unable to decode %q: %v", rec.Body.String(), err)
+			}
+			if resp.Status != tc.status || resp.Message == "" {
+				t.Errorf("unexpected response: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestListRulesHandler(t *testing.T) {
+	c := &Controller{
+		logger:  logging.GetLogger(),
+		backend: &fakeBackend{chains: map[string][]string{"INPUT": {"-P INPUT ACCEPT", "-A INPUT -j DROP"}}},
+	}
+	for query, expected := range map[string]string{
+		"?family=ipv6": "-P INPUT ACCEPT\n-A INPUT -j DROP\n",
+		"":             "# ipv4\n-P INPUT ACCEPT\n-A INPUT -j DROP\n# ipv6\n-P INPUT ACCEPT\n-A INPUT -j DROP\n",
+	} {
+		req := httptest.NewRequest("GET", "/v1/iptables/list/filter/INPUT"+query, nil)
+		rec := httptest.NewRecorder()
+		c.listRulesHandler()(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != expected {
+			t.Errorf("%q: expected %q, got %v %q", query, expected, rec.Code, rec.Body.String())
+		}
+	}
+}
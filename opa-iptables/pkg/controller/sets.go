@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"reflect"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// syncSets creates sets and replaces their entries. Sets are synced before rules are
+// inserted, so rules referencing them can be inserted.
+func (c *Controller) syncSets(sets []iptables.Set) error {
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+
+	for _, s := range sets {
+		if err := c.sets.SyncSet(s); err != nil {
+			return err
+		}
+		c.logger.Infof("Synced set %v with %v entries", s.Name, len(s.Entries))
+	}
+	return nil
+}
+
+// destroySets destroys sets which are not in keep. Sets are destroyed after rules referencing
+// them are deleted. Errors are only logged, as rules are already deleted at this point.
+func (c *Controller) destroySets(sets []iptables.Set, keep []iptables.Set) {
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+
+	kept := make(map[string]bool)
+	for _, s := range keep {
+		kept[s.Name] = true
+	}
+	for _, s := range sets {
+		if kept[s.Name] {
+			continue
+		}
+		if err := c.sets.DestroySet(s.Name); err != nil {
+			c.logger.Error(err)
+			continue
+		}
+		c.logger.Infof("Destroyed set %v", s.Name)
+	}
+}
+
+// revertSets reverts sets synced for a RuleSet whose rules were rejected. Sets which existed
+// before, as sets of previously owned RuleSets, are synced back to their previous entries and
+// sets created for the RuleSet are destroyed. Errors are only logged, as the original error
+// is returned to the caller.
+func (c *Controller) revertSets(sets []iptables.Set, previous map[string]iptables.Set) {
+	c.txMu.Lock()
+	defer c.txMu.Unlock()
+
+	for _, s := range sets {
+		prev, ok := previous[s.Name]
+		switch {
+		case !ok:
+			if err := c.sets.DestroySet(s.Name); err != nil {
+				c.logger.Error(err)
+				continue
+			}
+			c.logger.Infof("Destroyed set %v", s.Name)
+		case !reflect.DeepEqual(prev, s):
+			if err := c.sets.SyncSet(prev); err != nil {
+				c.logger.Error(err)
+				continue
+			}
+			c.logger.Infof("Reverted set %v to %v entries", s.Name, len(prev.Entries))
+		}
+	}
+}
+
+// ownedSets returns sets of the RuleSets owned by the controller, by name.
+func (c *Controller) ownedSets() map[string]iptables.Set {
+	c.ownedMu.Lock()
+	defer c.ownedMu.Unlock()
+	sets := make(map[string]iptables.Set)
+	for _, ruleSet := range c.owned {
+		for _, s := range ruleSet.Sets {
+			sets[s.Name] = s
+		}
+	}
+	return sets
+}
+
+// setsEqual reports whether sets a and b have the same entries. Nil and empty sets are equal.
+func setsEqual(a, b []iptables.Set) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+)
+
+// fakeSetManager records synced and destroyed sets.
+type fakeSetManager struct {
+	synced    []string
+	destroyed []string
+}
+
+func (m *fakeSetManager) SyncSet(s iptables.Set) error {
+	m.synced = append(m.synced, s.Name)
+	return nil
+}
+
+func (m *fakeSetManager) DestroySet(name string) error {
+	m.destroyed = append(m.destroyed, name)
+	return nil
+}
+
+func TestReplaceRuleSetSets(t *testing.T) {
+	rule := iptables.Rule{Table: "filter", Chain: "INPUT", MatchSet: &iptables.MatchSet{Name: "allow"}, Jump: "ACCEPT"}
+
+	var old, new iptables.RuleSet
+	old.Rules = []iptables.Rule{rule}
+	old.Sets = []iptables.Set{
+		{Name: "allow", Type: iptables.SetHashIP, Entries: []string{"10.0.0.1"}},
+		{Name: "stale", Type: iptables.SetHashIP},
+	}
+	new.Rules = []iptables.Rule{rule}
+	new.Sets = []iptables.Set{{Name: "allow", Type: iptables.SetHashIP, Entries: []string{"10.0.0.1", "10.0.0.2"}}}
+
+	sets := &fakeSetManager{}
+	// backend doesn't implement Apply, so replacing rules would panic
+	c := &Controller{logger: logging.GetLogger(), backend: &fakeBackend{}, sets: sets}
+	if err := c.replaceRuleSet("", old, new); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sets.synced, []string{"allow"}) {
+		t.Errorf("Expected synced sets [allow], got %v", sets.synced)
+	}
+	if !reflect.DeepEqual(sets.destroyed, []string{"stale"}) {
+		t.Errorf("Expected destroyed sets [stale], got %v", sets.destroyed)
+	}
+}
+
+func TestRejectedRuleSetRevertsSets(t *testing.T) {
+	rule := iptables.Rule{Table: "filter", Chain: "INPUT", MatchSet: &iptables.MatchSet{Name: "allow"}, Jump: "ACCEPT"}
+	evil := iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: "666", Jump: "DROP"}
+	allow := iptables.Set{Name: "allow", Type: iptables.SetHashIP, Entries: []string{"10.0.0.1"}}
+
+	var old, new iptables.RuleSet
+	old.Metadata.ID, new.Metadata.ID = "web", "web"
+	old.Rules = []iptables.Rule{rule}
+	old.Sets = []iptables.Set{allow}
+	new.Rules = []iptables.Rule{rule, evil}
+	new.Sets = []iptables.Set{
+		{Name: "allow", Type: iptables.SetHashIP, Entries: []string{"10.0.0.2"}},
+		{Name: "created", Type: iptables.SetHashIP},
+	}
+
+	sets := &fakeSetManager{}
+	c := &Controller{logger: logging.GetLogger(), backend: &rejectBackend{}, sets: sets}
+	if err := c.insertRuleSet("iptables/web", new); err == nil {
+		t.Fatal("expected insert to be rejected")
+	}
+	// sets didn't exist before, so they are destroyed
+	if !reflect.DeepEqual(sets.destroyed, []string{"allow", "created"}) {
+		t.Errorf("Expected destroyed sets [allow created], got %v", sets.destroyed)
+	}
+
+	sets.synced, sets.destroyed = nil, nil
+	if err := c.insertRuleSet("iptables/web", old); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.replaceRuleSet("iptables/web", old, new); err == nil {
+		t.Fatal("expected replace to be rejected")
+	}
+	// allow is synced by insert, by replace and back to the entries of old ruleSet
+	if !reflect.DeepEqual(sets.synced, []string{"allow", "allow", "created", "allow"}) {
+		t.Errorf("Expected synced sets [allow allow created allow], got %v", sets.synced)
+	}
+	if !reflect.DeepEqual(sets.destroyed, []string{"created"}) {
+		t.Errorf("Expected destroyed sets [created], got %v", sets.destroyed)
+	}
+	if owned := c.ownedSets(); !reflect.DeepEqual(owned, map[string]iptables.Set{"allow": allow}) {
+		t.Errorf("Expected old sets to stay owned, got %v", owned)
+	}
+}
+
+func TestSetsEqual(t *testing.T) {
+	s := []iptables.Set{{Name: "allow", Type: iptables.SetHashIP}}
+	if !setsEqual(nil, []iptables.Set{}) {
+		t.Error("Expected nil and empty sets to be equal")
+	}
+	if setsEqual(s, nil) {
+		t.Error("Expected sets to differ")
+	}
+}
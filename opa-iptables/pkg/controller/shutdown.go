@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ShutdownKeep leaves rules inserted by the controller in the kernel.
+	ShutdownKeep = "keep"
+	// ShutdownCleanup deletes rules inserted by the controller and forgets watched states.
+	ShutdownCleanup = "cleanup"
+	// ShutdownPin reinserts missing rules inserted by the controller and leaves them in the kernel,
+	// along with watched states.
+	ShutdownPin = "pin"
+)
+
+// ParseShutdownPolicy validates the policy applied to rules inserted by the controller on shutdown.
+func ParseShutdownPolicy(policy string) (string, error) {
+	switch policy {
+	case "", ShutdownKeep:
+		return ShutdownKeep, nil
+	case ShutdownCleanup, ShutdownPin:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown shutdown policy %q: must be one of %v | %v | %v", policy, ShutdownKeep, ShutdownCleanup, ShutdownPin)
+	}
+}
+
+// Action taken on a RuleSet on shutdown.
+const (
+	auditKept    = "kept"
+	auditRemoved = "removed"
+	auditPinned  = "pinned"
+	auditFailed  = "failed"
+)
+
+// auditRecord is the final record of the controller, describing the action taken on every
+// RuleSet inserted by the controller on shutdown.
+type auditRecord struct {
+	Time       time.Time        `json:"time"`
+	InstanceID string           `json:"instance_id,omitempty"`
+	Policy     string           `json:"policy"`
+	RuleSets   []auditedRuleSet `json:"rulesets"`
+	Duration   string           `json:"duration"`
+}
+
+type auditedRuleSet struct {
+	ID     string `json:"_id"`
+	Rules  int    `json:"rules"`
+	Action string `json:"action"`
+	// Repaired is the number of drifted rules repaired before pinning the RuleSet.
+	Repaired int    `json:"repaired,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// applyShutdownPolicy applies the shutdown policy to RuleSets inserted by the controller and
+// reports the audit record. Watcher, reconciler and API server are expected to be stopped, so
+// rules are no longer changed by them.
+func (c *Controller) applyShutdownPolicy() auditRecord {
+	start := time.Now()
+	record := auditRecord{Time: start, InstanceID: c.instanceID, Policy: c.shutdownPolicy, RuleSets: []auditedRuleSet{}}
+	if record.Policy == "" {
+		record.Policy = ShutdownKeep
+	}
+
+	for _, owned := range c.ownedRuleSets() {
+		queryPath, ruleSet := owned.queryPath, owned.RuleSet
+		audited := auditedRuleSet{ID: ruleSet.Metadata.ID, Rules: len(ruleSet.Rules), Action: auditKept}
+		switch record.Policy {
+		case ShutdownCleanup:
+			audited.Action = auditRemoved
+			if err := c.deleteRuleSet(queryPath, ruleSet); err != nil {
+				audited.Action, audited.Error = auditFailed, ruleSetError(ruleSet, err)
+				c.logger.Error(audited.Error)
+				break
+			}
+			c.deleteOldRulesFromOPA(context.Background(), ruleSet.Metadata.ID)
+		case ShutdownPin:
+			audited.Action = auditPinned
+			d, _, err := c.repairRuleSet(queryPath, ruleSet, func(d drift) {
+				c.logger.Infof("RuleSet %q has %v drifted rules, repairing them before pinning", ruleSet.Metadata.ID, d.count())
+			})
+			if err != nil {
+				audited.Action, audited.Error = auditFailed, ruleSetError(ruleSet, err)
+				c.logger.Error(audited.Error)
+				break
+			}
+			audited.Repaired = d.count()
+		}
+		record.RuleSets = append(record.RuleSets, audited)
+	}
+
+	if record.Policy == ShutdownCleanup {
+		// rules of the watched states are deleted, so they must not be resumed
+		for _, queryPath := range c.w.queryPaths() {
+			c.w.setStates(queryPath, nil)
+		}
+	}
+	record.Duration = time.Since(start).String()
+	c.reportAudit(record)
+	return record
+}
+
+// reportAudit logs the audit record and appends it to the audit file, if it's configured.
+func (c *Controller) reportAudit(record auditRecord) {
+	counts := make(map[string]int)
+	for _, r := range record.RuleSets {
+		counts[r.Action]++
+	}
+	c.logger.WithFields(logrus.Fields{
+		"policy":   record.Policy,
+		"rulesets": len(record.RuleSets),
+		"kept":     counts[auditKept],
+		"removed":  counts[auditRemoved],
+		"pinned":   counts[auditPinned],
+		"failed":   counts[auditFailed],
+	}).Info("Shutdown audit record")
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		c.logger.Error(err)
+		return
+	}
+	c.logger.Debugf("Shutdown audit record: %s", data)
+
+	if c.auditFile == "" {
+		return
+	}
+	f, err := os.OpenFile(c.auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		c.logger.Errorf("Unable to write audit record: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		c.logger.Errorf("Unable to write audit record: %v", err)
+		return
+	}
+	if err := f.Sync(); err != nil {
+		c.logger.Errorf("Unable to write audit record: %v", err)
+	}
+}
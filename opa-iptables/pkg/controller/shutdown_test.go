@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+)
+
+func TestApplyShutdownPolicy(t *testing.T) {
+	web := iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT"}
+	ssh := iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"}
+
+	tests := []struct {
+		policy  string
+		txs     [][]string
+		actions []string
+		watched bool
+	}{
+		{
+			policy:  ShutdownKeep,
+			actions: []string{auditKept, auditKept},
+			watched: true,
+		},
+		{
+			policy: ShutdownCleanup,
+			txs: [][]string{
+				{"delete filter INPUT -p tcp --dport 22 -j ACCEPT"},
+				{"delete filter INPUT -p tcp --dport 80 -j ACCEPT"},
+			},
+			actions: []string{auditRemoved, auditRemoved},
+		},
+		{
+			// web is in the kernel, rule of ssh is missing
+			policy:  ShutdownPin,
+			txs:     [][]string{{"add filter INPUT -p tcp --dport 22 -j ACCEPT"}},
+			actions: []string{auditPinned, auditPinned},
+			watched: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			backend := &recordBackend{fakeBackend: fakeBackend{rules: map[string]bool{web.String(): true}}}
+			auditFile := filepath.Join(t.TempDir(), "audit.log")
+			c := &Controller{
+				logger:         logging.GetLogger(),
+				opaClient:      &fakeOPA{data: make(map[string][]byte)},
+				backend:        backend,
+				shutdownPolicy: tc.policy,
+				auditFile:      auditFile,
+				w:              &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+			}
+			for _, s := range []state{
+				{id: "web", queryPath: "iptables/web", rules: []iptables.Rule{web}},
+				{id: "ssh", queryPath: "iptables/ssh", rules: []iptables.Rule{ssh}},
+			} {
+				c.own(s.queryPath, s.ruleSet())
+				c.w.addState(&s)
+			}
+
+			record := c.applyShutdownPolicy()
+			if !reflect.DeepEqual(backend.txs, tc.txs) {
+				t.Errorf("expected transactions %v, got %v", tc.txs, backend.txs)
+			}
+			var actions []string
+			for _, r := range record.RuleSets {
+				actions = append(actions, r.Action)
+			}
+			if record.Policy != tc.policy || !reflect.DeepEqual(actions, tc.actions) {
+				t.Errorf("unexpected audit record %+v", record)
+			}
+			if tc.policy == ShutdownPin && (record.RuleSets[0].ID != "ssh" || record.RuleSets[0].Repaired != 1) {
+				t.Errorf("expected missing rule of ssh to be repaired: %+v", record.RuleSets)
+			}
+			if watched := len(c.w.states()) > 0; watched != tc.watched {
+				t.Errorf("expected watched states %v, got %v", tc.watched, c.w.states())
+			}
+
+			data, err := ioutil.ReadFile(auditFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var written auditRecord
+			if err := json.Unmarshal([]byte(strings.TrimSpace(string(data))), &written); err != nil {
+				t.Fatal(err)
+			}
+			if written.Policy != tc.policy || len(written.RuleSets) != 2 {
+				t.Errorf("unexpected audit file %s", data)
+			}
+		})
+	}
+
+	if _, err := ParseShutdownPolicy("flush"); err == nil {
+		t.Error("expected error for unknown shutdown policy")
+	}
+}
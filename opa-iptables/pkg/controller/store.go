@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+const (
+	// RestoreResume restores persisted states and resumes watching them.
+	RestoreResume = "resume"
+	// RestoreCleanup deletes rules of persisted states from the kernel and forgets them.
+	RestoreCleanup = "cleanup"
+	// RestoreIgnore forgets persisted states, rules are left in the kernel.
+	RestoreIgnore = "ignore"
+)
+
+// ParseRestorePolicy validates the policy used for persisted states on startup.
+func ParseRestorePolicy(policy string) (string, error) {
+	switch policy {
+	case "", RestoreResume:
+		return RestoreResume, nil
+	case RestoreCleanup, RestoreIgnore:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown restore policy %q: must be one of %v | %v | %v", policy, RestoreResume, RestoreCleanup, RestoreIgnore)
+	}
+}
+
+// storedState is a persisted watcher state. Rules and sets inserted for the state are stored as well,
+// so they can be replaced or deleted after restart, even if OPA has lost its data.
+type storedState struct {
+	QueryPath string          `json:"query_path"`
+	ID        string          `json:"_id"`
+	Input     interface{}     `json:"input"`
+	Rules     []iptables.Rule `json:"rules"`
+	Sets      []iptables.Set  `json:"sets,omitempty"`
+}
+
+// stateStore persists watched states into a local JSON file. The file is rewritten
+// atomically on every change, so it always contains a consistent set of states.
+type stateStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newStateStore(path string) *stateStore {
+	return &stateStore{path: path}
+}
+
+// load returns persisted states. Missing file means no state was persisted.
+func (s *stateStore) load() ([]state, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state file: %v", err)
+	}
+
+	var stored []storedState
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("unable to parse state file %v: %v", s.path, err)
+	}
+	states := make([]state, len(stored))
+	for i, st := range stored {
+		states[i] = state{
+			id:        st.ID,
+			payload:   payload{Input: st.Input},
+			queryPath: st.QueryPath,
+			rules:     st.Rules,
+			sets:      st.Sets,
+		}
+	}
+	return states, nil
+}
+
+// save replaces persisted states with given states.
+func (s *stateStore) save(states []state) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := make([]storedState, len(states))
+	for i, st := range states {
+		stored[i] = storedState{
+			QueryPath: st.queryPath,
+			ID:        st.id,
+			Input:     st.payload.Input,
+			Rules:     st.rules,
+			Sets:      st.sets,
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		if stored[i].QueryPath != stored[j].QueryPath {
+			return stored[i].QueryPath < stored[j].QueryPath
+		}
+		return stored[i].ID < stored[j].ID
+	})
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to write state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write state file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write state file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("unable to write state file: %v", err)
+	}
+	return nil
+}
+
+// restoreStates applies the restore policy to the states persisted by previous run of the controller.
+func (c *Controller) restoreStates() {
+	states, err := c.w.store.load()
+	if err != nil {
+		c.logger.Errorf("Unable to restore watcher states: %v", err)
+		return
+	}
+	if len(states) == 0 {
+		return
+	}
+
+	switch c.restorePolicy {
+	case RestoreResume:
+		if !c.watcher {
+			c.logger.Warnf("Found %v persisted watcher states, but watcher is disabled. They are kept until watcher is enabled.", len(states))
+			return
+		}
+		for i := range states {
+			s := states[i]
+			// OPA may have been restarted as well, so rules of the state are put back
+			if err := c.putNewRulesToOPA(context.Background(), s.id, s.rules); err != nil {
+				c.logger.Errorf("Unable to store rules of queryPath %v into OPA: %v", s.queryPath, err)
+			}
+			c.own(s.queryPath, s.ruleSet())
+			c.w.addState(&s)
+		}
+		c.logger.Infof("Resumed watching %v persisted states", len(states))
+
+	case RestoreCleanup:
+		var remaining []state
+		for _, s := range states {
+			ruleSet := s.ruleSet()
+			if err := c.deleteRuleSet(s.queryPath, ruleSet); err != nil {
+				c.logger.Errorf("Unable to clean up rules of queryPath %v: %v", s.queryPath, err)
+				remaining = append(remaining, s)
+				continue
+			}
+			c.deleteOldRulesFromOPA(context.Background(), s.id)
+		}
+		c.logger.Infof("Cleaned up %v out of %v persisted states", len(states)-len(remaining), len(states))
+		if err := c.w.store.save(remaining); err != nil {
+			c.logger.Error(err)
+		}
+
+	case RestoreIgnore:
+		c.logger.Infof("Ignoring %v persisted states", len(states))
+		if err := c.w.store.save(nil); err != nil {
+			c.logger.Error(err)
+		}
+	}
+}
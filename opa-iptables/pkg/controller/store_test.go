@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+func TestStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa-iptables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newStateStore(filepath.Join(dir, "state.json"))
+
+	states, err := store.load()
+	if err != nil || len(states) != 0 {
+		t.Fatalf("Expected no states from missing file, got %v %v", states, err)
+	}
+
+	expected := []state{
+		{
+			id:        "web-v1",
+			payload:   payload{Input: map[string]interface{}{"port": "80"}},
+			queryPath: "iptables/web",
+			rules:     []iptables.Rule{{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT"}},
+			sets:      []iptables.Set{{Name: "web-clients", Type: "hash:net", Family: iptables.IPv4, Entries: []string{"10.0.0.0/8"}}},
+		},
+		{
+			id:        "ssh-v1",
+			queryPath: "iptables/ssh",
+		},
+	}
+	if err := store.save(expected); err != nil {
+		t.Fatal(err)
+	}
+
+	states, err = store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// states are stored sorted by queryPath
+	expected[0], expected[1] = expected[1], expected[0]
+	if !reflect.DeepEqual(states, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, states)
+	}
+
+	if _, err := ParseRestorePolicy("purge"); err == nil {
+		t.Error("Expected error for unknown restore policy")
+	}
+}
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	cmd "github.com/open-policy-agent/contrib/opa-iptables/pkg/command"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/converter"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/trace"
+)
+
+// Sources of the rules a packet is traced through.
+const (
+	// traceKernel traces through the rules and policies read from the kernel.
+	traceKernel = "kernel"
+	// traceManaged traces through the RuleSets inserted by the controller only.
+	traceManaged = "managed"
+)
+
+// traceResponse is the trace of a packet, along with rules of the kernel which can't be evaluated.
+type traceResponse struct {
+	trace.Result
+	Source  string               `json:"source"`
+	Skipped converter.SaveErrors `json:"skipped,omitempty"`
+}
+
+// tracePacket traces the packet through the rules of given source.
+func (c *Controller) tracePacket(source string, packet trace.Packet) (traceResponse, error) {
+	resp := traceResponse{Source: source}
+	var tables trace.Tables
+	switch source {
+	case traceKernel:
+		family := iptables.IPv4
+		if ip := net.ParseIP(packet.Source); ip != nil && ip.To4() == nil {
+			family = iptables.IPv6
+		}
+		listing, err := c.kernelListing(family)
+		if err != nil {
+			return resp, err
+		}
+		tables = trace.Tables{Rules: listing.Rules, Policies: listing.Policies}
+		resp.Skipped = listing.Skipped
+	case traceManaged:
+		tables = c.managedTables()
+	default:
+		return resp, fmt.Errorf("invalid source %q: must be one of %v | %v", source, traceKernel, traceManaged)
+	}
+
+	result, err := trace.Trace(tables, packet)
+	if err != nil {
+		return resp, err
+	}
+	resp.Result = result
+	return resp, nil
+}
+
+// kernelListing reads rules and policies of given family from the kernel.
+func (c *Controller) kernelListing(family iptables.Family) (converter.Listing, error) {
+	if c.backend.Name() != iptables.BackendIPTables {
+		return converter.Listing{}, fmt.Errorf("tracing kernel rules is not supported by the %v backend", c.backend.Name())
+	}
+	out, err := cmd.RunCommand(iptablesCommand(family) + "-save")
+	if err != nil {
+		return converter.Listing{}, fmt.Errorf("unable to read %v rules: %v", family, err)
+	}
+	return converter.IPTablesSaveToListing(bytes.NewReader(out), family)
+}
+
+// managedTables returns rules of the RuleSets inserted by the controller, as they are inserted
+// into the kernel. Policies of built-in chains are not known, so they are assumed to be ACCEPT.
+func (c *Controller) managedTables() trace.Tables {
+	var tables trace.Tables
+	for _, ruleSet := range c.ownedRuleSets() {
+		rules, err := c.effectiveRules(ruleSet.RuleSet)
+		if err != nil {
+			c.logger.Warnf("Unable to trace rules of RuleSet %q: %v", ruleSet.Metadata.ID, err)
+			continue
+		}
+		tables.Rules = append(tables.Rules, rules...)
+	}
+	return tables
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+)
+
+func TestTraceHandler(t *testing.T) {
+	c := &Controller{
+		logger:        logging.GetLogger(),
+		backend:       &recordBackend{},
+		instanceID:    "node-1",
+		managedChains: true,
+		w:             &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+		auth:          &authenticator{},
+	}
+	var web iptables.RuleSet
+	web.Metadata.ID = "web"
+	web.Rules = []iptables.Rule{
+		{Chain: "INPUT", SourceAddress: "203.0.113.0/24", Jump: "DROP"},
+		{Chain: "INPUT", Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT"},
+	}
+	c.own("", web)
+
+	do := func(url, body string, code int) traceResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		c.router().ServeHTTP(rec, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		if rec.Code != code {
+			t.Fatalf("POST %v: expected status %v, got %v: %v", url, code, rec.Code, rec.Body.String())
+		}
+		var resp traceResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do("/v1/iptables/trace?source=managed", `{"source": "203.0.113.7", "destination": "10.0.0.1", "protocol": "tcp", "destination_port": 80}`, http.StatusOK)
+	if resp.Source != traceManaged || resp.Verdict != "DROP" || resp.Decision == nil || resp.Decision.Chain != managedChainName("filter", "web", "INPUT") || resp.Decision.Position != 1 {
+		t.Errorf("unexpected trace %+v", resp)
+	}
+	if resp.Rule == nil || !strings.HasPrefix(resp.Rule.Comment, "opa-iptables:node-1:web") {
+		t.Errorf("expected rule of RuleSet web, got %+v", resp.Rule)
+	}
+
+	resp = do("/v1/iptables/trace?source=managed", `{"source": "10.0.0.2", "destination": "10.0.0.1", "protocol": "tcp", "destination_port": 80}`, http.StatusOK)
+	if resp.Verdict != "ACCEPT" || resp.Decision == nil || resp.Decision.Position != 2 {
+		t.Errorf("unexpected trace %+v", resp)
+	}
+
+	do("/v1/iptables/trace?source=managed", `{"source": "10.0.0.2", "destination": "10.0.0.1"}`, http.StatusBadRequest)
+	do("/v1/iptables/trace?source=routes", `{"source": "10.0.0.2", "destination": "10.0.0.1", "protocol": "tcp"}`, http.StatusBadRequest)
+}
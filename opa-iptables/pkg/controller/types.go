@@ -5,42 +5,119 @@ import (
 	"sync"
 	"time"
 
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/opa"
 	"github.com/sirupsen/logrus"
 )
 
 type Config struct {
-	OpaEndpoint      string
-	OpaAuthorization string
-	OpaTrustedCAFile string
-	ControllerAddr   string
-	ControllerPort   string
-	WatcherInterval  time.Duration
-	WatcherFlag      bool
-	WorkerCount      int
+	ControllerAddr  string
+	ControllerPort  string
+	WatcherInterval time.Duration
+	WatcherFlag     bool
+	WorkerCount     int
+	Backend         iptables.Backend
+	ManagedChains   bool
+	// ReconcileInterval is the interval of checking watched states for drift. Zero disables the reconciler.
+	ReconcileInterval time.Duration
+	// StateFile is the path of the file used for persisting watcher states. Empty disables persistence.
+	StateFile string
+	// RestorePolicy decides what happens to persisted states on startup. i.e. resume | cleanup | ignore
+	RestorePolicy string
+	// TLSCertFile and TLSKeyFile enable serving the API over HTTPS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile requires clients to present a certificate signed by one of its CAs.
+	TLSClientCAFile string
+	// Tokens maps bearer tokens accepted by the API to their subject. Empty disables token authentication.
+	Tokens map[string]string
+	// AuthorizationPath is the path of the OPA policy rule which authorizes each API call.
+	// Empty disables authorization.
+	AuthorizationPath string
+	// InstanceID identifies the controller in ownership tags added to comments of the rules.
+	// Empty disables ownership tags and garbage collection.
+	InstanceID string
+	// GCInterval is the interval of removing orphaned rules. Zero disables periodic garbage collection.
+	GCInterval time.Duration
+	// ShutdownPolicy decides what happens to inserted rules on shutdown. i.e. keep | cleanup | pin
+	ShutdownPolicy string
+	// AuditFile is the path of the file the shutdown audit record is appended to. Empty only logs it.
+	AuditFile string
+	// CountersInterval is the interval of pushing counters of inserted rules into OPA. Zero disables it.
+	CountersInterval time.Duration
+	// CountersPath is the path of OPA data document counters are pushed into.
+	CountersPath string
+	// OpaClient evaluates policies, i.e. through the remote or the embedded OPA.
+	OpaClient opa.Client
 }
 
 // Controller is a struct which is used for storing server related data.
-// It contains logger for centralize logging, opaClient for accessing OPA REST API, and
-// watcher for watching any state changes in ruleset of registred state stored in
-// watcherstate map.
+// It contains logger for centralize logging, opaClient for accessing OPA REST API, backend for
+// programming rules into the kernel and watcher for watching any state changes in ruleset of
+// registred state stored in watcherstate map.
 type Controller struct {
 	listenAddr         string
 	server             http.Server
 	logger             *logrus.Logger
 	opaClient          opa.Client
+	backend            iptables.Backend
+	sets               iptables.SetManager
 	w                  *watcher
 	watcherWorkerCount int
 	watcher            bool
+	// managedChains places rules of each ruleset into dedicated chains owned by the controller.
+	managedChains bool
+	reconciler    *reconciler
+	restorePolicy string
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsClientCA   string
+	auth          *authenticator
+	// instanceID is used in ownership tags of the rules, it's empty if ownership tags are disabled.
+	instanceID string
+	collector  *collector
+	ownedMu    sync.Mutex
+	// owned are RuleSets inserted by the controller and not deleted yet, by query path and "_id".
+	owned map[stateKey]iptables.RuleSet
+	// shutdownPolicy is applied to inserted rules once the controller is stopped.
+	shutdownPolicy string
+	auditFile      string
+	// counters collects packet and byte counters of inserted rules.
+	counters *counterCollector
+	// txMu serializes transactions and set changes applied to the kernel.
+	txMu sync.Mutex
 }
 
 // state is used for storing nessecarry information for doing repeated query for checking
-// "_id" field in ruleset. This state is stored in a watcherState map using "queryPath" as
-// a key and "state" as a value.
+// "_id" field in ruleset. A state is stored for every RuleSet returned by the query path in
+// a watcherState map using "queryPath" and "_id" as a key and "state" as a value.
 type state struct {
 	id        string
 	payload   payload
 	queryPath string
+	// rules are the rules inserted for the ruleset of the state.
+	rules []iptables.Rule
+	// sets are the ipsets synced for the ruleset of the state.
+	sets []iptables.Set
+}
+
+// ruleSet returns the RuleSet of the state, as stored with the state.
+func (s *state) ruleSet() iptables.RuleSet {
+	var ruleSet iptables.RuleSet
+	ruleSet.Metadata.ID = s.id
+	ruleSet.Rules = s.rules
+	ruleSet.Sets = s.sets
+	return ruleSet
+}
+
+// stateKey identifies a watched state by the query path and "_id" of its RuleSet.
+type stateKey struct {
+	queryPath string
+	id        string
+}
+
+func (s *state) key() stateKey {
+	return stateKey{queryPath: s.queryPath, id: s.id}
 }
 
 type payload struct {
@@ -66,7 +143,13 @@ type watcher struct {
 	watcherInterval time.Duration
 	watcherDoneCh   chan struct{}
 	logger          *logrus.Logger
+	// store persists watcherState across restarts of the controller, it's nil if persistence is disabled.
+	store *stateStore
 
 	mu           sync.RWMutex // guard the following fields
-	watcherState map[string]*state
+	watcherState map[stateKey]*state
+	// checks are outcomes of the last check of each watched query path.
+	checks map[string]watchCheck
+	// queryLocks serialize checks of each query path.
+	queryLocks map[string]*sync.Mutex
 }
@@ -2,54 +2,224 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/metrics"
 )
 
+// watchJob is a watched query path sent to a worker. done is called once the query path is checked.
+type watchJob struct {
+	queryPath string
+	done      func()
+}
+
+// watchCheck is the outcome of the last check of a watched query path.
+type watchCheck struct {
+	checkedAt time.Time
+	err       error
+}
+
 func (w *watcher) addState(s *state) {
 	w.mu.Lock()
-	w.watcherState[s.queryPath] = s
+	w.watcherState[s.key()] = s
+	metrics.WatchedStates.Set(float64(len(w.watcherState)))
 	w.mu.Unlock()
+	w.persist()
 }
 
-func (w *watcher) removeState(queryPath string) {
+func (w *watcher) removeState(key stateKey) {
 	w.mu.Lock()
-	_, ok := w.watcherState[queryPath]
+	_, ok := w.watcherState[key]
 	if ok {
-		delete(w.watcherState, queryPath)
+		delete(w.watcherState, key)
+		metrics.WatchedStates.Set(float64(len(w.watcherState)))
 	}
 	w.mu.Unlock()
+	if ok {
+		w.persist()
+	}
 }
 
-func (w *watcher) getState(key string) (state, error) {
-	w.mu.RLock()
-	s, ok := w.watcherState[key]
+// setStates replaces states of the query path with given states. Nil states stop watching
+// the query path.
+func (w *watcher) setStates(queryPath string, states []state) {
+	w.mu.Lock()
+	for key := range w.watcherState {
+		if key.queryPath == queryPath {
+			delete(w.watcherState, key)
+		}
+	}
+	for i := range states {
+		s := states[i]
+		w.watcherState[s.key()] = &s
+	}
+	if len(states) == 0 {
+		delete(w.checks, queryPath)
+	}
+	metrics.WatchedStates.Set(float64(len(w.watcherState)))
+	w.mu.Unlock()
+	w.persist()
+}
+
+// recordCheck records the outcome of checking the query path.
+func (w *watcher) recordCheck(queryPath string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.checks == nil {
+		w.checks = make(map[string]watchCheck)
+	}
+	w.checks[queryPath] = watchCheck{checkedAt: time.Now(), err: err}
+}
+
+// lockQueryPath serializes checks of the query path, so the workers and the watch API never
+// apply changes of the same query path concurrently. Returned function releases the lock.
+func (w *watcher) lockQueryPath(queryPath string) func() {
+	w.mu.Lock()
+	if w.queryLocks == nil {
+		w.queryLocks = make(map[string]*sync.Mutex)
+	}
+	l, ok := w.queryLocks[queryPath]
 	if !ok {
-		w.mu.RUnlock()
-		return state{}, fmt.Errorf("no state found of key %v", key)
+		l = &sync.Mutex{}
+		w.queryLocks[queryPath] = l
 	}
+	w.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// watchEntry describes a watched query path, as reported by watch API.
+type watchEntry struct {
+	QueryPath string `json:"query_path"`
+	// IDs are "_id" of the watched RuleSets of the query path.
+	IDs   []string    `json:"_ids"`
+	Input interface{} `json:"input"`
+	// LastChecked is nil until the query path is checked for the first time.
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// entry returns the watch entry of the query path. Error is returned if the query path isn't watched.
+func (w *watcher) entry(queryPath string) (watchEntry, error) {
+	states, err := w.getStates(queryPath)
+	if err != nil {
+		return watchEntry{}, err
+	}
+	e := watchEntry{QueryPath: queryPath, Input: states[0].payload.Input}
+	for _, s := range states {
+		e.IDs = append(e.IDs, s.id)
+	}
+
+	w.mu.RLock()
+	check, ok := w.checks[queryPath]
 	w.mu.RUnlock()
-	return *s, nil
+	if ok {
+		e.LastChecked = &check.checkedAt
+		if check.err != nil {
+			e.LastError = check.err.Error()
+		}
+	}
+	return e, nil
 }
 
-func (w *watcher) watch(workerCh chan<- state) {
+// entries returns watch entries of all the watched query paths, sorted by query path.
+func (w *watcher) entries() []watchEntry {
+	entries := []watchEntry{}
+	for _, queryPath := range w.queryPaths() {
+		// query path may have been removed in the meantime
+		if e, err := w.entry(queryPath); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// persist saves watched states into the store, if it's configured.
+func (w *watcher) persist() {
+	if w.store == nil {
+		return
+	}
+	if err := w.store.save(w.states()); err != nil {
+		w.logger.Errorf("Unable to persist watcher states: %v", err)
+	}
+}
+
+// getStates returns copy of the states of the query path, sorted by "_id".
+// Error is returned if the query path isn't watched.
+func (w *watcher) getStates(queryPath string) ([]state, error) {
 	w.mu.RLock()
-	for queryPath := range w.watcherState {
-		s, ok := w.watcherState[queryPath]
-		if !ok {
-			w.logger.Debugf("key %v don't exists in watcherState map", queryPath)
-			continue
+	var states []state
+	for key, s := range w.watcherState {
+		if key.queryPath == queryPath {
+			states = append(states, *s)
 		}
-		workerCh <- *s
 	}
 	w.mu.RUnlock()
+	if len(states) == 0 {
+		return nil, fmt.Errorf("no state found of queryPath %v", queryPath)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].id < states[j].id })
+	return states, nil
+}
+
+// hasState reports whether the state of the query path is watched.
+func (w *watcher) hasState(queryPath, id string) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	_, ok := w.watcherState[stateKey{queryPath: queryPath, id: id}]
+	return ok
+}
+
+// states returns copy of all the watched states.
+func (w *watcher) states() []state {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	states := make([]state, 0, len(w.watcherState))
+	for _, s := range w.watcherState {
+		states = append(states, *s)
+	}
+	return states
+}
+
+// queryPaths returns watched query paths, sorted.
+func (w *watcher) queryPaths() []string {
+	w.mu.RLock()
+	seen := make(map[string]bool)
+	var queryPaths []string
+	for key := range w.watcherState {
+		if !seen[key.queryPath] {
+			seen[key.queryPath] = true
+			queryPaths = append(queryPaths, key.queryPath)
+		}
+	}
+	w.mu.RUnlock()
+	sort.Strings(queryPaths)
+	return queryPaths
+}
+
+// watch sends every watched query path to the workers and records the time taken by the
+// workers to check all of them. Every query path is queried once per cycle, no matter how
+// many RuleSets it returns.
+func (w *watcher) watch(workerCh chan<- watchJob) {
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, queryPath := range w.queryPaths() {
+		wg.Add(1)
+		workerCh <- watchJob{queryPath: queryPath, done: wg.Done}
+	}
+	wg.Wait()
+	metrics.WatcherCycleDuration.Observe(time.Since(start).Seconds())
 }
 
 func (c *Controller) newWatcher() {
 	
-	workerCh := make(chan state)
+	workerCh := make(chan watchJob)
 	workerDoneCh := make(chan struct{}, c.watcherWorkerCount)
 	c.startWorker(workerCh, workerDoneCh)
 
@@ -81,7 +251,7 @@ func (c *Controller) stopWatcher(ctx context.Context) error {
 	}
 }
 
-func (c *Controller) startWorker(workerCh <-chan state, done chan<- struct{}) {
+func (c *Controller) startWorker(workerCh <-chan watchJob, done chan<- struct{}) {
 	for i := 1 ; i <= c.watcherWorkerCount ; i++ {
 		go c.worker(i, workerCh, done)
 	}
@@ -95,65 +265,263 @@ func (c *Controller) stopWorker(done chan struct{}) {
 }
 
 // worker runs in it's own goroutine.
-func (c *Controller) worker(id int, workerCh <-chan state, done chan<- struct{}) {
+func (c *Controller) worker(id int, workerCh <-chan watchJob, done chan<- struct{}) {
 	c.logger.Infof("Worker %v started", id)
 
-	for s := range workerCh {
+	for job := range workerCh {
+		c.checkQueryPath(context.Background(), id, job.queryPath)
+		job.done()
+	}
+	c.logger.Infof("worker %v stopped", id)
+	done <- struct{}{}
+}
+
+// checkQueryPath checks the watched states of the query path and records the outcome.
+// It returns false if the query path isn't watched.
+func (c *Controller) checkQueryPath(ctx context.Context, id int, queryPath string) bool {
+	unlock := c.w.lockQueryPath(queryPath)
+	defer unlock()
 
-		res, err := c.handleQuery(s.queryPath, s.payload.Input)
-		if err != nil {
-			c.logger.Debugf("[Worker: %v] Error while querying opa: %v", id, err)
+	// states may have been changed by previous check, so they are read under the lock
+	states, err := c.w.getStates(queryPath)
+	if err != nil {
+		return false
+	}
+	err = c.checkStates(ctx, id, queryPath, states)
+	if err != nil {
+		c.logger.Warnf("[Worker: %v] Error while checking queryPath %v: %v", id, queryPath, err)
+	}
+	c.w.recordCheck(queryPath, err)
+	return true
+}
+
+// checkStates queries OPA for the RuleSets of the query path and compares them with the
+// watched states of the query path by "_id". RuleSets with a new "_id" are inserted, states
+// whose "_id" is no longer returned are deleted and sets of the remaining states are updated.
+// If a single RuleSet changed its "_id", its rules are replaced in a single transaction.
+// Errors of all the RuleSets are returned, RuleSets which failed are retried on next check.
+func (c *Controller) checkStates(ctx context.Context, id int, queryPath string, states []state) error {
+	if len(states) == 0 {
+		return nil
+	}
+	res, err := c.handleQuery(ctx, queryPath, states[0].payload.Input)
+	if err != nil {
+		return fmt.Errorf("error while querying opa: %w", err)
+	}
+
+	ruleSets, err := iptables.UnmarshalRuleset(res)
+	if err != nil {
+		return fmt.Errorf("error while unmarshaling ruleset: %v", err)
+	}
+
+	if len(ruleSets) == 0 {
+		// policy or data may be missing, i.e. OPA was restarted, so rules are kept until
+		// the query path is deleted
+		c.logger.Warnf("[Worker: %v] Query of queryPath %v didn't return any RuleSet, keeping current rules", id, queryPath)
+		return errors.New("query didn't return any RuleSet, current rules are kept")
+	}
+
+	current := make(map[string]state)
+	for _, s := range states {
+		current[s.id] = s
+	}
+
+	var errs checkErrors
+	returned := make(map[string]bool)
+	var added []iptables.RuleSet
+	for _, ruleSet := range ruleSets {
+		rsID := ruleSet.Metadata.ID
+		if rsID == "" || returned[rsID] {
+			c.logger.Errorf("[Worker: %v] RuleSet of queryPath %v has empty or duplicate \"_id\" %q, skipping it", id, queryPath, rsID)
+			errs = append(errs, fmt.Errorf("RuleSet has empty or duplicate \"_id\" %q", rsID))
 			continue
 		}
+		returned[rsID] = true
 
-		ruleSets, err := iptables.UnmarshalRuleset(res)
-		if err != nil {
-			c.logger.Debugf("[Worker: %v] Error while Unmarshaling ruleset: %v", id, err)
+		if s, ok := current[rsID]; ok {
+			errs.add(c.updateSets(id, s, ruleSet))
 			continue
 		}
+		added = append(added, ruleSet)
+	}
 
-		if len(ruleSets) == 1 {
-			ruleset := ruleSets[0]
-			newID := ruleset.Metadata.ID
-			currentID := s.id
-
-			if currentID != newID {
-
-				c.logger.Infof("[Worker: %v] Data changes of queryPath %v, Replacing rules", id, s.queryPath)
-				oldRules, _ := c.getCurrentRulesFromOPA(currentID)
-				newRules := ruleset.Rules
-				err := replaceRules(oldRules, newRules)
-				if err != nil {
-					c.logger.Error(err)
-					continue
-				}
-
-				c.putNewRulesToOPA(newID, newRules)
-				c.deleteOldRulesFromOPA(currentID)
-
-				newState := state{
-					id:        newID,
-					payload:   s.payload,
-					queryPath: s.queryPath,
-				}
-				c.w.addState(&newState)
-			}
+	var removed []state
+	for _, s := range states {
+		if !returned[s.id] {
+			removed = append(removed, s)
 		}
 	}
-	c.logger.Infof("worker %v stopped", id)
-	done <- struct{}{}
+
+	if len(added) == 1 && len(removed) == 1 {
+		errs.add(c.replaceState(ctx, id, removed[0], added[0]))
+		return errs.err()
+	}
+	// new RuleSets are inserted before old ones are deleted, so traffic accepted by both
+	// is never dropped in between
+	for _, ruleSet := range added {
+		errs.add(c.insertState(ctx, id, states[0], ruleSet))
+	}
+	for _, s := range removed {
+		errs.add(c.deleteState(ctx, id, s, ruleSets))
+	}
+	return errs.err()
+}
+
+// checkErrors collects errors of the RuleSets of a checked query path.
+type checkErrors []error
+
+func (errs *checkErrors) add(err error) {
+	if err != nil {
+		*errs = append(*errs, err)
+	}
+}
+
+// err returns nil if there are no errors, or a single error joining all of them.
+func (errs checkErrors) err() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// updateSets updates membership of the sets of the state, if the sets of the RuleSet with
+// the same "_id" changed. Rules are left untouched.
+func (c *Controller) updateSets(id int, s state, ruleset iptables.RuleSet) error {
+	if setsEqual(ruleset.Sets, s.sets) {
+		return nil
+	}
+	if err := ruleset.Validate(); err != nil {
+		c.logger.Errorf("[Worker: %v] RuleSet %q of queryPath %v is invalid: %v", id, s.id, s.queryPath, err)
+		return fmt.Errorf("RuleSet %q is invalid: %v", s.id, err)
+	}
+
+	c.logger.Infof("[Worker: %v] Sets of RuleSet %q of queryPath %v changed, Updating sets", id, s.id, s.queryPath)
+	if err := c.syncSets(ruleset.Sets); err != nil {
+		c.logger.Error(err)
+		return fmt.Errorf("unable to update sets of RuleSet %q: %v", s.id, err)
+	}
+	c.destroySets(s.sets, ruleset.Sets)
+
+	s.sets = ruleset.Sets
+	c.w.addState(&s)
+	return nil
 }
 
-func replaceRules(old, new []iptables.Rule) error {
-	//deletes old rules
-	err := deleteRules(old)
+// replaceState replaces rules of the state with rules of the RuleSet, which is returned
+// instead of the state with a new "_id".
+func (c *Controller) replaceState(ctx context.Context, id int, s state, ruleset iptables.RuleSet) error {
+	newID := ruleset.Metadata.ID
+	if err := ruleset.Validate(); err != nil {
+		c.logger.Errorf("[Worker: %v] RuleSet %q of queryPath %v is invalid: %v", id, newID, s.queryPath, err)
+		metrics.Replacements.WithLabelValues(metrics.ResultFailure).Inc()
+		return fmt.Errorf("RuleSet %q is invalid: %v", newID, err)
+	}
+
+	c.logger.Infof("[Worker: %v] Data changes of queryPath %v, Replacing rules of RuleSet %q with %q", id, s.queryPath, s.id, newID)
+	err := c.replaceRuleSet(s.queryPath, c.stateRuleSet(ctx, s), ruleset)
+	metrics.Replacements.WithLabelValues(metrics.Result(err)).Inc()
 	if err != nil {
+		c.logger.Error(err)
+		return fmt.Errorf("unable to replace RuleSet %q with %q: %v", s.id, newID, err)
+	}
+
+	c.putNewRulesToOPA(ctx, newID, ruleset.Rules)
+	c.deleteOldRulesFromOPA(ctx, s.id)
+
+	newState := state{
+		id:        newID,
+		payload:   s.payload,
+		queryPath: s.queryPath,
+		rules:     ruleset.Rules,
+		sets:      ruleset.Sets,
+	}
+	c.w.removeState(s.key())
+	c.w.addState(&newState)
+	return nil
+}
+
+// insertState inserts rules of the RuleSet, which is newly returned by the query path of the
+// state, and starts watching it.
+func (c *Controller) insertState(ctx context.Context, id int, s state, ruleset iptables.RuleSet) error {
+	newID := ruleset.Metadata.ID
+	if err := ruleset.Validate(); err != nil {
+		c.logger.Errorf("[Worker: %v] RuleSet %q of queryPath %v is invalid: %v", id, newID, s.queryPath, err)
+		metrics.Replacements.WithLabelValues(metrics.ResultFailure).Inc()
+		return fmt.Errorf("RuleSet %q is invalid: %v", newID, err)
+	}
+
+	c.logger.Infof("[Worker: %v] Data changes of queryPath %v, Inserting rules of RuleSet %q", id, s.queryPath, newID)
+	err := c.insertRuleSet(s.queryPath, ruleset)
+	metrics.Replacements.WithLabelValues(metrics.Result(err)).Inc()
+	if err != nil {
+		err = errors.New(ruleSetError(ruleset, err))
+		c.logger.Error(err)
 		return err
 	}
-	//inserts new rules
-	err = insertRules(new)
+
+	c.putNewRulesToOPA(ctx, newID, ruleset.Rules)
+	newState := state{
+		id:        newID,
+		payload:   s.payload,
+		queryPath: s.queryPath,
+		rules:     ruleset.Rules,
+		sets:      ruleset.Sets,
+	}
+	c.w.addState(&newState)
+	return nil
+}
+
+// deleteState deletes rules of the state, which is no longer returned by its query path, and
+// stops watching it. Sets used by the returned ruleSets are kept.
+func (c *Controller) deleteState(ctx context.Context, id int, s state, ruleSets []iptables.RuleSet) error {
+	c.logger.Infof("[Worker: %v] Data changes of queryPath %v, Deleting rules of RuleSet %q", id, s.queryPath, s.id)
+	old := c.stateRuleSet(ctx, s)
+
+	var keep []iptables.Set
+	for _, ruleSet := range ruleSets {
+		keep = append(keep, ruleSet.Sets...)
+	}
+	used := make(map[string]bool)
+	for _, set := range keep {
+		used[set.Name] = true
+	}
+	old.Sets = nil
+	for _, set := range s.sets {
+		if !used[set.Name] {
+			old.Sets = append(old.Sets, set)
+		}
+	}
+
+	err := c.deleteRuleSet(s.queryPath, old)
+	metrics.Replacements.WithLabelValues(metrics.Result(err)).Inc()
 	if err != nil {
+		err = errors.New(ruleSetError(old, err))
+		c.logger.Error(err)
 		return err
 	}
+
+	c.deleteOldRulesFromOPA(ctx, s.id)
+	c.w.removeState(s.key())
 	return nil
 }
+
+// stateRuleSet returns the RuleSet currently inserted for the state. Rules stored in OPA are
+// preferred, rules stored with the state are used if OPA doesn't know them, i.e. it was restarted.
+func (c *Controller) stateRuleSet(ctx context.Context, s state) iptables.RuleSet {
+	rules, err := c.getCurrentRulesFromOPA(ctx, s.id)
+	if err != nil || len(rules) == 0 {
+		rules = s.rules
+	}
+	var ruleSet iptables.RuleSet
+	ruleSet.Metadata.ID = s.id
+	ruleSet.Rules = rules
+	ruleSet.Sets = s.sets
+	return ruleSet
+}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/opa"
+)
+
+// recordBackend records every applied transaction.
+type recordBackend struct {
+	fakeBackend
+	txs [][]string
+}
+
+func (b *recordBackend) Apply(tx *iptables.Transaction) error {
+	var ops []string
+	for _, op := range tx.Ops {
+		r := op.Rule
+		r.SetDefaults()
+		ops = append(ops, string(op.Type)+" "+r.String())
+	}
+	b.txs = append(b.txs, ops)
+	return nil
+}
+
+func TestCheckStates(t *testing.T) {
+	rule := func(port string) iptables.Rule {
+		return iptables.Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: port, Jump: "ACCEPT"}
+	}
+	o := &fakeOPA{data: make(map[string][]byte)}
+	backend := &recordBackend{}
+	c := &Controller{
+		logger:    logging.GetLogger(),
+		opaClient: o,
+		backend:   backend,
+		w:         &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+	}
+	c.w.setStates("iptables/rules", []state{
+		{id: "web", queryPath: "iptables/rules", rules: []iptables.Rule{rule("80")}},
+		{id: "ssh", queryPath: "iptables/rules", rules: []iptables.Rule{rule("22")}},
+	})
+	c.w.addState(&state{id: "other", queryPath: "iptables/other"})
+
+	check := func(result string, ids ...string) {
+		t.Helper()
+		o.result = result
+		backend.txs = nil
+		states, _ := c.w.getStates("iptables/rules")
+		c.checkStates(context.Background(), 1, "iptables/rules", states)
+
+		states, _ = c.w.getStates("iptables/rules")
+		var got []string
+		for _, s := range states {
+			got = append(got, s.id)
+		}
+		if !reflect.DeepEqual(got, ids) {
+			t.Errorf("expected states %v, got %v", ids, got)
+		}
+	}
+
+	// ssh is removed, db and dns are added, rules of web are untouched
+	check(`{"result": [
+		{"metadata": {"_id": "web"}, "rules": [{"protocol": "tcp", "destination_port": "80", "jump": "ACCEPT"}]},
+		{"metadata": {"_id": "db"}, "rules": [{"protocol": "tcp", "destination_port": "5432", "jump": "ACCEPT"}]},
+		{"metadata": {"_id": "dns"}, "rules": [{"protocol": "udp", "destination_port": "53", "jump": "ACCEPT"}]}
+	]}`, "db", "dns", "web")
+	expected := [][]string{
+		{"add filter INPUT -p tcp --dport 5432 -j ACCEPT"},
+		{"add filter INPUT -p udp --dport 53 -j ACCEPT"},
+		{"delete filter INPUT -p tcp --dport 22 -j ACCEPT"},
+	}
+	if !reflect.DeepEqual(backend.txs, expected) {
+		t.Errorf("expected transactions %v, got %v", expected, backend.txs)
+	}
+	if _, ok := o.data["state/db"]; !ok {
+		t.Error("expected rules of db to be stored into OPA")
+	}
+
+	// single RuleSet with a new "_id" is replaced in a single transaction
+	check(`{"result": [
+		{"metadata": {"_id": "web-v2"}, "rules": [{"protocol": "tcp", "destination_port": "8080", "jump": "ACCEPT"}]},
+		{"metadata": {"_id": "db"}, "rules": [{"protocol": "tcp", "destination_port": "5432", "jump": "ACCEPT"}]},
+		{"metadata": {"_id": "dns"}, "rules": [{"protocol": "udp", "destination_port": "53", "jump": "ACCEPT"}]}
+	]}`, "db", "dns", "web-v2")
+	expected = [][]string{{"delete filter INPUT -p tcp --dport 80 -j ACCEPT", "add filter INPUT -p tcp --dport 8080 -j ACCEPT"}}
+	if !reflect.DeepEqual(backend.txs, expected) {
+		t.Errorf("expected transactions %v, got %v", expected, backend.txs)
+	}
+
+	// empty result keeps the current rules
+	check(`{"result": []}`, "db", "dns", "web-v2")
+	if len(backend.txs) != 0 {
+		t.Errorf("expected no transaction, got %v", backend.txs)
+	}
+
+	if _, err := c.w.getStates("iptables/other"); err != nil {
+		t.Errorf("expected states of other query path to be kept: %v", err)
+	}
+}
+
+func TestWatchAPI(t *testing.T) {
+	o := &fakeOPA{
+		result: `{"result": [{"metadata": {"_id": "web"}, "rules": [{"protocol": "tcp", "destination_port": "80", "jump": "ACCEPT"}]}]}`,
+		data:   map[string][]byte{"state/web": []byte("[]")},
+	}
+	backend := &recordBackend{}
+	c := &Controller{
+		logger:    logging.GetLogger(),
+		opaClient: o,
+		backend:   backend,
+		watcher:   true,
+		w:         &watcher{watcherState: make(map[stateKey]*state), logger: logging.GetLogger()},
+		auth:      &authenticator{},
+	}
+	input := map[string]interface{}{"env": "prod"}
+	c.w.addState(&state{id: "web", queryPath: "iptables/rules", payload: payload{Input: input}})
+
+	do := func(method, url string, code int, v interface{}) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		c.router().ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+		if rec.Code != code {
+			t.Fatalf("%v %v: expected status %v, got %v: %v", method, url, code, rec.Code, rec.Body.String())
+		}
+		if v != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var entries []watchEntry
+	do("GET", "/v1/iptables/watch", http.StatusOK, &entries)
+	if len(entries) != 1 || entries[0].QueryPath != "iptables/rules" || !reflect.DeepEqual(entries[0].IDs, []string{"web"}) ||
+		!reflect.DeepEqual(entries[0].Input, input) || entries[0].LastChecked != nil {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	o.queryErr = &opa.Error{Code: "internal_error", Message: "eval failed"}
+	do("POST", "/v1/iptables/watch/check?q=iptables/rules", http.StatusOK, &entries)
+	if len(entries) != 1 || entries[0].LastChecked == nil || !strings.Contains(entries[0].LastError, "eval failed") {
+		t.Fatalf("unexpected entries after failed check: %+v", entries)
+	}
+
+	o.queryErr = nil
+	var e watchEntry
+	do("POST", "/v1/iptables/watch/check", http.StatusOK, &entries)
+	do("GET", "/v1/iptables/watch?q=iptables/rules", http.StatusOK, &e)
+	if e.LastChecked == nil || e.LastError != "" {
+		t.Errorf("unexpected entry after successful check: %+v", e)
+	}
+
+	do("POST", "/v1/iptables/watch/check?q=iptables/missing", http.StatusNotFound, nil)
+	do("DELETE", "/v1/iptables/watch?q=iptables/rules", http.StatusOK, &e)
+	do("GET", "/v1/iptables/watch?q=iptables/rules", http.StatusNotFound, nil)
+	do("DELETE", "/v1/iptables/watch?q=iptables/rules", http.StatusNotFound, nil)
+	if _, ok := o.data["state/web"]; ok {
+		t.Error("expected rules of the state to be deleted from OPA")
+	}
+	if len(backend.txs) != 0 {
+		t.Errorf("expected rules to be kept in the kernel, got %v", backend.txs)
+	}
+}
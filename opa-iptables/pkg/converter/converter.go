@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"strconv"
 	"strings"
 
 	"github.com/mattn/go-shellwords"
@@ -11,10 +12,17 @@ import (
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
 )
 
-func marshal(tf flag.IPTableflagSet) ([]byte, error) {
+func marshal(tf flag.IPTableflagSet, family iptables.Family) ([]byte, error) {
+	return json.MarshalIndent(ruleFromFlags(tf, family), "", "    ")
+}
+
+// ruleFromFlags returns the rule described by parsed flags.
+func ruleFromFlags(tf flag.IPTableflagSet, family iptables.Family) iptables.Rule {
 	r := iptables.Rule{
 		Table:              strings.ToLower(tf.TableFlag),
-		Chain:              strings.ToUpper(tf.ChainFlag),
+		Chain:              tf.ChainFlag,
+		Action:             tf.ActionFlag,
+		RuleNumber:         tf.RuleNumFlag,
 		Protocol:           tf.ProtocolFlag,
 		DestinationPort:    tf.DportFlag,
 		DestinationAddress: tf.DestinationFlag,
@@ -26,14 +34,122 @@ func marshal(tf flag.IPTableflagSet) ([]byte, error) {
 		SourceRange:        tf.SrcRangeFlag,
 		Jump:               tf.JumpFlag,
 		ToPorts:            tf.ToPortFlag,
+		ToSource:           tf.ToSourceFlag,
+		ToDestination:      tf.ToDestFlag,
 		LogPrefix:			tf.LogPrefixFlag,
-		Match:              strings.Split(tf.MatchFlag, ","),
-		Ctstate:            strings.Split(tf.CTStateFlag, ","),
+		Match:              splitList(tf.MatchFlag),
+		Ctstate:            splitList(tf.CTStateFlag),
 		TCPFlags:           iptables.TcpFlags(tf.TCPFlag),
-		Comment:            tf.Comment,
+		Comment:            iptables.UnquoteComment(tf.Comment),
+		Family:             family,
+		MacSource:          tf.MacSourceFlag,
+		Mark:               tf.MarkFlag,
+		ConnMark:           tf.ConnMarkFlag,
+		ICMPType:           tf.ICMPTypeFlag,
+		LogLevel:           tf.LogLevelFlag,
+		NFLogGroup:         tf.NFLogGroupFlag,
+		RejectWith:         tf.RejectWithFlag,
+		SetMark:            tf.SetMarkFlag,
+		SaveMark:           tf.SaveMarkFlag,
+		RestoreMark:        tf.RestoreMarkFlag,
+		OnPort:             tf.OnPortFlag,
+		OnIP:               tf.OnIPFlag,
+		CTNoTrack:          tf.NoTrackFlag,
+		CTZone:             tf.ZoneFlag,
+		CTHelper:           tf.HelperFlag,
+		Random:             tf.RandomFlag,
+	}
+	// names of user defined chains are case sensitive
+	if iptables.IsBuiltinChain(r.Chain) {
+		r.Chain = strings.ToUpper(r.Chain)
+	}
+	addMatches(&r, tf)
+	return r
+}
+
+// parseArgs parses arguments of iptables command. First argument is the name of the command.
+func parseArgs(args []string) (flag.IPTableflagSet, error) {
+	var tf flag.IPTableflagSet
+	fs := flag.NewFlagSet("iptables", flag.ContinueOnError)
+	fs.InitFlagSet(&tf)
+
+	// -I CHAIN may be followed by a rule number, but flags take a fixed number of arguments
+	for i := 0; i+2 < len(args); i++ {
+		if args[i] != "-I" && args[i] != "--insert" {
+			continue
+		}
+		if _, err := strconv.Atoi(args[i+2]); err == nil {
+			tf.RuleNumFlag = args[i+2]
+			args = append(args[:i+2:i+2], args[i+3:]...)
+		}
+		break
 	}
 
-	return json.MarshalIndent(r, "", "    ")
+	err := fs.Parse(args)
+	return tf, err
+}
+
+// splitList splits comma separated list. Empty list is returned as nil.
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// addMatches sets options of match modules, which are present in the flagSet.
+func addMatches(r *iptables.Rule, tf flag.IPTableflagSet) {
+	if tf.SportsFlag != "" || tf.DportsFlag != "" || tf.PortsFlag != "" {
+		r.Multiport = &iptables.Multiport{
+			SourcePorts:      tf.SportsFlag,
+			DestinationPorts: tf.DportsFlag,
+			Ports:            tf.PortsFlag,
+		}
+	}
+	if tf.LimitFlag != "" || tf.LimitBurstFlag != "" {
+		r.Limit = &iptables.Limit{Rate: tf.LimitFlag, Burst: tf.LimitBurstFlag}
+	}
+	if tf.HashLimitNameFlag != "" || tf.HashLimitUptoFlag != "" || tf.HashLimitAboveFlag != "" {
+		r.HashLimit = &iptables.HashLimit{
+			Name:            tf.HashLimitNameFlag,
+			Upto:            tf.HashLimitUptoFlag,
+			Above:           tf.HashLimitAboveFlag,
+			Burst:           tf.HashLimitBurstFlag,
+			SourceMask:      tf.HashLimitSrcMaskFlag,
+			DestinationMask: tf.HashLimitDstMaskFlag,
+			Expire:          tf.HashLimitExpireFlag,
+		}
+		if tf.HashLimitModeFlag != "" {
+			r.HashLimit.Mode = strings.Split(tf.HashLimitModeFlag, ",")
+		}
+	}
+	if tf.RecentActionFlag != "" || tf.RecentNameFlag != "" {
+		r.Recent = &iptables.Recent{
+			Name:     tf.RecentNameFlag,
+			Action:   tf.RecentActionFlag,
+			Side:     tf.RecentSideFlag,
+			Seconds:  tf.SecondsFlag,
+			HitCount: tf.HitCountFlag,
+		}
+	}
+	if tf.UIDOwnerFlag != "" || tf.GIDOwnerFlag != "" || tf.SocketExistsFlag {
+		r.Owner = &iptables.Owner{UID: tf.UIDOwnerFlag, GID: tf.GIDOwnerFlag, SocketExists: tf.SocketExistsFlag}
+	}
+	if tf.MatchSetFlag != "" {
+		set := strings.SplitN(tf.MatchSetFlag, "#", 2)
+		r.MatchSet = &iptables.MatchSet{Name: set[0]}
+		if len(set) == 2 {
+			r.MatchSet.Flags = set[1]
+		}
+	}
+	if tf.SrcTypeFlag != "" || tf.DstTypeFlag != "" {
+		r.AddrType = &iptables.AddrType{
+			SourceType:      tf.SrcTypeFlag,
+			DestinationType: tf.DstTypeFlag,
+			LimitIfaceIn:    tf.LimitIfaceInFlag,
+			LimitIfaceOut:   tf.LimitIfaceOutFlag,
+		}
+	}
 }
 
 // IPTableToJSON reads '\n' delimeted rules from reader, parse each rule and returns rules describes in JSON format as a string.
@@ -50,10 +166,6 @@ func IPTableToJSON(reader io.Reader) ([]string, error) {
 
 	rules := strings.Split(string(b), "\n")
 	for _, rule := range rules {
-		fs := flag.NewFlagSet("iptables", flag.ContinueOnError)
-		var flagSet flag.IPTableflagSet
-		fs.InitFlagSet(&flagSet)
-
 		// Parse line as a shell words
 		// i.e "iptables --comment "hello world""
 		// args should be ["iptables","--comment","hello world"]
@@ -63,13 +175,19 @@ func IPTableToJSON(reader io.Reader) ([]string, error) {
 			continue
 		}
 
-		err = fs.Parse(args)
+		flagSet, err := parseArgs(args)
 		if err != nil {
 			jsonRules = append(jsonRules, "\"Error: "+err.Error()+"\"")
 			continue
 		}
 
-		rule, err := marshal(flagSet)
+		// rules written for ip6tables are only valid for ipv6 family
+		var family iptables.Family
+		if len(args) > 0 && strings.HasSuffix(args[0], "ip6tables") {
+			family = iptables.IPv6
+		}
+
+		rule, err := marshal(flagSet, family)
 		if err != nil {
 			jsonRules = append(jsonRules, "\"Error: "+err.Error()+"\"")
 			continue
@@ -1,8 +1,12 @@
 package converter
 
 import (
+	"encoding/json"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
 )
 
 var rule = `iptables -t filter -A INPUT -m conntrack,tcp,comment -p tcp -i eth0 -o eth0 -s 192.168.0.1 -d 127.0.0.1 --ctstate ESTABLISHED,RELATED -dport 8080 -sport 9090 -j DROP --to-ports 80 --tcp-flags ALL ACK,RST,SYN,FIN --comment "hello world"`
@@ -15,6 +19,7 @@ var expected = []string{`{
     "source": "192.168.0.1",
     "source_port": "9090",
     "to_ports": "80",
+    "action": "append",
     "jump": "DROP",
     "in_interface": "eth0",
     "out_interface": "eth0",
@@ -52,4 +57,27 @@ func TestIPTableToJSON(t *testing.T) {
             t.Errorf("wanted: %v, but got: %v",expected[i],rule)
         } 
     }
-}
\ No newline at end of file
+}
+func TestIPTableToJSONMatches(t *testing.T) {
+	rule := `iptables -A INPUT -p tcp -m multiport --dports 80,443 -m limit --limit 10/minute --limit-burst 20 -m set --match-set blocklist src -j DROP`
+	rules, err := IPTableToJSON(strings.NewReader(rule))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r iptables.Rule
+	if err := json.Unmarshal([]byte(rules[0]), &r); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Multiport, &iptables.Multiport{DestinationPorts: "80,443"}) {
+		t.Errorf("unexpected multiport: %+v", r.Multiport)
+	}
+	if !reflect.DeepEqual(r.Limit, &iptables.Limit{Rate: "10/minute", Burst: "20"}) {
+		t.Errorf("unexpected limit: %+v", r.Limit)
+	}
+	if !reflect.DeepEqual(r.MatchSet, &iptables.MatchSet{Name: "blocklist", Flags: "src"}) {
+		t.Errorf("unexpected match_set: %+v", r.MatchSet)
+	}
+	if !reflect.DeepEqual(r.Match, []string{"multiport", "limit", "set"}) {
+		t.Errorf("unexpected match: %v", r.Match)
+	}
+}
@@ -0,0 +1,195 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// Export formats of a RuleSet.
+const (
+	FormatCommands = "commands"
+	FormatRestore  = "restore"
+)
+
+// RuleToCommands returns iptables commands which add the rule, one for each address family of
+// the rule. Arguments are quoted for a POSIX shell.
+// i.e iptables -t filter -A INPUT -p tcp --dport 22 -m comment --comment 'allow ssh' -j ACCEPT
+func RuleToCommands(r iptables.Rule) ([]string, error) {
+	r.SetDefaults()
+	families, err := r.Families()
+	if err != nil {
+		return nil, err
+	}
+	args, err := ruleArgs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []string
+	for _, family := range families {
+		command := []string{"iptables", "-t", r.Table}
+		if family == iptables.IPv6 {
+			command[0] = "ip6tables"
+		}
+		command = append(command, args...)
+
+		quoted := make([]string, len(command))
+		for i, arg := range command {
+			quoted[i] = shellQuote(arg)
+		}
+		commands = append(commands, strings.Join(quoted, " "))
+	}
+	return commands, nil
+}
+
+// RuleSetToCommands returns ipset commands which create sets of the ruleset, followed by
+// iptables commands which add its rules. Family of the ruleset is used for rules which don't
+// specify it.
+func RuleSetToCommands(ruleSet iptables.RuleSet) ([]string, error) {
+	var commands []string
+	for _, s := range ruleSet.Sets {
+		commands = append(commands, setCommands(s)...)
+	}
+	for i, r := range ruleSet.Rules {
+		if r.Family == "" {
+			r.Family = ruleSet.Family
+		}
+		c, err := RuleToCommands(r)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%v]: %v", i, err)
+		}
+		commands = append(commands, c...)
+	}
+	return commands, nil
+}
+
+// RuleSetToRestore returns input of iptables-restore (or ip6tables-restore for ipv6 family)
+// which adds rules of the ruleset belonging to the family. Each table is declared once and
+// user defined chains containing the rules are declared at the top of their table.
+//
+// Without --noflush iptables-restore replaces the whole content of the declared tables, and
+// with --noflush declaring an existing user defined chain flushes it.
+func RuleSetToRestore(ruleSet iptables.RuleSet, family iptables.Family) ([]byte, error) {
+	if family != iptables.IPv4 && family != iptables.IPv6 {
+		return nil, fmt.Errorf("family of iptables-restore input must be one of ipv4 | ipv6")
+	}
+
+	var tables []string
+	chains := make(map[string][]string)
+	lines := make(map[string][]string)
+	for i, r := range ruleSet.Rules {
+		if r.Family == "" {
+			r.Family = ruleSet.Family
+		}
+		r.SetDefaults()
+		families, err := r.Families()
+		if err != nil {
+			return nil, fmt.Errorf("rules[%v]: %v", i, err)
+		}
+		if !containsFamily(families, family) {
+			continue
+		}
+		args, err := ruleArgs(r)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%v]: %v", i, err)
+		}
+
+		if _, ok := lines[r.Table]; !ok {
+			tables = append(tables, r.Table)
+		}
+		if !iptables.IsBuiltinChain(r.Chain) && !containsString(chains[r.Table], r.Chain) {
+			chains[r.Table] = append(chains[r.Table], r.Chain)
+		}
+		quoted := make([]string, len(args))
+		for j, arg := range args {
+			quoted[j] = iptables.RestoreQuote(arg)
+		}
+		lines[r.Table] = append(lines[r.Table], strings.Join(quoted, " "))
+	}
+	sort.Strings(tables)
+
+	var buf bytes.Buffer
+	for _, table := range tables {
+		fmt.Fprintf(&buf, "*%v\n", table)
+		for _, chain := range chains[table] {
+			fmt.Fprintf(&buf, ":%v - [0:0]\n", chain)
+		}
+		for _, line := range lines[table] {
+			buf.WriteString(line + "\n")
+		}
+		buf.WriteString("COMMIT\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// ruleArgs returns arguments which add the rule to its chain, without the table.
+// i.e -A INPUT -p tcp --dport 22 -j ACCEPT
+func ruleArgs(r iptables.Rule) ([]string, error) {
+	var args []string
+	switch r.Action {
+	case "", "append":
+		args = []string{"-A", r.Chain}
+	case "insert":
+		if r.RuleNumber == "" {
+			return nil, fmt.Errorf("to use insert action ,you must need to provides rule_number")
+		}
+		if _, err := strconv.Atoi(r.RuleNumber); err != nil {
+			return nil, err
+		}
+		args = []string{"-I", r.Chain, r.RuleNumber}
+	default:
+		return nil, fmt.Errorf("invalid action %q: must be one of append | insert", r.Action)
+	}
+
+	// comments keep the literal quotes added by Construct, so exported rules are identical to the
+	// rules installed by the controller
+	return append(args, r.Construct()...), nil
+}
+
+// setCommands returns ipset commands which create the set and add its entries.
+// Commands are idempotent, entries which are not a part of the set are not removed.
+func setCommands(s iptables.Set) []string {
+	family := "inet"
+	if s.Family == iptables.IPv6 {
+		family = "inet6"
+	}
+	commands := []string{fmt.Sprintf("ipset -exist create %v %v family %v", shellQuote(s.Name), shellQuote(s.Type), family)}
+	for _, entry := range s.Entries {
+		commands = append(commands, fmt.Sprintf("ipset -exist add %v %v", shellQuote(s.Name), shellQuote(entry)))
+	}
+	return commands
+}
+
+var shellSafeRegexp = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./!-]+$`)
+
+// shellQuote quotes the argument using single quotes, so a POSIX shell passes it as it is.
+func shellQuote(arg string) string {
+	if shellSafeRegexp.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+func containsFamily(families []iptables.Family, family iptables.Family) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
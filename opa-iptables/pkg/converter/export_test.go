@@ -0,0 +1,263 @@
+package converter
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-shellwords"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+func TestRuleToCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     iptables.Rule
+		expected []string
+	}{
+		{
+			name:     "defaults",
+			rule:     iptables.Rule{Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"},
+			expected: []string{"iptables -t filter -A INPUT -p tcp --dport 22 -j ACCEPT"},
+		},
+		{
+			name:     "both families",
+			rule:     iptables.Rule{Family: iptables.DualStack, Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"},
+			expected: []string{"iptables -t filter -A INPUT -p tcp --dport 22 -j ACCEPT", "ip6tables -t filter -A INPUT -p tcp --dport 22 -j ACCEPT"},
+		},
+		{
+			name:     "insert",
+			rule:     iptables.Rule{Table: "nat", Chain: "prerouting", Action: "insert", RuleNumber: "2", DestinationAddress: "192.168.1.1", Protocol: "tcp", Jump: "DNAT", ToDestination: "10.0.0.2:8080"},
+			expected: []string{"iptables -t nat -I PREROUTING 2 -p tcp -d 192.168.1.1 -j DNAT --to-destination 10.0.0.2:8080"},
+		},
+		{
+			name:     "quoting",
+			rule:     iptables.Rule{Family: iptables.IPv6, InInterface: "!lo", Jump: "LOG", LogPrefix: "it's dropped: ", Comment: "log $all"},
+			expected: []string{`ip6tables -t filter -A INPUT ! -i lo -j LOG --log-prefix 'it'\''s dropped: ' -m comment --comment '"log $all"'`},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			commands, err := RuleToCommands(tc.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(commands, tc.expected) {
+				t.Errorf("wanted: %q, but got: %q", tc.expected, commands)
+			}
+		})
+	}
+}
+
+func TestRuleToCommandsErrors(t *testing.T) {
+	rules := []iptables.Rule{
+		{Action: "insert", Jump: "ACCEPT"},
+		{Action: "insert", RuleNumber: "first", Jump: "ACCEPT"},
+		{Action: "prepend", Jump: "ACCEPT"},
+		{Family: iptables.IPv6, SourceAddress: "10.0.0.1", Jump: "ACCEPT"},
+	}
+	for _, r := range rules {
+		if _, err := RuleToCommands(r); err == nil {
+			t.Errorf("expected error for %+v", r)
+		}
+	}
+}
+
+func TestRuleSetToCommands(t *testing.T) {
+	var ruleSet iptables.RuleSet
+	ruleSet.Family = iptables.IPv4
+	ruleSet.Sets = []iptables.Set{{Name: "blocklist", Type: iptables.SetHashNet, Entries: []string{"10.1.0.0/16"}}}
+	ruleSet.Rules = []iptables.Rule{{MatchSet: &iptables.MatchSet{Name: "blocklist", Flags: "src"}, Jump: "DROP"}}
+
+	commands, err := RuleSetToCommands(ruleSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ipset -exist create blocklist hash:net family inet",
+		"ipset -exist add blocklist 10.1.0.0/16",
+		"iptables -t filter -A INPUT -m set --match-set blocklist src -j DROP",
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("wanted: %q, but got: %q", expected, commands)
+	}
+}
+
+func TestRuleSetToRestore(t *testing.T) {
+	var ruleSet iptables.RuleSet
+	ruleSet.Rules = []iptables.Rule{
+		{Table: "nat", Chain: "POSTROUTING", OutInterface: "eth0", Jump: "MASQUERADE"},
+		{Chain: "web-in", Protocol: "tcp", DestinationPort: "80", Jump: "ACCEPT", Comment: `say "hi"`},
+		{Protocol: "tcp", Jump: "web-in"},
+		{SourceAddress: "fd00::/8", Jump: "DROP"},
+	}
+
+	out, err := RuleSetToRestore(ruleSet, iptables.IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `*filter
+:web-in - [0:0]
+-A web-in -p tcp --dport 80 -j ACCEPT -m comment --comment "\"say \"hi\"\""
+-A INPUT -p tcp -j web-in
+COMMIT
+*nat
+-A POSTROUTING -o eth0 -j MASQUERADE
+COMMIT
+`
+	if string(out) != expected {
+		t.Errorf("wanted:\n%v\nbut got:\n%v", expected, string(out))
+	}
+
+	if _, err := RuleSetToRestore(ruleSet, iptables.DualStack); err == nil {
+		t.Error("expected error for dual stack family")
+	}
+}
+
+// randomRule generates a valid rule of the family in the canonical form produced by the
+// converter, except the list of matches.
+func randomRule(rnd *rand.Rand, family iptables.Family) iptables.Rule {
+	pick := func(choices ...string) string { return choices[rnd.Intn(len(choices))] }
+	maybe := func() bool { return rnd.Intn(2) == 0 }
+	addr := func() string {
+		if family == iptables.IPv6 {
+			return pick("fd00::1", "fd00::/8", "!2001:db8::/32")
+		}
+		return pick("10.0.0.1", "10.0.0.0/8", "!192.168.0.0/16")
+	}
+
+	r := iptables.Rule{Table: "filter", Chain: pick("INPUT", "FORWARD", "web-in"), Action: "append", Family: family}
+	switch rnd.Intn(5) {
+	case 0:
+		r.Jump = pick("ACCEPT", "DROP", "web-out")
+	case 1:
+		r.Jump = "LOG"
+		r.LogPrefix = pick("dropped: ", `say "hi" `, "it's")
+		r.LogLevel = pick("", "info", "warning")
+	case 2:
+		r.Table, r.Chain, r.Jump = "nat", "POSTROUTING", "MASQUERADE"
+		r.Random = maybe()
+	case 3:
+		r.Table, r.Chain, r.Jump = "mangle", pick("PREROUTING", "OUTPUT"), "MARK"
+		r.SetMark = pick("0x1", "0x2/0xff")
+	case 4:
+		r.Table, r.Chain, r.Jump = "raw", pick("PREROUTING", "OUTPUT"), "CT"
+		r.CTNoTrack = true
+	}
+	if maybe() {
+		r.Action, r.RuleNumber = "insert", pick("1", "3")
+	}
+
+	if maybe() {
+		r.Protocol = pick("tcp", "udp")
+		if maybe() {
+			r.DestinationPort = pick("22", "8000:8080")
+		}
+		if maybe() {
+			r.Multiport = &iptables.Multiport{SourcePorts: "1024:65535"}
+		}
+	}
+	if maybe() {
+		r.SourceAddress = addr()
+	}
+	if maybe() {
+		r.DestinationAddress = addr()
+	}
+	if r.Table != "nat" && r.Chain != "OUTPUT" && maybe() {
+		r.InInterface = pick("eth0", "!lo", "veth+")
+	}
+	if maybe() {
+		r.Ctstate = []string{"RELATED", "ESTABLISHED"}
+	}
+	if maybe() {
+		r.Limit = &iptables.Limit{Rate: "10/minute", Burst: pick("", "20")}
+	}
+	if maybe() {
+		r.Mark = pick("0x1", "!0x2/0xff")
+	}
+	if maybe() {
+		r.Comment = pick("allow ssh", `it's "quoted"`, "a\\b", "$HOME")
+	}
+	return r
+}
+
+// parseCommand parses an iptables command, the same way as IPTableToJSON.
+func parseCommand(command string) (iptables.Rule, error) {
+	args, err := shellwords.Parse(command)
+	if err != nil {
+		return iptables.Rule{}, err
+	}
+	tf, err := parseArgs(args)
+	if err != nil {
+		return iptables.Rule{}, err
+	}
+	family := iptables.IPv4
+	if args[0] == "ip6tables" {
+		family = iptables.IPv6
+	}
+	return ruleFromFlags(tf, family), nil
+}
+
+func TestRuleToCommandsRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		r := randomRule(rnd, []iptables.Family{iptables.IPv4, iptables.IPv6}[i%2])
+		commands, err := RuleToCommands(r)
+		if err != nil {
+			t.Fatalf("%+v: %v", r, err)
+		}
+		if len(commands) != 1 {
+			t.Fatalf("expected a single command for %+v, got %q", r, commands)
+		}
+		parsed, err := parseCommand(commands[0])
+		if err != nil {
+			t.Fatalf("%v: %v", commands[0], err)
+		}
+		parsed.Match = nil
+		if !reflect.DeepEqual(parsed, r) {
+			t.Errorf("%v\nwanted: %+v\nbut got: %+v", commands[0], r, parsed)
+		}
+	}
+}
+
+func TestRuleSetToRestoreRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, family := range []iptables.Family{iptables.IPv4, iptables.IPv6} {
+		for i := 0; i < 50; i++ {
+			var ruleSet iptables.RuleSet
+			for j := rnd.Intn(10); j >= 0; j-- {
+				r := randomRule(rnd, family)
+				// iptables-save output only contains appended rules
+				r.Action, r.RuleNumber = "append", ""
+				ruleSet.Rules = append(ruleSet.Rules, r)
+			}
+
+			out, err := RuleSetToRestore(ruleSet, family)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := IPTablesSaveToRuleSet(bytes.NewReader(out), "", family)
+			if err != nil {
+				t.Fatalf("%v\n%v", string(out), err)
+			}
+
+			// rules are grouped by table
+			var expected []iptables.Rule
+			for _, table := range []string{"filter", "mangle", "nat", "raw"} {
+				for _, r := range ruleSet.Rules {
+					if r.Table == table {
+						expected = append(expected, r)
+					}
+				}
+			}
+			for j := range parsed.Rules {
+				parsed.Rules[j].Match = nil
+			}
+			if !reflect.DeepEqual(parsed.Rules, expected) {
+				t.Errorf("%v\nwanted: %+v\nbut got: %+v", strings.TrimSpace(string(out)), expected, parsed.Rules)
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package converter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-shellwords"
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// LineError describes a line of iptables-save output which can't be converted.
+type LineError struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+	Err  string `json:"error"`
+}
+
+// SaveErrors contains errors of all the lines which can't be converted.
+type SaveErrors []LineError
+
+func (errs SaveErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = fmt.Sprintf("line %v: %v", e.Line, e.Err)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// counters printed by iptables-save -c, i.e [10:840]
+var countersRegexp = regexp.MustCompile(`^\[(\d+):(\d+)\]\s*`)
+
+// CountedRule is a rule of iptables-save -c output along with its packet and byte counters.
+type CountedRule struct {
+	Rule    iptables.Rule
+	Packets uint64
+	Bytes   uint64
+}
+
+// IPTablesSaveToRuleSet converts output of iptables-save (or ip6tables-save) into a RuleSet with
+// given id and family. Rules are validated, and if any rule can't be converted or is invalid,
+// SaveErrors describing each such line is returned.
+//
+// Only rules are converted. Chain policies and declarations of user defined chains are not a part
+// of a RuleSet, so user defined chains referenced by the rules must exist when they are inserted.
+func IPTablesSaveToRuleSet(reader io.Reader, id string, family iptables.Family) (iptables.RuleSet, error) {
+	var ruleSet iptables.RuleSet
+	ruleSet.Metadata.ID = id
+	ruleSet.Family = family
+	ruleSet.Rules = []iptables.Rule{}
+
+	var errs SaveErrors
+	table := ""
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		fail := func(format string, a ...interface{}) {
+			errs = append(errs, LineError{Line: n, Text: line, Err: fmt.Sprintf(format, a...)})
+		}
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "*"):
+			table = strings.TrimPrefix(line, "*")
+		case line == "COMMIT":
+			table = ""
+		case strings.HasPrefix(line, ":"):
+			if table == "" {
+				fail("chain declared outside of a table")
+			}
+		default:
+			if table == "" {
+				fail("rule outside of a table")
+				continue
+			}
+			r, err := parseSaveRule(countersRegexp.ReplaceAllString(line, ""), family)
+			if err != nil {
+				fail("%v", err)
+				continue
+			}
+			r.Table = table
+			if err := r.Validate(); err != nil {
+				fail("%v", err)
+				continue
+			}
+			ruleSet.Rules = append(ruleSet.Rules, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return iptables.RuleSet{}, err
+	}
+	if table != "" {
+		errs = append(errs, LineError{Err: fmt.Sprintf("table %v is not committed", table)})
+	}
+	if len(errs) > 0 {
+		return iptables.RuleSet{}, errs
+	}
+	return ruleSet, nil
+}
+
+// IPTablesSaveCounters converts rules of iptables-save -c (or ip6tables-save -c) output along
+// with their counters. Unlike IPTablesSaveToRuleSet, rules are not validated and lines which can't
+// be converted are skipped, so output of a host with rules of other tools can be read.
+func IPTablesSaveCounters(reader io.Reader, family iptables.Family) ([]CountedRule, error) {
+	var rules []CountedRule
+	table := ""
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "*"):
+			table = strings.TrimPrefix(line, "*")
+		case line == "COMMIT":
+			table = ""
+		default:
+			m := countersRegexp.FindStringSubmatch(line)
+			if table == "" || m == nil {
+				continue
+			}
+			r, err := parseSaveRule(line[len(m[0]):], family)
+			if err != nil {
+				continue
+			}
+			r.Table = table
+			packets, _ := strconv.ParseUint(m[1], 10, 64)
+			bytes, _ := strconv.ParseUint(m[2], 10, 64)
+			rules = append(rules, CountedRule{Rule: r, Packets: packets, Bytes: bytes})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Listing is the whole output of iptables-save, converted for inspecting rules of a host.
+type Listing struct {
+	Rules []iptables.Rule
+	// Policies of built-in chains by table and chain, i.e "filter/INPUT": "DROP"
+	Policies map[string]string
+	// Skipped describes rules which can't be converted.
+	Skipped SaveErrors
+}
+
+// IPTablesSaveToListing converts output of iptables-save (or ip6tables-save) into a Listing.
+// Unlike IPTablesSaveToRuleSet, rules are not validated and rules which can't be converted are
+// only reported as skipped, so output of a host with rules of other tools can be read.
+func IPTablesSaveToListing(reader io.Reader, family iptables.Family) (Listing, error) {
+	listing := Listing{Policies: make(map[string]string)}
+	table := ""
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "*"):
+			table = strings.TrimPrefix(line, "*")
+		case line == "COMMIT":
+			table = ""
+		case strings.HasPrefix(line, ":"):
+			// i.e :INPUT DROP [0:0], policy of user defined chains is "-"
+			fields := strings.Fields(strings.TrimPrefix(line, ":"))
+			if table != "" && len(fields) > 1 && fields[1] != "-" {
+				listing.Policies[table+"/"+fields[0]] = fields[1]
+			}
+		default:
+			if table == "" {
+				continue
+			}
+			r, err := parseSaveRule(countersRegexp.ReplaceAllString(line, ""), family)
+			if err != nil {
+				listing.Skipped = append(listing.Skipped, LineError{Line: n, Text: line, Err: err.Error()})
+				continue
+			}
+			r.Table = table
+			listing.Rules = append(listing.Rules, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Listing{}, err
+	}
+	return listing, nil
+}
+
+// parseSaveRule parses a rule line of iptables-save, i.e -A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
+func parseSaveRule(line string, family iptables.Family) (iptables.Rule, error) {
+	args, err := shellwords.Parse(line)
+	if err != nil {
+		return iptables.Rule{}, err
+	}
+	if len(args) == 0 || (args[0] != "-A" && args[0] != "--append") {
+		return iptables.Rule{}, fmt.Errorf("expected -A CHAIN")
+	}
+
+	// first argument is the name of the command
+	tf, err := parseArgs(append([]string{"iptables"}, args...))
+	if err != nil {
+		return iptables.Rule{}, err
+	}
+	return ruleFromFlags(tf, family), nil
+}
@@ -0,0 +1,127 @@
+package converter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+var save = `# Generated by iptables-save v1.8.7
+*filter
+:INPUT DROP [0:0]
+:web-in - [0:0]
+[12:720] -A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A INPUT -s 10.0.0.0/8 -p tcp -m tcp --dport 22 -m comment --comment "ssh from lan" -j ACCEPT
+-A INPUT ! -i lo -p tcp -m multiport --dports 80,443 -j web-in
+-A web-in -p tcp -j REJECT --reject-with tcp-reset
+COMMIT
+*mangle
+:PREROUTING ACCEPT [0:0]
+-A PREROUTING -j MARK --set-xmark 0x1/0xffffffff
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+-A PREROUTING -d 192.168.1.1/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 10.0.0.2:8080
+COMMIT
+`
+
+func TestIPTablesSaveToRuleSet(t *testing.T) {
+	ruleSet, err := IPTablesSaveToRuleSet(strings.NewReader(save), "host", iptables.IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ruleSet.Metadata.ID != "host" || ruleSet.Family != iptables.IPv4 {
+		t.Errorf("Unexpected metadata %v and family %v", ruleSet.Metadata.ID, ruleSet.Family)
+	}
+
+	expected := []iptables.Rule{
+		{Table: "filter", Chain: "INPUT", Match: []string{"conntrack"}, Ctstate: []string{"RELATED", "ESTABLISHED"}, Jump: "ACCEPT"},
+		{Table: "filter", Chain: "INPUT", SourceAddress: "10.0.0.0/8", Protocol: "tcp", Match: []string{"tcp", "comment"}, DestinationPort: "22", Comment: "ssh from lan", Jump: "ACCEPT"},
+		{Table: "filter", Chain: "INPUT", InInterface: "!lo", Protocol: "tcp", Match: []string{"multiport"}, Multiport: &iptables.Multiport{DestinationPorts: "80,443"}, Jump: "web-in"},
+		{Table: "filter", Chain: "web-in", Protocol: "tcp", Jump: "REJECT", RejectWith: "tcp-reset"},
+		{Table: "mangle", Chain: "PREROUTING", Jump: "MARK", SetMark: "0x1/0xffffffff"},
+		{Table: "nat", Chain: "PREROUTING", DestinationAddress: "192.168.1.1/32", Protocol: "tcp", Match: []string{"tcp"}, DestinationPort: "80", Jump: "DNAT", ToDestination: "10.0.0.2:8080"},
+	}
+	if len(ruleSet.Rules) != len(expected) {
+		t.Fatalf("Expected %v rules, got %v", len(expected), len(ruleSet.Rules))
+	}
+	for i, r := range ruleSet.Rules {
+		expected[i].Family = iptables.IPv4
+		expected[i].Action = "append"
+		if !reflect.DeepEqual(r, expected[i]) {
+			t.Errorf("Rule %v: expected %#v, got %#v", i, expected[i], r)
+		}
+	}
+}
+
+func TestIPTablesSaveToRuleSetErrors(t *testing.T) {
+	input := `*filter
+-A INPUT -m physdev --physdev-in eth0 -j ACCEPT
+-A INPUT -p udp --dport 99999 -j ACCEPT
+-A INPUT -j ACCEPT
+COMMIT
+-A INPUT -j DROP
+*nat
+-A POSTROUTING -j MARK --set-xmark 0x3/0x1
+`
+	_, err := IPTablesSaveToRuleSet(strings.NewReader(input), "host", iptables.IPv4)
+	errs, ok := err.(SaveErrors)
+	if !ok {
+		t.Fatalf("Expected SaveErrors, got %v", err)
+	}
+	var lines []int
+	for _, e := range errs {
+		lines = append(lines, e.Line)
+	}
+	// last error is the uncommitted nat table, which has no line
+	if expected := []int{2, 3, 6, 8, 0}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected errors of lines %v, got %v: %v", expected, lines, errs)
+	}
+}
+
+func TestIPTablesSaveCounters(t *testing.T) {
+	input := `*filter
+:INPUT ACCEPT [100:6000]
+[12:720] -A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
+[0:0] -A INPUT -m unknown --whatever -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 23 -j DROP
+COMMIT
+[5:300] -A INPUT -j ACCEPT
+`
+	rules, err := IPTablesSaveCounters(strings.NewReader(input), iptables.IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("Expected 1 rule, got %+v", rules)
+	}
+	expected := iptables.Rule{Table: "filter", Chain: "INPUT", Action: "append", Protocol: "tcp", Match: []string{"tcp"}, DestinationPort: "22", Jump: "ACCEPT", Family: iptables.IPv4}
+	if !reflect.DeepEqual(rules[0].Rule, expected) || rules[0].Packets != 12 || rules[0].Bytes != 720 {
+		t.Errorf("Unexpected rule %+v", rules[0])
+	}
+}
+
+func TestIPTablesSaveToListing(t *testing.T) {
+	input := `*filter
+:INPUT DROP [0:0]
+:web-in - [0:0]
+-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
+-A INPUT -m unknown --whatever -j ACCEPT
+COMMIT
+`
+	listing, err := IPTablesSaveToListing(strings.NewReader(input), iptables.IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listing.Policies, map[string]string{"filter/INPUT": "DROP"}) {
+		t.Errorf("Unexpected policies %v", listing.Policies)
+	}
+	if len(listing.Rules) != 1 || listing.Rules[0].DestinationPort != "22" {
+		t.Errorf("Unexpected rules %+v", listing.Rules)
+	}
+	if len(listing.Skipped) != 1 || listing.Skipped[0].Line != 5 {
+		t.Errorf("Unexpected skipped lines %+v", listing.Skipped)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
@@ -47,6 +48,148 @@ func (fs *FlagSet) AddStringFlag(p *string, name string, value string, numArgs i
 	fs.AddFlag(newStringValue(value, p), name, numArgs)
 }
 
+// listValue represents a flag which can be repeated. Values are joined by ','.
+// i.e -m conntrack -m comment is parsed as "conntrack,comment"
+type listValue string
+
+func (l *listValue) Set(val string) error {
+	if *l != "" {
+		val = string(*l) + "," + val
+	}
+	*l = listValue(val)
+	return nil
+}
+
+func (l *listValue) String() string {
+	return string(*l)
+}
+
+// AddListFlag adds a flag which can be repeated to a FlagSet.
+func (fs *FlagSet) AddListFlag(p *string, name string, numArgs int) {
+	fs.AddFlag((*listValue)(p), name, numArgs)
+}
+
+// constValue represents a flag without arguments, which stores a constant value when it's present.
+// i.e --rsource sets "source"
+type constValue struct {
+	p     *string
+	value string
+}
+
+func (c constValue) Set(string) error {
+	*c.p = c.value
+	return nil
+}
+
+func (c constValue) String() string {
+	return *c.p
+}
+
+// AddConstFlag adds a flag without arguments, which sets value to p, to a FlagSet.
+func (fs *FlagSet) AddConstFlag(p *string, name string, value string) {
+	fs.AddFlag(constValue{p, value}, name, 0)
+}
+
+// boolValue represents a flag without arguments. i.e --socket-exists
+type boolValue bool
+
+func (b *boolValue) Set(string) error {
+	*b = true
+	return nil
+}
+
+func (b *boolValue) String() string {
+	return fmt.Sprint(bool(*b))
+}
+
+// AddBoolFlag adds a flag without arguments to a FlagSet.
+func (fs *FlagSet) AddBoolFlag(p *bool, name string) {
+	fs.AddFlag((*boolValue)(p), name, 0)
+}
+
+// markValue represents --mark flag, which is provided by both mark and connmark modules.
+// Value is stored according to the last module loaded by -m.
+type markValue struct {
+	tf *IPTableflagSet
+}
+
+func (m markValue) Set(val string) error {
+	modules := strings.Split(m.tf.MatchFlag, ",")
+	if modules[len(modules)-1] == "connmark" {
+		m.tf.ConnMarkFlag = val
+	} else {
+		m.tf.MarkFlag = val
+	}
+	return nil
+}
+
+func (m markValue) String() string {
+	return m.tf.MarkFlag
+}
+
+// chainValue represents -A and -I flags, which set the chain and the action of the rule.
+type chainValue struct {
+	tf     *IPTableflagSet
+	action string
+}
+
+func (c chainValue) Set(val string) error {
+	if c.tf.ChainFlag != "" {
+		return fmt.Errorf("chain is already set to %v", c.tf.ChainFlag)
+	}
+	c.tf.ChainFlag = val
+	c.tf.ActionFlag = c.action
+	return nil
+}
+
+func (c chainValue) String() string {
+	return c.tf.ChainFlag
+}
+
+// xmarkValue represents --set-xmark flag of MARK and CONNMARK targets, as printed by iptables-save.
+// value/mask, which only sets bits of the mask, is the same as --set-mark value/mask.
+type xmarkValue struct {
+	p *string
+}
+
+func (x xmarkValue) Set(val string) error {
+	parts := strings.SplitN(val, "/", 2)
+	value, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return err
+	}
+	mask := uint64(0xffffffff)
+	if len(parts) == 2 {
+		if mask, err = strconv.ParseUint(parts[1], 0, 32); err != nil {
+			return err
+		}
+	}
+	if value&^mask != 0 {
+		return fmt.Errorf("marks toggling bits outside of the mask are not supported")
+	}
+	*x.p = val
+	return nil
+}
+
+func (x xmarkValue) String() string {
+	return *x.p
+}
+
+// fullMaskValue represents --nfmask and --ctmask flags of CONNMARK target. Only the default
+// mask, which copies whole mark, is supported.
+type fullMaskValue struct{}
+
+func (fullMaskValue) Set(val string) error {
+	if mask, err := strconv.ParseUint(val, 0, 32); err != nil || mask != 0xffffffff {
+		return fmt.Errorf("only mask 0xffffffff is supported")
+	}
+	return nil
+}
+
+func (fullMaskValue) String() string {
+	return "0xffffffff"
+}
+
 // TCPFlags is a struct describes --tcp-flags iptable commandline flag.
 type TCPFlags iptables.TcpFlags
 
@@ -121,6 +264,8 @@ type FlagSet struct {
 	actual        map[string]*Flag
 	parsed        bool
 	errorHandling errorHandling
+	// negate is set, when "!" precedes the next flag
+	negate bool
 }
 
 // NewFlagSet returns a new, empty flag set with the specified name and error handling property.
@@ -188,6 +333,16 @@ func (fs *FlagSet) parseOne() (bool, error) {
 	}
 	s := fs.args[0]
 
+	// "!" inverts the sense of the following flag, its value is prefixed with "!". i.e ! -s 10.0.0.1
+	if s == "!" {
+		if fs.negate {
+			return false, fmt.Errorf("multiple \"!\" flags not allowed")
+		}
+		fs.negate = true
+		fs.args = fs.args[1:]
+		return true, nil
+	}
+
 	if len(s) < 2 || s[0] != '-' {
 		return false, fmt.Errorf("%v is not a flag, flag must starts with '-' or '--' and length must be greater than one",s)
 	}
@@ -231,6 +386,13 @@ func (fs *FlagSet) parseOne() (bool, error) {
 	if !hasArgs {
 		return false, argumentError{name, numArg}
 	}
+	if fs.negate {
+		if numArg == 0 {
+			return false, fmt.Errorf("flag %s can't be inverted", name)
+		}
+		fs.negate = false
+		actualValue = "!" + actualValue
+	}
 	if err := flag.value.Set(actualValue); err != nil {
 		return false, valueError{name, actualValue, err}
 	}
@@ -249,6 +411,10 @@ func (fs *FlagSet) Parse(arguments []string) error {
 type IPTableflagSet struct {
 	TableFlag        string
 	ChainFlag        string
+	ActionFlag       string
+	// RuleNumFlag is the rule number of -I CHAIN [rulenum]. It's set by the caller, as flags take
+	// fixed number of arguments.
+	RuleNumFlag      string
 	ProtocolFlag     string
 	SourceFlag       string
 	DestinationFlag  string
@@ -261,18 +427,83 @@ type IPTableflagSet struct {
 	JumpFlag         string
 	MatchFlag        string
 	ToPortFlag       string
+	ToSourceFlag     string
+	ToDestFlag       string
 	CTStateFlag      string
 	Comment          string
 	LogPrefixFlag    string
 
 	TCPFlag TCPFlags
+
+	// multiport module
+	SportsFlag string
+	DportsFlag string
+	PortsFlag  string
+
+	// limit module
+	LimitFlag      string
+	LimitBurstFlag string
+
+	// hashlimit module
+	HashLimitUptoFlag    string
+	HashLimitAboveFlag   string
+	HashLimitBurstFlag   string
+	HashLimitModeFlag    string
+	HashLimitSrcMaskFlag string
+	HashLimitDstMaskFlag string
+	HashLimitExpireFlag  string
+	HashLimitNameFlag    string
+
+	// recent module
+	RecentNameFlag   string
+	RecentActionFlag string
+	RecentSideFlag   string
+	SecondsFlag      string
+	HitCountFlag     string
+
+	MacSourceFlag string
+
+	// owner module
+	UIDOwnerFlag     string
+	GIDOwnerFlag     string
+	SocketExistsFlag bool
+
+	MarkFlag     string
+	ConnMarkFlag string
+
+	// set module, name and flags are delimited by '#'
+	MatchSetFlag string
+
+	ICMPTypeFlag string
+
+	// addrtype module
+	SrcTypeFlag       string
+	DstTypeFlag       string
+	LimitIfaceInFlag  bool
+	LimitIfaceOutFlag bool
+
+	// target options
+	LogLevelFlag    string
+	NFLogGroupFlag  string
+	RejectWithFlag  string
+	SetMarkFlag     string
+	SaveMarkFlag    bool
+	RestoreMarkFlag bool
+	OnPortFlag      string
+	OnIPFlag        string
+	NoTrackFlag     bool
+	ZoneFlag        string
+	HelperFlag      string
+	RandomFlag      bool
 }
 
 // InitFlagSet Adds user defined Flag into FlagSet.
 func (fs *FlagSet) InitFlagSet(tf *IPTableflagSet) {
 	fs.AddStringFlag(&tf.TableFlag, "t", "", 1)
-	fs.AddStringFlag(&tf.ChainFlag, "A", "", 1)
-	fs.AddStringFlag(&tf.ChainFlag, "I", "", 1)
+	fs.AddFlag(chainValue{tf, "append"}, "A", 1)
+	fs.AddFlag(chainValue{tf, "append"}, "append", 1)
+	fs.AddFlag(chainValue{tf, "insert"}, "I", 1)
+	fs.AddFlag(chainValue{tf, "insert"}, "insert", 1)
 	fs.AddStringFlag(&tf.ProtocolFlag, "p", "", 1)
 	fs.AddStringFlag(&tf.SourceFlag, "s", "", 1)
 	fs.AddStringFlag(&tf.SourceFlag, "source", "", 1)
@@ -289,10 +520,79 @@ func (fs *FlagSet) InitFlagSet(tf *IPTableflagSet) {
 	fs.AddStringFlag(&tf.DesRangeFlag, "dst-range", "", 1)
 	fs.AddStringFlag(&tf.SrcRangeFlag, "src-range", "", 1)
 	fs.AddStringFlag(&tf.JumpFlag, "j", "", 1)
-	fs.AddStringFlag(&tf.MatchFlag, "m", "", 1)
+	fs.AddListFlag(&tf.MatchFlag, "m", 1)
+	fs.AddListFlag(&tf.MatchFlag, "match", 1)
 	fs.AddStringFlag(&tf.ToPortFlag, "to-ports", "", 1)
+	fs.AddStringFlag(&tf.ToSourceFlag, "to-source", "", 1)
+	fs.AddStringFlag(&tf.ToDestFlag, "to-destination", "", 1)
 	fs.AddStringFlag(&tf.CTStateFlag, "ctstate", "", 1)
+	fs.AddStringFlag(&tf.CTStateFlag, "state", "", 1)
 	fs.AddStringFlag(&tf.Comment, "comment", "", 1)
 	fs.AddStringFlag(&tf.LogPrefixFlag, "log-prefix", "", 1)
 	fs.AddFlag(&tf.TCPFlag, "tcp-flags", 2)
+
+	fs.AddStringFlag(&tf.SportsFlag, "sports", "", 1)
+	fs.AddStringFlag(&tf.SportsFlag, "source-ports", "", 1)
+	fs.AddStringFlag(&tf.DportsFlag, "dports", "", 1)
+	fs.AddStringFlag(&tf.DportsFlag, "destination-ports", "", 1)
+	fs.AddStringFlag(&tf.PortsFlag, "ports", "", 1)
+
+	fs.AddStringFlag(&tf.LimitFlag, "limit", "", 1)
+	fs.AddStringFlag(&tf.LimitBurstFlag, "limit-burst", "", 1)
+
+	fs.AddStringFlag(&tf.HashLimitUptoFlag, "hashlimit-upto", "", 1)
+	fs.AddStringFlag(&tf.HashLimitUptoFlag, "hashlimit", "", 1)
+	fs.AddStringFlag(&tf.HashLimitAboveFlag, "hashlimit-above", "", 1)
+	fs.AddStringFlag(&tf.HashLimitBurstFlag, "hashlimit-burst", "", 1)
+	fs.AddStringFlag(&tf.HashLimitModeFlag, "hashlimit-mode", "", 1)
+	fs.AddStringFlag(&tf.HashLimitSrcMaskFlag, "hashlimit-srcmask", "", 1)
+	fs.AddStringFlag(&tf.HashLimitDstMaskFlag, "hashlimit-dstmask", "", 1)
+	fs.AddStringFlag(&tf.HashLimitExpireFlag, "hashlimit-htable-expire", "", 1)
+	fs.AddStringFlag(&tf.HashLimitNameFlag, "hashlimit-name", "", 1)
+
+	fs.AddStringFlag(&tf.RecentNameFlag, "name", "", 1)
+	fs.AddConstFlag(&tf.RecentActionFlag, "set", "set")
+	fs.AddConstFlag(&tf.RecentActionFlag, "rcheck", "rcheck")
+	fs.AddConstFlag(&tf.RecentActionFlag, "update", "update")
+	fs.AddConstFlag(&tf.RecentActionFlag, "remove", "remove")
+	fs.AddConstFlag(&tf.RecentSideFlag, "rsource", "source")
+	fs.AddConstFlag(&tf.RecentSideFlag, "rdest", "destination")
+	fs.AddStringFlag(&tf.SecondsFlag, "seconds", "", 1)
+	fs.AddStringFlag(&tf.HitCountFlag, "hitcount", "", 1)
+
+	fs.AddStringFlag(&tf.MacSourceFlag, "mac-source", "", 1)
+
+	fs.AddStringFlag(&tf.UIDOwnerFlag, "uid-owner", "", 1)
+	fs.AddStringFlag(&tf.GIDOwnerFlag, "gid-owner", "", 1)
+	fs.AddBoolFlag(&tf.SocketExistsFlag, "socket-exists")
+
+	fs.AddFlag(markValue{tf}, "mark", 1)
+
+	fs.AddStringFlag(&tf.MatchSetFlag, "match-set", "", 2)
+
+	fs.AddStringFlag(&tf.ICMPTypeFlag, "icmp-type", "", 1)
+	fs.AddStringFlag(&tf.ICMPTypeFlag, "icmpv6-type", "", 1)
+
+	fs.AddStringFlag(&tf.SrcTypeFlag, "src-type", "", 1)
+	fs.AddStringFlag(&tf.DstTypeFlag, "dst-type", "", 1)
+	fs.AddBoolFlag(&tf.LimitIfaceInFlag, "limit-iface-in")
+	fs.AddBoolFlag(&tf.LimitIfaceOutFlag, "limit-iface-out")
+
+	fs.AddStringFlag(&tf.LogLevelFlag, "log-level", "", 1)
+	fs.AddStringFlag(&tf.NFLogGroupFlag, "nflog-group", "", 1)
+	fs.AddStringFlag(&tf.LogPrefixFlag, "nflog-prefix", "", 1)
+	fs.AddStringFlag(&tf.RejectWithFlag, "reject-with", "", 1)
+	fs.AddStringFlag(&tf.SetMarkFlag, "set-mark", "", 1)
+	fs.AddStringFlag(&tf.SetMarkFlag, "tproxy-mark", "", 1)
+	fs.AddFlag(xmarkValue{&tf.SetMarkFlag}, "set-xmark", 1)
+	fs.AddFlag(fullMaskValue{}, "nfmask", 1)
+	fs.AddFlag(fullMaskValue{}, "ctmask", 1)
+	fs.AddBoolFlag(&tf.SaveMarkFlag, "save-mark")
+	fs.AddBoolFlag(&tf.RestoreMarkFlag, "restore-mark")
+	fs.AddStringFlag(&tf.OnPortFlag, "on-port", "", 1)
+	fs.AddStringFlag(&tf.OnIPFlag, "on-ip", "", 1)
+	fs.AddBoolFlag(&tf.NoTrackFlag, "notrack")
+	fs.AddStringFlag(&tf.ZoneFlag, "zone", "", 1)
+	fs.AddStringFlag(&tf.HelperFlag, "helper", "", 1)
+	fs.AddBoolFlag(&tf.RandomFlag, "random")
 }
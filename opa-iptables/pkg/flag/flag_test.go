@@ -17,6 +17,7 @@ func TestParse(t *testing.T) {
 			IPTableflagSet{
 				TableFlag:    "filter",
 				ChainFlag:    "INPUT",
+				ActionFlag:   "append",
 				ProtocolFlag: "tcp",
 				DportFlag:    "8080",
 				SportFlag:    "9090",
@@ -34,6 +35,66 @@ func TestParse(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			"iptables -A INPUT -p tcp -m multiport --dports 80,443 -m connmark --mark 0x1 -m mark --mark 0x2/0xff -m recent --name ssh --rsource --update --seconds 60 -m set --match-set blocklist src,dst -m owner --uid-owner 1000 --socket-exists -j DROP",
+			IPTableflagSet{
+				ChainFlag:        "INPUT",
+				ActionFlag:       "append",
+				ProtocolFlag:     "tcp",
+				JumpFlag:         "DROP",
+				MatchFlag:        "multiport,connmark,mark,recent,set,owner",
+				DportsFlag:       "80,443",
+				ConnMarkFlag:     "0x1",
+				MarkFlag:         "0x2/0xff",
+				RecentNameFlag:   "ssh",
+				RecentSideFlag:   "source",
+				RecentActionFlag: "update",
+				SecondsFlag:      "60",
+				MatchSetFlag:     "blocklist#src,dst",
+				UIDOwnerFlag:     "1000",
+				SocketExistsFlag: true,
+			},
+			nil,
+		},
+		{
+			"iptables -t mangle -A PREROUTING -p tcp -j TPROXY --on-port 15001 --on-ip 127.0.0.1 --tproxy-mark 0x1/0x1",
+			IPTableflagSet{
+				TableFlag:    "mangle",
+				ChainFlag:    "PREROUTING",
+				ActionFlag:   "append",
+				ProtocolFlag: "tcp",
+				JumpFlag:     "TPROXY",
+				OnPortFlag:   "15001",
+				OnIPFlag:     "127.0.0.1",
+				SetMarkFlag:  "0x1/0x1",
+			},
+			nil,
+		},
+		{
+			"iptables -t nat -A POSTROUTING -j MASQUERADE --random",
+			IPTableflagSet{
+				TableFlag:  "nat",
+				ChainFlag:  "POSTROUTING",
+				ActionFlag: "append",
+				JumpFlag:   "MASQUERADE",
+				RandomFlag: true,
+			},
+			nil,
+		},
+		{
+			"iptables -A INPUT ! -s 10.0.0.0/8 -p tcp -m state ! --state NEW -j MARK --set-xmark 0x1/0xff",
+			IPTableflagSet{
+				ChainFlag:    "INPUT",
+				ActionFlag:   "append",
+				SourceFlag:   "!10.0.0.0/8",
+				ProtocolFlag: "tcp",
+				MatchFlag:    "state",
+				CTStateFlag:  "!NEW",
+				JumpFlag:     "MARK",
+				SetMarkFlag:  "0x1/0xff",
+			},
+			nil,
+		},
 		{
 			"iptables -t -A PREROUTING",
 			IPTableflagSet{},
@@ -0,0 +1,112 @@
+package iptables
+
+import (
+	"fmt"
+)
+
+const (
+	// BackendIPTables programs rules using iptables and ip6tables utilities.
+	BackendIPTables = "iptables"
+	// BackendNFTables programs rules natively using nftables netlink API.
+	BackendNFTables = "nftables"
+)
+
+// Backend programs rules into the firewall of the kernel.
+// Same Rule (and RuleSet) is used for describing rules of every backend.
+type Backend interface {
+	// Name returns name of the backend as used in controller flag.
+	Name() string
+	// AddRule inserts the rule for each address family of the rule.
+	AddRule(r Rule) error
+	// DeleteRule deletes the rule for each address family of the rule.
+	DeleteRule(r Rule) error
+	// RuleExists checks whether the rule exists for every address family of the rule.
+	RuleExists(r Rule) (bool, error)
+	// ListRules lists rules of given table and chain for each address family of the family.
+	ListRules(table, chain string, family Family) (map[Family][]string, error)
+	// NewChain creates user defined chain, or flushes it if it already exists.
+	NewChain(table, chain string, family Family) error
+	// DeleteChain flushes and deletes user defined chain.
+	DeleteChain(table, chain string, family Family) error
+	// Apply applies the transaction atomically. If any operation of the transaction is rejected,
+	// state of the kernel is rolled back and *TransactionError is returned.
+	Apply(tx *Transaction) error
+}
+
+// NewBackend returns the Backend of given name.
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case "", BackendIPTables:
+		return &iptablesBackend{}, nil
+	case BackendNFTables:
+		return newNFTablesBackend(), nil
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %q: must be one of %v | %v", name, BackendIPTables, BackendNFTables)
+	}
+}
+
+// iptablesBackend programs rules using go-iptables, which runs iptables and ip6tables utilities.
+type iptablesBackend struct{}
+
+func (b *iptablesBackend) Name() string {
+	return BackendIPTables
+}
+
+func (b *iptablesBackend) AddRule(r Rule) error {
+	r.init()
+	return r.AddRule()
+}
+
+func (b *iptablesBackend) DeleteRule(r Rule) error {
+	r.init()
+	return r.DeleteRule()
+}
+
+func (b *iptablesBackend) RuleExists(r Rule) (bool, error) {
+	r.init()
+	families, err := r.Families()
+	if err != nil {
+		return false, err
+	}
+	for _, family := range families {
+		ipt, err := newIPTables(family)
+		if err != nil {
+			return false, err
+		}
+		exists, err := ipt.Exists(r.Table, r.Chain, r.Construct()...)
+		if err != nil || !exists {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (b *iptablesBackend) ListRules(table, chain string, family Family) (map[Family][]string, error) {
+	return ListRules(table, chain, family)
+}
+
+func (b *iptablesBackend) NewChain(table, chain string, family Family) error {
+	for _, f := range family.Expand() {
+		ipt, err := newIPTables(f)
+		if err != nil {
+			return err
+		}
+		if err := ipt.ClearChain(table, chain); err != nil {
+			return fmt.Errorf("%v: %v", f, err)
+		}
+	}
+	return nil
+}
+
+func (b *iptablesBackend) DeleteChain(table, chain string, family Family) error {
+	for _, f := range family.Expand() {
+		ipt, err := newIPTables(f)
+		if err != nil {
+			return err
+		}
+		if err := ipt.ClearAndDeleteChain(table, chain); err != nil {
+			return fmt.Errorf("%v: %v", f, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	goiptables "github.com/coreos/go-iptables/iptables"
+)
+
+// Family is the address family which a rule is programmed into.
+type Family string
+
+const (
+	// IPv4 rules are programmed using iptables.
+	IPv4 Family = "ipv4"
+	// IPv6 rules are programmed using ip6tables.
+	IPv6 Family = "ipv6"
+	// DualStack rules are programmed using both iptables and ip6tables.
+	DualStack Family = "both"
+)
+
+// defaultFamily is the family of rules which neither specify a family nor use any address.
+var defaultFamily = IPv4
+
+// SetDefaultFamily sets the family of rules which neither specify a family nor use any address.
+// It's ipv4 by default, so rules are programmed into ip6tables only if they ask for it.
+func SetDefaultFamily(s string) error {
+	f, err := ParseFamily(s)
+	if err != nil {
+		return err
+	}
+	if f == "" {
+		f = IPv4
+	}
+	defaultFamily = f
+	return nil
+}
+
+// DefaultFamily returns the family of rules which neither specify a family nor use any address.
+func DefaultFamily() Family {
+	return defaultFamily
+}
+
+// ParseFamily parses the family name as it appears in a Rule, RuleSet or query parameter.
+// An empty string is returned as it is, which means family needs to be inferred.
+func ParseFamily(s string) (Family, error) {
+	switch f := Family(strings.ToLower(s)); f {
+	case "", IPv4, IPv6, DualStack:
+		return f, nil
+	case "inet":
+		return DualStack, nil
+	default:
+		return "", fmt.Errorf("invalid family %q: must be one of ipv4 | ipv6 | both", s)
+	}
+}
+
+// Expand returns the single-stack families described by f.
+// Empty family is treated as DualStack.
+func (f Family) Expand() []Family {
+	switch f {
+	case IPv4, IPv6:
+		return []Family{f}
+	default:
+		return []Family{IPv4, IPv6}
+	}
+}
+
+// Families returns the address families in which the rule needs to be programmed.
+// If rule doesn't specify a family then it is inferred from the addresses used in the rule.
+// Rule which doesn't have any address is programmed into the default family, ipv4 unless
+// it's changed by SetDefaultFamily.
+func (r *Rule) Families() ([]Family, error) {
+	family, err := ParseFamily(string(r.Family))
+	if err != nil {
+		return nil, err
+	}
+
+	inferred, err := r.inferFamily()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case family == "" && inferred == "":
+		family = defaultFamily
+	case family == "":
+		family = inferred
+	case inferred == "":
+	case family != DualStack && family != inferred:
+		return nil, fmt.Errorf("rule family %q doesn't match with %v addresses used in the rule", family, inferred)
+	case family == DualStack:
+		return nil, fmt.Errorf("rule family %q can't be used with %v only addresses", family, inferred)
+	}
+
+	return family.Expand(), nil
+}
+
+// inferFamily returns the family of addresses used in the rule.
+// Empty family is returned if rule doesn't contain any IP address.
+func (r *Rule) inferFamily() (Family, error) {
+	addrs := []string{
+		r.SourceAddress,
+		r.DestinationAddress,
+		r.SourceRange,
+		r.DestinationRange,
+		r.ToSource,
+		r.ToDestination,
+	}
+
+	var family Family
+	for _, addr := range addrs {
+		f := addressFamily(addr)
+		if f == "" {
+			continue
+		}
+		if family != "" && family != f {
+			return "", fmt.Errorf("rule mixes ipv4 and ipv6 addresses")
+		}
+		family = f
+	}
+	return family, nil
+}
+
+// addressFamily returns the family of address specification used in iptables options.
+// i.e 10.0.0.1, !10.0.0.0/8, 10.0.0.1-10.0.0.9, 10.0.0.1:80, [fd00::1]:80, fd00::/64
+// Empty string is returned if given specification is not an IP address (i.e hostname).
+func addressFamily(spec string) Family {
+	spec = strings.TrimPrefix(strings.TrimSpace(spec), "!")
+	if spec == "" {
+		return ""
+	}
+	// [fd00::1]:80 or [fd00::1]-[fd00::9]:80
+	if spec[0] == '[' {
+		return IPv6
+	}
+	// ranges i.e 10.0.0.1-10.0.0.9
+	spec = strings.SplitN(spec, "-", 2)[0]
+	// masks i.e 10.0.0.0/8
+	spec = strings.SplitN(spec, "/", 2)[0]
+
+	if ip := net.ParseIP(spec); ip != nil {
+		if ip.To4() != nil {
+			return IPv4
+		}
+		return IPv6
+	}
+	// address with port i.e 10.0.0.1:80
+	if host, _, err := net.SplitHostPort(spec); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			return IPv4
+		}
+	}
+	return ""
+}
+
+// newIPTables returns go-iptables handle of given single-stack family.
+func newIPTables(f Family) (*goiptables.IPTables, error) {
+	if f == IPv6 {
+		return goiptables.NewWithProtocol(goiptables.ProtocolIPv6)
+	}
+	return goiptables.NewWithProtocol(goiptables.ProtocolIPv4)
+}
@@ -0,0 +1,119 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddressFamily(t *testing.T) {
+	var testcases = []struct {
+		spec   string
+		family Family
+	}{
+		{"", ""},
+		{"192.168.0.1", IPv4},
+		{"!10.0.0.0/8", IPv4},
+		{"192.168.1.100-192.168.1.199", IPv4},
+		{"10.0.0.1:8080", IPv4},
+		{"fd00::1", IPv6},
+		{"!fd00::/64", IPv6},
+		{"[fd00::1]:8080", IPv6},
+		{"example.com", ""},
+	}
+	for _, tt := range testcases {
+		if f := addressFamily(tt.spec); f != tt.family {
+			t.Errorf("%q: expected %q, got %q", tt.spec, tt.family, f)
+		}
+	}
+}
+
+func TestRuleFamilies(t *testing.T) {
+	var testcases = []struct {
+		rule     Rule
+		families []Family
+		err      bool
+	}{
+		{
+			Rule{Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"},
+			[]Family{IPv4},
+			false,
+		},
+		{
+			Rule{SourceAddress: "10.0.0.0/8", Jump: "DROP"},
+			[]Family{IPv4},
+			false,
+		},
+		{
+			Rule{SourceAddress: "fd00::/8", Jump: "DROP"},
+			[]Family{IPv6},
+			false,
+		},
+		{
+			Rule{Family: IPv6, Protocol: "tcp", Jump: "DROP"},
+			[]Family{IPv6},
+			false,
+		},
+		{
+			Rule{Family: "Both", Jump: "DROP"},
+			[]Family{IPv4, IPv6},
+			false,
+		},
+		{
+			Rule{Family: IPv6, SourceAddress: "10.0.0.1", Jump: "DROP"},
+			nil,
+			true,
+		},
+		{
+			Rule{SourceAddress: "10.0.0.1", DestinationAddress: "fd00::1", Jump: "DROP"},
+			nil,
+			true,
+		},
+		{
+			Rule{Family: "ipv5", Jump: "DROP"},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range testcases {
+		families, err := tt.rule.Families()
+		if (err != nil) != tt.err {
+			t.Errorf("%v: expected error %v, got %v", tt.rule, tt.err, err)
+		}
+		if !reflect.DeepEqual(families, tt.families) {
+			t.Errorf("%v: expected %v, got %v", tt.rule, tt.families, families)
+		}
+	}
+}
+
+func TestRuleSetDefaultFamily(t *testing.T) {
+	res := []byte(`{"result":[{"metadata":{"_id":"1"},"family":"ipv6","rules":[{"jump":"DROP"},{"family":"both","jump":"ACCEPT"}]}]}`)
+	ruleSets, err := UnmarshalRuleset(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ruleSets[0].Rules[0].Family; got != IPv6 {
+		t.Errorf("Expected %q, got %q", IPv6, got)
+	}
+	if got := ruleSets[0].Rules[1].Family; got != DualStack {
+		t.Errorf("Expected %q, got %q", DualStack, got)
+	}
+}
+
+func TestSetDefaultFamily(t *testing.T) {
+	defer SetDefaultFamily(string(IPv4))
+	if err := SetDefaultFamily("both"); err != nil {
+		t.Fatal(err)
+	}
+	r := Rule{Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"}
+	if families, err := r.Families(); err != nil || !reflect.DeepEqual(families, []Family{IPv4, IPv6}) {
+		t.Errorf("Expected both families, got %v %v", families, err)
+	}
+	// addresses still decide family of the rule
+	r = Rule{SourceAddress: "10.0.0.0/8", Jump: "DROP"}
+	if families, err := r.Families(); err != nil || !reflect.DeepEqual(families, []Family{IPv4}) {
+		t.Errorf("Expected ipv4 family, got %v %v", families, err)
+	}
+	if err := SetDefaultFamily("ipv5"); err == nil {
+		t.Error("Expected error for invalid family")
+	}
+}
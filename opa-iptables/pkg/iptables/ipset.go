@@ -0,0 +1,94 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/command"
+)
+
+// Supported types of ipsets.
+const (
+	SetHashIP     = "hash:ip"
+	SetHashNet    = "hash:net"
+	SetHashIPPort = "hash:ip,port"
+)
+
+// Set is an ipset managed by the controller. Rules reference the set by its name using match_set.
+type Set struct {
+	// Name of the set, up to 27 characters.
+	Name string `json:"name"`
+	// Type of the set. Choices : hash:ip | hash:net | hash:ip,port
+	Type string `json:"type"`
+	// Family of entries of the set. Choices : ipv4 | ipv6  Default : ipv4
+	Family Family `json:"family,omitempty"`
+	// Entries of the set. i.e 10.0.0.1 for hash:ip, 10.0.0.0/8 for hash:net and
+	// 10.0.0.1,tcp:80 for hash:ip,port
+	Entries []string `json:"entries"`
+}
+
+// family returns family of the set, defaulting to IPv4.
+func (s Set) family() Family {
+	if s.Family == "" {
+		return IPv4
+	}
+	return s.Family
+}
+
+// SetManager programs ipsets into the kernel.
+type SetManager interface {
+	// SyncSet creates the set if it doesn't exist and atomically replaces its entries,
+	// so rules referencing the set never see it partially filled.
+	SyncSet(s Set) error
+	// DestroySet destroys the set. Set which doesn't exist is ignored.
+	DestroySet(name string) error
+}
+
+// NewSetManager returns SetManager which uses ipset command.
+func NewSetManager() SetManager {
+	return &ipsetManager{}
+}
+
+type ipsetManager struct{}
+
+func (m *ipsetManager) SyncSet(s Set) error {
+	_, err := command.RunCommandWithInput(s.restoreInput(), "ipset", "-exist", "restore")
+	if err != nil {
+		return fmt.Errorf("unable to sync set %v: %v", s.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetManager) DestroySet(name string) error {
+	_, err := command.RunCommand("ipset", "destroy", name)
+	if err != nil && !strings.Contains(err.Error(), "does not exist") {
+		return fmt.Errorf("unable to destroy set %v: %v", name, err)
+	}
+	return nil
+}
+
+// tmpSetName is the name of the set which is filled with new entries and swapped with the set.
+func tmpSetName(name string) string {
+	return name + "-tmp"
+}
+
+// restoreInput generates ipset restore input, which fills a temporary set and swaps it with the set.
+func (s Set) restoreInput() []byte {
+	family := "inet"
+	if s.family() == IPv6 {
+		family = "inet6"
+	}
+	tmp := tmpSetName(s.Name)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "create %v %v family %v\n", s.Name, s.Type, family)
+	fmt.Fprintf(&buf, "create %v %v family %v\n", tmp, s.Type, family)
+	fmt.Fprintf(&buf, "flush %v\n", tmp)
+	for _, entry := range s.Entries {
+		fmt.Fprintf(&buf, "add %v %v\n", tmp, entry)
+	}
+	fmt.Fprintf(&buf, "swap %v %v\n", tmp, s.Name)
+	fmt.Fprintf(&buf, "destroy %v\n", tmp)
+	return buf.Bytes()
+}
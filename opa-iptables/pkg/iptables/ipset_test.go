@@ -0,0 +1,77 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetRestoreInput(t *testing.T) {
+	s := Set{Name: "blocklist", Type: SetHashNet, Family: IPv6, Entries: []string{"fd00::/8", "2001:db8::1"}}
+	expected := "create blocklist hash:net family inet6\n" +
+		"create blocklist-tmp hash:net family inet6\n" +
+		"flush blocklist-tmp\n" +
+		"add blocklist-tmp fd00::/8\n" +
+		"add blocklist-tmp 2001:db8::1\n" +
+		"swap blocklist-tmp blocklist\n" +
+		"destroy blocklist-tmp\n"
+	if got := string(s.restoreInput()); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestValidateSets(t *testing.T) {
+	var testcases = []struct {
+		sets   []Set
+		rules  []Rule
+		fields []string
+	}{
+		{
+			[]Set{{Name: "web", Type: SetHashIPPort, Entries: []string{"10.0.0.1,tcp:80", "10.0.0.2,443"}}},
+			[]Rule{{Family: IPv4, MatchSet: &MatchSet{Name: "web", Flags: "dst,dst"}, Jump: "ACCEPT"}},
+			nil,
+		},
+		{
+			[]Set{{Name: "a very long name of the set, over limit", Type: SetHashIP}},
+			nil,
+			[]string{"sets[0].name"},
+		},
+		{
+			[]Set{{Name: "x", Type: SetHashIP}, {Name: "x", Type: SetHashNet}},
+			nil,
+			[]string{"sets[1].name"},
+		},
+		{
+			[]Set{{Name: "x", Type: "list:set", Family: DualStack}},
+			nil,
+			[]string{"sets[0].family", "sets[0].type"},
+		},
+		{
+			[]Set{{Name: "x", Type: SetHashIP, Entries: []string{"10.0.0.0/8", "fd00::1", "10.0.0.1"}}},
+			nil,
+			[]string{"sets[0].entries[0]", "sets[0].entries[1]"},
+		},
+		{
+			[]Set{{Name: "x", Type: SetHashIPPort, Entries: []string{"10.0.0.1", "10.0.0.1,icmp:8", "10.0.0.1,99999"}}},
+			nil,
+			[]string{"sets[0].entries[0]", "sets[0].entries[1]", "sets[0].entries[2]"},
+		},
+		{
+			[]Set{{Name: "x", Type: SetHashNet, Entries: []string{"10.0.0.0/8"}}},
+			[]Rule{{MatchSet: &MatchSet{Name: "!x"}, Jump: "DROP", Family: DualStack}},
+			[]string{"rules[0].match_set.name"},
+		},
+	}
+
+	for i, tt := range testcases {
+		rs := RuleSet{Rules: tt.rules, Sets: tt.sets}
+		var fields []string
+		if err := rs.Validate(); err != nil {
+			for _, e := range err.(ValidationErrors) {
+				fields = append(fields, e.Field)
+			}
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("Testcase %v: expected invalid fields %v, got %v", i, tt.fields, fields)
+		}
+	}
+}
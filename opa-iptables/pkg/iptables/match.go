@@ -0,0 +1,219 @@
+package iptables
+
+import (
+	"strings"
+)
+
+// Options of match modules. Options which accept a ! argument in iptables invert the
+// sense of the match when the value starts with "!", same as the options of Rule.
+
+// Multiport matches a set of source or destination ports using multiport module.
+// Up to 15 ports can be specified. A port range (port:port) counts as two ports.
+// It can only be used in conjunction with one of the protocol tcp, udp, udplite, dccp or sctp.
+type Multiport struct {
+	// Comma separated list of source ports. i.e 80,443,8000:8080
+	SourcePorts string `json:"source_ports,omitempty"`
+	// Comma separated list of destination ports.
+	DestinationPorts string `json:"destination_ports,omitempty"`
+	// Comma separated list of ports which match either source or destination port.
+	Ports string `json:"ports,omitempty"`
+}
+
+// Limit matches at a limited rate using a token bucket filter.
+type Limit struct {
+	// Maximum average matching rate, a number with an optional /second, /minute, /hour or /day suffix.
+	// i.e 3/hour
+	Rate string `json:"rate,omitempty"`
+	// Maximum initial number of packets to match. Default is 5.
+	Burst string `json:"burst,omitempty"`
+}
+
+// HashLimit is like Limit, but it keeps a separate token bucket for each group of packets
+// grouped by the mode. i.e per source address.
+type HashLimit struct {
+	// Name of the hash table, it's shown in /proc/net/ipt_hashlimit/<name>.
+	Name string `json:"name,omitempty"`
+	// Match if the rate is below or equal to given rate. i.e 100/second
+	Upto string `json:"upto,omitempty"`
+	// Match if the rate is above given rate.
+	Above string `json:"above,omitempty"`
+	// Maximum initial number of packets to match.
+	Burst string `json:"burst,omitempty"`
+	// Fields which are used for grouping packets. Choices : srcip | srcport | dstip | dstport
+	Mode []string `json:"mode,omitempty"`
+	// Prefix length of source address used for grouping, when srcip mode is used.
+	SourceMask string `json:"srcmask,omitempty"`
+	// Prefix length of destination address used for grouping, when dstip mode is used.
+	DestinationMask string `json:"dstmask,omitempty"`
+	// Number of milliseconds after which hash entries expire.
+	Expire string `json:"htable_expire,omitempty"`
+}
+
+// Recent dynamically creates a list of addresses and matches against it.
+type Recent struct {
+	// Name of the list. Default is DEFAULT.
+	Name string `json:"name,omitempty"`
+	// Action done on the list.
+	// Choices : set | rcheck | update | remove
+	// set adds address of the packet to the list, rcheck checks whether the address is in the list,
+	// update checks it and updates its "last seen" timestamp and remove removes it from the list.
+	Action string `json:"action,omitempty"`
+	// Address of the packet which is used. Choices : source | destination  Default : source
+	Side string `json:"side,omitempty"`
+	// Match only if the address was last seen within given number of seconds. Requires rcheck or update.
+	Seconds string `json:"seconds,omitempty"`
+	// Match only if the address has been seen at least given number of times. Requires rcheck or update.
+	HitCount string `json:"hitcount,omitempty"`
+}
+
+// Owner matches characteristics of the local process which created the packet.
+// It's only valid in the OUTPUT and POSTROUTING chains.
+type Owner struct {
+	// User name or id (or range of ids) of the owner of the socket. i.e root, 1000, 1000-2000
+	UID string `json:"uid_owner,omitempty"`
+	// Group name or id (or range of ids) of the owner of the socket.
+	GID string `json:"gid_owner,omitempty"`
+	// Match only packets which are associated with a socket.
+	SocketExists bool `json:"socket_exists,omitempty"`
+}
+
+// MatchSet matches addresses, ports or networks stored in an ipset.
+type MatchSet struct {
+	// Name of the ipset.
+	Name string `json:"name,omitempty"`
+	// Comma separated list of src and dst, describing which part of the packet is matched against
+	// each dimension of the set. i.e src,dst
+	Flags string `json:"flags,omitempty"`
+}
+
+// AddrType matches packets based on type of their addresses.
+// Types are UNSPEC, UNICAST, LOCAL, BROADCAST, ANYCAST, MULTICAST, BLACKHOLE, UNREACHABLE,
+// PROHIBIT, THROW, NAT and XRESOLVE.
+type AddrType struct {
+	// Type of source address.
+	SourceType string `json:"src_type,omitempty"`
+	// Type of destination address.
+	DestinationType string `json:"dst_type,omitempty"`
+	// Limit the match to the incoming interface of the packet.
+	LimitIfaceIn bool `json:"limit_iface_in,omitempty"`
+	// Limit the match to the outgoing interface of the packet.
+	LimitIfaceOut bool `json:"limit_iface_out,omitempty"`
+}
+
+func (rs *ruleSpec) addFlag(set bool, flag string) {
+	if set {
+		rs.spec = append(rs.spec, flag)
+	}
+}
+
+func (rs *ruleSpec) addMultiport(m *Multiport) {
+	if m == nil || (m.SourcePorts == "" && m.DestinationPorts == "" && m.Ports == "") {
+		return
+	}
+	rs.addMatch("multiport")
+	rs.addParam(m.SourcePorts, "--sports")
+	rs.addParam(m.DestinationPorts, "--dports")
+	rs.addParam(m.Ports, "--ports")
+}
+
+func (rs *ruleSpec) addLimit(l *Limit) {
+	if l == nil || (l.Rate == "" && l.Burst == "") {
+		return
+	}
+	rs.addMatch("limit")
+	rs.addParam(l.Rate, "--limit")
+	rs.addParam(l.Burst, "--limit-burst")
+}
+
+func (rs *ruleSpec) addHashLimit(h *HashLimit) {
+	if h == nil {
+		return
+	}
+	rs.addMatch("hashlimit")
+	rs.addParam(h.Upto, "--hashlimit-upto")
+	rs.addParam(h.Above, "--hashlimit-above")
+	rs.addParam(h.Burst, "--hashlimit-burst")
+	rs.addParam(strings.Join(h.Mode, ","), "--hashlimit-mode")
+	rs.addParam(h.SourceMask, "--hashlimit-srcmask")
+	rs.addParam(h.DestinationMask, "--hashlimit-dstmask")
+	rs.addParam(h.Expire, "--hashlimit-htable-expire")
+	rs.addParam(h.Name, "--hashlimit-name")
+}
+
+func (rs *ruleSpec) addRecent(r *Recent) {
+	if r == nil {
+		return
+	}
+	rs.addMatch("recent")
+	rs.addParam(r.Name, "--name")
+	switch r.Side {
+	case "source":
+		rs.spec = append(rs.spec, "--rsource")
+	case "destination":
+		rs.spec = append(rs.spec, "--rdest")
+	}
+	if r.Action != "" {
+		rs.spec = append(rs.spec, "--"+r.Action)
+	}
+	rs.addParam(r.Seconds, "--seconds")
+	rs.addParam(r.HitCount, "--hitcount")
+}
+
+func (rs *ruleSpec) addOwner(o *Owner) {
+	if o == nil || (o.UID == "" && o.GID == "" && !o.SocketExists) {
+		return
+	}
+	rs.addMatch("owner")
+	rs.addParam(o.UID, "--uid-owner")
+	rs.addParam(o.GID, "--gid-owner")
+	rs.addFlag(o.SocketExists, "--socket-exists")
+}
+
+func (rs *ruleSpec) addMatchSet(s *MatchSet) {
+	if s == nil || s.Name == "" {
+		return
+	}
+	rs.addMatch("set")
+	name, negate := splitNegation(s.Name)
+	if negate {
+		rs.spec = append(rs.spec, "!")
+	}
+	flags := s.Flags
+	if flags == "" {
+		flags = "src"
+	}
+	rs.spec = append(rs.spec, "--match-set", name, flags)
+}
+
+// addICMPType adds icmp or icmp6 module, depending on the protocol of the rule.
+func (rs *ruleSpec) addICMPType(protocol, icmpType string) {
+	if icmpType == "" {
+		return
+	}
+	if isICMPv6(protocol) {
+		rs.addMatch("icmp6")
+		rs.addParam(icmpType, "--icmpv6-type")
+		return
+	}
+	rs.addMatch("icmp")
+	rs.addParam(icmpType, "--icmp-type")
+}
+
+func (rs *ruleSpec) addAddrType(a *AddrType) {
+	if a == nil || (a.SourceType == "" && a.DestinationType == "") {
+		return
+	}
+	rs.addMatch("addrtype")
+	rs.addParam(a.SourceType, "--src-type")
+	rs.addParam(a.DestinationType, "--dst-type")
+	rs.addFlag(a.LimitIfaceIn, "--limit-iface-in")
+	rs.addFlag(a.LimitIfaceOut, "--limit-iface-out")
+}
+
+func isICMPv6(protocol string) bool {
+	switch strings.ToLower(protocol) {
+	case "icmpv6", "ipv6-icmp", "58":
+		return true
+	}
+	return false
+}
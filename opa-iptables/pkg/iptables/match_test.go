@@ -0,0 +1,107 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchConstruction(t *testing.T) {
+	var testcases = []struct {
+		rule   Rule
+		result []string
+	}{
+		{
+			Rule{Protocol: "tcp", Multiport: &Multiport{DestinationPorts: "80,443,8000:8080"}, Jump: "ACCEPT"},
+			[]string{"-p", "tcp", "-m", "multiport", "--dports", "80,443,8000:8080", "-j", "ACCEPT"},
+		},
+		{
+			Rule{Protocol: "udp", Multiport: &Multiport{SourcePorts: "!53,123"}},
+			[]string{"-p", "udp", "-m", "multiport", "!", "--sports", "53,123"},
+		},
+		{
+			Rule{Protocol: "icmp", Limit: &Limit{Rate: "1/second", Burst: "10"}, Jump: "ACCEPT"},
+			[]string{"-p", "icmp", "-m", "limit", "--limit", "1/second", "--limit-burst", "10", "-j", "ACCEPT"},
+		},
+		{
+			Rule{HashLimit: &HashLimit{Name: "http", Above: "100/second", Mode: []string{"srcip", "dstport"}, SourceMask: "24"}, Jump: "DROP"},
+			[]string{"-m", "hashlimit", "--hashlimit-above", "100/second", "--hashlimit-mode", "srcip,dstport", "--hashlimit-srcmask", "24", "--hashlimit-name", "http", "-j", "DROP"},
+		},
+		{
+			Rule{Recent: &Recent{Name: "ssh", Action: "update", Side: "source", Seconds: "60", HitCount: "4"}, Jump: "DROP"},
+			[]string{"-m", "recent", "--name", "ssh", "--rsource", "--update", "--seconds", "60", "--hitcount", "4", "-j", "DROP"},
+		},
+		{
+			Rule{MacSource: "!00:11:22:33:44:55", Jump: "DROP"},
+			[]string{"-m", "mac", "!", "--mac-source", "00:11:22:33:44:55", "-j", "DROP"},
+		},
+		{
+			Rule{Chain: "OUTPUT", Owner: &Owner{UID: "1000", SocketExists: true}, Jump: "ACCEPT"},
+			[]string{"-m", "owner", "--uid-owner", "1000", "--socket-exists", "-j", "ACCEPT"},
+		},
+		{
+			Rule{Mark: "0x1/0xff", ConnMark: "!0x2", Jump: "ACCEPT"},
+			[]string{"-m", "mark", "--mark", "0x1/0xff", "-m", "connmark", "!", "--mark", "0x2", "-j", "ACCEPT"},
+		},
+		{
+			Rule{MatchSet: &MatchSet{Name: "!blocklist", Flags: "src,dst"}, Jump: "DROP"},
+			[]string{"-m", "set", "!", "--match-set", "blocklist", "src,dst", "-j", "DROP"},
+		},
+		{
+			Rule{MatchSet: &MatchSet{Name: "blocklist"}, Jump: "DROP"},
+			[]string{"-m", "set", "--match-set", "blocklist", "src", "-j", "DROP"},
+		},
+		{
+			Rule{Protocol: "icmp", ICMPType: "echo-request", Jump: "ACCEPT"},
+			[]string{"-p", "icmp", "-m", "icmp", "--icmp-type", "echo-request", "-j", "ACCEPT"},
+		},
+		{
+			Rule{Protocol: "icmpv6", ICMPType: "neighbour-solicitation", Jump: "ACCEPT"},
+			[]string{"-p", "icmpv6", "-m", "icmp6", "--icmpv6-type", "neighbour-solicitation", "-j", "ACCEPT"},
+		},
+		{
+			Rule{AddrType: &AddrType{DestinationType: "LOCAL", LimitIfaceIn: true}, Jump: "ACCEPT"},
+			[]string{"-m", "addrtype", "--dst-type", "LOCAL", "--limit-iface-in", "-j", "ACCEPT"},
+		},
+	}
+
+	for _, tt := range testcases {
+		if !reflect.DeepEqual(tt.result, tt.rule.Construct()) {
+			t.Errorf("Expected %s, but got %s", tt.result, tt.rule.Construct())
+		}
+	}
+}
+
+func TestValidateMatches(t *testing.T) {
+	var testcases = []struct {
+		rule   Rule
+		fields []string
+	}{
+		{Rule{Protocol: "tcp", Multiport: &Multiport{DestinationPorts: "80,443"}}, nil},
+		{Rule{Multiport: &Multiport{DestinationPorts: "80,443"}}, []string{"multiport"}},
+		{Rule{Protocol: "tcp", Multiport: &Multiport{Ports: "1:2,3:4,5:6,7:8,9:10,11:12,13:14,15:16"}}, []string{"multiport.ports"}},
+		{Rule{Limit: &Limit{Rate: "3/fortnight"}}, []string{"limit.rate"}},
+		{Rule{HashLimit: &HashLimit{Name: "x", Upto: "10/s", Above: "20/s"}}, []string{"hashlimit"}},
+		{Rule{HashLimit: &HashLimit{Upto: "10/s", Mode: []string{"srcmac"}}}, []string{"hashlimit.name", "hashlimit.mode"}},
+		{Rule{Recent: &Recent{Action: "set", Seconds: "60"}}, []string{"recent"}},
+		{Rule{Recent: &Recent{Action: "check"}}, []string{"recent.action"}},
+		{Rule{MacSource: "00:11:22"}, []string{"mac_source"}},
+		{Rule{Owner: &Owner{UID: "0"}}, []string{"owner"}},
+		{Rule{Chain: "OUTPUT", Owner: &Owner{UID: "0"}}, nil},
+		{Rule{Mark: "0x1/mask"}, []string{"mark"}},
+		{Rule{MatchSet: &MatchSet{Name: "set", Flags: "src,any"}}, []string{"match_set.flags"}},
+		{Rule{ICMPType: "echo-request"}, []string{"icmp_type"}},
+		{Rule{AddrType: &AddrType{SourceType: "LOCAL,REMOTE"}}, []string{"addrtype.src_type"}},
+	}
+
+	for i, tt := range testcases {
+		var fields []string
+		if err := tt.rule.Validate(); err != nil {
+			for _, e := range err.(ValidationErrors) {
+				fields = append(fields, e.Field)
+			}
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("Testcase %v: expected invalid fields %v, got %v", i, tt.fields, fields)
+		}
+	}
+}
@@ -0,0 +1,1379 @@
+package iptables
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// nftTablePrefix is prepended to the name of iptables table for getting name of nftables table.
+// i.e rules of "filter" table are stored in "ip opa_filter" and "ip6 opa_filter" tables.
+const nftTablePrefix = "opa_"
+
+// nftablesBackend programs rules natively using nftables netlink API.
+//
+// Specification of the rule generated by Rule.String is stored as a comment of nftables rule.
+// It is used for finding the rule while deleting it and it makes rules easy to audit using
+// "nft list ruleset".
+type nftablesBackend struct {
+	mu sync.Mutex
+}
+
+func newNFTablesBackend() *nftablesBackend {
+	return &nftablesBackend{}
+}
+
+func (b *nftablesBackend) Name() string {
+	return BackendNFTables
+}
+
+func (b *nftablesBackend) AddRule(r Rule) error {
+	return b.apply(Operation{Type: OpAdd, Rule: r})
+}
+
+func (b *nftablesBackend) DeleteRule(r Rule) error {
+	return b.apply(Operation{Type: OpDelete, Rule: r})
+}
+
+func (b *nftablesBackend) RuleExists(r Rule) (bool, error) {
+	r.init()
+	families, err := r.Families()
+	if err != nil {
+		return false, err
+	}
+	comment, err := nftComment(r)
+	if err != nil {
+		return false, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	conn, err := nftables.New()
+	if err != nil {
+		return false, err
+	}
+	for _, family := range families {
+		table := nftTable(family, r.Table)
+		chain, err := conn.ListChain(table, r.Chain)
+		if err != nil {
+			return false, nil
+		}
+		rules, err := conn.GetRules(table, chain)
+		if err != nil {
+			return false, err
+		}
+		if findNFTRule(rules, comment) == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (b *nftablesBackend) NewChain(table, chain string, family Family) error {
+	return b.apply(Operation{Type: OpNewChain, Rule: Rule{Table: table, Chain: chain, Family: family}})
+}
+
+func (b *nftablesBackend) DeleteChain(table, chain string, family Family) error {
+	return b.apply(Operation{Type: OpDeleteChain, Rule: Rule{Table: table, Chain: chain, Family: family}})
+}
+
+// apply applies a single operation in its own batch.
+func (b *nftablesBackend) apply(op Operation) error {
+	err := b.Apply(&Transaction{Ops: []Operation{op}})
+	if txErr, ok := err.(*TransactionError); ok {
+		return txErr.Err
+	}
+	return err
+}
+
+// Apply queues every operation of the transaction on a single connection and sends them with
+// a single Flush, which the kernel commits as one nftables transaction. Either every operation
+// is applied or none of them, so nothing needs to be reverted.
+func (b *nftablesBackend) Apply(tx *Transaction) error {
+	ops, err := tx.normalize()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	batch, err := newNFTBatch()
+	if err != nil {
+		return &TransactionError{Index: -1, Err: err}
+	}
+	for i, op := range ops {
+		if err := batch.queue(op); err != nil {
+			return &TransactionError{Index: i, Op: op, Err: err}
+		}
+	}
+	if err := batch.conn.Flush(); err != nil {
+		return &TransactionError{Index: -1, Err: err}
+	}
+	return nil
+}
+
+// ListRules lists comments of the rules, which contain specification of the rule.
+// Rules which are not created by the backend are listed using their handle.
+func (b *nftablesBackend) ListRules(table, chain string, family Family) (map[Family][]string, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make(map[Family][]string)
+	for _, f := range family.Expand() {
+		t := nftTable(f, strings.ToLower(table))
+		c, err := conn.ListChain(t, chainName(chain))
+		if err != nil {
+			// table or chain is created lazily while adding first rule
+			continue
+		}
+		rules, err := conn.GetRules(t, c)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", f, err)
+		}
+		for _, rule := range rules {
+			if comment, ok := userdata.GetString(rule.UserData, userdata.TypeComment); ok {
+				list[f] = append(list[f], comment)
+			} else {
+				list[f] = append(list[f], fmt.Sprintf("%v %v handle %v", table, chain, rule.Handle))
+			}
+		}
+	}
+	return list, nil
+}
+
+// nftBatch queues operations on a single connection, so they're sent to the kernel in a single
+// batch by Flush. Queued operations are not visible in the kernel before Flush, so rules of the
+// chains touched by the batch are listed once and tracked as operations are queued.
+type nftBatch struct {
+	conn   *nftables.Conn
+	chains map[nftChainKey]*nftBatchChain
+}
+
+type nftChainKey struct {
+	family Family
+	table  string
+	chain  string
+}
+
+// nftBatchChain is the chain as it is after the queued operations. chain is nil if the chain
+// doesn't exist. Rules queued by the batch don't have a handle until the batch is flushed.
+type nftBatchChain struct {
+	chain *nftables.Chain
+	rules []*nftables.Rule
+}
+
+func newNFTBatch() (*nftBatch, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	return &nftBatch{conn: conn, chains: make(map[nftChainKey]*nftBatchChain)}, nil
+}
+
+// queue queues the operation for each family of its rule.
+func (batch *nftBatch) queue(op Operation) error {
+	r := op.Rule
+	families, err := r.Families()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		switch op.Type {
+		case OpAdd:
+			err = batch.addRule(r, family)
+		case OpDelete:
+			err = batch.deleteRule(r, family)
+		case OpNewChain:
+			err = batch.newChain(family, r.Table, r.Chain)
+		case OpDeleteChain:
+			err = batch.deleteChain(family, r.Table, r.Chain)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", family, err)
+		}
+	}
+	return nil
+}
+
+func (batch *nftBatch) addRule(r Rule, family Family) error {
+	exprs, err := nftExprs(r, family)
+	if err != nil {
+		return err
+	}
+	comment, err := nftComment(r)
+	if err != nil {
+		return err
+	}
+
+	c, err := batch.ensureChain(family, r.Table, r.Chain)
+	if err != nil {
+		return err
+	}
+	if target := r.Jump; target != "" && !isBuiltinTarget(target) {
+		if _, err := batch.ensureChain(family, r.Table, target); err != nil {
+			return err
+		}
+	}
+
+	rule := &nftables.Rule{
+		Table:    c.chain.Table,
+		Chain:    c.chain,
+		Exprs:    exprs,
+		UserData: comment,
+	}
+
+	switch r.Action {
+	case "insert":
+		if r.RuleNumber == "" {
+			return fmt.Errorf("to use insert action ,you must need to provides rule_number")
+		}
+		ruleNum, err := strconv.Atoi(r.RuleNumber)
+		if err != nil {
+			return err
+		}
+		if ruleNum < 1 || ruleNum > len(c.rules)+1 {
+			return fmt.Errorf("invalid rule number %v: chain %v contains %v rules", ruleNum, r.Chain, len(c.rules))
+		}
+		// new rule is placed after the rule at position (ruleNum - 1), or before the rule at
+		// position ruleNum, whichever is in the kernel already
+		i := ruleNum - 1
+		switch {
+		case i == 0:
+			batch.conn.InsertRule(rule)
+		case c.rules[i-1].Handle != 0:
+			rule.Position = c.rules[i-1].Handle
+			batch.conn.AddRule(rule)
+		case i < len(c.rules) && c.rules[i].Handle != 0:
+			rule.Position = c.rules[i].Handle
+			batch.conn.InsertRule(rule)
+		case i == len(c.rules):
+			batch.conn.AddRule(rule)
+		default:
+			return fmt.Errorf("invalid rule number %v: rule can't be placed between rules added by the same transaction", ruleNum)
+		}
+		c.rules = append(c.rules[:i], append([]*nftables.Rule{rule}, c.rules[i:]...)...)
+	default:
+		// appends rule only if it doesn't exists
+		if nftRuleIndex(c.rules, comment) >= 0 {
+			return nil
+		}
+		batch.conn.AddRule(rule)
+		c.rules = append(c.rules, rule)
+	}
+	return nil
+}
+
+func (batch *nftBatch) deleteRule(r Rule, family Family) error {
+	comment, err := nftComment(r)
+	if err != nil {
+		return err
+	}
+
+	c, err := batch.chain(family, r.Table, r.Chain)
+	if err != nil {
+		return err
+	}
+	if c.chain == nil {
+		return fmt.Errorf("chain %v doesn't exists in table %v", r.Chain, nftTable(family, r.Table).Name)
+	}
+	i := nftRuleIndex(c.rules, comment)
+	if i < 0 {
+		return fmt.Errorf("rule doesn't exist in chain %v of table %v", r.Chain, c.chain.Table.Name)
+	}
+	if c.rules[i].Handle == 0 {
+		return fmt.Errorf("rule added by the same transaction can't be deleted")
+	}
+	if err := batch.conn.DelRule(c.rules[i]); err != nil {
+		return err
+	}
+	c.rules = append(c.rules[:i], c.rules[i+1:]...)
+	return nil
+}
+
+// newChain creates the chain, or flushes it if it exists.
+func (batch *nftBatch) newChain(family Family, table, chain string) error {
+	c, err := batch.ensureChain(family, table, chain)
+	if err != nil {
+		return err
+	}
+	batch.conn.FlushChain(c.chain)
+	c.rules = nil
+	return nil
+}
+
+func (batch *nftBatch) deleteChain(family Family, table, chain string) error {
+	c, err := batch.chain(family, table, chain)
+	if err != nil {
+		return err
+	}
+	if c.chain == nil {
+		return fmt.Errorf("chain %v doesn't exists in table %v", chain, nftTable(family, table).Name)
+	}
+	batch.conn.FlushChain(c.chain)
+	batch.conn.DelChain(c.chain)
+	c.chain, c.rules = nil, nil
+	return nil
+}
+
+// chain returns the chain as it is after the queued operations.
+func (batch *nftBatch) chain(family Family, table, chain string) (*nftBatchChain, error) {
+	key := nftChainKey{family, table, chain}
+	if c, ok := batch.chains[key]; ok {
+		return c, nil
+	}
+	c := &nftBatchChain{}
+	t := nftTable(family, table)
+	// table or chain is created lazily while adding first rule
+	if ch, err := batch.conn.ListChain(t, chain); err == nil {
+		rules, err := batch.conn.GetRules(t, ch)
+		if err != nil {
+			return nil, err
+		}
+		c.chain, c.rules = ch, rules
+	}
+	batch.chains[key] = c
+	return c, nil
+}
+
+// ensureChain queues creation of nftables table and chain, if it doesn't exist.
+// Chains of iptables, i.e INPUT, are created as a base chain attached to the same hook and priority
+// as iptables does. Other chains are created as a regular chain.
+func (batch *nftBatch) ensureChain(family Family, table, chain string) (*nftBatchChain, error) {
+	c, err := batch.chain(family, table, chain)
+	if err != nil || c.chain != nil {
+		return c, err
+	}
+
+	t := nftTable(family, table)
+	batch.conn.AddTable(t)
+	ch := &nftables.Chain{
+		Name:  chain,
+		Table: t,
+	}
+	if spec, ok := nftBaseChains[table][chain]; ok {
+		policy := nftables.ChainPolicyAccept
+		ch.Hooknum = spec.hook
+		ch.Priority = spec.priority
+		ch.Type = spec.typ
+		ch.Policy = &policy
+	}
+	batch.conn.AddChain(ch)
+	c.chain = ch
+	return c, nil
+}
+
+func nftTable(family Family, table string) *nftables.Table {
+	f := nftables.TableFamilyIPv4
+	if family == IPv6 {
+		f = nftables.TableFamilyIPv6
+	}
+	return &nftables.Table{
+		Name:   nftTablePrefix + table,
+		Family: f,
+	}
+}
+
+func nftComment(r Rule) ([]byte, error) {
+	spec := r.String()
+	// userdata stores length of the comment in a single byte, including null terminator
+	if len(spec) > 254 {
+		return nil, fmt.Errorf("rule specification is too long for nftables: %v", spec)
+	}
+	return userdata.AppendString(nil, userdata.TypeComment, spec), nil
+}
+
+func findNFTRule(rules []*nftables.Rule, comment []byte) *nftables.Rule {
+	if i := nftRuleIndex(rules, comment); i >= 0 {
+		return rules[i]
+	}
+	return nil
+}
+
+// nftRuleIndex returns index of the rule with given comment, or -1 if there is no such rule.
+func nftRuleIndex(rules []*nftables.Rule, comment []byte) int {
+	want, _ := userdata.GetString(comment, userdata.TypeComment)
+	for i, rule := range rules {
+		if got, ok := userdata.GetString(rule.UserData, userdata.TypeComment); ok && got == want {
+			return i
+		}
+	}
+	return -1
+}
+
+type nftChainSpec struct {
+	hook     *nftables.ChainHook
+	priority *nftables.ChainPriority
+	typ      nftables.ChainType
+}
+
+// nftBaseChains describes hook, priority and type of chains of iptables tables.
+//
+// Chains are hooked at the same hook and priority as chains of other tables of the host, so
+// verdicts are not authoritative: accept only ends evaluation of the opa_ table and the packet is
+// still evaluated by other tables, in undefined order. Only drop is final.
+var nftBaseChains = map[string]map[string]nftChainSpec{
+	"filter": {
+		"INPUT":   {nftables.ChainHookInput, nftables.ChainPriorityFilter, nftables.ChainTypeFilter},
+		"FORWARD": {nftables.ChainHookForward, nftables.ChainPriorityFilter, nftables.ChainTypeFilter},
+		"OUTPUT":  {nftables.ChainHookOutput, nftables.ChainPriorityFilter, nftables.ChainTypeFilter},
+	},
+	"nat": {
+		"PREROUTING":  {nftables.ChainHookPrerouting, nftables.ChainPriorityNATDest, nftables.ChainTypeNAT},
+		"INPUT":       {nftables.ChainHookInput, nftables.ChainPriorityNATSource, nftables.ChainTypeNAT},
+		"OUTPUT":      {nftables.ChainHookOutput, nftables.ChainPriorityNATDest, nftables.ChainTypeNAT},
+		"POSTROUTING": {nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource, nftables.ChainTypeNAT},
+	},
+	"mangle": {
+		"PREROUTING":  {nftables.ChainHookPrerouting, nftables.ChainPriorityMangle, nftables.ChainTypeFilter},
+		"INPUT":       {nftables.ChainHookInput, nftables.ChainPriorityMangle, nftables.ChainTypeFilter},
+		"FORWARD":     {nftables.ChainHookForward, nftables.ChainPriorityMangle, nftables.ChainTypeFilter},
+		"OUTPUT":      {nftables.ChainHookOutput, nftables.ChainPriorityMangle, nftables.ChainTypeRoute},
+		"POSTROUTING": {nftables.ChainHookPostrouting, nftables.ChainPriorityMangle, nftables.ChainTypeFilter},
+	},
+	"raw": {
+		"PREROUTING": {nftables.ChainHookPrerouting, nftables.ChainPriorityRaw, nftables.ChainTypeFilter},
+		"OUTPUT":     {nftables.ChainHookOutput, nftables.ChainPriorityRaw, nftables.ChainTypeFilter},
+	},
+	"security": {
+		"INPUT":   {nftables.ChainHookInput, nftables.ChainPrioritySecurity, nftables.ChainTypeFilter},
+		"FORWARD": {nftables.ChainHookForward, nftables.ChainPrioritySecurity, nftables.ChainTypeFilter},
+		"OUTPUT":  {nftables.ChainHookOutput, nftables.ChainPrioritySecurity, nftables.ChainTypeFilter},
+	},
+}
+
+// builtinTargets are targets which are not a chain.
+var builtinTargets = map[string]bool{
+	"ACCEPT": true, "DROP": true, "RETURN": true, "REJECT": true, "LOG": true,
+	"SNAT": true, "DNAT": true, "MASQUERADE": true, "REDIRECT": true,
+	"MARK": true, "CONNMARK": true, "TPROXY": true, "CT": true, "NOTRACK": true, "NFLOG": true,
+}
+
+func isBuiltinTarget(target string) bool {
+	return builtinTargets[strings.ToUpper(target)]
+}
+
+// nftExprs translates the rule into nftables expressions of given single-stack family.
+// The translation mirrors options generated by Rule.Construct, so the same rule
+// has the same meaning on both backends.
+func nftExprs(r Rule, family Family) ([]expr.Any, error) {
+	var b nftBuilder
+	b.family = family
+
+	proto, err := b.protocol(r.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.address(r.SourceAddress, true); err != nil {
+		return nil, err
+	}
+	if err := b.address(r.DestinationAddress, false); err != nil {
+		return nil, err
+	}
+	if err := b.port(proto, r.SourcePort, 0); err != nil {
+		return nil, err
+	}
+	if err := b.port(proto, r.DestinationPort, 2); err != nil {
+		return nil, err
+	}
+	b.iface(r.InInterface, expr.MetaKeyIIFNAME)
+	b.iface(r.OutInterface, expr.MetaKeyOIFNAME)
+	if err := b.addressRange(r.SourceRange, true); err != nil {
+		return nil, err
+	}
+	if err := b.addressRange(r.DestinationRange, false); err != nil {
+		return nil, err
+	}
+	if err := b.ctstate(r.Ctstate); err != nil {
+		return nil, err
+	}
+	if err := b.tcpFlags(proto, r.TCPFlags); err != nil {
+		return nil, err
+	}
+	if err := b.matches(r, proto); err != nil {
+		return nil, err
+	}
+	b.exprs = append(b.exprs, &expr.Counter{})
+	if err := b.target(r); err != nil {
+		return nil, err
+	}
+	return b.exprs, nil
+}
+
+// nftBuilder builds nftables expressions, option by option.
+// Every match is loaded into register 1 and compared immediately.
+type nftBuilder struct {
+	family Family
+	exprs  []expr.Any
+}
+
+func (b *nftBuilder) add(e ...expr.Any) {
+	b.exprs = append(b.exprs, e...)
+}
+
+var nftProtocols = map[string]byte{
+	"icmp":      unix.IPPROTO_ICMP,
+	"tcp":       unix.IPPROTO_TCP,
+	"udp":       unix.IPPROTO_UDP,
+	"esp":       unix.IPPROTO_ESP,
+	"ah":        unix.IPPROTO_AH,
+	"icmpv6":    unix.IPPROTO_ICMPV6,
+	"ipv6-icmp": unix.IPPROTO_ICMPV6,
+	"sctp":      unix.IPPROTO_SCTP,
+	"udplite":   unix.IPPROTO_UDPLITE,
+	"dccp":      unix.IPPROTO_DCCP,
+	"gre":       unix.IPPROTO_GRE,
+}
+
+// protocol adds match of layer 4 protocol and returns name of matched protocol.
+func (b *nftBuilder) protocol(spec string) (string, error) {
+	value, negate := splitNegation(spec)
+	value = strings.ToLower(value)
+	if value == "" || value == "all" || value == "0" {
+		return "", nil
+	}
+
+	num, ok := nftProtocols[value]
+	if !ok {
+		n, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			p, found := lookupProtocol(value)
+			if !found {
+				return "", fmt.Errorf("unsupported protocol %q", value)
+			}
+			n = uint64(p)
+		}
+		num = byte(n)
+	}
+
+	b.add(
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: cmpOp(negate), Register: 1, Data: []byte{num}},
+	)
+	if negate {
+		return "", nil
+	}
+	return value, nil
+}
+
+// address adds match of source or destination address of network header.
+func (b *nftBuilder) address(spec string, source bool) error {
+	value, negate := splitNegation(spec)
+	if value == "" {
+		return nil
+	}
+
+	ip, mask, err := parseAddress(value, b.family)
+	if err != nil {
+		return err
+	}
+
+	offset, length := uint32(16), uint32(4)
+	if b.family == IPv6 {
+		offset, length = 24, 16
+	}
+	if source {
+		offset -= length
+	}
+
+	b.add(&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length})
+	if ones, bits := mask.Size(); ones != bits {
+		b.add(&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: length, Mask: mask, Xor: make([]byte, length)})
+	}
+	b.add(&expr.Cmp{Op: cmpOp(negate), Register: 1, Data: ip.Mask(mask)})
+	return nil
+}
+
+// addressRange adds match of iprange module.
+func (b *nftBuilder) addressRange(spec string, source bool) error {
+	value, negate := splitNegation(spec)
+	if value == "" {
+		return nil
+	}
+
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) != 2 {
+		return fmt.Errorf("invalid ip range %q", value)
+	}
+	from, _, err := parseAddress(bounds[0], b.family)
+	if err != nil {
+		return err
+	}
+	to, _, err := parseAddress(bounds[1], b.family)
+	if err != nil {
+		return err
+	}
+
+	offset, length := uint32(16), uint32(4)
+	if b.family == IPv6 {
+		offset, length = 24, 16
+	}
+	if source {
+		offset -= length
+	}
+
+	b.add(
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Range{Op: cmpOp(negate), Register: 1, FromData: from, ToData: to},
+	)
+	return nil
+}
+
+// port adds match of source or destination port of transport header.
+func (b *nftBuilder) port(proto, spec string, offset uint32) error {
+	value, negate := splitNegation(spec)
+	if value == "" {
+		return nil
+	}
+	switch proto {
+	case "tcp", "udp", "udplite", "sctp", "dccp":
+	default:
+		return fmt.Errorf("port %q requires one of the protocol tcp, udp, udplite, sctp or dccp", value)
+	}
+
+	first, last, err := parsePortRange(proto, value)
+	if err != nil {
+		return err
+	}
+
+	b.add(&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2})
+	if first == last {
+		b.add(&expr.Cmp{Op: cmpOp(negate), Register: 1, Data: be16(first)})
+	} else {
+		b.add(&expr.Range{Op: cmpOp(negate), Register: 1, FromData: be16(first), ToData: be16(last)})
+	}
+	return nil
+}
+
+// iface adds match of name of input or output interface.
+func (b *nftBuilder) iface(spec string, key expr.MetaKey) {
+	value, negate := splitNegation(spec)
+	if value == "" {
+		return
+	}
+
+	var data []byte
+	if strings.HasSuffix(value, "+") {
+		// compare only prefix of interface name
+		data = []byte(strings.TrimSuffix(value, "+"))
+	} else {
+		data = make([]byte, unix.IFNAMSIZ)
+		copy(data, value)
+	}
+	b.add(
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: cmpOp(negate), Register: 1, Data: data},
+	)
+}
+
+var nftCtStates = map[string]uint32{
+	"INVALID":     expr.CtStateBitINVALID,
+	"ESTABLISHED": expr.CtStateBitESTABLISHED,
+	"RELATED":     expr.CtStateBitRELATED,
+	"NEW":         expr.CtStateBitNEW,
+	"UNTRACKED":   expr.CtStateBitUNTRACKED,
+}
+
+// ctstate adds match of state of the connection tracked by conntrack.
+func (b *nftBuilder) ctstate(states []string) error {
+	if isEmpty(states) {
+		return nil
+	}
+
+	var mask uint32
+	for _, state := range states {
+		if state == "" {
+			continue
+		}
+		bit, ok := nftCtStates[strings.ToUpper(state)]
+		if !ok {
+			return fmt.Errorf("ctstate %q is not supported by nftables backend", state)
+		}
+		mask |= bit
+	}
+
+	b.add(
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: ne32(mask), Xor: ne32(0)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ne32(0)},
+	)
+	return nil
+}
+
+var nftTCPFlags = map[string]byte{
+	"FIN":  0x01,
+	"SYN":  0x02,
+	"RST":  0x04,
+	"PSH":  0x08,
+	"ACK":  0x10,
+	"URG":  0x20,
+	"ALL":  0x3f,
+	"NONE": 0x00,
+}
+
+// tcpFlags adds match of flags of tcp header.
+func (b *nftBuilder) tcpFlags(proto string, tf TcpFlags) error {
+	if len(tf.Flags) == 0 || len(tf.FlagsSet) == 0 {
+		return nil
+	}
+	if proto != "tcp" {
+		return fmt.Errorf("tcp_flags requires protocol tcp")
+	}
+
+	mask, err := tcpFlagBits(tf.Flags)
+	if err != nil {
+		return err
+	}
+	set, err := tcpFlagBits(tf.FlagsSet)
+	if err != nil {
+		return err
+	}
+
+	b.add(
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{mask}, Xor: []byte{0}},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{set}},
+	)
+	return nil
+}
+
+func tcpFlagBits(flags []string) (byte, error) {
+	var bits byte
+	for _, flag := range flags {
+		bit, ok := nftTCPFlags[strings.ToUpper(flag)]
+		if !ok {
+			return 0, fmt.Errorf("invalid tcp flag %q", flag)
+		}
+		bits |= bit
+	}
+	return bits, nil
+}
+
+// matches adds matches of extension modules. Modules which don't have a native equivalent
+// in nftables are rejected.
+func (b *nftBuilder) matches(r Rule, proto string) error {
+	unsupported := map[string]bool{
+		"multiport": r.Multiport != nil,
+		"hashlimit": r.HashLimit != nil,
+		"recent":    r.Recent != nil,
+		"match_set": r.MatchSet != nil,
+		"addrtype":  r.AddrType != nil,
+	}
+	for _, name := range []string{"multiport", "hashlimit", "recent", "match_set", "addrtype"} {
+		if unsupported[name] {
+			return fmt.Errorf("%v is not supported by nftables backend", name)
+		}
+	}
+
+	if err := b.icmpType(proto, r.ICMPType); err != nil {
+		return err
+	}
+	if err := b.mac(r.MacSource); err != nil {
+		return err
+	}
+	if err := b.owner(r.Owner); err != nil {
+		return err
+	}
+	if err := b.mark(r.Mark, &expr.Meta{Key: expr.MetaKeyMARK, Register: 1}); err != nil {
+		return err
+	}
+	if err := b.mark(r.ConnMark, &expr.Ct{Key: expr.CtKeyMARK, Register: 1}); err != nil {
+		return err
+	}
+	return b.limit(r.Limit)
+}
+
+var nftICMPTypes = map[string]byte{
+	"echo-reply":              0,
+	"destination-unreachable": 3,
+	"redirect":                5,
+	"echo-request":            8,
+	"time-exceeded":           11,
+	"parameter-problem":       12,
+	"timestamp-request":       13,
+	"timestamp-reply":         14,
+}
+
+var nftICMPv6Types = map[string]byte{
+	"destination-unreachable": 1,
+	"packet-too-big":          2,
+	"time-exceeded":           3,
+	"parameter-problem":       4,
+	"echo-request":            128,
+	"echo-reply":              129,
+	"router-solicitation":     133,
+	"router-advertisement":    134,
+	"neighbour-solicitation":  135,
+	"neighbour-advertisement": 136,
+	"redirect":                137,
+}
+
+// icmpType adds match of type, and optional code, of icmp header. i.e echo-request, 3/4
+func (b *nftBuilder) icmpType(proto, spec string) error {
+	value, negate := splitNegation(spec)
+	if value == "" {
+		return nil
+	}
+	types := nftICMPTypes
+	switch {
+	case proto == "icmp" && b.family == IPv4:
+	case isICMPv6(proto) && b.family == IPv6:
+		types = nftICMPv6Types
+	default:
+		return fmt.Errorf("icmp_type requires protocol icmp for ipv4 or icmpv6 for ipv6 rules")
+	}
+
+	parts := strings.SplitN(value, "/", 2)
+	data := make([]byte, 0, 2)
+	if t, ok := types[strings.ToLower(parts[0])]; ok {
+		data = append(data, t)
+	} else if n, err := strconv.ParseUint(parts[0], 10, 8); err == nil {
+		data = append(data, byte(n))
+	} else {
+		return fmt.Errorf("icmp type %q is not supported by nftables backend", value)
+	}
+	if len(parts) == 2 {
+		code, err := strconv.ParseUint(parts[1], 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid icmp code %q", value)
+		}
+		data = append(data, byte(code))
+	}
+
+	b.add(
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: uint32(len(data))},
+		&expr.Cmp{Op: cmpOp(negate), Register: 1, Data: data},
+	)
+	return nil
+}
+
+// mac adds match of source address of ethernet header.
+func (b *nftBuilder) mac(spec string) error {
+	value, negate := splitNegation(spec)
+	if value == "" {
+		return nil
+	}
+	hw, err := net.ParseMAC(value)
+	if err != nil || len(hw) != 6 {
+		return fmt.Errorf("invalid mac address %q", value)
+	}
+	b.add(
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+		&expr.Cmp{Op: cmpOp(negate), Register: 1, Data: []byte(hw)},
+	)
+	return nil
+}
+
+// owner adds match of uid and gid of the socket. Only numeric ids are supported, as names
+// would be resolved on the host running the controller.
+func (b *nftBuilder) owner(o *Owner) error {
+	if o == nil {
+		return nil
+	}
+	if o.SocketExists {
+		return fmt.Errorf("owner socket_exists is not supported by nftables backend")
+	}
+	ids := []struct {
+		spec string
+		key  expr.MetaKey
+	}{
+		{o.UID, expr.MetaKeySKUID},
+		{o.GID, expr.MetaKeySKGID},
+	}
+	for _, id := range ids {
+		value, negate := splitNegation(id.spec)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("owner %q is not supported by nftables backend, only numeric ids are supported", value)
+		}
+		b.add(
+			&expr.Meta{Key: id.key, Register: 1},
+			&expr.Cmp{Op: cmpOp(negate), Register: 1, Data: ne32(uint32(n))},
+		)
+	}
+	return nil
+}
+
+// mark adds match of packet or connection mark loaded by load. i.e 0x1, 0x1/0xff
+func (b *nftBuilder) mark(spec string, load expr.Any) error {
+	value, negate := splitNegation(spec)
+	if value == "" {
+		return nil
+	}
+	mark, mask, err := parseMark(value)
+	if err != nil {
+		return err
+	}
+	b.add(load)
+	if mask != 0xffffffff {
+		b.add(&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: ne32(mask), Xor: ne32(0)})
+	}
+	b.add(&expr.Cmp{Op: cmpOp(negate), Register: 1, Data: ne32(mark & mask)})
+	return nil
+}
+
+var nftLimitUnits = map[string]expr.LimitTime{
+	"second": expr.LimitTimeSecond,
+	"minute": expr.LimitTimeMinute,
+	"hour":   expr.LimitTimeHour,
+	"day":    expr.LimitTimeDay,
+}
+
+// limit adds rate limit of limit module. Defaults are the same as of iptables: 3/hour and burst of 5.
+func (b *nftBuilder) limit(l *Limit) error {
+	if l == nil {
+		return nil
+	}
+	rate, unit, err := parseRate(l.Rate)
+	if err != nil {
+		return err
+	}
+	burst := uint64(5)
+	if l.Burst != "" {
+		burst, err = strconv.ParseUint(l.Burst, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid limit burst %q", l.Burst)
+		}
+	}
+	b.add(&expr.Limit{Type: expr.LimitTypePkts, Rate: rate, Unit: unit, Burst: uint32(burst)})
+	return nil
+}
+
+// parseRate parses rate of limit module. i.e 3/hour, 10/s, 5
+func parseRate(spec string) (uint64, expr.LimitTime, error) {
+	if spec == "" {
+		return 3, expr.LimitTimeHour, nil
+	}
+	parts := strings.SplitN(spec, "/", 2)
+	rate, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rate %q", spec)
+	}
+	if len(parts) == 1 {
+		return rate, expr.LimitTimeSecond, nil
+	}
+	// iptables accepts any prefix of the unit. i.e s, sec, second
+	for name, unit := range nftLimitUnits {
+		if parts[1] != "" && strings.HasPrefix(name, parts[1]) {
+			return rate, unit, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid rate %q", spec)
+}
+
+// parseMark parses mark with optional mask. i.e 0x1, 1/0xff
+func parseMark(spec string) (uint32, uint32, error) {
+	parts := strings.SplitN(spec, "/", 2)
+	mark, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid mark %q", spec)
+	}
+	mask := uint64(0xffffffff)
+	if len(parts) == 2 {
+		mask, err = strconv.ParseUint(parts[1], 0, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid mark %q", spec)
+		}
+	}
+	return uint32(mark), uint32(mask), nil
+}
+
+// target adds statements of the target of the rule.
+func (b *nftBuilder) target(r Rule) error {
+	nfproto := uint32(unix.NFPROTO_IPV4)
+	if b.family == IPv6 {
+		nfproto = unix.NFPROTO_IPV6
+	}
+
+	switch target := strings.ToUpper(r.Jump); target {
+	case "":
+	case "ACCEPT":
+		b.add(&expr.Verdict{Kind: expr.VerdictAccept})
+	case "DROP":
+		b.add(&expr.Verdict{Kind: expr.VerdictDrop})
+	case "RETURN":
+		b.add(&expr.Verdict{Kind: expr.VerdictReturn})
+	case "REJECT":
+		reject, err := nftReject(r.RejectWith, b.family)
+		if err != nil {
+			return err
+		}
+		b.add(reject)
+	case "LOG":
+		log := &expr.Log{}
+		if r.LogPrefix != "" {
+			log.Key = 1 << unix.NFTA_LOG_PREFIX
+			log.Data = []byte(r.LogPrefix)
+		}
+		if r.LogLevel != "" {
+			level, ok := nftLogLevels[strings.ToLower(r.LogLevel)]
+			if !ok {
+				return fmt.Errorf("invalid log level %q", r.LogLevel)
+			}
+			log.Key |= 1 << unix.NFTA_LOG_LEVEL
+			log.Level = level
+		}
+		b.add(log)
+	case "NFLOG":
+		log := &expr.Log{Key: 1 << unix.NFTA_LOG_GROUP}
+		if r.NFLogGroup != "" {
+			group, err := strconv.ParseUint(r.NFLogGroup, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid nflog group %q", r.NFLogGroup)
+			}
+			log.Group = uint16(group)
+		}
+		if r.LogPrefix != "" {
+			log.Key |= 1 << unix.NFTA_LOG_PREFIX
+			log.Data = []byte(r.LogPrefix)
+		}
+		b.add(log)
+	case "MARK":
+		if err := b.setMetaMark(r.SetMark); err != nil {
+			return err
+		}
+	case "CONNMARK":
+		switch {
+		case r.SaveMark:
+			b.add(
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true},
+			)
+		case r.RestoreMark:
+			b.add(
+				&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true},
+			)
+		default:
+			err := b.setMark(r.SetMark,
+				&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+				&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true})
+			if err != nil {
+				return err
+			}
+		}
+	case "TPROXY":
+		if err := b.tproxy(r, byte(nfproto)); err != nil {
+			return err
+		}
+	case "CT", "NOTRACK":
+		if r.CTZone != "" || r.CTHelper != "" {
+			return fmt.Errorf("ct_zone and ct_helper are not supported by nftables backend")
+		}
+		if target == "CT" && !r.CTNoTrack {
+			return fmt.Errorf("target CT requires ct_notrack")
+		}
+		b.add(&expr.Notrack{})
+	case "SNAT", "DNAT":
+		natType, to := expr.NATTypeSourceNAT, r.ToSource
+		if target == "DNAT" {
+			natType, to = expr.NATTypeDestNAT, r.ToDestination
+		}
+		if to == "" {
+			return fmt.Errorf("target %v requires %v", target, map[string]string{"SNAT": "to_source", "DNAT": "to_destination"}[target])
+		}
+		nat, err := b.natRange(to)
+		if err != nil {
+			return err
+		}
+		nat.Type = natType
+		nat.Family = nfproto
+		nat.Random = r.Random
+		b.add(nat)
+	case "MASQUERADE":
+		masq := &expr.Masq{Random: r.Random}
+		if r.ToPorts != "" {
+			if err := b.loadPorts(r.Protocol, r.ToPorts, 1); err != nil {
+				return err
+			}
+			masq.ToPorts = true
+			masq.RegProtoMin, masq.RegProtoMax = 1, 2
+		}
+		b.add(masq)
+	case "REDIRECT":
+		redir := &expr.Redir{}
+		if r.ToPorts != "" {
+			if err := b.loadPorts(r.Protocol, r.ToPorts, 1); err != nil {
+				return err
+			}
+			redir.RegisterProtoMin, redir.RegisterProtoMax = 1, 2
+		}
+		if r.Random {
+			redir.Flags |= expr.NF_NAT_RANGE_PROTO_RANDOM
+		}
+		b.add(redir)
+	default:
+		// user defined chain
+		b.add(&expr.Verdict{Kind: expr.VerdictJump, Chain: r.Jump})
+	}
+	return nil
+}
+
+var nftLogLevels = map[string]expr.LogLevel{
+	"emerg": expr.LogLevelEmerg, "alert": expr.LogLevelAlert, "crit": expr.LogLevelCrit,
+	"error": expr.LogLevelErr, "warning": expr.LogLevelWarning, "notice": expr.LogLevelNotice,
+	"info": expr.LogLevelInfo, "debug": expr.LogLevelDebug,
+	"0": expr.LogLevelEmerg, "1": expr.LogLevelAlert, "2": expr.LogLevelCrit, "3": expr.LogLevelErr,
+	"4": expr.LogLevelWarning, "5": expr.LogLevelNotice, "6": expr.LogLevelInfo, "7": expr.LogLevelDebug,
+}
+
+// nftRejectCodes are icmp and icmpv6 codes of reject types.
+var nftRejectCodes = map[string]uint8{
+	"icmp-net-unreachable":   0,
+	"icmp-host-unreachable":  1,
+	"icmp-port-unreachable":  3,
+	"icmp-proto-unreachable": 2,
+	"icmp-net-prohibited":    9,
+	"icmp-host-prohibited":   10,
+	"icmp-admin-prohibited":  13,
+	"icmp6-no-route":         0,
+	"icmp6-adm-prohibited":   1,
+	"icmp6-addr-unreachable": 3,
+	"icmp6-port-unreachable": 4,
+}
+
+// nftReject returns reject statement of given reject type for the rule of given family. Default
+// is port unreachable, same as of iptables. Code of NFT_REJECT_ICMP_UNREACH is icmp code in ip
+// tables and icmpv6 code in ip6 tables, so reject types of the other family are rejected.
+func nftReject(with string, family Family) (*expr.Reject, error) {
+	if with == "" {
+		return &expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_PORT_UNREACH}, nil
+	}
+	if with == "tcp-reset" {
+		return &expr.Reject{Type: unix.NFT_REJECT_TCP_RST}, nil
+	}
+	code, ok := nftRejectCodes[with]
+	if !ok {
+		return nil, fmt.Errorf("invalid reject type %q", with)
+	}
+	if rejectTypes[with] != family {
+		return nil, fmt.Errorf("reject type %q requires rule of %v family", with, rejectTypes[with])
+	}
+	return &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: code}, nil
+}
+
+// setMark sets packet or connection mark. Mark is loaded by load and stored by store,
+// mark with mask keeps bits outside the mask.
+func (b *nftBuilder) setMark(spec string, load, store expr.Any) error {
+	mark, mask, err := parseMark(spec)
+	if err != nil {
+		return err
+	}
+	if mask == 0xffffffff {
+		b.add(&expr.Immediate{Register: 1, Data: ne32(mark)})
+	} else {
+		b.add(load, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: ne32(^mask), Xor: ne32(mark & mask)})
+	}
+	b.add(store)
+	return nil
+}
+
+// setMetaMark sets packet mark.
+func (b *nftBuilder) setMetaMark(spec string) error {
+	return b.setMark(spec,
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true})
+}
+
+// tproxy redirects the packet to the local socket, optionally marks it and accepts it,
+// which is what TPROXY target of iptables does.
+func (b *nftBuilder) tproxy(r Rule, nfproto byte) error {
+	tproxy := &expr.TProxy{Family: nfproto, TableFamily: nfproto}
+	if r.OnIP != "" {
+		ip, _, err := parseAddress(r.OnIP, b.family)
+		if err != nil {
+			return err
+		}
+		b.add(&expr.Immediate{Register: 1, Data: ip})
+		tproxy.RegAddr = 1
+	}
+	port, err := strconv.ParseUint(r.OnPort, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid tproxy port %q", r.OnPort)
+	}
+	b.add(&expr.Immediate{Register: 2, Data: be16(uint16(port))})
+	tproxy.RegPort = 2
+	b.add(tproxy)
+
+	if r.SetMark != "" {
+		if err := b.setMetaMark(r.SetMark); err != nil {
+			return err
+		}
+	}
+	b.add(&expr.Verdict{Kind: expr.VerdictAccept})
+	return nil
+}
+
+// natRange loads address and port range of SNAT/DNAT into the registers.
+// i.e 10.0.0.1, 10.0.0.1-10.0.0.9, 10.0.0.1:80, 10.0.0.1:80-90, [fd00::1]:80
+func (b *nftBuilder) natRange(spec string) (*expr.NAT, error) {
+	addrs, ports := spec, ""
+	if strings.HasPrefix(spec, "[") {
+		end := strings.Index(spec, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid nat address %q", spec)
+		}
+		addrs = spec[1:end]
+		ports = strings.TrimPrefix(spec[end+1:], ":")
+	} else if b.family == IPv4 {
+		if i := strings.Index(spec, ":"); i >= 0 {
+			addrs, ports = spec[:i], spec[i+1:]
+		}
+	}
+
+	nat := &expr.NAT{}
+	bounds := strings.SplitN(addrs, "-", 2)
+	from, _, err := parseAddress(bounds[0], b.family)
+	if err != nil {
+		return nil, err
+	}
+	b.add(&expr.Immediate{Register: 1, Data: from})
+	nat.RegAddrMin, nat.RegAddrMax = 1, 1
+	if len(bounds) == 2 {
+		to, _, err := parseAddress(bounds[1], b.family)
+		if err != nil {
+			return nil, err
+		}
+		b.add(&expr.Immediate{Register: 2, Data: to})
+		nat.RegAddrMax = 2
+	}
+
+	if ports != "" {
+		if err := b.loadPorts("tcp", strings.Replace(ports, "-", ":", 1), 3); err != nil {
+			return nil, err
+		}
+		nat.RegProtoMin, nat.RegProtoMax = 3, 4
+	}
+	nat.Specified = true
+	return nat, nil
+}
+
+// loadPorts loads first and last port of port range into register reg and reg+1.
+func (b *nftBuilder) loadPorts(proto, spec string, reg uint32) error {
+	first, last, err := parsePortRange(proto, strings.Replace(spec, "-", ":", 1))
+	if err != nil {
+		return err
+	}
+	b.add(
+		&expr.Immediate{Register: reg, Data: be16(first)},
+		&expr.Immediate{Register: reg + 1, Data: be16(last)},
+	)
+	return nil
+}
+
+func splitNegation(spec string) (string, bool) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "!") {
+		return strings.TrimSpace(spec[1:]), true
+	}
+	return spec, false
+}
+
+func cmpOp(negate bool) expr.CmpOp {
+	if negate {
+		return expr.CmpOpNeq
+	}
+	return expr.CmpOpEq
+}
+
+// parseAddress parses plain IP address or network address with mask of given family.
+// Mask can be either a network mask or a plain number.
+func parseAddress(spec string, family Family) (net.IP, net.IPMask, error) {
+	addr, maskSpec := spec, ""
+	if i := strings.Index(spec, "/"); i >= 0 {
+		addr, maskSpec = spec[:i], spec[i+1:]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid ip address %q: hostnames are not supported by nftables backend", spec)
+	}
+	bits := 128
+	if family == IPv4 {
+		if ip = ip.To4(); ip == nil {
+			return nil, nil, fmt.Errorf("%q is not an ipv4 address", spec)
+		}
+		bits = 32
+	} else if ip.To4() != nil {
+		return nil, nil, fmt.Errorf("%q is not an ipv6 address", spec)
+	}
+
+	mask := net.CIDRMask(bits, bits)
+	if maskSpec != "" {
+		if ones, err := strconv.Atoi(maskSpec); err == nil {
+			if ones < 0 || ones > bits {
+				return nil, nil, fmt.Errorf("invalid mask of %q", spec)
+			}
+			mask = net.CIDRMask(ones, bits)
+		} else if m := net.ParseIP(maskSpec); m != nil && family == IPv4 && m.To4() != nil {
+			mask = net.IPMask(m.To4())
+		} else {
+			return nil, nil, fmt.Errorf("invalid mask of %q", spec)
+		}
+	}
+	return ip, mask, nil
+}
+
+// parsePortRange parses port or port range in form of first:last.
+// Port can be either a number or a service name.
+func parsePortRange(proto, spec string) (uint16, uint16, error) {
+	bounds := strings.SplitN(spec, ":", 2)
+	first, err := parsePort(proto, bounds[0], 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	last := first
+	if len(bounds) == 2 {
+		last, err = parsePort(proto, bounds[1], 65535)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if first > last {
+		first, last = last, first
+	}
+	return first, last, nil
+}
+
+func parsePort(proto, spec string, def uint16) (uint16, error) {
+	if spec == "" {
+		return def, nil
+	}
+	if port, err := strconv.ParseUint(spec, 10, 16); err == nil {
+		return uint16(port), nil
+	}
+	if proto == "" {
+		proto = "tcp"
+	}
+	port, err := net.LookupPort(proto, spec)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q: %v", spec, err)
+	}
+	return uint16(port), nil
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+// ne32 encodes v in native endianness, which is used by conntrack state.
+func ne32(v uint32) []byte {
+	return binaryutil.NativeEndian.PutUint32(v)
+}
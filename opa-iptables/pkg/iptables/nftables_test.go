@@ -0,0 +1,183 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestNFTExprs(t *testing.T) {
+	var testcases = []struct {
+		rule   Rule
+		family Family
+		result []expr.Any
+	}{
+		{
+			Rule{Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"},
+			IPv4,
+			[]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 22}},
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		},
+		{
+			Rule{SourceAddress: "!10.0.0.0/8", InInterface: "eth+", Jump: "DROP"},
+			IPv4,
+			[]expr.Any{
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{255, 0, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{10, 0, 0, 0}},
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte("eth")},
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+		},
+		{
+			Rule{DestinationAddress: "fd00::1", Protocol: "udp", SourcePort: "1000:2000", Jump: "MYCHAIN"},
+			IPv6,
+			[]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2},
+				&expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: []byte{0x03, 0xe8}, ToData: []byte{0x07, 0xd0}},
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictJump, Chain: "MYCHAIN"},
+			},
+		},
+		{
+			Rule{Protocol: "icmp", ICMPType: "echo-request", Mark: "0x1/0xff", Limit: &Limit{Rate: "10/min"}, Jump: "ACCEPT"},
+			IPv4,
+			[]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{8}},
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: ne32(0xff), Xor: ne32(0)},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ne32(1)},
+				&expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeMinute, Burst: 5},
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		},
+		{
+			Rule{MacSource: "00:11:22:33:44:55", Owner: &Owner{UID: "!1000"}, Jump: "DROP"},
+			IPv6,
+			[]expr.Any{
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55}},
+				&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ne32(1000)},
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+		},
+		{
+			Rule{Protocol: "tcp", Jump: "REJECT", RejectWith: "tcp-reset"},
+			IPv4,
+			[]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+				&expr.Counter{},
+				&expr.Reject{Type: unix.NFT_REJECT_TCP_RST},
+			},
+		},
+		{
+			Rule{Jump: "REJECT", RejectWith: "icmp6-adm-prohibited"},
+			IPv6,
+			[]expr.Any{
+				&expr.Counter{},
+				&expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 1},
+			},
+		},
+		{
+			Rule{Jump: "MARK", SetMark: "0x1/0xff"},
+			IPv4,
+			[]expr.Any{
+				&expr.Counter{},
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: ne32(0xffffff00), Xor: ne32(1)},
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true},
+			},
+		},
+		{
+			Rule{Jump: "CONNMARK", SaveMark: true},
+			IPv6,
+			[]expr.Any{
+				&expr.Counter{},
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true},
+			},
+		},
+		{
+			Rule{Protocol: "tcp", Jump: "TPROXY", OnPort: "15001", SetMark: "0x1"},
+			IPv4,
+			[]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+				&expr.Counter{},
+				&expr.Immediate{Register: 2, Data: []byte{0x3a, 0x99}},
+				&expr.TProxy{Family: unix.NFPROTO_IPV4, TableFamily: unix.NFPROTO_IPV4, RegPort: 2},
+				&expr.Immediate{Register: 1, Data: ne32(1)},
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		},
+		{
+			Rule{Jump: "NFLOG", NFLogGroup: "5", LogPrefix: "audit"},
+			IPv4,
+			[]expr.Any{
+				&expr.Counter{},
+				&expr.Log{Key: 1<<unix.NFTA_LOG_GROUP | 1<<unix.NFTA_LOG_PREFIX, Group: 5, Data: []byte("audit")},
+			},
+		},
+		{
+			Rule{Jump: "CT", CTNoTrack: true},
+			IPv4,
+			[]expr.Any{&expr.Counter{}, &expr.Notrack{}},
+		},
+	}
+
+	for _, tt := range testcases {
+		exprs, err := nftExprs(tt.rule, tt.family)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.rule, err)
+			continue
+		}
+		if !reflect.DeepEqual(exprs, tt.result) {
+			t.Errorf("%v: expected %#v, got %#v", tt.rule, tt.result, exprs)
+		}
+	}
+}
+
+func TestNFTExprsError(t *testing.T) {
+	var testcases = []Rule{
+		{DestinationPort: "22", Jump: "ACCEPT"},
+		{SourceAddress: "example.com", Jump: "ACCEPT"},
+		{Protocol: "udp", TCPFlags: TcpFlags{Flags: []string{"SYN"}, FlagsSet: []string{"SYN"}}},
+		{Ctstate: []string{"SNAT"}},
+		{Jump: "DNAT"},
+		{Protocol: "tcp", Multiport: &Multiport{DestinationPorts: "80,443"}},
+		{Recent: &Recent{Name: "ssh", Action: "set"}},
+		{MatchSet: &MatchSet{Name: "blocklist"}},
+		{Owner: &Owner{UID: "root"}},
+		{Protocol: "icmpv6", ICMPType: "echo-request"},
+		{Jump: "CT", CTZone: "1"},
+		{Jump: "REJECT", RejectWith: "icmp-bogus"},
+		{Jump: "REJECT", RejectWith: "icmp6-port-unreachable"},
+	}
+	for _, rule := range testcases {
+		if _, err := nftExprs(rule, IPv4); err == nil {
+			t.Errorf("%v: expected error", rule)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/command"
+)
+
+// restoreBatch is an input of iptables-restore for a single family.
+// ops maps each table to indices of the operations applied to it, in order of the input.
+// lines maps line number of the input to the index of operation in the transaction, and
+// commits maps line number of each COMMIT of the input to its table.
+// snapshot is output of iptables-save for the tables, saved before the batch is applied.
+type restoreBatch struct {
+	family   Family
+	tables   []string
+	input    []byte
+	ops      map[string][]int
+	lines    map[int]int
+	commits  map[int]string
+	snapshot []byte
+}
+
+// committedBatch is a batch whose given tables were committed by iptables-restore.
+type committedBatch struct {
+	batch  restoreBatch
+	tables []string
+}
+
+// Apply applies the transaction using iptables-restore, so every table is committed atomically.
+// Tables touched by the transaction are saved using iptables-save before applying the transaction.
+// If any operation is rejected, operations of the committed tables are reverted one by one, so
+// rules of other processes, which changed the tables meanwhile, are left untouched.
+func (b *iptablesBackend) Apply(tx *Transaction) error {
+	ops, err := tx.normalize()
+	if err != nil {
+		return err
+	}
+
+	batches, err := b.restoreBatches(ops)
+	if err != nil {
+		return err
+	}
+
+	var applied []committedBatch
+	for _, batch := range batches {
+		batch.snapshot, err = saveTables(batch.family, batch.tables)
+		if err != nil {
+			return &TransactionError{Index: -1, Err: err, RollbackErr: rollback(ops, applied)}
+		}
+
+		_, err = command.RunCommandWithInput(batch.input, restoreCommand(batch.family), "--noflush")
+		if err != nil {
+			txErr := &TransactionError{Index: -1, Err: fmt.Errorf("%v: %v", batch.family, err)}
+			table, tableOk := batch.failedTable(err)
+			if i, ok := batch.failedOp(err); ok {
+				txErr.Index, txErr.Op = i, ops[i]
+			} else if tableOk {
+				// COMMIT of the table was rejected, which doesn't tell the rejected rule
+				if i, ok := batch.testOps(ops, table); ok {
+					txErr.Index, txErr.Op = i, ops[i]
+				}
+			}
+			// iptables-restore commits each table on its own, so tables of the failed batch
+			// committed before the failed table are reverted as well. If the failed table is
+			// unknown, none of them is assumed to be committed.
+			var committed []string
+			for _, t := range batch.tables {
+				if !tableOk || t == table {
+					break
+				}
+				committed = append(committed, t)
+			}
+			txErr.RollbackErr = rollback(ops, append(applied, committedBatch{batch, committed}))
+			return txErr
+		}
+		applied = append(applied, committedBatch{batch, batch.tables})
+	}
+	return nil
+}
+
+// restoreBatches generates iptables-restore input of each family from the operations.
+// Appending a rule which already exists is skipped, same as AppendUnique.
+func (b *iptablesBackend) restoreBatches(ops []Operation) ([]restoreBatch, error) {
+	var batches []restoreBatch
+	for _, family := range []Family{IPv4, IPv6} {
+		byTable := make(map[string][]int)
+		var tables []string
+		// present tracks whether the rule exists after applying previous operations
+		present := make(map[string]bool)
+
+		for i, op := range ops {
+			if !hasFamily(op.Rule, family) {
+				continue
+			}
+			key := op.Rule.String()
+			if op.Type == OpDelete {
+				present[key] = false
+			} else if op.Type == OpAdd && op.Rule.Action != "insert" {
+				exists, ok := present[key]
+				if !ok {
+					var err error
+					exists, err = ruleExists(op.Rule, family)
+					if err != nil {
+						return nil, &TransactionError{Index: i, Op: op, Err: err}
+					}
+				}
+				present[key] = true
+				if exists {
+					continue
+				}
+			}
+			if _, ok := byTable[op.Rule.Table]; !ok {
+				tables = append(tables, op.Rule.Table)
+			}
+			byTable[op.Rule.Table] = append(byTable[op.Rule.Table], i)
+		}
+		if len(tables) == 0 {
+			continue
+		}
+		sort.Strings(tables)
+
+		batch := restoreBatch{family: family, tables: tables, ops: byTable, lines: make(map[int]int), commits: make(map[int]string)}
+		var buf bytes.Buffer
+		line := 0
+		for _, table := range tables {
+			fmt.Fprintf(&buf, "*%v\n", table)
+			line++
+			for _, i := range byTable[table] {
+				specs, err := restoreLines(ops[i])
+				if err != nil {
+					return nil, &TransactionError{Index: i, Op: ops[i], Err: err}
+				}
+				for _, spec := range specs {
+					buf.WriteString(spec + "\n")
+					line++
+					batch.lines[line] = i
+				}
+			}
+			buf.WriteString("COMMIT\n")
+			line++
+			batch.commits[line] = table
+		}
+		batch.input = buf.Bytes()
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// restoreLines returns commands of iptables-restore for the operation.
+// i.e -A INPUT -p tcp --dport 8080 -j DROP
+func restoreLines(op Operation) ([]string, error) {
+	switch op.Type {
+	case OpNewChain:
+		// with --noflush, declaring existing chain flushes it
+		return []string{fmt.Sprintf(":%v - [0:0]", op.Rule.Chain)}, nil
+	case OpDeleteChain:
+		return []string{"-F " + op.Rule.Chain, "-X " + op.Rule.Chain}, nil
+	}
+	line, err := restoreLine(op)
+	if err != nil {
+		return nil, err
+	}
+	return []string{line}, nil
+}
+
+// restoreLine returns command of iptables-restore for adding or deleting the rule.
+func restoreLine(op Operation) (string, error) {
+	var args []string
+	switch {
+	case op.Type == OpDelete:
+		args = []string{"-D", op.Rule.Chain}
+	case op.Rule.Action == "insert":
+		if op.Rule.RuleNumber == "" {
+			return "", fmt.Errorf("to use insert action ,you must need to provides rule_number")
+		}
+		if _, err := strconv.Atoi(op.Rule.RuleNumber); err != nil {
+			return "", err
+		}
+		args = []string{"-I", op.Rule.Chain, op.Rule.RuleNumber}
+	default:
+		args = []string{"-A", op.Rule.Chain}
+	}
+	args = append(args, op.Rule.Construct()...)
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = RestoreQuote(arg)
+	}
+	return strings.Join(quoted, " "), nil
+}
+
+// RestoreQuote quotes the argument, so iptables-restore parses it as a single argument.
+// Arguments which don't need quoting are returned as they are.
+func RestoreQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\") {
+		return arg
+	}
+	arg = strings.Replace(arg, `\`, `\\`, -1)
+	arg = strings.Replace(arg, `"`, `\"`, -1)
+	return `"` + arg + `"`
+}
+
+var restoreLineRegexp = regexp.MustCompile(`line:? (\d+)`)
+
+// failedLine returns line number of the input reported by iptables-restore in the error.
+func failedLine(err error) (int, bool) {
+	m := restoreLineRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line, true
+}
+
+// failedOp returns index of the operation rejected by iptables-restore, using line number
+// reported by iptables-restore. It fails if COMMIT of a table was rejected.
+func (batch restoreBatch) failedOp(err error) (int, bool) {
+	line, ok := failedLine(err)
+	if !ok {
+		return 0, false
+	}
+	i, ok := batch.lines[line]
+	return i, ok
+}
+
+// failedTable returns the table rejected by iptables-restore, which is the table of the first
+// COMMIT following the line reported by iptables-restore.
+func (batch restoreBatch) failedTable(err error) (string, bool) {
+	line, ok := failedLine(err)
+	if !ok {
+		return "", false
+	}
+	commit := -1
+	for l := range batch.commits {
+		if l >= line && (commit < 0 || l < commit) {
+			commit = l
+		}
+	}
+	if commit < 0 {
+		return "", false
+	}
+	return batch.commits[commit], true
+}
+
+// testOps returns index of the operation of the table, which is rejected by iptables-restore --test.
+// Operations are tested one by one, each along with the preceding ones, so rules which depend on
+// chains created by the transaction are tested as they are applied.
+func (batch restoreBatch) testOps(ops []Operation, table string) (int, bool) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%v\n", table)
+	for _, i := range batch.ops[table] {
+		lines, err := restoreLines(ops[i])
+		if err != nil {
+			return i, true
+		}
+		for _, l := range lines {
+			buf.WriteString(l + "\n")
+		}
+		input := append(append([]byte(nil), buf.Bytes()...), "COMMIT\n"...)
+		if _, err := command.RunCommandWithInput(input, restoreCommand(batch.family), "--test", "--noflush"); err != nil {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func hasFamily(r Rule, family Family) bool {
+	families, _ := r.Families()
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleExists(r Rule, family Family) (bool, error) {
+	ipt, err := newIPTables(family)
+	if err != nil {
+		return false, err
+	}
+	return ipt.Exists(r.Table, r.Chain, r.Construct()...)
+}
+
+// saveTables returns output of iptables-save for given tables.
+func saveTables(family Family, tables []string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, table := range tables {
+		out, err := command.RunCommandWithInput(nil, saveCommand(family), "-t", table)
+		if err != nil {
+			return nil, fmt.Errorf("unable to save table %v: %v", table, err)
+		}
+		buf.Write(out)
+	}
+	return buf.Bytes(), nil
+}
+
+// rollback reverts operations of committed tables of applied batches in reverse order.
+func rollback(ops []Operation, applied []committedBatch) error {
+	var firstErr error
+	for i := len(applied) - 1; i >= 0; i-- {
+		err := applied[i].batch.revert(ops, applied[i].tables)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%v: %v", applied[i].batch.family, err)
+		}
+	}
+	return firstErr
+}
+
+// revert reverts operations of the batch applied to given tables. Rules deleted by the batch
+// are inserted back at their position in the snapshot, once other operations are reverted.
+func (batch restoreBatch) revert(ops []Operation, tables []string) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	saved := parseSave(batch.snapshot)
+	input, deleted, err := revertInput(ops, batch.ops, tables, saved)
+	if err != nil {
+		return err
+	}
+	if _, err := command.RunCommandWithInput(input, restoreCommand(batch.family), "--noflush"); err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	var deletedTables []string
+	for table := range deleted {
+		deletedTables = append(deletedTables, table)
+	}
+	sort.Strings(deletedTables)
+	out, err := saveTables(batch.family, deletedTables)
+	if err != nil {
+		return err
+	}
+	input = reinsertInput(saved, parseSave(out), deleted)
+	_, err = command.RunCommandWithInput(input, restoreCommand(batch.family), "--noflush")
+	return err
+}
+
+// savedTables maps tables to their chains, and chains to their rules as printed by iptables-save,
+// i.e -A INPUT -p tcp -m tcp --dport 80 -j ACCEPT
+type savedTables map[string]map[string][]string
+
+// parseSave parses output of iptables-save.
+func parseSave(out []byte) savedTables {
+	tables := make(savedTables)
+	var chains map[string][]string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "*"):
+			chains = make(map[string][]string)
+			tables[line[1:]] = chains
+		case chains == nil || len(fields) == 0:
+		case strings.HasPrefix(line, ":"):
+			chains[fields[0][1:]] = nil
+		case fields[0] == "-A" && len(fields) > 1:
+			chains[fields[1]] = append(chains[fields[1]], line)
+		}
+	}
+	return tables
+}
+
+// revertInput returns input of iptables-restore reverting given operations applied to the tables,
+// in reverse order. Added rules are deleted and created chains are deleted, while flushed and
+// deleted chains are refilled with their rules in the snapshot. Deleted rules can't be reverted
+// by their position, so the number of rules deleted from each chain of each table is returned.
+func revertInput(ops []Operation, applied map[string][]int, tables []string, saved savedTables) ([]byte, map[string]map[string]int, error) {
+	var buf bytes.Buffer
+	deleted := make(map[string]map[string]int)
+	for _, table := range tables {
+		fmt.Fprintf(&buf, "*%v\n", table)
+		chains := saved[table]
+		indices := applied[table]
+		for j := len(indices) - 1; j >= 0; j-- {
+			op := ops[indices[j]]
+			chain := op.Rule.Chain
+			switch op.Type {
+			case OpAdd:
+				line, err := restoreLine(Operation{Type: OpDelete, Rule: op.Rule})
+				if err != nil {
+					return nil, nil, err
+				}
+				buf.WriteString(line + "\n")
+			case OpDelete:
+				if deleted[table] == nil {
+					deleted[table] = make(map[string]int)
+				}
+				deleted[table][chain]++
+			case OpNewChain:
+				rules, existed := chains[chain]
+				buf.WriteString("-F " + chain + "\n")
+				if !existed {
+					buf.WriteString("-X " + chain + "\n")
+				}
+				for _, r := range rules {
+					buf.WriteString(r + "\n")
+				}
+			case OpDeleteChain:
+				fmt.Fprintf(&buf, ":%v - [0:0]\n", chain)
+				for _, r := range chains[chain] {
+					buf.WriteString(r + "\n")
+				}
+			}
+		}
+		buf.WriteString("COMMIT\n")
+	}
+	return buf.Bytes(), deleted, nil
+}
+
+// reinsertInput returns input of iptables-restore inserting rules of the snapshot, which are
+// missing in current tables, back at their position. At most the number of deleted rules of
+// each chain is inserted into the chain.
+func reinsertInput(saved, current savedTables, deleted map[string]map[string]int) []byte {
+	var buf bytes.Buffer
+	var tables []string
+	for table := range deleted {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Fprintf(&buf, "*%v\n", table)
+		var chains []string
+		for chain := range deleted[table] {
+			chains = append(chains, chain)
+		}
+		sort.Strings(chains)
+		for _, chain := range chains {
+			limit := deleted[table][chain]
+			cur := current[table][chain]
+			// j is the index of current rules matched so far, rules are inserted before it
+			j, inserted := 0, 0
+			for _, rule := range saved[table][chain] {
+				if inserted == limit {
+					break
+				}
+				if k := indexOf(cur[j:], rule); k >= 0 {
+					j += k + 1
+					continue
+				}
+				fmt.Fprintf(&buf, "-I %v %v%v\n", chain, j+inserted+1, strings.TrimPrefix(rule, "-A "+chain))
+				inserted++
+			}
+		}
+		buf.WriteString("COMMIT\n")
+	}
+	return buf.Bytes()
+}
+
+func indexOf(rules []string, rule string) int {
+	for i, r := range rules {
+		if r == rule {
+			return i
+		}
+	}
+	return -1
+}
+
+func restoreCommand(family Family) string {
+	if family == IPv6 {
+		return "ip6tables-restore"
+	}
+	return "iptables-restore"
+}
+
+func saveCommand(family Family) string {
+	if family == IPv6 {
+		return "ip6tables-save"
+	}
+	return "iptables-save"
+}
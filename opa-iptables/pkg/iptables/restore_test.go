@@ -0,0 +1,166 @@
+package iptables
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRestoreLine(t *testing.T) {
+	var testcases = []struct {
+		op     Operation
+		result string
+	}{
+		{
+			Operation{Type: OpAdd, Rule: Rule{Chain: "INPUT", Protocol: "tcp", DestinationPort: "8080", Jump: "DROP"}},
+			"-A INPUT -p tcp --dport 8080 -j DROP",
+		},
+		{
+			Operation{Type: OpAdd, Rule: Rule{Chain: "INPUT", Action: "insert", RuleNumber: "2", Jump: "ACCEPT"}},
+			"-I INPUT 2 -j ACCEPT",
+		},
+		{
+			Operation{Type: OpDelete, Rule: Rule{Chain: "OUTPUT", Jump: "DROP", Comment: "block all"}},
+			`-D OUTPUT -j DROP -m comment --comment "\"block all\""`,
+		},
+	}
+	for _, tt := range testcases {
+		line, err := restoreLine(tt.op)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if line != tt.result {
+			t.Errorf("Expected %v, got %v", tt.result, line)
+		}
+	}
+
+	if _, err := restoreLine(Operation{Type: OpAdd, Rule: Rule{Chain: "INPUT", Action: "insert"}}); err == nil {
+		t.Errorf("Expected error for insert action without rule_num")
+	}
+}
+
+func TestRestoreLines(t *testing.T) {
+	var tx Transaction
+	tx.NewChain("filter", "OPA-web-INPUT", DualStack)
+	tx.DeleteChain("filter", "OPA-old-INPUT", DualStack)
+
+	var result [][]string
+	for _, op := range tx.Ops {
+		lines, err := restoreLines(op)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		result = append(result, lines)
+	}
+	expected := [][]string{
+		{":OPA-web-INPUT - [0:0]"},
+		{"-F OPA-old-INPUT", "-X OPA-old-INPUT"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestFailedOp(t *testing.T) {
+	batch := restoreBatch{lines: map[int]int{2: 0, 3: 4}}
+	var testcases = []struct {
+		err   error
+		index int
+		ok    bool
+	}{
+		{errors.New("exit status 1: iptables-restore: line 3 failed"), 4, true},
+		{errors.New("exit status 1: iptables-restore v1.8.7 (nf_tables): line 2: RULE_DELETE failed (Bad rule): rule in chain INPUT"), 0, true},
+		{errors.New("exit status 1: iptables-restore: line 4 failed"), 0, false},
+		{errors.New("exit status 2"), 0, false},
+	}
+	for _, tt := range testcases {
+		index, ok := batch.failedOp(tt.err)
+		if index != tt.index || ok != tt.ok {
+			t.Errorf("%v: expected (%v, %v), got (%v, %v)", tt.err, tt.index, tt.ok, index, ok)
+		}
+	}
+}
+
+func TestFailedTable(t *testing.T) {
+	batch := restoreBatch{commits: map[int]string{4: "filter", 7: "nat"}}
+	var testcases = []struct {
+		err   error
+		table string
+		ok    bool
+	}{
+		{errors.New("exit status 1: iptables-restore: line 3 failed"), "filter", true},
+		{errors.New("exit status 1: iptables-restore: line 4 failed"), "filter", true},
+		{errors.New("exit status 1: iptables-restore: line 7 failed"), "nat", true},
+		{errors.New("exit status 1: iptables-restore: line 8 failed"), "", false},
+		{errors.New("exit status 2"), "", false},
+	}
+	for _, tt := range testcases {
+		table, ok := batch.failedTable(tt.err)
+		if table != tt.table || ok != tt.ok {
+			t.Errorf("%v: expected (%v, %v), got (%v, %v)", tt.err, tt.table, tt.ok, table, ok)
+		}
+	}
+}
+
+const savedFilter = `# Generated by iptables-save
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OPA-web - [0:0]
+-A INPUT -s 10.0.0.1/32 -j DROP
+-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
+-A INPUT -j OPA-web
+-A OPA-web -p tcp -m tcp --dport 80 -j ACCEPT
+COMMIT
+`
+
+func TestRevertInput(t *testing.T) {
+	var tx Transaction
+	tx.NewChain("filter", "OPA-db", IPv4)
+	tx.Add(Rule{Table: "filter", Chain: "OPA-db", Protocol: "tcp", DestinationPort: "5432", Jump: "ACCEPT"})
+	tx.Add(Rule{Table: "filter", Chain: "INPUT", Jump: "OPA-db"})
+	tx.Delete(Rule{Table: "filter", Chain: "INPUT", Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"})
+	tx.Delete(Rule{Table: "filter", Chain: "INPUT", Jump: "OPA-web"})
+	tx.DeleteChain("filter", "OPA-web", IPv4)
+
+	applied := map[string][]int{"filter": {0, 1, 2, 3, 4, 5}}
+	input, deleted, err := revertInput(tx.Ops, applied, []string{"filter"}, parseSave([]byte(savedFilter)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `*filter
+:OPA-web - [0:0]
+-A OPA-web -p tcp -m tcp --dport 80 -j ACCEPT
+-D INPUT -j OPA-db
+-D OPA-db -p tcp --dport 5432 -j ACCEPT
+-F OPA-db
+-X OPA-db
+COMMIT
+`
+	if string(input) != expected {
+		t.Errorf("Expected %v, got %v", expected, string(input))
+	}
+	if !reflect.DeepEqual(deleted, map[string]map[string]int{"filter": {"INPUT": 2}}) {
+		t.Errorf("unexpected deleted rules %v", deleted)
+	}
+}
+
+func TestReinsertInput(t *testing.T) {
+	// another process appended a rule to INPUT after the transaction deleted two of its rules
+	current := parseSave([]byte(`*filter
+:INPUT ACCEPT [0:0]
+-A INPUT -s 10.0.0.1/32 -j DROP
+-A INPUT -s 10.0.0.2/32 -j DROP
+COMMIT
+`))
+	deleted := map[string]map[string]int{"filter": {"INPUT": 2}}
+	input := reinsertInput(parseSave([]byte(savedFilter)), current, deleted)
+	expected := `*filter
+-I INPUT 2 -p tcp -m tcp --dport 22 -j ACCEPT
+-I INPUT 3 -j OPA-web
+COMMIT
+`
+	if string(input) != expected {
+		t.Errorf("Expected %v, got %v", expected, string(input))
+	}
+}
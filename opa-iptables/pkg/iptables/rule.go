@@ -117,16 +117,103 @@ type Rule struct {
 	// Possible states are INVALID, NEW, ESTABLISHED, RELATED, UNTRACKED, SNAT, DNAT
 	Ctstate []string `json:"ctstate,omitempty"`
 
+	// Matches a set of source or destination ports using multiport module.
+	Multiport *Multiport `json:"multiport,omitempty"`
+
+	// Limits the rate of matching packets using limit module.
+	Limit *Limit `json:"limit,omitempty"`
+
+	// Limits the rate of matching packets per group of packets (i.e. per source address) using hashlimit module.
+	HashLimit *HashLimit `json:"hashlimit,omitempty"`
+
+	// Matches addresses of a dynamic list maintained by recent module.
+	Recent *Recent `json:"recent,omitempty"`
+
+	// Matches source MAC address, which must be of the form XX:XX:XX:XX:XX:XX.
+	// It's only valid for packets entering the PREROUTING, FORWARD and INPUT chains.
+	// A ! argument before the address inverts the sense of the match.
+	MacSource string `json:"mac_source,omitempty"`
+
+	// Matches the owner of the socket which created the packet using owner module.
+	Owner *Owner `json:"owner,omitempty"`
+
+	// Matches netfilter mark of the packet using mark module. i.e 0x1, 0x1/0xff
+	// A ! argument before the mark inverts the sense of the match.
+	Mark string `json:"mark,omitempty"`
+
+	// Matches netfilter mark of the connection using connmark module. i.e 0x1, 0x1/0xff
+	// A ! argument before the mark inverts the sense of the match.
+	ConnMark string `json:"connmark,omitempty"`
+
+	// Matches addresses, ports or networks stored in an ipset using set module.
+	// A ! argument before the name of the set inverts the sense of the match.
+	MatchSet *MatchSet `json:"match_set,omitempty"`
+
+	// Matches ICMP type, which can be a numeric type, type/code or one of the names shown by
+	// "iptables -p icmp -h". It requires protocol icmp, or icmpv6 for ICMPv6 types.
+	// A ! argument before the type inverts the sense of the match.
+	ICMPType string `json:"icmp_type,omitempty"`
+
+	// Matches types of source and destination addresses using addrtype module.
+	AddrType *AddrType `json:"addrtype,omitempty"`
+
 	// Specifies a match to use, that is, an extension module that tests for a specific property.
 	// The set of matches make up the condition under which a target is invoked.
 	// Matches are evaluated first to last if specified as an array and work in short-circuit fashion,
 	// i.e. if one extension yields false, evaluation will stop.
 	Match []string `json:"match,omitempty"`
 
+	// Prefix of log messages of LOG and NFLOG targets. Up to 29 characters for LOG and 64 for NFLOG.
 	LogPrefix string `json:"log_prefix,omitempty"`
 
+	// Level of logging of LOG target, which can be a number or a name.
+	// Choices : emerg | alert | crit | error | warning | notice | info | debug
+	LogLevel string `json:"log_level,omitempty"`
+
+	// Netlink group to which NFLOG target sends packets. Default is 0.
+	NFLogGroup string `json:"nflog_group,omitempty"`
+
+	// Type of the error packet sent back by REJECT target. i.e icmp-host-prohibited, tcp-reset
+	// Default : icmp-port-unreachable (icmp6-port-unreachable for ipv6)
+	RejectWith string `json:"reject_with,omitempty"`
+
+	// Mark set by MARK (packet mark), CONNMARK (connection mark) and TPROXY (packet mark) targets,
+	// in form of value[/mask]. Bits of the mark which are zero in the mask are left untouched.
+	SetMark string `json:"set_mark,omitempty"`
+
+	// CONNMARK target copies the packet mark to the connection mark.
+	SaveMark bool `json:"save_mark,omitempty"`
+
+	// CONNMARK target copies the connection mark to the packet mark.
+	RestoreMark bool `json:"restore_mark,omitempty"`
+
+	// Port to which TPROXY target redirects packets. It's only valid in PREROUTING chain of mangle table.
+	OnPort string `json:"on_port,omitempty"`
+
+	// Address to which TPROXY target redirects packets. Default is the address of incoming interface.
+	OnIP string `json:"on_ip,omitempty"`
+
+	// CT target disables connection tracking for matching packets, same as NOTRACK target.
+	// It's only valid in raw table.
+	CTNoTrack bool `json:"ct_notrack,omitempty"`
+
+	// Conntrack zone assigned by CT target.
+	CTZone string `json:"ct_zone,omitempty"`
+
+	// Conntrack helper assigned by CT target. i.e ftp
+	CTHelper string `json:"ct_helper,omitempty"`
+
+	// Randomize source port mapping of SNAT, DNAT, MASQUERADE and REDIRECT targets.
+	Random bool `json:"random,omitempty"`
+
 	// This specifies a comment that will be added to the rule.
 	Comment string `json:"comment,omitempty"`
+
+	// Address family of the rule. Rule is programmed using iptables for ipv4 and ip6tables for ipv6.
+	// Choices : ipv4 | ipv6 | both
+	// Default : inferred from the addresses used in the rule. Rule without any address is
+	//           programmed into ipv4 only, unless the controller is started with -default-family.
+	Family Family `json:"family,omitempty"`
 }
 
 type TcpFlags struct {
@@ -169,14 +256,30 @@ func (rs *ruleSpec) addComment(matchs []string, comment string) {
 	for _, match := range matchs {
 		if match == "comment" && comment != "" {
 			rs.addMatch("comment")
-			rs.spec = append(rs.spec, "--comment", fmt.Sprintf("\"%s\"", comment))
+			rs.spec = append(rs.spec, "--comment", quoteComment(comment))
 			return
 		}
 	}
 	if comment != "" {
 		rs.addMatch("comment")
-		rs.spec = append(rs.spec, "--comment", fmt.Sprintf("\"%s\"", comment))
+		rs.spec = append(rs.spec, "--comment", quoteComment(comment))
+	}
+}
+
+// quoteComment wraps the comment in literal quotes. Rules are installed without a shell, so
+// the quotes are a part of the comment installed into the kernel.
+func quoteComment(comment string) string {
+	return fmt.Sprintf("\"%s\"", comment)
+}
+
+// UnquoteComment returns the comment of the rule from the comment installed into the kernel, by
+// removing the literal quotes added by quoteComment. Rules parsed from iptables commands and
+// iptables-save output are normalized by it, so they are equal to the rules they were built from.
+func UnquoteComment(comment string) string {
+	if len(comment) >= 2 && strings.HasPrefix(comment, `"`) && strings.HasSuffix(comment, `"`) {
+		return comment[1 : len(comment)-1]
 	}
+	return comment
 }
 
 func (rs *ruleSpec) addIPRange(matchs []string, sourceRange, destinationRange string) {
@@ -241,11 +344,31 @@ func (r *Rule) Construct() []string {
 	rs.addIPRange(r.Match, r.SourceRange, r.DestinationRange)
 	rs.addCTState(r.Match, r.Ctstate)
 	rs.addTCPFlags(r.TCPFlags)
+	rs.addMultiport(r.Multiport)
+	rs.addLimit(r.Limit)
+	rs.addHashLimit(r.HashLimit)
+	rs.addRecent(r.Recent)
+	if r.MacSource != "" {
+		rs.addMatch("mac")
+		rs.addParam(r.MacSource, "--mac-source")
+	}
+	rs.addOwner(r.Owner)
+	if r.Mark != "" {
+		rs.addMatch("mark")
+		rs.addParam(r.Mark, "--mark")
+	}
+	if r.ConnMark != "" {
+		rs.addMatch("connmark")
+		rs.addParam(r.ConnMark, "--mark")
+	}
+	rs.addMatchSet(r.MatchSet)
+	rs.addICMPType(r.Protocol, r.ICMPType)
+	rs.addAddrType(r.AddrType)
 	rs.addParam(r.Jump, "-j")
 	rs.addParam(r.ToSource, "--to-source")
 	rs.addParam(r.ToDestination, "--to-destination")
 	rs.addParam(r.ToPorts, "--to-ports")
-	rs.addParam(r.LogPrefix, "--log-prefix")
+	rs.addTarget(r)
 	rs.addComment(r.Match, r.Comment)
 	return rs.spec
 }
@@ -272,12 +395,38 @@ func UnmarshalRules(data []byte) ([]Rule,error) {
 	return rules.Rules, nil
 }
 
+// AddRule inserts the rule into the kernel for each address family of the rule.
+// If the rule can't be inserted into one of the families, it's deleted from families
+// it was already inserted into.
 func (r *Rule) AddRule() error {
-	ipt, err := goiptables.NewWithProtocol(goiptables.ProtocolIPv4)
+	families, err := r.Families()
 	if err != nil {
 		return err
 	}
+	var applied []Family
+	for _, family := range families {
+		ipt, err := newIPTables(family)
+		if err != nil {
+			return r.undo(err, applied, r.deleteRule)
+		}
+		// appending already existing rule doesn't change anything, so it must not be undone
+		exists := false
+		if r.Action != "insert" {
+			if exists, err = ipt.Exists(r.Table, r.Chain, r.Construct()...); err != nil {
+				return r.undo(fmt.Errorf("%v: %v", family, err), applied, r.deleteRule)
+			}
+		}
+		if err := r.addRule(ipt); err != nil {
+			return r.undo(fmt.Errorf("%v: %v", family, err), applied, r.deleteRule)
+		}
+		if !exists {
+			applied = append(applied, family)
+		}
+	}
+	return nil
+}
 
+func (r *Rule) addRule(ipt *goiptables.IPTables) error {
 	switch r.Action {
 	// inserts rulespec to specified table/chain (in specified position)
 	case "insert":
@@ -286,41 +435,107 @@ func (r *Rule) AddRule() error {
 			if err != nil {
 				return err
 			}
-			ipt.Insert(r.Table, r.Chain, ruleNum, r.Construct()...)
-		} else {
-			return errors.New("to use insert action ,you must need to provides rule_number")
+			return ipt.Insert(r.Table, r.Chain, ruleNum, r.Construct()...)
 		}
+		return errors.New("to use insert action ,you must need to provides rule_number")
 	default:
 		// appends rulespec to specified table/chain
 		return ipt.AppendUnique(r.Table, r.Chain, r.Construct()...)
 	}
-	return nil
 }
 
+// DeleteRule deletes the rule from the kernel for each address family of the rule.
+// If the rule can't be deleted from one of the families, it's inserted back into families
+// it was already deleted from, using its action.
 func (r *Rule) DeleteRule() error {
-	ipt, err := goiptables.NewWithProtocol(goiptables.ProtocolIPv4)
+	families, err := r.Families()
 	if err != nil {
 		return err
 	}
+	var applied []Family
+	for _, family := range families {
+		ipt, err := newIPTables(family)
+		if err != nil {
+			return r.undo(err, applied, r.addRule)
+		}
+		if err := r.deleteRule(ipt); err != nil {
+			return r.undo(fmt.Errorf("%v: %v", family, err), applied, r.addRule)
+		}
+		applied = append(applied, family)
+	}
+	return nil
+}
+
+func (r *Rule) deleteRule(ipt *goiptables.IPTables) error {
 	return ipt.Delete(r.Table, r.Chain, r.Construct()...)
 }
 
+// undo reverts the change of the rule in already applied families using revert, after applying
+// it to another family failed with err. Errors of reverting are appended to err.
+func (r *Rule) undo(err error, applied []Family, revert func(*goiptables.IPTables) error) error {
+	for i := len(applied) - 1; i >= 0; i-- {
+		ipt, undoErr := newIPTables(applied[i])
+		if undoErr == nil {
+			undoErr = revert(ipt)
+		}
+		if undoErr != nil {
+			err = fmt.Errorf("%v (undo failed: %v: %v)", err, applied[i], undoErr)
+		}
+	}
+	return err
+}
+
+// SetDefaults adds default values of table and chain to the rule, if it doesn't provide them.
+func (r *Rule) SetDefaults() {
+	r.init()
+}
+
 // adding default values to IPTables rules (if user not provides it)
 func (r *Rule) init() {
 	r.Table = strings.ToLower(r.Table)
 	if r.Table == "" {
 		r.Table = "filter"
 	}
-	r.Chain = strings.ToUpper(r.Chain)
+	r.Chain = chainName(r.Chain)
 	if r.Chain == "" {
 		r.Chain = "INPUT"
 	}
 }
 
-func ListRules(table, chain string) ([]string, error) {
-	ipt, err := goiptables.NewWithProtocol(goiptables.ProtocolIPv4)
-	if err != nil {
-		return nil, err
+var builtinChains = map[string]bool{
+	"INPUT":       true,
+	"FORWARD":     true,
+	"OUTPUT":      true,
+	"PREROUTING":  true,
+	"POSTROUTING": true,
+}
+
+// chainName uppercases names of the standard chains. Names of user defined chains are case sensitive.
+func chainName(chain string) string {
+	if upper := strings.ToUpper(chain); builtinChains[upper] {
+		return upper
+	}
+	return chain
+}
+
+// IsBuiltinChain reports whether chain is one of the standard chains of iptables.
+func IsBuiltinChain(chain string) bool {
+	return builtinChains[strings.ToUpper(chain)]
+}
+
+// ListRules lists rules of given table and chain by family. For DualStack family, rules of both families are listed.
+func ListRules(table, chain string, family Family) (map[Family][]string, error) {
+	rules := make(map[Family][]string)
+	for _, f := range family.Expand() {
+		ipt, err := newIPTables(f)
+		if err != nil {
+			return nil, err
+		}
+		r, err := ipt.List(strings.ToLower(table), chainName(chain))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", f, err)
+		}
+		rules[f] = r
 	}
-	return ipt.List(strings.ToLower(table), strings.ToUpper(chain))
+	return rules, nil
 }
@@ -9,7 +9,11 @@ type RuleSet struct {
 	Metadata struct {
 		ID string `json:"_id"`
 	} `json:"metadata"`
-	Rules []Rule `json:"rules"`
+	// Family is used as a default address family for rules which don't specify it.
+	Family Family `json:"family,omitempty"`
+	Rules  []Rule `json:"rules"`
+	// Sets are ipsets created before rules are inserted, so rules can reference them using match_set.
+	Sets []Set `json:"sets,omitempty"`
 }
 
 type OpaResponse struct {
@@ -34,5 +38,21 @@ func UnmarshalRuleset(opaQueryRes []byte) ([]RuleSet, error) {
 	if or.isEmpty() {
 		return []RuleSet{},nil
 	}
+	for i := range or.RuleSets {
+		or.RuleSets[i].setDefaultFamily()
+	}
 	return or.RuleSets, nil
-}
\ No newline at end of file
+}
+
+// setDefaultFamily propagates family of the ruleset to the rules which don't specify it,
+// so rules keep their family when they are stored and deleted later.
+func (rs *RuleSet) setDefaultFamily() {
+	if rs.Family == "" {
+		return
+	}
+	for i := range rs.Rules {
+		if rs.Rules[i].Family == "" {
+			rs.Rules[i].Family = rs.Family
+		}
+	}
+}
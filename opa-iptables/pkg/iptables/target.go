@@ -0,0 +1,33 @@
+package iptables
+
+import (
+	"strings"
+)
+
+// addTarget adds options of the target of the rule. Options which don't belong to the target
+// are passed as they are, so iptables reports them.
+func (rs *ruleSpec) addTarget(r *Rule) {
+	switch strings.ToUpper(r.Jump) {
+	case "NFLOG":
+		rs.addParam(r.NFLogGroup, "--nflog-group")
+		rs.addParam(r.LogPrefix, "--nflog-prefix")
+	case "TPROXY":
+		rs.addParam(r.OnPort, "--on-port")
+		rs.addParam(r.OnIP, "--on-ip")
+		rs.addParam(r.SetMark, "--tproxy-mark")
+	default:
+		rs.addParam(r.LogPrefix, "--log-prefix")
+		rs.addParam(r.LogLevel, "--log-level")
+		rs.addParam(r.NFLogGroup, "--nflog-group")
+		rs.addParam(r.RejectWith, "--reject-with")
+		rs.addParam(r.SetMark, "--set-mark")
+		rs.addFlag(r.SaveMark, "--save-mark")
+		rs.addFlag(r.RestoreMark, "--restore-mark")
+		rs.addParam(r.OnPort, "--on-port")
+		rs.addParam(r.OnIP, "--on-ip")
+	}
+	rs.addFlag(r.CTNoTrack, "--notrack")
+	rs.addParam(r.CTZone, "--zone")
+	rs.addParam(r.CTHelper, "--helper")
+	rs.addFlag(r.Random, "--random")
+}
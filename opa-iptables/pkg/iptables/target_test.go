@@ -0,0 +1,96 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTargetConstruction(t *testing.T) {
+	var testcases = []struct {
+		rule   Rule
+		result []string
+	}{
+		{
+			Rule{Protocol: "tcp", Jump: "REJECT", RejectWith: "tcp-reset"},
+			[]string{"-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset"},
+		},
+		{
+			Rule{Jump: "LOG", LogPrefix: "dropped: ", LogLevel: "warning"},
+			[]string{"-j", "LOG", "--log-prefix", "dropped: ", "--log-level", "warning"},
+		},
+		{
+			Rule{Jump: "NFLOG", NFLogGroup: "5", LogPrefix: "audit"},
+			[]string{"-j", "NFLOG", "--nflog-group", "5", "--nflog-prefix", "audit"},
+		},
+		{
+			Rule{Jump: "MARK", SetMark: "0x1/0xff"},
+			[]string{"-j", "MARK", "--set-mark", "0x1/0xff"},
+		},
+		{
+			Rule{Jump: "CONNMARK", RestoreMark: true},
+			[]string{"-j", "CONNMARK", "--restore-mark"},
+		},
+		{
+			Rule{Protocol: "tcp", Jump: "TPROXY", OnPort: "15001", OnIP: "127.0.0.1", SetMark: "0x1/0x1"},
+			[]string{"-p", "tcp", "-j", "TPROXY", "--on-port", "15001", "--on-ip", "127.0.0.1", "--tproxy-mark", "0x1/0x1"},
+		},
+		{
+			Rule{Jump: "CT", CTNoTrack: true},
+			[]string{"-j", "CT", "--notrack"},
+		},
+		{
+			Rule{Jump: "CT", CTZone: "1", CTHelper: "ftp"},
+			[]string{"-j", "CT", "--zone", "1", "--helper", "ftp"},
+		},
+		{
+			Rule{Jump: "MASQUERADE", Random: true},
+			[]string{"-j", "MASQUERADE", "--random"},
+		},
+	}
+
+	for _, tt := range testcases {
+		if !reflect.DeepEqual(tt.result, tt.rule.Construct()) {
+			t.Errorf("Expected %s, but got %s", tt.result, tt.rule.Construct())
+		}
+	}
+}
+
+func TestValidateTargets(t *testing.T) {
+	var testcases = []struct {
+		rule   Rule
+		fields []string
+	}{
+		{Rule{Protocol: "tcp", Jump: "REJECT", RejectWith: "tcp-reset"}, nil},
+		{Rule{Jump: "REJECT", RejectWith: "tcp-reset"}, []string{"reject_with"}},
+		{Rule{Jump: "REJECT", RejectWith: "icmp-bogus"}, []string{"reject_with"}},
+		{Rule{Family: IPv6, Jump: "REJECT", RejectWith: "icmp-host-prohibited"}, []string{"reject_with"}},
+		{Rule{Table: "nat", Chain: "PREROUTING", Jump: "REJECT"}, []string{"jump"}},
+		{Rule{Protocol: "tcp", Jump: "DROP", RejectWith: "tcp-reset"}, []string{"reject_with"}},
+		{Rule{Jump: "LOG", LogLevel: "loud"}, []string{"log_level"}},
+		{Rule{Jump: "NFLOG", NFLogGroup: "70000"}, []string{"nflog_group"}},
+		{Rule{Table: "mangle", Jump: "MARK", SetMark: "0x1/0xff"}, nil},
+		{Rule{Table: "mangle", Jump: "MARK"}, []string{"set_mark"}},
+		{Rule{Table: "mangle", Jump: "MARK", SetMark: "one"}, []string{"set_mark"}},
+		{Rule{Table: "mangle", Jump: "CONNMARK", SaveMark: true, RestoreMark: true}, []string{"jump"}},
+		{Rule{Jump: "ACCEPT", SaveMark: true}, []string{"save_mark"}},
+		{Rule{Table: "mangle", Chain: "PREROUTING", Protocol: "tcp", Jump: "TPROXY", OnPort: "15001", SetMark: "0x1/0x1"}, nil},
+		{Rule{Table: "mangle", Chain: "PREROUTING", Protocol: "icmp", Jump: "TPROXY", OnPort: "99999"}, []string{"jump", "on_port"}},
+		{Rule{Table: "nat", Chain: "PREROUTING", Protocol: "tcp", Jump: "TPROXY", OnPort: "15001"}, []string{"jump"}},
+		{Rule{Table: "raw", Chain: "PREROUTING", Jump: "CT", CTNoTrack: true}, nil},
+		{Rule{Table: "raw", Chain: "PREROUTING", Jump: "CT"}, []string{"jump"}},
+		{Rule{Table: "raw", Chain: "PREROUTING", Jump: "NOTRACK", CTZone: "1"}, []string{"ct_zone"}},
+		{Rule{Jump: "ACCEPT", Random: true}, []string{"random"}},
+	}
+
+	for i, tt := range testcases {
+		var fields []string
+		if err := tt.rule.Validate(); err != nil {
+			for _, e := range err.(ValidationErrors) {
+				fields = append(fields, e.Field)
+			}
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("Testcase %v: expected invalid fields %v, got %v", i, tt.fields, fields)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package iptables
+
+import (
+	"fmt"
+)
+
+// OpType is the type of change applied to the rule in a Transaction.
+type OpType string
+
+const (
+	// OpAdd inserts the rule according to its action.
+	OpAdd OpType = "add"
+	// OpDelete deletes the rule.
+	OpDelete OpType = "delete"
+	// OpNewChain creates the chain described by Rule.Table and Rule.Chain, or flushes it if it
+	// already exists.
+	OpNewChain OpType = "new_chain"
+	// OpDeleteChain flushes and deletes the chain described by Rule.Table and Rule.Chain.
+	OpDeleteChain OpType = "delete_chain"
+)
+
+// Operation is a single change of a Transaction.
+type Operation struct {
+	Type OpType `json:"op"`
+	Rule Rule   `json:"rule"`
+}
+
+// Transaction is a batch of operations which is applied atomically by Backend.Apply.
+// Either every operation is applied or kernel is left in the state it was before the transaction.
+type Transaction struct {
+	Ops []Operation
+}
+
+// Add adds insertion of given rules to the transaction.
+func (tx *Transaction) Add(rules ...Rule) {
+	for _, r := range rules {
+		tx.Ops = append(tx.Ops, Operation{Type: OpAdd, Rule: r})
+	}
+}
+
+// Delete adds deletion of given rules to the transaction.
+func (tx *Transaction) Delete(rules ...Rule) {
+	for _, r := range rules {
+		tx.Ops = append(tx.Ops, Operation{Type: OpDelete, Rule: r})
+	}
+}
+
+// NewChain adds creation of the chain to the transaction. Existing chain is flushed.
+func (tx *Transaction) NewChain(table, chain string, family Family) {
+	tx.Ops = append(tx.Ops, Operation{Type: OpNewChain, Rule: Rule{Table: table, Chain: chain, Family: family}})
+}
+
+// DeleteChain adds deletion of the chain, including its rules, to the transaction.
+func (tx *Transaction) DeleteChain(table, chain string, family Family) {
+	tx.Ops = append(tx.Ops, Operation{Type: OpDeleteChain, Rule: Rule{Table: table, Chain: chain, Family: family}})
+}
+
+// TransactionError describes the operation of a transaction which was rejected.
+// Index is -1 if rejected operation couldn't be determined.
+type TransactionError struct {
+	Index int
+	Op    Operation
+	Err   error
+	// RollbackErr is set if transaction fails to restore state of the kernel after rejection.
+	RollbackErr error
+}
+
+func (e *TransactionError) Error() string {
+	var msg string
+	if e.Index < 0 {
+		msg = fmt.Sprintf("transaction was rejected: %v", e.Err)
+	} else if e.Op.Type == OpNewChain || e.Op.Type == OpDeleteChain {
+		msg = fmt.Sprintf("%v %v of table %v was rejected: %v", e.Op.Type, e.Op.Rule.Chain, e.Op.Rule.Table, e.Err)
+	} else {
+		msg = fmt.Sprintf("%v of rule %v (%v) was rejected: %v", e.Op.Type, e.Index+1, e.Op.Rule.String(), e.Err)
+	}
+	if e.RollbackErr != nil {
+		msg += fmt.Sprintf(" (rollback failed: %v)", e.RollbackErr)
+	}
+	return msg
+}
+
+// normalize returns copy of operations with default values of rules.
+// Address families of rules are validated before touching the kernel.
+func (tx *Transaction) normalize() ([]Operation, error) {
+	ops := make([]Operation, len(tx.Ops))
+	for i, op := range tx.Ops {
+		op.Rule.init()
+		if _, err := op.Rule.Families(); err != nil {
+			return nil, &TransactionError{Index: i, Op: op, Err: err}
+		}
+		ops[i] = op
+	}
+	return ops, nil
+}
@@ -0,0 +1,800 @@
+package iptables
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FieldError describes invalid value of a single field of the rule.
+// Field is the JSON name of the field, prefixed by the index of the rule for rulesets.
+// i.e rules[1].destination_port
+type FieldError struct {
+	Field   string `json:"field"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("%v: %v", e.Field, e.Message)
+	}
+	return fmt.Sprintf("%v: %q %v", e.Field, e.Value, e.Message)
+}
+
+// ValidationErrors is a list of invalid fields returned by Validate.
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs *ValidationErrors) add(field, value, format string, args ...interface{}) {
+	*errs = append(*errs, FieldError{Field: field, Value: value, Message: fmt.Sprintf(format, args...)})
+}
+
+// chainsOfTable lists builtin chains of each table.
+var chainsOfTable = map[string][]string{
+	"filter":   {"INPUT", "FORWARD", "OUTPUT"},
+	"nat":      {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
+	"mangle":   {"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"},
+	"raw":      {"PREROUTING", "OUTPUT"},
+	"security": {"INPUT", "FORWARD", "OUTPUT"},
+}
+
+// targetScope restricts the table, and builtin chains, in which the target can be used.
+// Targets not listed here can be used in any table. Empty table means any table.
+type targetScope struct {
+	table  string
+	chains []string
+}
+
+var targetScopes = map[string]targetScope{
+	"DNAT":       {"nat", []string{"PREROUTING", "OUTPUT"}},
+	"SNAT":       {"nat", []string{"POSTROUTING", "INPUT"}},
+	"MASQUERADE": {"nat", []string{"POSTROUTING"}},
+	"REDIRECT":   {"nat", []string{"PREROUTING", "OUTPUT"}},
+	"TPROXY":     {"mangle", []string{"PREROUTING"}},
+	"CT":         {"raw", []string{"PREROUTING", "OUTPUT"}},
+	"NOTRACK":    {"raw", []string{"PREROUTING", "OUTPUT"}},
+	"REJECT":     {"", []string{"INPUT", "FORWARD", "OUTPUT"}},
+}
+
+// portProtocols are protocols which support port options.
+var portProtocols = map[string]bool{"tcp": true, "udp": true, "udplite": true, "sctp": true, "dccp": true}
+
+var protocols = map[string]bool{
+	"all": true, "tcp": true, "udp": true, "udplite": true, "icmp": true, "icmpv6": true, "ipv6-icmp": true,
+	"esp": true, "ah": true, "sctp": true, "dccp": true, "gre": true, "mh": true,
+}
+
+// protocolsFile is the netdb file used for resolving names of the other protocols, as iptables
+// does using getprotobyname.
+const protocolsFile = "/etc/protocols"
+
+var (
+	netdbOnce      sync.Once
+	netdbProtocols map[string]int
+)
+
+// lookupProtocol returns the number of the protocol with given name or alias from /etc/protocols.
+func lookupProtocol(name string) (int, bool) {
+	netdbOnce.Do(func() {
+		f, err := os.Open(protocolsFile)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		netdbProtocols = parseProtocols(f)
+	})
+	n, ok := netdbProtocols[strings.ToLower(name)]
+	return n, ok
+}
+
+// parseProtocols parses lines of /etc/protocols format, "name number [aliases...] [# comment]",
+// into protocol numbers by lowercase name and alias.
+func parseProtocols(r io.Reader) map[string]int {
+	numbers := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 0 || n > 255 {
+			continue
+		}
+		for _, name := range append(fields[:1], fields[2:]...) {
+			name = strings.ToLower(name)
+			if _, ok := numbers[name]; !ok {
+				numbers[name] = n
+			}
+		}
+	}
+	return numbers
+}
+
+var tcpFlags = map[string]bool{
+	"SYN": true, "ACK": true, "FIN": true, "RST": true, "URG": true, "PSH": true, "ALL": true, "NONE": true,
+}
+
+var ctstates = map[string]bool{
+	"INVALID": true, "NEW": true, "ESTABLISHED": true, "RELATED": true, "UNTRACKED": true, "SNAT": true, "DNAT": true,
+}
+
+var (
+	chainNameRegexp   = regexp.MustCompile(`^[^\s!-][^\s]{0,27}$`)
+	serviceNameRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+	hostnameRegexp    = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+	interfaceRegexp   = regexp.MustCompile(`^[^\s/]{1,15}$`)
+)
+
+// Validate checks that the rule is consistent before it is programmed into the kernel:
+// table and chain exist, target can be used in the table and chain, options dependent on the
+// protocol or target are used with them, and addresses and ports have valid syntax.
+// ValidationErrors is returned if any field is invalid.
+func (r Rule) Validate() error {
+	var errs ValidationErrors
+	r.validate("", true, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate validates every rule of the ruleset. Fields of ValidationErrors are prefixed by
+// the index of the rule. i.e rules[0].jump
+func (rs RuleSet) Validate() error {
+	return rs.validate(true)
+}
+
+// ValidateDelete validates the ruleset before its rules are deleted. Connection states aren't
+// checked, so rules inserted with states unknown to the validator can still be deleted.
+func (rs RuleSet) ValidateDelete() error {
+	return rs.validate(false)
+}
+
+func (rs RuleSet) validate(insert bool) error {
+	var errs ValidationErrors
+	if _, err := ParseFamily(string(rs.Family)); err != nil {
+		errs.add("family", string(rs.Family), "must be one of ipv4 | ipv6 | both")
+	}
+	for i, r := range rs.Rules {
+		r.validate(fmt.Sprintf("rules[%v].", i), insert, &errs)
+	}
+	rs.validateSets(&errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+var setNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,27}$`)
+
+// validateSets validates sets of the ruleset and rules which reference them.
+func (rs RuleSet) validateSets(errs *ValidationErrors) {
+	families := make(map[string]Family)
+	for i, s := range rs.Sets {
+		field := func(name string) string { return fmt.Sprintf("sets[%v].%v", i, name) }
+		if !setNameRegexp.MatchString(s.Name) {
+			errs.add(field("name"), s.Name, "is not a valid set name")
+		}
+		if _, ok := families[s.Name]; ok {
+			errs.add(field("name"), s.Name, "is used by multiple sets")
+		}
+		families[s.Name] = s.family()
+
+		if s.family() != IPv4 && s.family() != IPv6 {
+			errs.add(field("family"), string(s.Family), "must be one of ipv4 | ipv6")
+		}
+		if !contains([]string{SetHashIP, SetHashNet, SetHashIPPort}, s.Type) {
+			errs.add(field("type"), s.Type, "must be one of %v | %v | %v", SetHashIP, SetHashNet, SetHashIPPort)
+			continue
+		}
+		for j, entry := range s.Entries {
+			validateSetEntry(fmt.Sprintf("sets[%v].entries[%v]", i, j), s, entry, errs)
+		}
+	}
+
+	for i, r := range rs.Rules {
+		if r.MatchSet == nil {
+			continue
+		}
+		name, _ := splitNegation(r.MatchSet.Name)
+		family, ok := families[name]
+		if !ok {
+			continue
+		}
+		if rf, err := r.Families(); err == nil && (len(rf) != 1 || rf[0] != family) {
+			errs.add(fmt.Sprintf("rules[%v].match_set.name", i), r.MatchSet.Name, "references %v set, but rule is not of %v family", family, family)
+		}
+	}
+}
+
+func validateSetEntry(field string, s Set, entry string, errs *ValidationErrors) {
+	addr, port := entry, ""
+	if s.Type == SetHashIPPort {
+		parts := strings.SplitN(entry, ",", 2)
+		if len(parts) != 2 {
+			errs.add(field, entry, "must be in form of address,[protocol:]port")
+			return
+		}
+		addr, port = parts[0], parts[1]
+	}
+
+	if s.Type == SetHashNet && strings.Contains(addr, "/") {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			errs.add(field, entry, "is not a valid network address")
+			return
+		}
+	} else if net.ParseIP(addr) == nil {
+		errs.add(field, entry, "is not a valid ip address")
+		return
+	}
+	if addressFamily(addr) != s.family() {
+		errs.add(field, entry, "is not an %v address", s.family())
+	}
+
+	if port != "" {
+		if i := strings.Index(port, ":"); i >= 0 {
+			if !contains([]string{"tcp", "udp", "sctp", "udplite"}, port[:i]) {
+				errs.add(field, entry, "protocol must be one of tcp | udp | sctp | udplite")
+			}
+			port = port[i+1:]
+		}
+		validatePortRange(field, port, "-", errs)
+	}
+}
+
+func (r Rule) validate(prefix string, insert bool, errs *ValidationErrors) {
+	field := func(name string) string { return prefix + name }
+	r.init()
+
+	chains, ok := chainsOfTable[r.Table]
+	if !ok {
+		errs.add(field("table"), r.Table, "is not a valid table, must be one of filter | nat | mangle | raw | security")
+	}
+	builtin := IsBuiltinChain(r.Chain)
+	switch {
+	case builtin && ok && !contains(chains, r.Chain):
+		errs.add(field("chain"), r.Chain, "is not a chain of table %v, must be one of %v", r.Table, strings.Join(chains, " | "))
+	case !builtin && !chainNameRegexp.MatchString(r.Chain):
+		errs.add(field("chain"), r.Chain, "is not a valid chain name")
+	}
+
+	switch r.Action {
+	case "", "append":
+		if r.RuleNumber != "" {
+			errs.add(field("rule_num"), r.RuleNumber, "can only be used with insert action")
+		}
+	case "insert":
+		if r.RuleNumber == "" {
+			errs.add(field("rule_num"), "", "is required by insert action")
+		} else if n, err := strconv.Atoi(r.RuleNumber); err != nil || n < 1 {
+			errs.add(field("rule_num"), r.RuleNumber, "must be a positive number")
+		}
+	default:
+		errs.add(field("action"), r.Action, "must be one of append | insert")
+	}
+
+	if _, err := r.Families(); err != nil {
+		errs.add(field("family"), string(r.Family), "%v", err)
+	}
+
+	r.validateProtocol(field, errs)
+	validateAddress(field("source"), r.SourceAddress, errs)
+	validateAddress(field("destination"), r.DestinationAddress, errs)
+	validateRange(field("src_range"), r.SourceRange, errs)
+	validateRange(field("dst_range"), r.DestinationRange, errs)
+	r.validateInterfaces(field, errs)
+	r.validateTarget(field, errs)
+	r.validateMatches(field, errs)
+
+	for _, state := range r.Ctstate {
+		if insert && state != "" && !ctstates[strings.ToUpper(strings.TrimPrefix(state, "!"))] {
+			errs.add(field("ctstate"), state, "is not a valid connection state")
+		}
+	}
+	if len(r.Comment) > 256 {
+		errs.add(field("comment"), "", "must not be longer than 256 characters")
+	}
+}
+
+func (r Rule) validateProtocol(field func(string) string, errs *ValidationErrors) {
+	negated := strings.HasPrefix(r.Protocol, "!")
+	proto := strings.ToLower(strings.TrimPrefix(r.Protocol, "!"))
+	if proto != "" && !protocols[proto] {
+		if _, ok := lookupProtocol(proto); !ok {
+			if n, err := strconv.Atoi(proto); err != nil || n < 0 || n > 255 {
+				errs.add(field("protocol"), r.Protocol, "is not a valid protocol")
+			}
+		}
+	}
+
+	// port options are provided by the module of the protocol
+	portsAllowed := portProtocols[proto] && !negated
+	ports := []struct{ name, value string }{
+		{"source_port", r.SourcePort},
+		{"destination_port", r.DestinationPort},
+	}
+	for _, p := range ports {
+		if p.value == "" {
+			continue
+		}
+		if !portsAllowed {
+			errs.add(field(p.name), p.value, "requires protocol tcp | udp | udplite | sctp | dccp")
+		}
+		validatePort(field(p.name), p.value, errs)
+	}
+
+	tf := r.TCPFlags
+	if len(tf.Flags) > 0 || len(tf.FlagsSet) > 0 {
+		if proto != "tcp" || negated {
+			errs.add(field("tcp_flags"), "", "requires protocol tcp")
+		}
+		if len(tf.Flags) == 0 || len(tf.FlagsSet) == 0 {
+			errs.add(field("tcp_flags"), "", "requires both flags and flags_set")
+		}
+		for _, f := range append(append([]string{}, tf.Flags...), tf.FlagsSet...) {
+			if !tcpFlags[strings.ToUpper(f)] {
+				errs.add(field("tcp_flags"), f, "is not a valid tcp flag")
+			}
+		}
+	}
+}
+
+func (r Rule) validateInterfaces(field func(string) string, errs *ValidationErrors) {
+	if r.InInterface != "" {
+		if !interfaceRegexp.MatchString(strings.TrimPrefix(r.InInterface, "!")) {
+			errs.add(field("in_interface"), r.InInterface, "is not a valid interface name")
+		}
+		if r.Chain == "OUTPUT" || r.Chain == "POSTROUTING" {
+			errs.add(field("in_interface"), r.InInterface, "can't be used in %v chain", r.Chain)
+		}
+	}
+	if r.OutInterface != "" {
+		if !interfaceRegexp.MatchString(strings.TrimPrefix(r.OutInterface, "!")) {
+			errs.add(field("out_interface"), r.OutInterface, "is not a valid interface name")
+		}
+		if r.Chain == "INPUT" || r.Chain == "PREROUTING" {
+			errs.add(field("out_interface"), r.OutInterface, "can't be used in %v chain", r.Chain)
+		}
+	}
+}
+
+func (r Rule) validateTarget(field func(string) string, errs *ValidationErrors) {
+	target := strings.ToUpper(r.Jump)
+	if r.Jump != "" && !isBuiltinTarget(r.Jump) && !chainNameRegexp.MatchString(r.Jump) {
+		errs.add(field("jump"), r.Jump, "is not a valid target")
+	}
+	if scope, ok := targetScopes[target]; ok {
+		if scope.table != "" && r.Table != scope.table {
+			errs.add(field("jump"), r.Jump, "can only be used in %v table", scope.table)
+		} else if IsBuiltinChain(r.Chain) && !contains(scope.chains, r.Chain) {
+			errs.add(field("jump"), r.Jump, "can only be used in %v chains", strings.Join(scope.chains, " | "))
+		}
+	}
+
+	proto := strings.ToLower(r.Protocol)
+	switch {
+	case target == "DNAT" && r.ToDestination == "":
+		errs.add(field("to_destination"), "", "is required by DNAT target")
+	case target != "DNAT" && r.ToDestination != "":
+		errs.add(field("to_destination"), r.ToDestination, "can only be used with DNAT target")
+	}
+	switch {
+	case target == "SNAT" && r.ToSource == "":
+		errs.add(field("to_source"), "", "is required by SNAT target")
+	case target != "SNAT" && r.ToSource != "":
+		errs.add(field("to_source"), r.ToSource, "can only be used with SNAT target")
+	}
+	if r.ToPorts != "" {
+		if target != "MASQUERADE" && target != "REDIRECT" {
+			errs.add(field("to_ports"), r.ToPorts, "can only be used with MASQUERADE | REDIRECT targets")
+		}
+		if !portProtocols[proto] {
+			errs.add(field("to_ports"), r.ToPorts, "requires protocol tcp | udp | udplite | sctp | dccp")
+		}
+		validatePortRange(field("to_ports"), r.ToPorts, "-", errs)
+	}
+	r.validateTargetOptions(field, errs)
+}
+
+var logLevels = map[string]bool{
+	"emerg": true, "alert": true, "crit": true, "error": true, "warning": true, "notice": true, "info": true, "debug": true,
+	"0": true, "1": true, "2": true, "3": true, "4": true, "5": true, "6": true, "7": true,
+}
+
+var rejectTypes = map[string]Family{
+	"icmp-net-unreachable":   IPv4,
+	"icmp-host-unreachable":  IPv4,
+	"icmp-port-unreachable":  IPv4,
+	"icmp-proto-unreachable": IPv4,
+	"icmp-net-prohibited":    IPv4,
+	"icmp-host-prohibited":   IPv4,
+	"icmp-admin-prohibited":  IPv4,
+	"icmp6-no-route":         IPv6,
+	"icmp6-adm-prohibited":   IPv6,
+	"icmp6-addr-unreachable": IPv6,
+	"icmp6-port-unreachable": IPv6,
+	"tcp-reset":              DualStack,
+}
+
+// validateTargetOptions validates options of targets other than NAT targets.
+func (r Rule) validateTargetOptions(field func(string) string, errs *ValidationErrors) {
+	target := strings.ToUpper(r.Jump)
+	requires := func(name, value string, set bool, targets ...string) {
+		if set && !contains(targets, target) {
+			errs.add(field(name), value, "can only be used with %v target", strings.Join(targets, " | "))
+		}
+	}
+	requires("log_prefix", r.LogPrefix, r.LogPrefix != "", "LOG", "NFLOG")
+	requires("log_level", r.LogLevel, r.LogLevel != "", "LOG")
+	requires("nflog_group", r.NFLogGroup, r.NFLogGroup != "", "NFLOG")
+	requires("reject_with", r.RejectWith, r.RejectWith != "", "REJECT")
+	requires("set_mark", r.SetMark, r.SetMark != "", "MARK", "CONNMARK", "TPROXY")
+	requires("save_mark", "", r.SaveMark, "CONNMARK")
+	requires("restore_mark", "", r.RestoreMark, "CONNMARK")
+	requires("on_port", r.OnPort, r.OnPort != "", "TPROXY")
+	requires("on_ip", r.OnIP, r.OnIP != "", "TPROXY")
+	requires("ct_notrack", "", r.CTNoTrack, "CT")
+	requires("ct_zone", r.CTZone, r.CTZone != "", "CT")
+	requires("ct_helper", r.CTHelper, r.CTHelper != "", "CT")
+	requires("random", "", r.Random, "SNAT", "DNAT", "MASQUERADE", "REDIRECT")
+
+	if max := map[string]int{"LOG": 29, "NFLOG": 64}[target]; max > 0 && len(r.LogPrefix) > max {
+		errs.add(field("log_prefix"), r.LogPrefix, "must not be longer than %v characters", max)
+	}
+	if r.LogLevel != "" && !logLevels[strings.ToLower(r.LogLevel)] {
+		errs.add(field("log_level"), r.LogLevel, "must be one of emerg | alert | crit | error | warning | notice | info | debug")
+	}
+	if r.NFLogGroup != "" {
+		if n, err := strconv.Atoi(r.NFLogGroup); err != nil || n < 0 || n > 65535 {
+			errs.add(field("nflog_group"), r.NFLogGroup, "must be between 0 and 65535")
+		}
+	}
+
+	if r.RejectWith != "" {
+		family, ok := rejectTypes[r.RejectWith]
+		switch {
+		case !ok:
+			errs.add(field("reject_with"), r.RejectWith, "is not a valid reject type")
+		case family == DualStack && strings.ToLower(r.Protocol) != "tcp":
+			errs.add(field("reject_with"), r.RejectWith, "requires protocol tcp")
+		case family != DualStack:
+			if families, err := r.Families(); err == nil && (len(families) != 1 || families[0] != family) {
+				errs.add(field("reject_with"), r.RejectWith, "requires rule of %v family", family)
+			}
+		}
+	}
+
+	if r.SetMark != "" {
+		if _, _, err := parseMark(r.SetMark); err != nil {
+			errs.add(field("set_mark"), r.SetMark, "is not a valid mark, must be value[/mask]")
+		}
+	}
+	switch target {
+	case "MARK":
+		if r.SetMark == "" {
+			errs.add(field("set_mark"), "", "is required by MARK target")
+		}
+	case "CONNMARK":
+		n := 0
+		for _, set := range []bool{r.SetMark != "", r.SaveMark, r.RestoreMark} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			errs.add(field("jump"), r.Jump, "requires exactly one of set_mark, save_mark and restore_mark")
+		}
+	case "TPROXY":
+		if r.OnPort == "" {
+			errs.add(field("on_port"), "", "is required by TPROXY target")
+		}
+		if p := strings.ToLower(r.Protocol); p != "tcp" && p != "udp" {
+			errs.add(field("jump"), r.Jump, "requires protocol tcp | udp")
+		}
+	case "CT":
+		if !r.CTNoTrack && r.CTZone == "" && r.CTHelper == "" {
+			errs.add(field("jump"), r.Jump, "requires ct_notrack, ct_zone or ct_helper")
+		}
+		if r.CTNoTrack && (r.CTZone != "" || r.CTHelper != "") {
+			errs.add(field("ct_notrack"), "", "can't be used with ct_zone or ct_helper")
+		}
+	}
+	if r.OnPort != "" {
+		validatePortRange(field("on_port"), r.OnPort, ":", errs)
+	}
+	if r.OnIP != "" && net.ParseIP(r.OnIP) == nil {
+		errs.add(field("on_ip"), r.OnIP, "is not a valid ip address")
+	}
+	validateNumber(field("ct_zone"), r.CTZone, errs)
+}
+
+// validatePort validates port specification of --sport and --dport. i.e 80, http, 1024:65535, !22
+func validatePort(field, spec string, errs *ValidationErrors) {
+	validatePortRange(field, strings.TrimPrefix(spec, "!"), ":", errs)
+}
+
+func validatePortRange(field, spec, sep string, errs *ValidationErrors) {
+	parts := strings.Split(spec, sep)
+	if len(parts) > 2 {
+		errs.add(field, spec, "is not a valid port range")
+		return
+	}
+	for i, part := range parts {
+		// first or last port of the range may be omitted
+		if part == "" && len(parts) == 2 {
+			continue
+		}
+		if n, err := strconv.Atoi(part); err == nil {
+			if n < 0 || n > 65535 {
+				errs.add(field, spec, "port must be between 0 and 65535")
+				return
+			}
+			continue
+		}
+		// service names can't be used in ranges
+		if i > 0 || len(parts) > 1 || !serviceNameRegexp.MatchString(part) {
+			errs.add(field, spec, "is not a valid port")
+			return
+		}
+	}
+}
+
+// validateAddress validates address specification of -s and -d.
+// i.e 10.0.0.1, !10.0.0.0/8, 10.0.0.0/255.0.0.0, fd00::/64, example.com
+func validateAddress(field, spec string, errs *ValidationErrors) {
+	addr := strings.TrimPrefix(spec, "!")
+	if addr == "" {
+		return
+	}
+	host, mask := addr, ""
+	if i := strings.Index(addr, "/"); i >= 0 {
+		host, mask = addr[:i], addr[i+1:]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if mask != "" || !hostnameRegexp.MatchString(host) {
+			errs.add(field, spec, "is not a valid address")
+		}
+		return
+	}
+	if mask == "" {
+		return
+	}
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	if n, err := strconv.Atoi(mask); err == nil {
+		if n < 0 || n > bits {
+			errs.add(field, spec, "mask must be between 0 and %v", bits)
+		}
+		return
+	}
+	if m := net.ParseIP(mask); m == nil || (m.To4() == nil) != (bits == 128) {
+		errs.add(field, spec, "is not a valid mask")
+	}
+}
+
+// validateRange validates ip range of iprange module. i.e 10.0.0.1-10.0.0.9
+func validateRange(field, spec string, errs *ValidationErrors) {
+	r := strings.TrimPrefix(spec, "!")
+	if r == "" {
+		return
+	}
+	parts := strings.Split(r, "-")
+	if len(parts) > 2 {
+		errs.add(field, spec, "is not a valid ip range")
+		return
+	}
+	var first net.IP
+	for _, part := range parts {
+		ip := net.ParseIP(part)
+		if ip == nil {
+			errs.add(field, spec, "is not a valid ip range")
+			return
+		}
+		if first != nil && (first.To4() == nil) != (ip.To4() == nil) {
+			errs.add(field, spec, "mixes ipv4 and ipv6 addresses")
+			return
+		}
+		first = ip
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var addrTypes = map[string]bool{
+	"UNSPEC": true, "UNICAST": true, "LOCAL": true, "BROADCAST": true, "ANYCAST": true, "MULTICAST": true,
+	"BLACKHOLE": true, "UNREACHABLE": true, "PROHIBIT": true, "THROW": true, "NAT": true, "XRESOLVE": true,
+}
+
+var hashLimitModes = map[string]bool{"srcip": true, "srcport": true, "dstip": true, "dstport": true}
+
+var rateRegexp = regexp.MustCompile(`^[0-9]+(/(s|se|sec|seco|secon|second|m|mi|min|minu|minut|minute|h|ho|hou|hour|d|da|day))?$`)
+
+// validateMatches validates options of match modules.
+func (r Rule) validateMatches(field func(string) string, errs *ValidationErrors) {
+	proto := strings.ToLower(r.Protocol)
+
+	if m := r.Multiport; m != nil {
+		if !portProtocols[proto] {
+			errs.add(field("multiport"), "", "requires protocol tcp | udp | udplite | sctp | dccp")
+		}
+		if m.SourcePorts == "" && m.DestinationPorts == "" && m.Ports == "" {
+			errs.add(field("multiport"), "", "requires source_ports, destination_ports or ports")
+		}
+		if m.Ports != "" && (m.SourcePorts != "" || m.DestinationPorts != "") {
+			errs.add(field("multiport.ports"), m.Ports, "can't be used with source_ports or destination_ports")
+		}
+		validatePortList(field("multiport.source_ports"), m.SourcePorts, errs)
+		validatePortList(field("multiport.destination_ports"), m.DestinationPorts, errs)
+		validatePortList(field("multiport.ports"), m.Ports, errs)
+	}
+
+	if l := r.Limit; l != nil {
+		validateRate(field("limit.rate"), l.Rate, errs)
+		validateNumber(field("limit.burst"), l.Burst, errs)
+	}
+
+	if h := r.HashLimit; h != nil {
+		if h.Name == "" {
+			errs.add(field("hashlimit.name"), "", "is required")
+		}
+		if (h.Upto == "") == (h.Above == "") {
+			errs.add(field("hashlimit"), "", "requires exactly one of upto and above")
+		}
+		validateRate(field("hashlimit.upto"), h.Upto, errs)
+		validateRate(field("hashlimit.above"), h.Above, errs)
+		validateNumber(field("hashlimit.burst"), h.Burst, errs)
+		validateNumber(field("hashlimit.srcmask"), h.SourceMask, errs)
+		validateNumber(field("hashlimit.dstmask"), h.DestinationMask, errs)
+		validateNumber(field("hashlimit.htable_expire"), h.Expire, errs)
+		for _, mode := range h.Mode {
+			if !hashLimitModes[mode] {
+				errs.add(field("hashlimit.mode"), mode, "must be one of srcip | srcport | dstip | dstport")
+			}
+		}
+	}
+
+	if rc := r.Recent; rc != nil {
+		switch rc.Action {
+		case "set", "remove":
+			if rc.Seconds != "" || rc.HitCount != "" {
+				errs.add(field("recent"), "", "seconds and hitcount require rcheck | update action")
+			}
+		case "rcheck", "update":
+		default:
+			errs.add(field("recent.action"), rc.Action, "must be one of set | rcheck | update | remove")
+		}
+		if rc.Side != "" && rc.Side != "source" && rc.Side != "destination" {
+			errs.add(field("recent.side"), rc.Side, "must be one of source | destination")
+		}
+		validateNumber(field("recent.seconds"), rc.Seconds, errs)
+		validateNumber(field("recent.hitcount"), rc.HitCount, errs)
+	}
+
+	if r.MacSource != "" {
+		if hw, err := net.ParseMAC(strings.TrimPrefix(r.MacSource, "!")); err != nil || len(hw) != 6 {
+			errs.add(field("mac_source"), r.MacSource, "is not a valid mac address")
+		}
+		if r.Chain == "OUTPUT" || r.Chain == "POSTROUTING" {
+			errs.add(field("mac_source"), r.MacSource, "can't be used in %v chain", r.Chain)
+		}
+	}
+
+	if o := r.Owner; o != nil {
+		if o.UID == "" && o.GID == "" && !o.SocketExists {
+			errs.add(field("owner"), "", "requires uid_owner, gid_owner or socket_exists")
+		}
+		if IsBuiltinChain(r.Chain) && r.Chain != "OUTPUT" && r.Chain != "POSTROUTING" {
+			errs.add(field("owner"), "", "can only be used in OUTPUT | POSTROUTING chains")
+		}
+	}
+
+	for _, mark := range []struct{ name, value string }{{"mark", r.Mark}, {"connmark", r.ConnMark}} {
+		if mark.value == "" {
+			continue
+		}
+		if _, _, err := parseMark(strings.TrimPrefix(mark.value, "!")); err != nil {
+			errs.add(field(mark.name), mark.value, "is not a valid mark, must be value[/mask]")
+		}
+	}
+
+	if s := r.MatchSet; s != nil {
+		if strings.TrimPrefix(s.Name, "!") == "" {
+			errs.add(field("match_set.name"), "", "is required")
+		}
+		if s.Flags != "" {
+			flags := strings.Split(s.Flags, ",")
+			if len(flags) > 6 {
+				errs.add(field("match_set.flags"), s.Flags, "must not contain more than 6 flags")
+			}
+			for _, f := range flags {
+				if f != "src" && f != "dst" {
+					errs.add(field("match_set.flags"), f, "must be one of src | dst")
+				}
+			}
+		}
+	}
+
+	if r.ICMPType != "" && proto != "icmp" && !isICMPv6(proto) {
+		errs.add(field("icmp_type"), r.ICMPType, "requires protocol icmp | icmpv6")
+	}
+
+	if a := r.AddrType; a != nil {
+		if a.SourceType == "" && a.DestinationType == "" {
+			errs.add(field("addrtype"), "", "requires src_type or dst_type")
+		}
+		for _, t := range []struct{ name, value string }{{"addrtype.src_type", a.SourceType}, {"addrtype.dst_type", a.DestinationType}} {
+			for _, v := range strings.Split(strings.TrimPrefix(t.value, "!"), ",") {
+				if t.value != "" && !addrTypes[strings.ToUpper(v)] {
+					errs.add(field(t.name), v, "is not a valid address type")
+				}
+			}
+		}
+		if a.LimitIfaceIn && a.LimitIfaceOut {
+			errs.add(field("addrtype"), "", "limit_iface_in and limit_iface_out can't be used together")
+		}
+	}
+}
+
+// validatePortList validates comma separated list of ports of multiport module.
+func validatePortList(field, spec string, errs *ValidationErrors) {
+	list := strings.TrimPrefix(spec, "!")
+	if list == "" {
+		return
+	}
+	count := 0
+	for _, port := range strings.Split(list, ",") {
+		count++
+		if strings.Contains(port, ":") {
+			count++
+		}
+		validatePortRange(field, port, ":", errs)
+	}
+	if count > 15 {
+		errs.add(field, spec, "must not contain more than 15 ports")
+	}
+}
+
+func validateRate(field, spec string, errs *ValidationErrors) {
+	if spec != "" && !rateRegexp.MatchString(spec) {
+		errs.add(field, spec, "is not a valid rate, must be number[/second|/minute|/hour|/day]")
+	}
+}
+
+func validateNumber(field, spec string, errs *ValidationErrors) {
+	if spec == "" {
+		return
+	}
+	if n, err := strconv.Atoi(spec); err != nil || n < 0 {
+		errs.add(field, spec, "must be a non-negative number")
+	}
+}
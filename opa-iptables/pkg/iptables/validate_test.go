@@ -0,0 +1,96 @@
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	var testcases = []struct {
+		rule   Rule
+		fields []string
+	}{
+		{Rule{Protocol: "tcp", DestinationPort: "80", SourceAddress: "10.0.0.0/8", Jump: "ACCEPT"}, nil},
+		{Rule{Chain: "input", Protocol: "udp", SourcePort: "1024:", DestinationAddress: "!fd00::/64", Jump: "DROP"}, nil},
+		{Rule{Protocol: "tcp", DestinationPort: "http", SourceRange: "10.0.0.1-10.0.0.9", Jump: "my-chain"}, nil},
+		{Rule{Table: "nat", Chain: "PREROUTING", Protocol: "tcp", DestinationPort: "80", Jump: "DNAT", ToDestination: "10.0.0.1:8080"}, nil},
+		{Rule{Table: "nat", Chain: "POSTROUTING", Protocol: "tcp", Jump: "MASQUERADE", ToPorts: "1024-2048"}, nil},
+		{Rule{Action: "insert", RuleNumber: "1", Jump: "LOG", LogPrefix: "dropped: "}, nil},
+		{Rule{DestinationPort: "80", Jump: "ACCEPT"}, []string{"destination_port"}},
+		{Rule{Protocol: "!tcp", SourcePort: "80"}, []string{"source_port"}},
+		{Rule{Protocol: "tcp", DestinationPort: "70000"}, []string{"destination_port"}},
+		{Rule{Action: "insert", Jump: "ACCEPT"}, []string{"rule_num"}},
+		{Rule{RuleNumber: "1", Jump: "ACCEPT"}, []string{"rule_num"}},
+		{Rule{Action: "prepend"}, []string{"action"}},
+		{Rule{Table: "filter", Jump: "DNAT", ToDestination: "10.0.0.1"}, []string{"jump"}},
+		{Rule{Table: "nat", Chain: "POSTROUTING", Jump: "DNAT", ToDestination: "10.0.0.1"}, []string{"jump"}},
+		{Rule{Table: "nat", Chain: "PREROUTING", Jump: "DNAT"}, []string{"to_destination"}},
+		{Rule{Jump: "ACCEPT", ToSource: "10.0.0.1"}, []string{"to_source"}},
+		{Rule{Table: "raw", Chain: "INPUT"}, []string{"chain"}},
+		{Rule{Table: "filters"}, []string{"table"}},
+		{Rule{SourceAddress: "10.0.0.300/8"}, []string{"source"}},
+		{Rule{DestinationAddress: "10.0.0.0/33"}, []string{"destination"}},
+		{Rule{SourceRange: "10.0.0.1-fd00::1"}, []string{"src_range"}},
+		{Rule{Chain: "OUTPUT", InInterface: "eth0"}, []string{"in_interface"}},
+		{Rule{Protocol: "udp", TCPFlags: TcpFlags{Flags: []string{"ALL"}, FlagsSet: []string{"SYN"}}}, []string{"tcp_flags"}},
+		{Rule{Ctstate: []string{"NEW", "OPEN"}}, []string{"ctstate"}},
+		{Rule{Ctstate: []string{"!new"}, Jump: "DROP"}, nil},
+		{Rule{Ctstate: []string{"!OPEN"}}, []string{"ctstate"}},
+		{Rule{Jump: "ACCEPT", LogPrefix: "prefix"}, []string{"log_prefix"}},
+	}
+
+	for i, tt := range testcases {
+		var fields []string
+		if err := tt.rule.Validate(); err != nil {
+			for _, e := range err.(ValidationErrors) {
+				fields = append(fields, e.Field)
+			}
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("Testcase %v: expected invalid fields %v, got %v", i, tt.fields, fields)
+		}
+	}
+}
+
+func TestValidateNetdbProtocol(t *testing.T) {
+	netdbOnce.Do(func() {})
+	defer func(saved map[string]int) { netdbProtocols = saved }(netdbProtocols)
+	netdbProtocols = parseProtocols(strings.NewReader(`# Internet (IP) protocols
+ip	0	IP		# internet protocol, pseudo protocol number
+igmp	2	IGMP		# Internet Group Management
+ospf	89	OSPFIGP		# Open Shortest Path First IGP
+vrrp	112	VRRP		# Virtual Router Redundancy Protocol
+`))
+
+	for _, proto := range []string{"igmp", "!ospf", "OSPFIGP", "vrrp", "112"} {
+		if err := (Rule{Protocol: proto, Jump: "ACCEPT"}).Validate(); err != nil {
+			t.Errorf("%q: unexpected error %v", proto, err)
+		}
+	}
+	if err := (Rule{Protocol: "pim", Jump: "ACCEPT"}).Validate(); err == nil {
+		t.Error("expected error for protocol missing from /etc/protocols")
+	}
+	if err := (Rule{Protocol: "vrrp", DestinationPort: "80", Jump: "ACCEPT"}).Validate(); err == nil {
+		t.Error("expected error for port of protocol without ports")
+	}
+}
+
+func TestValidateRuleSet(t *testing.T) {
+	var rs RuleSet
+	rs.Rules = []Rule{{Jump: "ACCEPT"}, {DestinationPort: "22"}}
+	err := rs.Validate()
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Field != "rules[1].destination_port" {
+		t.Errorf("Expected error of rules[1].destination_port, got %v", err)
+	}
+
+	// rules with unknown connection states can still be deleted
+	rs.Rules = []Rule{{Ctstate: []string{"OPEN"}, Jump: "ACCEPT"}}
+	if err := rs.Validate(); err == nil {
+		t.Error("Expected error of rules[0].ctstate")
+	}
+	if err := rs.ValidateDelete(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
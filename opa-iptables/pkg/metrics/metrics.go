@@ -0,0 +1,94 @@
+// Package metrics defines Prometheus metrics of the controller, which are served at /metrics.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "opa_iptables"
+
+// Results of operations.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+var (
+	// Rules counts rules inserted into and deleted from the kernel.
+	// i.e opa_iptables_rules_total{operation="insert",result="success",table="filter",chain="INPUT"}
+	Rules = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rules_total",
+		Help:      "Number of rules inserted into or deleted from the kernel, by operation, result, table and chain.",
+	}, []string{"operation", "result", "table", "chain"})
+
+	// OPARequestDuration observes latency of requests sent to OPA, by operation of opa.Client.
+	OPARequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "opa_request_duration_seconds",
+		Help:      "Latency of requests sent to OPA, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	// OPARequestErrors counts failed requests sent to OPA, by operation of opa.Client.
+	OPARequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "opa_request_errors_total",
+		Help:      "Number of failed requests sent to OPA, by operation.",
+	}, []string{"operation"})
+
+	// WatcherCycleDuration observes time taken by the watcher to check every watched state once.
+	WatcherCycleDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "watcher_cycle_duration_seconds",
+		Help:      "Time taken by the watcher to check every watched state once.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// WatchedStates is the number of states watched by the watcher.
+	WatchedStates = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "watched_states",
+		Help:      "Number of RuleSets watched by the watcher.",
+	})
+
+	// Replacements counts replacements of rules triggered by a change of "_id" of a watched RuleSet.
+	Replacements = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ruleset_replacements_total",
+		Help:      "Number of RuleSets replaced, inserted or deleted by the watcher because of a change of a watched query path, by result.",
+	}, []string{"result"})
+)
+
+// Registry contains metrics of the controller as well as Go runtime and process metrics.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		Rules,
+		OPARequestDuration,
+		OPARequestErrors,
+		WatcherCycleDuration,
+		WatchedStates,
+		Replacements,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler returns http.Handler which serves metrics of Registry in Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Result returns ResultFailure if err is not nil, otherwise ResultSuccess.
+func Result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
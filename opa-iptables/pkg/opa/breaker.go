@@ -0,0 +1,76 @@
+package opa
+
+import (
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+)
+
+// breaker is a circuit breaker, which stops calling OPA after threshold consecutive calls failed
+// because OPA is unavailable. Calls fail fast with ErrCircuitOpen until the timeout elapses, then
+// a single call probes OPA: the breaker closes if it succeeds, otherwise it opens again.
+// A nil breaker allows every call.
+type breaker struct {
+	threshold int
+	timeout   time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow returns ErrCircuitOpen if the call must not be sent. Every allowed call must be followed
+// by record or release.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.timeout {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// record records the outcome of an allowed call.
+func (b *breaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		if b.failures >= b.threshold {
+			logging.GetLogger().Info("OPA is available again, circuit breaker is closed")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			logging.GetLogger().Warnf("OPA failed %v consecutive calls, circuit breaker is open for %v", b.failures, b.timeout)
+		}
+		b.openedAt = time.Now()
+	}
+}
+
+// release ends an allowed call without an outcome, i.e. it was canceled.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
@@ -0,0 +1,267 @@
+package opa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/bundle"
+	"github.com/open-policy-agent/opa/v1/loader"
+	opalogging "github.com/open-policy-agent/opa/v1/logging"
+	"github.com/open-policy-agent/opa/v1/plugins"
+	"github.com/open-policy-agent/opa/v1/plugins/logs"
+	"github.com/open-policy-agent/opa/v1/sdk"
+	"github.com/open-policy-agent/opa/v1/storage"
+	"github.com/open-policy-agent/opa/v1/storage/inmem"
+	"github.com/open-policy-agent/opa/v1/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Modes of evaluating policies.
+const (
+	// ModeRemote sends queries to OPA over its REST API.
+	ModeRemote = "remote"
+	// ModeEmbedded evaluates policies inside the controller.
+	ModeEmbedded = "embedded"
+)
+
+// Codes of errors returned by the embedded OPA, which are the same as the codes returned by the
+// REST API of OPA.
+const (
+	codeInternal     = "internal_error"
+	codeInvalidParam = "invalid_parameter"
+	codeNotFound     = "resource_not_found"
+)
+
+// EmbeddedConfig configures the OPA embedded in the controller.
+type EmbeddedConfig struct {
+	// ID identifies the OPA in status and decision logs. Empty generates a random one.
+	ID string
+	// ConfigFile is the path of the OPA configuration file, which configures services, bundles
+	// downloaded from them, status and decision logs. Empty runs OPA without any plugin.
+	ConfigFile string
+	// Bundles are paths of bundle directories or archives loaded on startup.
+	Bundles []string
+	// V0Compatible parses policies written for OPA v0.x.
+	V0Compatible bool
+}
+
+// EmbeddedClient is Client which evaluates policies loaded through the OPA SDK, so decisions don't
+// depend on a remote OPA. Data documents are written into its in-memory store, and the same
+// paths and response documents as the REST API of OPA are used, so it's interchangeable with the
+// remote Client.
+type EmbeddedClient struct {
+	opa   *sdk.OPA
+	store storage.Store
+}
+
+// NewEmbedded starts OPA with given configuration. It doesn't wait for bundles downloaded from
+// services, so queries are undefined until they're activated, unless they're persisted by OPA.
+func NewEmbedded(ctx context.Context, config EmbeddedConfig) (*EmbeddedClient, error) {
+	logger := logging.GetLogger()
+
+	var opaConfig []byte
+	if config.ConfigFile != "" {
+		var err error
+		opaConfig, err = os.ReadFile(config.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read OPA config file: %v", err)
+		}
+	}
+
+	regoVersion := ast.RegoV1
+	if config.V0Compatible {
+		regoVersion = ast.RegoV0
+	}
+	bundles := make(map[string]*bundle.Bundle)
+	for _, path := range config.Bundles {
+		b, err := loader.NewFileLoader().WithRegoVersion(regoVersion).AsBundle(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load bundle %v: %v", path, err)
+		}
+		bundles[path] = b
+	}
+
+	store := inmem.New()
+	ready := make(chan struct{})
+	o, err := sdk.New(ctx, sdk.Options{
+		ID:           config.ID,
+		Config:       bytes.NewReader(opaConfig),
+		Logger:       &sdkLogger{logrus.NewEntry(logger)},
+		Store:        store,
+		Ready:        ready,
+		V0Compatible: config.V0Compatible,
+		ManagerOpts:  []func(*plugins.Manager){plugins.InitBundles(bundles)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to start embedded OPA: %v", err)
+	}
+	go func() {
+		select {
+		case <-ready:
+			logger.Info("Embedded OPA is ready")
+		case <-ctx.Done():
+		}
+	}()
+	return &EmbeddedClient{opa: o, store: store}, nil
+}
+
+// Stop stops plugins of OPA, i.e. flushes decision logs.
+func (c *EmbeddedClient) Stop(ctx context.Context) {
+	c.opa.Stop(ctx)
+}
+
+// DoQuery evaluates the decision at path with input of the request body, i.e. {"input": {...}}.
+// The response is {"result": ...}, or {} if the decision is undefined.
+func (c *EmbeddedClient) DoQuery(ctx context.Context, path string, input interface{}) ([]byte, error) {
+	d, ok := input.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("Invalid data; must be []byte")
+	}
+	var body struct {
+		Input *interface{} `json:"input"`
+	}
+	if len(d) > 0 {
+		if err := util.UnmarshalJSON(d, &body); err != nil {
+			return nil, &Error{Code: codeInvalidParam, Message: fmt.Sprintf("body contains malformed input document: %v", err)}
+		}
+	}
+	return c.decision(ctx, path, body.Input)
+}
+
+// GetData evaluates the document at path without input, like the REST API of OPA does.
+func (c *EmbeddedClient) GetData(ctx context.Context, path string) ([]byte, error) {
+	return c.decision(ctx, path, nil)
+}
+
+// decision evaluates the document at path. Like the REST API of OPA, the response contains
+// "decision_id" if decision logs are enabled.
+func (c *EmbeddedClient) decision(ctx context.Context, path string, input *interface{}) ([]byte, error) {
+	options := sdk.DecisionOptions{Path: "/" + strings.Trim(path, "/")}
+	if input != nil {
+		options.Input = *input
+	}
+	result, err := c.opa.Decision(ctx, options)
+	if err != nil {
+		if sdk.IsUndefinedErr(err) {
+			return []byte("{}"), nil
+		}
+		return nil, convertError(err)
+	}
+	res := map[string]interface{}{"result": result.Result}
+	if c.opa.Plugin(logs.Name) != nil {
+		res["decision_id"] = result.ID
+	}
+	return json.Marshal(res)
+}
+
+// PutData creates or overwrites the data document at path.
+func (c *EmbeddedClient) PutData(ctx context.Context, path string, data []byte) error {
+	p, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := util.UnmarshalJSON(data, &value); err != nil {
+		return &Error{Code: codeInvalidParam, Message: fmt.Sprintf("body contains malformed data document: %v", err)}
+	}
+	return c.write(ctx, func(txn storage.Transaction) error {
+		var op storage.PatchOp = storage.ReplaceOp
+		if _, err := c.store.Read(ctx, txn, p); err != nil {
+			if !storage.IsNotFound(err) {
+				return err
+			}
+			if err := storage.MakeDir(ctx, c.store, txn, p[:len(p)-1]); err != nil {
+				return err
+			}
+			op = storage.AddOp
+		}
+		return c.store.Write(ctx, txn, op, p, value)
+	})
+}
+
+// DeleteData deletes the data document at path. Like the REST API of OPA, it fails with
+// resource_not_found if the document doesn't exist.
+func (c *EmbeddedClient) DeleteData(ctx context.Context, path string) error {
+	p, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	return c.write(ctx, func(txn storage.Transaction) error {
+		if _, err := c.store.Read(ctx, txn, p); err != nil {
+			return err
+		}
+		return c.store.Write(ctx, txn, storage.RemoveOp, p, nil)
+	})
+}
+
+// write runs fn in a write transaction of the store, which is committed if fn succeeds.
+func (c *EmbeddedClient) write(ctx context.Context, fn func(txn storage.Transaction) error) error {
+	txn, err := c.store.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return convertError(err)
+	}
+	if err := fn(txn); err != nil {
+		c.store.Abort(ctx, txn)
+		return convertError(err)
+	}
+	return convertError(c.store.Commit(ctx, txn))
+}
+
+func parsePath(path string) (storage.Path, error) {
+	p, ok := storage.ParsePath("/" + strings.Trim(path, "/"))
+	if !ok || len(p) == 0 {
+		return nil, &Error{Code: codeInvalidParam, Message: fmt.Sprintf("invalid path %q", path)}
+	}
+	return p, nil
+}
+
+// convertError converts errors of OPA into Error, so they're reported like errors of the REST API.
+func convertError(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *sdk.Error:
+		return &Error{Code: codeInternal, Message: e.Error()}
+	case *storage.Error:
+		if storage.IsNotFound(err) {
+			return &Error{Code: codeNotFound, Message: e.Error()}
+		}
+		return &Error{Code: codeInternal, Message: e.Error()}
+	}
+	return &Error{Code: codeInternal, Message: err.Error()}
+}
+
+// sdkLogger writes logs of OPA into the logger of the controller.
+type sdkLogger struct {
+	entry *logrus.Entry
+}
+
+func (l *sdkLogger) Debug(format string, a ...interface{}) { l.entry.Debugf(format, a...) }
+func (l *sdkLogger) Info(format string, a ...interface{})  { l.entry.Infof(format, a...) }
+func (l *sdkLogger) Warn(format string, a ...interface{})  { l.entry.Warnf(format, a...) }
+func (l *sdkLogger) Error(format string, a ...interface{}) { l.entry.Errorf(format, a...) }
+
+func (l *sdkLogger) WithFields(fields map[string]interface{}) opalogging.Logger {
+	return &sdkLogger{l.entry.WithFields(fields)}
+}
+
+func (l *sdkLogger) GetLevel() opalogging.Level {
+	switch l.entry.Logger.GetLevel() {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return opalogging.Error
+	case logrus.WarnLevel:
+		return opalogging.Warn
+	case logrus.InfoLevel:
+		return opalogging.Info
+	}
+	return opalogging.Debug
+}
+
+// SetLevel is a no-op, the level is set by the flags of the controller.
+func (l *sdkLogger) SetLevel(opalogging.Level) {}
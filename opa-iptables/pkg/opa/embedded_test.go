@@ -0,0 +1,93 @@
+package opa
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const policy = `package iptables
+
+rules := [{"protocol": "tcp", "destination_port": "80", "jump": "ACCEPT"}] if input.web
+
+rules := [{"protocol": "tcp", "destination_port": "22", "jump": "ACCEPT"}] if data.iptables.ssh.enabled
+`
+
+func TestEmbeddedClient(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "policy.rego"), []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := NewEmbedded(ctx, EmbeddedConfig{ID: "test", Bundles: []string{dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(ctx)
+
+	query := func(input string, expected string) {
+		t.Helper()
+		res, err := c.DoQuery(ctx, "iptables/rules", []byte(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(res) != expected {
+			t.Errorf("query with %v: expected %v, got %v", input, expected, string(res))
+		}
+	}
+	query(`{"input": {"web": true}}`, `{"result":[{"destination_port":"80","jump":"ACCEPT","protocol":"tcp"}]}`)
+	query(`{"input": {}}`, `{}`)
+
+	if err := c.PutData(ctx, "iptables/ssh", []byte(`{"enabled": true}`)); err != nil {
+		t.Fatal(err)
+	}
+	query(`{}`, `{"result":[{"destination_port":"22","jump":"ACCEPT","protocol":"tcp"}]}`)
+
+	if err := c.PutData(ctx, "state/web", []byte(`[1]`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutData(ctx, "state/web", []byte(`[2]`)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.GetData(ctx, "state/web"); err != nil || string(data) != `{"result":[2]}` {
+		t.Errorf("unexpected data %s: %v", data, err)
+	}
+	if err := c.DeleteData(ctx, "state/web"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.GetData(ctx, "state/web"); err != nil || string(data) != `{}` {
+		t.Errorf("expected deleted data, got %s: %v", data, err)
+	}
+
+	var opaErr *Error
+	if err := c.DeleteData(ctx, "state/web"); !errors.As(err, &opaErr) || opaErr.Code != codeNotFound {
+		t.Errorf("expected %v error, got %v", codeNotFound, err)
+	}
+	if err := c.PutData(ctx, "state/web", []byte(`{`)); !errors.As(err, &opaErr) || opaErr.Code != codeInvalidParam {
+		t.Errorf("expected %v error, got %v", codeInvalidParam, err)
+	}
+}
+
+func TestEmbeddedClientV0Compatible(t *testing.T) {
+	dir := t.TempDir()
+	v0 := "package iptables\n\nallow { input.web }\n"
+	if err := os.WriteFile(filepath.Join(dir, "policy.rego"), []byte(v0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := NewEmbedded(ctx, EmbeddedConfig{Bundles: []string{dir}}); err == nil {
+		t.Error("expected v0 policy to be rejected")
+	}
+	c, err := NewEmbedded(ctx, EmbeddedConfig{Bundles: []string{dir}, V0Compatible: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(ctx)
+	if res, err := c.DoQuery(ctx, "iptables/allow", []byte(`{"input": {"web": true}}`)); err != nil || string(res) != `{"result":true}` {
+		t.Errorf("unexpected result %s: %v", res, err)
+	}
+}
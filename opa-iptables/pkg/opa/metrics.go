@@ -0,0 +1,54 @@
+package opa
+
+import (
+	"context"
+	"time"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/metrics"
+)
+
+// Operations of Client reported by metrics.
+const (
+	opQuery      = "query"
+	opPutData    = "put_data"
+	opGetData    = "get_data"
+	opDeleteData = "delete_data"
+)
+
+// instrumentedClient records latency and errors of each request of the wrapped Client.
+type instrumentedClient struct {
+	client Client
+}
+
+// Instrument returns Client which records latency and errors of requests of given Client
+// into metrics.OPARequestDuration and metrics.OPARequestErrors.
+func Instrument(client Client) Client {
+	return &instrumentedClient{client}
+}
+
+func observe(op string, start time.Time, err error) {
+	metrics.OPARequestDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.OPARequestErrors.WithLabelValues(op).Inc()
+	}
+}
+
+func (c *instrumentedClient) DoQuery(ctx context.Context, path string, input interface{}) (data []byte, err error) {
+	defer func(start time.Time) { observe(opQuery, start, err) }(time.Now())
+	return c.client.DoQuery(ctx, path, input)
+}
+
+func (c *instrumentedClient) PutData(ctx context.Context, path string, data []byte) (err error) {
+	defer func(start time.Time) { observe(opPutData, start, err) }(time.Now())
+	return c.client.PutData(ctx, path, data)
+}
+
+func (c *instrumentedClient) GetData(ctx context.Context, path string) (data []byte, err error) {
+	defer func(start time.Time) { observe(opGetData, start, err) }(time.Now())
+	return c.client.GetData(ctx, path)
+}
+
+func (c *instrumentedClient) DeleteData(ctx context.Context, path string) (err error) {
+	defer func(start time.Time) { observe(opDeleteData, start, err) }(time.Now())
+	return c.client.DeleteData(ctx, path)
+}
@@ -2,21 +2,41 @@ package opa
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math"
+	"math/rand"
 	"net/http"
-	"os"
 	"time"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/logging"
+	"golang.org/x/time/rate"
 )
 
 const (
 	documentEndpointFmt = `/v1/data/%s`
 )
 
+// Defaults of Config.
+const (
+	DefaultTimeout          = 10 * time.Second
+	DefaultMaxRetries       = 3
+	DefaultBreakerThreshold = 5
+	DefaultBreakerTimeout   = 30 * time.Second
+
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// ErrCircuitOpen is returned without calling OPA while the circuit breaker is open, i.e. OPA
+// failed too many consecutive calls.
+var ErrCircuitOpen = errors.New("OPA is unavailable: circuit breaker is open")
+
 // Error contains the standard error fields returned by OPA.
 type Error struct {
 	Code    string          `json:"code"`
@@ -33,103 +53,193 @@ type Client interface {
 	Data
 }
 
+// Query evaluates policies. The response contains "decision_id" along with "result", if
+// decision logs are enabled in OPA.
 type Query interface {
-	DoQuery(path string, input interface{}) (data []byte, err error)
+	DoQuery(ctx context.Context, path string, input interface{}) (data []byte, err error)
 }
 
 type Data interface {
-	PutData(path string, data []byte) error
-	GetData(path string) ([]byte, error)
-	DeleteData(path string) error
+	PutData(ctx context.Context, path string, data []byte) error
+	GetData(ctx context.Context, path string) ([]byte, error)
+	DeleteData(ctx context.Context, path string) error
+}
+
+// Config configures Client of the remote OPA.
+type Config struct {
+	Endpoint string
+	// Token is sent as bearer token of every call.
+	Token string
+	// TrustedCAFile is the path of CA certificates trusted in addition to the system ones, for
+	// verifying the certificate of OPA.
+	TrustedCAFile string
+	// CertFile and KeyFile are the client certificate and its private key presented to OPA (mTLS).
+	CertFile string
+	KeyFile  string
+	// Timeout of each attempt of a call.
+	Timeout time.Duration
+	// MaxRetries is the number of times a call is retried, if OPA is unavailable.
+	MaxRetries int
+	// RateLimit is the number of calls per second sent to OPA, including retries. Zero disables it.
+	RateLimit float64
+	// BreakerThreshold is the number of consecutive failed calls after which the circuit breaker
+	// opens. Zero disables the circuit breaker.
+	BreakerThreshold int
+	// BreakerTimeout is the time the circuit breaker stays open, before a single call probes OPA.
+	BreakerTimeout time.Duration
 }
 
 type opaClient struct {
 	opaEndpoint    string
 	authentication string
 	client         *http.Client
+	maxRetries     int
+	limiter        *rate.Limiter
+	breaker        *breaker
 }
 
-func New(opaEndpoint string, auth string, opaTrustedCAFile string) Client {
+// New returns Client of the remote OPA. Calls which fail because OPA is unavailable, i.e.
+// connection errors, 429 or 5xx, are retried with jittered exponential backoff. Every call of
+// the data API is idempotent, and queries don't change OPA, so all of them are retried.
+func New(config Config) (Client, error) {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
 	client := &http.Client{
-		Timeout: 10 * time.Second,
+		Timeout: config.Timeout,
 	}
-	if opaTrustedCAFile != "" {
-		if _, err := os.Stat(opaTrustedCAFile); err == nil {
-			tlsConfig, err := createTLSConfig(opaTrustedCAFile)
-			if err != nil {
-				log.Fatalf("Failed to create TLS config: %v", err)
-			}
-			client.Transport = &http.Transport{
-				TLSClientConfig: tlsConfig,
-			}
-		} else if !os.IsNotExist(err) {
-			log.Fatalf("Failed to check CA file: %v", err)
+	if config.TrustedCAFile != "" || config.CertFile != "" {
+		tlsConfig, err := createTLSConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create TLS config: %v", err)
 		}
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+
+	c := &opaClient{
+		opaEndpoint:    config.Endpoint,
+		authentication: config.Token,
+		client:         client,
+		maxRetries:     config.MaxRetries,
+	}
+	if config.RateLimit > 0 {
+		c.limiter = rate.NewLimiter(rate.Limit(config.RateLimit), int(math.Max(1, math.Ceil(config.RateLimit))))
+	}
+	if config.BreakerThreshold > 0 {
+		c.breaker = &breaker{threshold: config.BreakerThreshold, timeout: config.BreakerTimeout}
 	}
-	return &opaClient{opaEndpoint, auth, client}
+	return c, nil
 }
 
-func createTLSConfig(opaTrustedCAFile string) (*tls.Config, error) {
+func createTLSConfig(config Config) (*tls.Config, error) {
 	systemCertPool, err := x509.SystemCertPool()
 	if err != nil {
 		return nil, fmt.Errorf("failed to load system cert pool: %v", err)
 	}
-	rootCA, err := ioutil.ReadFile(opaTrustedCAFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read root CA certificate: %v", err)
-	}
-	if ok := systemCertPool.AppendCertsFromPEM(rootCA); !ok {
-		return nil, fmt.Errorf("failed to append root CA certificate")
+	if config.TrustedCAFile != "" {
+		rootCA, err := ioutil.ReadFile(config.TrustedCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read root CA certificate: %v", err)
+		}
+		if ok := systemCertPool.AppendCertsFromPEM(rootCA); !ok {
+			return nil, fmt.Errorf("failed to append root CA certificate")
+		}
 	}
-	return &tls.Config{
+	tlsConfig := &tls.Config{
 		RootCAs: systemCertPool,
-	}, nil
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
 }
 
-func (c *opaClient) DoQuery(path string, input interface{}) (data []byte, err error) {
+func (c *opaClient) DoQuery(ctx context.Context, path string, input interface{}) (data []byte, err error) {
 	url := c.opaEndpoint + fmt.Sprintf(documentEndpointFmt, path)
 	d, ok := input.([]byte)
 	if !ok {
 		return nil, fmt.Errorf("Invalid data; must be []byte")
 	}
-	res, err := c.do(http.MethodPost, url, d)
+	res, err := c.do(ctx, http.MethodPost, url, d)
 	if err != nil {
 		return nil, err
 	}
 	return res, nil
 }
 
-func (c *opaClient) PutData(path string, data []byte) error {
+func (c *opaClient) PutData(ctx context.Context, path string, data []byte) error {
 	url := c.opaEndpoint + fmt.Sprintf(documentEndpointFmt, path)
-	_, err := c.do(http.MethodPut, url, data)
+	_, err := c.do(ctx, http.MethodPut, url, data)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *opaClient) GetData(path string) ([]byte, error) {
+func (c *opaClient) GetData(ctx context.Context, path string) ([]byte, error) {
 	url := c.opaEndpoint + fmt.Sprintf(documentEndpointFmt, path)
-	res, err := c.do(http.MethodGet, url, nil)
+	res, err := c.do(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	return res, nil
 }
 
-func (c *opaClient) DeleteData(path string) error {
+func (c *opaClient) DeleteData(ctx context.Context, path string) error {
 	url := c.opaEndpoint + fmt.Sprintf(documentEndpointFmt, path)
-	_, err := c.do(http.MethodDelete, url, nil)
+	_, err := c.do(ctx, http.MethodDelete, url, nil)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *opaClient) do(method, url string, data []byte) ([]byte, error) {
-	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+// do sends the request, retrying it while OPA is unavailable, up to maxRetries times.
+func (c *opaClient) do(ctx context.Context, method, url string, data []byte) ([]byte, error) {
+	for i := 0; ; i++ {
+		if err := c.breaker.allow(); err != nil {
+			return nil, err
+		}
+		if c.limiter != nil {
+			if err := c.limiter.Wait(ctx); err != nil {
+				c.breaker.release()
+				return nil, err
+			}
+		}
+
+		res, unavailable, err := c.attempt(ctx, method, url, data)
+		if ctx.Err() != nil {
+			c.breaker.release()
+			return nil, ctx.Err()
+		}
+		c.breaker.record(unavailable)
+		if !unavailable || i >= c.maxRetries {
+			return res, err
+		}
+
+		wait := backoff(i)
+		logging.GetLogger().Debugf("Retrying %v %v in %v: %v", method, url, wait, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// attempt sends the request once. It reports whether the request failed because OPA is
+// unavailable, so it may succeed if it's retried.
+func (c *opaClient) attempt(ctx context.Context, method, url string, data []byte) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	req.Header.Add("Content-Type", "application/json")
 	if c.authentication != "" {
@@ -137,15 +247,16 @@ func (c *opaClient) do(method, url string, data []byte) ([]byte, error) {
 	}
 	res, err := c.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, true, err
 	}
 	defer res.Body.Close()
 
 	err = c.handleErrors(res)
 	if err != nil {
-		return nil, err
+		return nil, res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500, err
 	}
-	return ioutil.ReadAll(res.Body)
+	body, err := ioutil.ReadAll(res.Body)
+	return body, err != nil, err
 }
 
 func (c *opaClient) handleErrors(resp *http.Response) error {
@@ -154,7 +265,17 @@ func (c *opaClient) handleErrors(resp *http.Response) error {
 	}
 	var err Error
 	if err := json.NewDecoder(resp.Body).Decode(&err); err != nil {
-		return err
+		return fmt.Errorf("OPA responded with %v", resp.Status)
 	}
 	return &err
 }
+
+// backoff returns the time to wait before the retry after given number of retries, which is
+// a random duration up to an exponentially growing limit (full jitter).
+func backoff(retries int) time.Duration {
+	limit := maxBackoff
+	if retries < 16 && minBackoff<<uint(retries) < maxBackoff {
+		limit = minBackoff << uint(retries)
+	}
+	return time.Duration(rand.Int63n(int64(limit)) + 1)
+}
@@ -0,0 +1,147 @@
+package opa
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newServer returns OPA responding with the status returned by status for each call.
+func newServer(t *testing.T, status func(call int32) int) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := status(atomic.AddInt32(&calls, 1))
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			w.Write([]byte(`{"decision_id": "1", "result": true}`))
+			return
+		}
+		w.Write([]byte(`{"code": "internal_error", "message": "failed"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		status func(call int32) int
+		calls  int32
+		failed bool
+	}{
+		{
+			name: "unavailable then available",
+			status: func(call int32) int {
+				if call < 3 {
+					return http.StatusServiceUnavailable
+				}
+				return http.StatusOK
+			},
+			calls: 3,
+		},
+		{
+			name:   "retries exhausted",
+			status: func(int32) int { return http.StatusTooManyRequests },
+			calls:  3,
+			failed: true,
+		},
+		{
+			name:   "bad request is not retried",
+			status: func(int32) int { return http.StatusBadRequest },
+			calls:  1,
+			failed: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, calls := newServer(t, tc.status)
+			c, err := New(Config{Endpoint: srv.URL, MaxRetries: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := c.DoQuery(context.Background(), "iptables/allow", []byte(`{"input": {}}`))
+			if *calls != tc.calls {
+				t.Errorf("expected %v calls, got %v", tc.calls, *calls)
+			}
+			if tc.failed {
+				var opaErr *Error
+				if !errors.As(err, &opaErr) {
+					t.Errorf("expected OPA error, got %v", err)
+				}
+			} else if err != nil || string(res) != `{"decision_id": "1", "result": true}` {
+				t.Errorf("unexpected response %s: %v", res, err)
+			}
+		})
+	}
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	var healthy int32
+	srv, calls := newServer(t, func(int32) int {
+		if atomic.LoadInt32(&healthy) == 1 {
+			return http.StatusOK
+		}
+		return http.StatusBadGateway
+	})
+	c, err := New(Config{Endpoint: srv.URL, BreakerThreshold: 2, BreakerTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetData(ctx, "state/web"); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %v: expected OPA error, got %v", i, err)
+		}
+	}
+	if _, err := c.GetData(ctx, "state/web"); !errors.Is(err, ErrCircuitOpen) || *calls != 2 {
+		t.Fatalf("expected open circuit after %v calls, got %v", *calls, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&healthy, 1)
+	if _, err := c.GetData(ctx, "state/web"); err != nil {
+		t.Fatalf("expected probe to succeed, got %v", err)
+	}
+	if _, err := c.GetData(ctx, "state/web"); err != nil || *calls != 4 {
+		t.Errorf("expected closed circuit after %v calls, got %v", *calls, err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	srv, calls := newServer(t, func(int32) int { return http.StatusServiceUnavailable })
+	c, err := New(Config{Endpoint: srv.URL, MaxRetries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := c.PutData(ctx, "state/web", []byte(`[]`)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v after %v calls", err, *calls)
+	}
+
+	limited, err := New(Config{Endpoint: srv.URL, RateLimit: 0.1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited.DeleteData(context.Background(), "state/web")
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	before := atomic.LoadInt32(calls)
+	if err := limited.DeleteData(ctx, "state/web"); err == nil || atomic.LoadInt32(calls) != before {
+		t.Errorf("expected rate limited call to fail without calling OPA, got %v", err)
+	}
+}
+
+func TestNewInvalidTLS(t *testing.T) {
+	if _, err := New(Config{Endpoint: "https://127.0.0.1:8181", TrustedCAFile: "/nonexistent/ca.pem"}); err == nil {
+		t.Error("expected error for missing CA file")
+	}
+	if _, err := New(Config{Endpoint: "https://127.0.0.1:8181", CertFile: "/nonexistent/cert.pem", KeyFile: "/nonexistent/key.pem"}); err == nil {
+		t.Error("expected error for missing client certificate")
+	}
+}
@@ -0,0 +1,605 @@
+// Package trace simulates the traversal of a packet through iptables rules without touching the
+// kernel, to find the rule which decides the fate of the packet.
+package trace
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+// Paths of a packet through netfilter.
+const (
+	// PathInput is the path of a packet destined to the host.
+	PathInput = "input"
+	// PathForward is the path of a packet routed through the host.
+	PathForward = "forward"
+	// PathOutput is the path of a packet sent by the host.
+	PathOutput = "output"
+)
+
+// maxDepth limits nested jumps to user defined chains, so chains jumping to each other can't
+// loop forever.
+const maxDepth = 64
+
+// hooks are the built-in chains traversed by a packet on each path, in order.
+var hooks = map[string][]string{
+	PathInput:   {"PREROUTING", "INPUT"},
+	PathForward: {"PREROUTING", "FORWARD", "POSTROUTING"},
+	PathOutput:  {"OUTPUT", "POSTROUTING"},
+}
+
+// hookTables are the tables registered at each built-in chain, in order of their priority.
+var hookTables = map[string][]string{
+	"PREROUTING":  {"raw", "mangle", "nat"},
+	"INPUT":       {"mangle", "filter", "security", "nat"},
+	"FORWARD":     {"mangle", "filter", "security"},
+	"OUTPUT":      {"raw", "mangle", "nat", "filter", "security"},
+	"POSTROUTING": {"mangle", "nat"},
+}
+
+var conntrackStates = map[string]bool{
+	"NEW":         true,
+	"ESTABLISHED": true,
+	"RELATED":     true,
+	"INVALID":     true,
+	"UNTRACKED":   true,
+}
+
+// Packet describes the packet to trace.
+type Packet struct {
+	// Path of the packet.
+	// Choices : input | forward | output
+	// Default : forward if both interfaces are given, output if only outgoing interface is given,
+	//           otherwise input.
+	Path string `json:"path,omitempty"`
+
+	// Interface via which the packet is received.
+	InInterface string `json:"in_interface,omitempty"`
+
+	// Interface via which the packet is sent.
+	OutInterface string `json:"out_interface,omitempty"`
+
+	// Source and destination address of the packet. Both must be of the same family.
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+
+	// Protocol of the packet. i.e tcp, udp, icmp, icmpv6 or a protocol number.
+	Protocol string `json:"protocol"`
+
+	// Source and destination port of tcp, udp, udplite, dccp and sctp packets.
+	SourcePort      int `json:"source_port,omitempty"`
+	DestinationPort int `json:"destination_port,omitempty"`
+
+	// Conntrack state of the packet. NAT tables are only traversed by NEW packets.
+	// Choices : NEW | ESTABLISHED | RELATED | INVALID | UNTRACKED
+	// Default : NEW
+	State string `json:"state,omitempty"`
+}
+
+// Tables are the rules a packet is traced through, along with policies of built-in chains by table
+// and chain, i.e "filter/INPUT": "DROP". Policy of a built-in chain defaults to ACCEPT.
+type Tables struct {
+	Rules    []iptables.Rule
+	Policies map[string]string
+}
+
+// Step is a rule matched by the packet, or a policy applied to it.
+type Step struct {
+	Table string `json:"table"`
+	Chain string `json:"chain"`
+	// Position of the rule in the chain starting at 1, or 0 for the policy of the chain.
+	Position int    `json:"position"`
+	Spec     string `json:"spec,omitempty"`
+	Target   string `json:"target,omitempty"`
+	// Assumed lists matches of the rule which can't be evaluated offline, i.e limit or set, which
+	// are assumed to match.
+	Assumed []string `json:"assumed,omitempty"`
+
+	rule iptables.Rule
+}
+
+// Result is the outcome of tracing a packet.
+type Result struct {
+	Family iptables.Family `json:"family"`
+	Path   string          `json:"path"`
+	// Verdict is the fate of the packet. i.e ACCEPT, DROP, REJECT or QUEUE
+	Verdict string `json:"verdict"`
+	// Decision is the step which decided the verdict, the last step which accepted the packet
+	// outside of nat table, if it's accepted. It's nil if no chain traversed by the packet
+	// has rules or a policy.
+	Decision *Step `json:"decision,omitempty"`
+	// Rule is the rule of Decision, it's nil if the verdict is decided by a policy.
+	Rule *iptables.Rule `json:"rule,omitempty"`
+	// Steps are the rules matched by the packet and policies applied to it, in order.
+	Steps []Step `json:"steps"`
+	// Packet is the packet after address translation done by nat rules.
+	Packet Packet `json:"packet"`
+}
+
+// Trace walks the packet through the tables and chains in netfilter order and returns the rule and
+// the verdict which decide its fate. Only rules of the family of the packet are evaluated.
+//
+// Routing isn't simulated, so the path of a packet doesn't change when its destination is
+// translated.
+func Trace(t Tables, pkt Packet) (Result, error) {
+	p, err := newPacket(pkt)
+	if err != nil {
+		return Result{}, err
+	}
+	e := &evaluator{chains: make(map[string][]iptables.Rule), p: p}
+	for _, r := range t.Rules {
+		r.SetDefaults()
+		families, err := r.Families()
+		if err != nil || !containsFamily(families, p.family) {
+			continue
+		}
+		key := r.Table + "/" + r.Chain
+		e.chains[key] = append(e.chains[key], r)
+	}
+
+	result := Result{Family: p.family, Path: p.Path, Verdict: "ACCEPT"}
+	for _, hook := range hooks[p.Path] {
+		for _, table := range hookTables[hook] {
+			if table == "nat" && p.State != "NEW" {
+				continue
+			}
+			key := table + "/" + hook
+			policy, hasPolicy := t.Policies[key]
+			if _, hasRules := e.chains[key]; !hasRules && !hasPolicy {
+				continue
+			}
+			target, decision, err := e.run(table, hook, 0)
+			if err != nil {
+				return Result{}, err
+			}
+			if target == "" {
+				if policy == "" {
+					policy = "ACCEPT"
+				}
+				step := Step{Table: table, Chain: hook, Target: policy}
+				e.steps = append(e.steps, step)
+				target, decision = policy, &step
+			}
+			if target != "ACCEPT" {
+				result.Verdict, result.Decision = target, decision
+				return e.finish(result), nil
+			}
+			if table != "nat" {
+				result.Decision = decision
+			}
+		}
+	}
+	return e.finish(result), nil
+}
+
+type evaluator struct {
+	// chains are the rules of the family of the packet, by table and chain.
+	chains map[string][]iptables.Rule
+	p      *packet
+	steps  []Step
+}
+
+func (e *evaluator) finish(result Result) Result {
+	result.Steps = e.steps
+	if result.Steps == nil {
+		result.Steps = []Step{}
+	}
+	if result.Decision != nil && result.Decision.Position > 0 {
+		r := result.Decision.rule
+		result.Rule = &r
+	}
+	result.Packet = e.p.Packet
+	return result
+}
+
+// run traverses the chain and returns the target which decides the fate of the packet in the
+// table, along with its step. Empty target is returned if the packet reaches the end of the chain
+// or a RETURN rule.
+func (e *evaluator) run(table, chain string, depth int) (string, *Step, error) {
+	if depth > maxDepth {
+		return "", nil, fmt.Errorf("too many nested jumps to chain %v of %v table", chain, table)
+	}
+	for i, r := range e.chains[table+"/"+chain] {
+		matched, assumed := e.p.match(r)
+		if !matched {
+			continue
+		}
+		spec := r
+		spec.Action, spec.RuleNumber = "", ""
+		step := Step{Table: table, Chain: chain, Position: i + 1, Spec: spec.String(), Target: r.Jump, Assumed: assumed, rule: r}
+		e.steps = append(e.steps, step)
+
+		switch r.Jump {
+		case "":
+			continue
+		case "RETURN":
+			return "", nil, nil
+		case "ACCEPT", "DROP", "REJECT", "QUEUE", "NFQUEUE":
+			return r.Jump, &step, nil
+		case "DNAT", "SNAT", "MASQUERADE", "REDIRECT":
+			if table == "nat" {
+				e.p.translate(r)
+				return "ACCEPT", &step, nil
+			}
+			continue
+		case "NOTRACK":
+			e.p.State = "UNTRACKED"
+			continue
+		case "CT":
+			if r.CTNoTrack {
+				e.p.State = "UNTRACKED"
+			}
+			continue
+		}
+		if _, ok := e.chains[table+"/"+r.Jump]; ok {
+			target, decision, err := e.run(table, r.Jump, depth+1)
+			if err != nil || target != "" {
+				return target, decision, err
+			}
+		}
+		// other targets, i.e LOG or MARK, don't decide the fate of the packet
+	}
+	return "", nil, nil
+}
+
+// packet is a validated Packet.
+type packet struct {
+	Packet
+	family   iptables.Family
+	src, dst net.IP
+}
+
+// Validate returns an error if the packet can't be traced, i.e. its addresses are invalid or of
+// different families, or its protocol, ports, state or path are invalid.
+func (pkt Packet) Validate() error {
+	_, err := newPacket(pkt)
+	return err
+}
+
+func newPacket(pkt Packet) (*packet, error) {
+	p := &packet{Packet: pkt}
+	if p.src = net.ParseIP(pkt.Source); p.src == nil {
+		return nil, fmt.Errorf("invalid source address %q", pkt.Source)
+	}
+	if p.dst = net.ParseIP(pkt.Destination); p.dst == nil {
+		return nil, fmt.Errorf("invalid destination address %q", pkt.Destination)
+	}
+	if (p.src.To4() == nil) != (p.dst.To4() == nil) {
+		return nil, fmt.Errorf("source and destination addresses must be of the same family")
+	}
+	p.family = iptables.IPv4
+	if p.src.To4() == nil {
+		p.family = iptables.IPv6
+	}
+
+	p.Protocol = protocolName(pkt.Protocol)
+	if p.Protocol == "" || p.Protocol == "all" {
+		return nil, fmt.Errorf("protocol of the packet is required")
+	}
+	for _, port := range []int{pkt.SourcePort, pkt.DestinationPort} {
+		if port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %v", port)
+		}
+	}
+
+	p.State = strings.ToUpper(pkt.State)
+	if p.State == "" {
+		p.State = "NEW"
+	}
+	if !conntrackStates[p.State] {
+		return nil, fmt.Errorf("invalid state %q: must be one of NEW | ESTABLISHED | RELATED | INVALID | UNTRACKED", pkt.State)
+	}
+
+	p.Path = strings.ToLower(pkt.Path)
+	if p.Path == "" {
+		switch {
+		case pkt.InInterface != "" && pkt.OutInterface != "":
+			p.Path = PathForward
+		case pkt.OutInterface != "":
+			p.Path = PathOutput
+		default:
+			p.Path = PathInput
+		}
+	}
+	if _, ok := hooks[p.Path]; !ok {
+		return nil, fmt.Errorf("invalid path %q: must be one of %v | %v | %v", pkt.Path, PathInput, PathForward, PathOutput)
+	}
+	return p, nil
+}
+
+// match reports whether the packet matches the rule, along with matches which can't be evaluated
+// offline and are assumed to match.
+func (p *packet) match(r iptables.Rule) (bool, []string) {
+	var assumed []string
+	// check evaluates the option, which may be inverted by a ! argument. fn reports whether the
+	// value matches and whether it could be evaluated.
+	check := func(name, spec string, fn func(string) (bool, bool)) bool {
+		value, inverted := invert(spec)
+		if value == "" {
+			return true
+		}
+		matched, ok := fn(value)
+		if !ok {
+			assumed = append(assumed, name)
+			return true
+		}
+		return matched != inverted
+	}
+	unsupported := func(name string, used bool) bool {
+		if used {
+			assumed = append(assumed, name)
+		}
+		return true
+	}
+
+	matched := check("protocol", r.Protocol, p.matchProtocol) &&
+		check("source", r.SourceAddress, func(v string) (bool, bool) { return matchAddresses(v, p.src) }) &&
+		check("destination", r.DestinationAddress, func(v string) (bool, bool) { return matchAddresses(v, p.dst) }) &&
+		check("source port", r.SourcePort, func(v string) (bool, bool) { return p.matchPorts(v, p.SourcePort) }) &&
+		check("destination port", r.DestinationPort, func(v string) (bool, bool) { return p.matchPorts(v, p.DestinationPort) }) &&
+		check("in interface", r.InInterface, func(v string) (bool, bool) { return matchInterface(v, p.InInterface), true }) &&
+		check("out interface", r.OutInterface, func(v string) (bool, bool) { return matchInterface(v, p.OutInterface), true }) &&
+		check("src-range", r.SourceRange, func(v string) (bool, bool) { return matchRange(v, p.src) }) &&
+		check("dst-range", r.DestinationRange, func(v string) (bool, bool) { return matchRange(v, p.dst) }) &&
+		check("ctstate", strings.Join(r.Ctstate, ","), p.matchState)
+	if matched && r.Multiport != nil {
+		matched = check("multiport", r.Multiport.SourcePorts, func(v string) (bool, bool) { return p.matchPorts(v, p.SourcePort) }) &&
+			check("multiport", r.Multiport.DestinationPorts, func(v string) (bool, bool) { return p.matchPorts(v, p.DestinationPort) }) &&
+			check("multiport", r.Multiport.Ports, func(v string) (bool, bool) {
+				src, ok := p.matchPorts(v, p.SourcePort)
+				dst, _ := p.matchPorts(v, p.DestinationPort)
+				return src || dst, ok
+			})
+	}
+	if !matched {
+		return false, nil
+	}
+
+	unsupported("tcp-flags", len(r.TCPFlags.Flags) > 0)
+	unsupported("limit", r.Limit != nil)
+	unsupported("hashlimit", r.HashLimit != nil)
+	unsupported("recent", r.Recent != nil)
+	unsupported("mac", r.MacSource != "")
+	unsupported("owner", r.Owner != nil)
+	unsupported("mark", r.Mark != "")
+	unsupported("connmark", r.ConnMark != "")
+	unsupported("set", r.MatchSet != nil)
+	unsupported("icmp-type", r.ICMPType != "")
+	unsupported("addrtype", r.AddrType != nil)
+	return true, assumed
+}
+
+func (p *packet) matchProtocol(spec string) (bool, bool) {
+	name := protocolName(spec)
+	return name == "all" || name == p.Protocol, true
+}
+
+func (p *packet) matchState(spec string) (bool, bool) {
+	for _, s := range strings.Split(spec, ",") {
+		if strings.ToUpper(strings.TrimSpace(s)) == p.State {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// matchPorts matches the port against a comma separated list of ports and port ranges, which can
+// use service names. i.e 80,443,8000:8080
+func (p *packet) matchPorts(spec string, port int) (bool, bool) {
+	switch p.Protocol {
+	case "tcp", "udp", "udplite", "dccp", "sctp":
+	default:
+		return false, true
+	}
+	for _, item := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		first, ok := p.lookupPort(bounds[0], 0)
+		if !ok {
+			return false, false
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = p.lookupPort(bounds[1], 65535); !ok {
+				return false, false
+			}
+		}
+		if first > last {
+			first, last = last, first
+		}
+		if port >= first && port <= last {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+func (p *packet) lookupPort(s string, empty int) (int, bool) {
+	if s == "" {
+		return empty, true
+	}
+	if port, err := strconv.Atoi(s); err == nil {
+		return port, true
+	}
+	port, err := net.LookupPort(p.Protocol, s)
+	return port, err == nil
+}
+
+// translate applies address translation done by the nat rule to the packet.
+func (p *packet) translate(r iptables.Rule) {
+	switch r.Jump {
+	case "DNAT":
+		ip, port := natAddress(r.ToDestination)
+		if ip != nil {
+			p.dst, p.Destination = ip, ip.String()
+		}
+		if port > 0 {
+			p.DestinationPort = port
+		}
+	case "SNAT":
+		ip, port := natAddress(r.ToSource)
+		if ip != nil {
+			p.src, p.Source = ip, ip.String()
+		}
+		if port > 0 {
+			p.SourcePort = port
+		}
+	case "REDIRECT":
+		if port, err := strconv.Atoi(strings.SplitN(r.ToPorts, "-", 2)[0]); err == nil {
+			p.DestinationPort = port
+		}
+	}
+}
+
+// natAddress returns the first address and port of the address specification of nat targets.
+// i.e 10.0.0.1-10.0.0.9:80-90, [fd00::1]:80, fd00::1 or :80
+func natAddress(spec string) (net.IP, int) {
+	host, port := spec, ""
+	if strings.HasPrefix(spec, "[") {
+		if i := strings.LastIndex(spec, "]:"); i > 0 {
+			host, port = spec[:i+1], spec[i+2:]
+		}
+	} else if strings.Count(spec, ":") == 1 {
+		parts := strings.SplitN(spec, ":", 2)
+		host, port = parts[0], parts[1]
+	}
+	host = strings.Trim(strings.SplitN(host, "-", 2)[0], "[]")
+	n, _ := strconv.Atoi(strings.SplitN(port, "-", 2)[0])
+	return net.ParseIP(host), n
+}
+
+// matchAddresses matches the address against a comma separated list of addresses and networks.
+// Hostnames can't be evaluated offline.
+func matchAddresses(spec string, ip net.IP) (bool, bool) {
+	for _, item := range strings.Split(spec, ",") {
+		network, ok := parseNetwork(strings.TrimSpace(item))
+		if !ok {
+			return false, false
+		}
+		if network.Contains(ip) {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// parseNetwork parses an address with an optional prefix length or network mask.
+// i.e 10.0.0.1, 10.0.0.0/8, 10.0.0.0/255.0.0.0, fd00::/64
+func parseNetwork(spec string) (*net.IPNet, bool) {
+	parts := strings.SplitN(spec, "/", 2)
+	ip := net.ParseIP(parts[0])
+	if ip == nil {
+		return nil, false
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	mask := net.CIDRMask(bits, bits)
+	if len(parts) == 2 {
+		if m := net.ParseIP(parts[1]); m != nil {
+			if m4 := m.To4(); m4 != nil && bits == 8*net.IPv4len {
+				m = m4
+			}
+			mask = net.IPMask(m)
+		} else {
+			ones, err := strconv.Atoi(parts[1])
+			if err != nil || ones < 0 || ones > bits {
+				return nil, false
+			}
+			mask = net.CIDRMask(ones, bits)
+		}
+	}
+	if len(mask) != len(ip) {
+		return nil, false
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, true
+}
+
+// matchRange matches the address against a range of addresses. i.e 10.0.0.1-10.0.0.9
+func matchRange(spec string, ip net.IP) (bool, bool) {
+	bounds := strings.SplitN(spec, "-", 2)
+	first := net.ParseIP(strings.TrimSpace(bounds[0]))
+	last := first
+	if len(bounds) == 2 {
+		last = net.ParseIP(strings.TrimSpace(bounds[1]))
+	}
+	if first == nil || last == nil {
+		return false, false
+	}
+	if (first.To4() == nil) != (ip.To4() == nil) {
+		return false, true
+	}
+	ip, first, last = ip.To16(), first.To16(), last.To16()
+	return compareIP(ip, first) >= 0 && compareIP(ip, last) <= 0, true
+}
+
+func compareIP(a, b net.IP) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// matchInterface matches the interface name, a name ending with + matches any interface which
+// begins with the name. A packet without the interface never matches.
+func matchInterface(spec, iface string) bool {
+	if iface == "" {
+		return false
+	}
+	if strings.HasSuffix(spec, "+") {
+		return strings.HasPrefix(iface, strings.TrimSuffix(spec, "+"))
+	}
+	return spec == iface
+}
+
+// invert returns the value of the option and whether it's inverted by a ! argument.
+func invert(spec string) (string, bool) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "!") {
+		return strings.TrimSpace(strings.TrimPrefix(spec, "!")), true
+	}
+	return spec, false
+}
+
+var protocolNumbers = map[string]string{
+	"0":   "all",
+	"1":   "icmp",
+	"6":   "tcp",
+	"17":  "udp",
+	"33":  "dccp",
+	"50":  "esp",
+	"51":  "ah",
+	"58":  "icmpv6",
+	"132": "sctp",
+	"136": "udplite",
+}
+
+// protocolName returns the name of the protocol given by a name or a number.
+func protocolName(protocol string) string {
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+	if name, ok := protocolNumbers[protocol]; ok {
+		return name
+	}
+	if protocol == "ipv6-icmp" {
+		return "icmpv6"
+	}
+	return protocol
+}
+
+func containsFamily(families []iptables.Family, family iptables.Family) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
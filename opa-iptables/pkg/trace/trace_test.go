@@ -0,0 +1,136 @@
+package trace
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/contrib/opa-iptables/pkg/iptables"
+)
+
+var tables = Tables{
+	Rules: []iptables.Rule{
+		{Table: "nat", Chain: "PREROUTING", DestinationAddress: "192.168.1.1", Protocol: "tcp", DestinationPort: "80", Jump: "DNAT", ToDestination: "10.0.0.2:8080"},
+		{Chain: "INPUT", Ctstate: []string{"RELATED", "ESTABLISHED"}, Jump: "ACCEPT"},
+		{Chain: "INPUT", InInterface: "lo", Jump: "ACCEPT"},
+		{Chain: "INPUT", Protocol: "tcp", Jump: "web-in"},
+		{Chain: "INPUT", SourceAddress: "10.0.0.0/8", Protocol: "tcp", DestinationPort: "22", Jump: "ACCEPT"},
+		{Chain: "web-in", SourceAddress: "!10.0.0.0/8", Jump: "RETURN"},
+		{Chain: "web-in", Jump: "LOG", LogPrefix: "web "},
+		{Chain: "web-in", Protocol: "tcp", Multiport: &iptables.Multiport{DestinationPorts: "80,443"}, Limit: &iptables.Limit{Rate: "10/second"}, Jump: "ACCEPT"},
+		{Chain: "FORWARD", OutInterface: "eth+", Protocol: "tcp", DestinationPort: "8080", Jump: "ACCEPT"},
+		{Chain: "INPUT", SourceAddress: "fd00::/8", Jump: "ACCEPT"},
+	},
+	Policies: map[string]string{"filter/INPUT": "DROP", "filter/FORWARD": "DROP"},
+}
+
+func TestTrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		packet   Packet
+		verdict  string
+		decision Step
+		assumed  []string
+	}{
+		{
+			name:     "ssh from lan",
+			packet:   Packet{InInterface: "eth0", Source: "10.1.2.3", Destination: "10.0.0.1", Protocol: "tcp", SourcePort: 40000, DestinationPort: 22},
+			verdict:  "ACCEPT",
+			decision: Step{Table: "filter", Chain: "INPUT", Position: 4, Spec: "filter INPUT -p tcp -s 10.0.0.0/8 --dport 22 -j ACCEPT", Target: "ACCEPT"},
+		},
+		{
+			name:     "ssh from internet",
+			packet:   Packet{InInterface: "eth0", Source: "203.0.113.1", Destination: "10.0.0.1", Protocol: "tcp", DestinationPort: 22},
+			verdict:  "DROP",
+			decision: Step{Table: "filter", Chain: "INPUT", Target: "DROP"},
+		},
+		{
+			name:     "web from lan",
+			packet:   Packet{InInterface: "eth0", Source: "10.1.2.3", Destination: "10.0.0.1", Protocol: "6", DestinationPort: 443},
+			verdict:  "ACCEPT",
+			decision: Step{Table: "filter", Chain: "web-in", Position: 3, Spec: "filter web-in -p tcp -m multiport --dports 80,443 -m limit --limit 10/second -j ACCEPT", Target: "ACCEPT"},
+			assumed:  []string{"limit"},
+		},
+		{
+			name:     "established",
+			packet:   Packet{InInterface: "eth0", Source: "203.0.113.1", Destination: "10.0.0.1", Protocol: "udp", SourcePort: 53, DestinationPort: 5353, State: "established"},
+			verdict:  "ACCEPT",
+			decision: Step{Table: "filter", Chain: "INPUT", Position: 1, Spec: "filter INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT", Target: "ACCEPT"},
+		},
+		{
+			name:     "dnat forwarded",
+			packet:   Packet{InInterface: "eth1", OutInterface: "eth0", Source: "203.0.113.1", Destination: "192.168.1.1", Protocol: "tcp", DestinationPort: 80},
+			verdict:  "ACCEPT",
+			decision: Step{Table: "filter", Chain: "FORWARD", Position: 1, Spec: "filter FORWARD -p tcp --dport 8080 -o eth+ -j ACCEPT", Target: "ACCEPT"},
+		},
+		{
+			name:     "ipv6",
+			packet:   Packet{InInterface: "eth0", Source: "fd00::1", Destination: "fd00::2", Protocol: "icmpv6"},
+			verdict:  "ACCEPT",
+			decision: Step{Table: "filter", Chain: "INPUT", Position: 1, Spec: "filter INPUT -s fd00::/8 -j ACCEPT", Target: "ACCEPT"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := Trace(tables, tc.packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Verdict != tc.verdict {
+				t.Errorf("expected verdict %v, got %v", tc.verdict, result.Verdict)
+			}
+			if result.Decision == nil {
+				t.Fatalf("expected decision %+v, got none", tc.decision)
+			}
+			decision := *result.Decision
+			decision.rule = iptables.Rule{}
+			tc.decision.Assumed = tc.assumed
+			if !reflect.DeepEqual(decision, tc.decision) {
+				t.Errorf("expected decision %+v, got %+v", tc.decision, decision)
+			}
+			if (result.Rule != nil) != (tc.decision.Position > 0) {
+				t.Errorf("unexpected rule %+v", result.Rule)
+			}
+		})
+	}
+}
+
+func TestTraceTranslatesPacket(t *testing.T) {
+	result, err := Trace(tables, Packet{InInterface: "eth1", OutInterface: "eth0", Source: "203.0.113.1", Destination: "192.168.1.1", Protocol: "tcp", DestinationPort: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Path != PathForward || result.Packet.Destination != "10.0.0.2" || result.Packet.DestinationPort != 8080 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if len(result.Steps) != 2 || result.Steps[0].Target != "DNAT" {
+		t.Errorf("unexpected steps %+v", result.Steps)
+	}
+}
+
+func TestTraceErrors(t *testing.T) {
+	loop := Tables{Rules: []iptables.Rule{
+		{Chain: "INPUT", Jump: "a"},
+		{Chain: "a", Jump: "b"},
+		{Chain: "b", Jump: "a"},
+	}}
+	tests := []struct {
+		tables Tables
+		packet Packet
+	}{
+		{tables, Packet{Source: "10.0.0.1", Destination: "fd00::1", Protocol: "tcp"}},
+		{tables, Packet{Source: "host", Destination: "10.0.0.1", Protocol: "tcp"}},
+		{tables, Packet{Source: "10.0.0.1", Destination: "10.0.0.2"}},
+		{tables, Packet{Source: "10.0.0.1", Destination: "10.0.0.2", Protocol: "tcp", State: "OLD"}},
+		{tables, Packet{Source: "10.0.0.1", Destination: "10.0.0.2", Protocol: "tcp", Path: "sideways"}},
+		{loop, Packet{Source: "10.0.0.1", Destination: "10.0.0.2", Protocol: "tcp"}},
+	}
+	for i, tc := range tests {
+		if _, err := Trace(tc.tables, tc.packet); err == nil {
+			t.Errorf("test %v: expected error", i)
+		}
+		// only the packet of the loop is valid
+		if err := tc.packet.Validate(); (err == nil) != (i == len(tests)-1) {
+			t.Errorf("test %v: unexpected validation error %v", i, err)
+		}
+	}
+}